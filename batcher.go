@@ -0,0 +1,108 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"github.com/optiopay/kafka/proto"
+
+	"sync"
+	"time"
+)
+
+// ProduceBatch contains the messages which are produced in one request.
+type ProduceBatch struct {
+	messages []*proto.Message
+	timer    *time.Timer
+	done     chan struct{}
+
+	offset int64
+	err    error
+}
+
+// Done returns a channel which is closed when the batch is produced.
+func (b *ProduceBatch) Done() <-chan struct{} {
+	return b.done
+}
+
+// Result returns the offset of the first message of batch. It must be
+// called after the batch is done.
+func (b *ProduceBatch) Result() (int64, error) {
+	return b.offset, b.err
+}
+
+// ProduceBatcher coalesces the messages sent to the same partition.
+type ProduceBatcher struct {
+	sync.Mutex
+
+	batches map[string]*ProduceBatch
+}
+
+// NewProduceBatcher creates new ProduceBatcher object.
+func NewProduceBatcher() *ProduceBatcher {
+	return &ProduceBatcher{
+		batches: make(map[string]*ProduceBatch),
+	}
+}
+
+// Add appends the message to the open batch of key and returns the batch
+// and the position of message in it. The new batch is opened if there is
+// none. The batch is passed to send after linger or as soon as it has
+// size messages. Set size to 0 to disable the limit.
+func (b *ProduceBatcher) Add(key string, msg *proto.Message, linger time.Duration, size int, send func([]*proto.Message) (int64, error)) (*ProduceBatch, int) {
+	b.Lock()
+	defer b.Unlock()
+
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &ProduceBatch{
+			done: make(chan struct{}),
+		}
+		batch.timer = time.AfterFunc(linger, func() {
+			b.detach(key, batch)
+			batch.send(send)
+		})
+		b.batches[key] = batch
+	}
+
+	batch.messages = append(batch.messages, msg)
+	pos := len(batch.messages) - 1
+
+	if size > 0 && len(batch.messages) >= size {
+		delete(b.batches, key)
+
+		// The batch is already being sent if the timer has fired.
+		if batch.timer.Stop() {
+			go batch.send(send)
+		}
+	}
+
+	return batch, pos
+}
+
+// Len returns the number of open batches.
+func (b *ProduceBatcher) Len() int {
+	b.Lock()
+	defer b.Unlock()
+
+	return len(b.batches)
+}
+
+// detach closes the batch for new messages.
+func (b *ProduceBatcher) detach(key string, batch *ProduceBatch) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.batches[key] == batch {
+		delete(b.batches, key)
+	}
+}
+
+func (b *ProduceBatch) send(send func([]*proto.Message) (int64, error)) {
+	b.offset, b.err = send(b.messages)
+	close(b.done)
+}
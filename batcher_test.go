@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+func TestProduceBatcher(t *testing.T) {
+	b := NewProduceBatcher()
+
+	sent := make(chan []*proto.Message, 3)
+	send := func(messages []*proto.Message) (int64, error) {
+		sent <- messages
+		return 10, nil
+	}
+
+	first, pos := b.Add("a", &proto.Message{Value: []byte("1")}, time.Minute, 2, send)
+	if pos != 0 {
+		t.Fatalf("expected position 0, got %d", pos)
+	}
+
+	other, _ := b.Add("b", &proto.Message{Value: []byte("x")}, 10*time.Millisecond, 2, send)
+	if other == first {
+		t.Fatal("expected separate batches for different keys")
+	}
+
+	second, pos := b.Add("a", &proto.Message{Value: []byte("2")}, time.Minute, 2, send)
+	if second != first || pos != 1 {
+		t.Fatalf("expected the same batch at position 1, got %d", pos)
+	}
+
+	// The full batch is sent at once.
+	<-first.Done()
+	if offset, err := first.Result(); offset != 10 || err != nil {
+		t.Fatalf("unexpected result: %d, %v", offset, err)
+	}
+
+	// The batch which isn't full is sent after the linger.
+	<-other.Done()
+
+	if n := len(<-sent) + len(<-sent); n != 3 {
+		t.Fatalf("expected 3 messages sent, got %d", n)
+	}
+
+	if b.Len() != 0 {
+		t.Fatalf("expected no open batches, got %d", b.Len())
+	}
+
+	// The next message opens a new batch.
+	third, pos := b.Add("a", &proto.Message{Value: []byte("3")}, time.Millisecond, 0, func([]*proto.Message) (int64, error) {
+		return 0, errors.New("failed")
+	})
+	if third == first || pos != 0 {
+		t.Fatalf("expected new batch, got position %d", pos)
+	}
+
+	<-third.Done()
+	if _, err := third.Result(); err == nil {
+		t.Fatal("expected error of batch")
+	}
+}
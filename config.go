@@ -8,6 +8,12 @@
 package main
 
 import (
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,6 +28,102 @@ func (d *CfgDuration) UnmarshalText(data []byte) (err error) {
 	return
 }
 
+// CfgRequiredAcks is a produce acknowledgment level wrapper for Config.
+type CfgRequiredAcks struct {
+	Value int16
+}
+
+// UnmarshalText is a wrapper.
+func (a *CfgRequiredAcks) UnmarshalText(data []byte) (err error) {
+	a.Value, err = ParseRequiredAcks(string(data))
+	return
+}
+
+// CfgRegexp is a Regexp wrapper for Config.
+type CfgRegexp struct {
+	*regexp.Regexp
+}
+
+// UnmarshalText is a wrapper.
+func (r *CfgRegexp) UnmarshalText(data []byte) (err error) {
+	r.Regexp, err = regexp.Compile(string(data))
+	return
+}
+
+// CfgRoute maps the prefix of message key to partition. It is written as
+// {prefix}:{partition}.
+type CfgRoute struct {
+	Prefix    string
+	Partition int32
+}
+
+// UnmarshalText is a wrapper.
+func (r *CfgRoute) UnmarshalText(data []byte) error {
+	s := string(data)
+
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return fmt.Errorf("route must be {prefix}:{partition}: %q", s)
+	}
+
+	n, err := strconv.ParseInt(s[i+1:], 10, 32)
+	if err != nil || n < 0 {
+		return fmt.Errorf("bad partition in route: %q", s)
+	}
+
+	r.Prefix = s[:i]
+	r.Partition = int32(n)
+
+	return nil
+}
+
+// CfgTopicPattern is a topic name or a shell pattern (e.g. "team-*") for
+// Config.
+type CfgTopicPattern struct {
+	Pattern string
+}
+
+// UnmarshalText is a wrapper.
+func (t *CfgTopicPattern) UnmarshalText(data []byte) error {
+	if _, err := path.Match(string(data), ""); err != nil {
+		return fmt.Errorf("bad topic pattern: %q", data)
+	}
+	t.Pattern = string(data)
+	return nil
+}
+
+// CfgEnvelopeField is a name of meta field of message envelope for Config.
+type CfgEnvelopeField struct {
+	Name string
+}
+
+// UnmarshalText is a wrapper.
+func (f *CfgEnvelopeField) UnmarshalText(data []byte) error {
+	for _, name := range envelopeFields {
+		if name == string(data) {
+			f.Name = name
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown envelope field: %q", data)
+}
+
+// CfgPartitioner is a name of hash which chooses the partition by key.
+type CfgPartitioner struct {
+	Name string
+}
+
+// UnmarshalText is a wrapper.
+func (c *CfgPartitioner) UnmarshalText(data []byte) error {
+	for _, name := range partitioners {
+		if name == string(data) {
+			c.Name = name
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown partitioner: %q", data)
+}
+
 // Config is a main config structure
 type Config struct {
 	Global struct {
@@ -31,26 +133,76 @@ type Config struct {
 		Verbose    bool
 		GoMaxProcs int
 		MaxConns   int64
+
+		MaxRequestTimeout   CfgDuration
+		TotalRequestTimeout CfgDuration
+
+		AdminAddress string
+
+		ReadTimeout  CfgDuration
+		WriteTimeout CfgDuration
+		IdleTimeout  CfgDuration
+
+		ShutdownTimeout CfgDuration
+		MaxResponseTime CfgDuration
 	}
 	Kafka struct {
 		Broker []string
 	}
+	Cluster map[string]*struct {
+		Broker []string
+	}
+	Schema map[string]*struct {
+		File string
+	}
+	Routing map[string]*struct {
+		Route []CfgRoute
+	}
+	ContentType map[string]*struct {
+		Topic string
+	}
+	Topic map[string]*struct {
+		DefaultFetchSize int32
+		MaxFetchSize     int32
+		MinRequiredAcks  CfgRequiredAcks
+	}
 	Broker struct {
 		NumConns            int64
+		MaxNumConns         int64
+		MinConns            int64
+		MinHealthy          int64
+		DialRetryPeriod     CfgDuration
+		DialRetryWait       CfgDuration
 		LeaderRetryLimit    int
 		LeaderRetryWait     CfgDuration
 		DialTimeout         CfgDuration
 		ReconnectPeriod     CfgDuration
+		MaxRetryAfter       CfgDuration
 		GetOffsetsTimeout   CfgDuration
 		MetadataCachePeriod CfgDuration
 		GetMetadataTimeout  CfgDuration
+		MetadataParallelism int
+		MetadataRefreshWait CfgDuration
 		AllowTopicCreation  bool
+		TopicNamePattern    CfgRegexp
+		TopicAllowlist      []CfgTopicPattern
 	}
 	Producer struct {
 		RequestTimeout     CfgDuration
 		RetryLimit         int
 		RetryWait          CfgDuration
 		SendMessageTimeout CfgDuration
+		LeaderRetryLimit   int
+		RequiredAcks       CfgRequiredAcks
+		Partitioner        CfgPartitioner
+		FallbackOnNoLeader bool
+		IdempotencyTTL     CfgDuration
+		IdempotencyKeys    int
+		TransactionTimeout CfgDuration
+		BatchLinger        CfgDuration
+		BatchSize          int
+		Envelope           bool
+		EnvelopeMeta       []CfgEnvelopeField
 	}
 	Consumer struct {
 		RequestTimeout    CfgDuration
@@ -62,6 +214,20 @@ type Config struct {
 		MinFetchSize      int32
 		MaxFetchSize      int32
 		DefaultFetchSize  int32
+		MaxLimit          int32
+		MaxBufferedSize   int64
+		MaxRangeSize      int64
+
+		MaxTopicConsumers int64
+
+		PartitionReaders int
+
+		DefaultGroup string
+
+		SlowWriteThreshold CfgDuration
+
+		ResponseCacheSize    int64
+		ResponseCacheEntries int
 	}
 	OffsetCoordinator struct {
 		RetryErrLimit       int
@@ -69,11 +235,37 @@ type Config struct {
 		CommitOffsetTimeout CfgDuration
 		FetchOffsetTimeout  CfgDuration
 	}
+	Metrics struct {
+		GraphiteAddress  string
+		GraphitePrefix   string
+		GraphiteInterval CfgDuration
+		RuntimeInterval  CfgDuration
+	}
+	Tracing struct {
+		Endpoint    string
+		ServiceName string
+		SampleRatio float64
+		BatchSize   int
+		Interval    CfgDuration
+	}
+	CORS struct {
+		Enabled      bool
+		AllowOrigin  []string
+		AllowMethods []string
+		AllowHeaders []string
+		MaxAge       CfgDuration
+	}
+	Admin struct {
+		User     string
+		Password string
+	}
 	Logging struct {
 		DisableColors    bool
 		DisableTimestamp bool
 		FullTimestamp    bool
 		DisableSorting   bool
+		Format           string
+		Level            string
 	}
 }
 
@@ -84,20 +276,42 @@ func (c *Config) SetDefaults() {
 	c.Global.MaxConns = 1000000
 	c.Global.Logfile = "/var/log/kafka-http-proxy.log"
 	c.Global.Pidfile = "/run/kafka-http-proxy.pid"
+	c.Global.MaxRequestTimeout.Duration = 15 * time.Second
+	c.Global.ReadTimeout.Duration = time.Minute
+	c.Global.WriteTimeout.Duration = 0
+	c.Global.IdleTimeout.Duration = 2 * time.Minute
+	c.Global.ShutdownTimeout.Duration = 30 * time.Second
 
 	c.Broker.NumConns = 100
+	c.Broker.MaxNumConns = 1000
+	c.Broker.MinConns = 0
+	c.Broker.MinHealthy = 0
+	c.Broker.DialRetryPeriod.Duration = 0
+	c.Broker.DialRetryWait.Duration = 500 * time.Millisecond
 	c.Broker.DialTimeout.Duration = 500 * time.Millisecond
 	c.Broker.LeaderRetryLimit = 2
 	c.Broker.LeaderRetryWait.Duration = 500 * time.Millisecond
 	c.Broker.ReconnectPeriod.Duration = 15 * time.Second
+	c.Broker.MaxRetryAfter.Duration = 30 * time.Second
 	c.Broker.MetadataCachePeriod.Duration = 3 * time.Second
 	c.Broker.GetMetadataTimeout.Duration = 1 * time.Second
+	c.Broker.MetadataParallelism = 1
+	c.Broker.MetadataRefreshWait.Duration = 1 * time.Second
 	c.Broker.GetOffsetsTimeout.Duration = 10 * time.Second
 
 	c.Producer.RequestTimeout.Duration = 5 * time.Second
 	c.Producer.RetryLimit = 2
 	c.Producer.RetryWait.Duration = 200 * time.Millisecond
 	c.Producer.SendMessageTimeout.Duration = 15 * time.Second
+	c.Producer.LeaderRetryLimit = 1
+	c.Producer.RequiredAcks.Value = KafkaRequiredAcksAll
+	c.Producer.Partitioner.Name = PartitionerFNV1a
+	c.Producer.FallbackOnNoLeader = false
+	c.Producer.IdempotencyTTL.Duration = 0
+	c.Producer.IdempotencyKeys = 100000
+	c.Producer.TransactionTimeout.Duration = 1 * time.Minute
+	c.Producer.BatchLinger.Duration = 0
+	c.Producer.BatchSize = 100
 
 	c.Consumer.RequestTimeout.Duration = 50 * time.Millisecond
 	c.Consumer.RetryLimit = 2
@@ -108,14 +322,139 @@ func (c *Config) SetDefaults() {
 	c.Consumer.MinFetchSize = 1
 	c.Consumer.MaxFetchSize = 4194304
 	c.Consumer.DefaultFetchSize = 524288
+	c.Consumer.MaxLimit = 1000
+	c.Consumer.MaxBufferedSize = 16777216
+	c.Consumer.MaxRangeSize = 67108864
+	c.Consumer.MaxTopicConsumers = 0
+	c.Consumer.PartitionReaders = 4
+	c.Consumer.SlowWriteThreshold.Duration = 100 * time.Millisecond
+	c.Consumer.ResponseCacheSize = 0
+	c.Consumer.ResponseCacheEntries = 10000
 
 	c.OffsetCoordinator.RetryErrLimit = 2
 	c.OffsetCoordinator.RetryErrWait.Duration = 200 * time.Millisecond
 	c.OffsetCoordinator.CommitOffsetTimeout.Duration = 15 * time.Second
 	c.OffsetCoordinator.FetchOffsetTimeout.Duration = 15 * time.Second
 
+	c.Metrics.GraphitePrefix = "kafka-http-proxy"
+	c.Metrics.GraphiteInterval.Duration = time.Minute
+	c.Metrics.RuntimeInterval.Duration = 10 * time.Second
+
+	c.Tracing.ServiceName = "kafka-http-proxy"
+	c.Tracing.SampleRatio = 1
+	c.Tracing.BatchSize = 512
+	c.Tracing.Interval.Duration = 5 * time.Second
+
+	c.CORS.Enabled = false
+	c.CORS.MaxAge.Duration = 10 * time.Minute
+
 	c.Logging.DisableColors = true
 	c.Logging.DisableTimestamp = false
 	c.Logging.FullTimestamp = true
 	c.Logging.DisableSorting = true
+	c.Logging.Format = "text"
+}
+
+// FetchSize returns Consumer.DefaultFetchSize and Consumer.MaxFetchSize
+// overridden for the topic in the Topic section.
+func (c *Config) FetchSize(topic string) (int32, int32) {
+	defaultSize, maxSize := c.Consumer.DefaultFetchSize, c.Consumer.MaxFetchSize
+
+	if t, ok := c.Topic[topic]; ok {
+		if t.DefaultFetchSize > 0 {
+			defaultSize = t.DefaultFetchSize
+		}
+		if t.MaxFetchSize > 0 {
+			maxSize = t.MaxFetchSize
+		}
+	}
+	return defaultSize, maxSize
+}
+
+// MinRequiredAcks returns the lowest produce acknowledgment level allowed
+// for the topic in the Topic section.
+func (c *Config) MinRequiredAcks(topic string) int16 {
+	if t, ok := c.Topic[topic]; ok {
+		return t.MinRequiredAcks.Value
+	}
+	return KafkaRequiredAcksNone
+}
+
+// TopicAllowed returns true if the topic matches Broker.TopicAllowlist.
+// All topics are allowed if the list is empty.
+func (c *Config) TopicAllowed(topic string) bool {
+	if len(c.Broker.TopicAllowlist) == 0 {
+		return true
+	}
+	for _, t := range c.Broker.TopicAllowlist {
+		if ok, _ := path.Match(t.Pattern, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// runtimeOption returns true if the option can be changed without restart.
+func runtimeOption(section, name string) bool {
+	switch section {
+	case "Global":
+		return name == "Verbose" || name == "MaxConns" || name == "MaxRequestTimeout" || name == "TotalRequestTimeout" || name == "ShutdownTimeout" || name == "MaxResponseTime"
+	case "Broker":
+		return name == "MinHealthy" || name == "TopicNamePattern" || name == "TopicAllowlist"
+	case "Producer":
+		// The idempotency cache is created on start.
+		return name != "IdempotencyTTL" && name != "IdempotencyKeys"
+	case "Consumer":
+		// The response cache is created on start.
+		return name != "ResponseCacheSize" && name != "ResponseCacheEntries"
+	case "OffsetCoordinator", "CORS", "Admin":
+		return true
+	case "Logging":
+		return name == "Level"
+	}
+	return false
+}
+
+// MergeConfig returns a copy of the current configuration with the options
+// from the next one which can be changed at runtime. It also returns names
+// of the changed options and the options which require restart.
+func MergeConfig(cur, next *Config) (*Config, []string, []string) {
+	changed := []string{}
+	restart := []string{}
+
+	res := *cur
+
+	dst := reflect.ValueOf(&res).Elem()
+	src := reflect.ValueOf(next).Elem()
+
+	for i := 0; i < dst.NumField(); i++ {
+		section := dst.Type().Field(i).Name
+
+		if dst.Field(i).Kind() != reflect.Struct {
+			if !reflect.DeepEqual(dst.Field(i).Interface(), src.Field(i).Interface()) {
+				restart = append(restart, section)
+			}
+			continue
+		}
+
+		for j := 0; j < dst.Field(i).NumField(); j++ {
+			name := dst.Field(i).Type().Field(j).Name
+
+			d := dst.Field(i).Field(j)
+			v := src.Field(i).Field(j)
+
+			if reflect.DeepEqual(d.Interface(), v.Interface()) {
+				continue
+			}
+
+			if runtimeOption(section, name) {
+				d.Set(v)
+				changed = append(changed, section+"."+name)
+			} else {
+				restart = append(restart, section+"."+name)
+			}
+		}
+	}
+
+	return &res, changed, restart
 }
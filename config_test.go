@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeConfig(t *testing.T) {
+	cur := &Config{}
+	cur.SetDefaults()
+	cur.Kafka.Broker = []string{"localhost:9092"}
+
+	next := &Config{}
+	next.SetDefaults()
+	next.Kafka.Broker = []string{"localhost:9093"}
+	next.Consumer.MaxFetchSize = 1024
+	next.Broker.NumConns = 1
+	next.Logging.Level = "warn"
+	next.Global.ReadTimeout.Duration = time.Second
+
+	res, changed, restart := MergeConfig(cur, next)
+
+	if res.Consumer.MaxFetchSize != 1024 || res.Logging.Level != "warn" {
+		t.Fatalf("runtime options were not applied: %+v", res)
+	}
+
+	if res.Broker.NumConns != cur.Broker.NumConns || res.Kafka.Broker[0] != "localhost:9092" {
+		t.Fatalf("restart options were applied: %+v", res)
+	}
+
+	if len(changed) != 2 || changed[0] != "Consumer.MaxFetchSize" || changed[1] != "Logging.Level" {
+		t.Fatalf("unexpected changed options: %v", changed)
+	}
+
+	if len(restart) != 3 || restart[0] != "Global.ReadTimeout" || restart[1] != "Kafka.Broker" || restart[2] != "Broker.NumConns" {
+		t.Fatalf("unexpected restart options: %v", restart)
+	}
+
+	if cur.Consumer.MaxFetchSize == 1024 {
+		t.Fatalf("current config was modified")
+	}
+}
+
+func TestConfigFetchSize(t *testing.T) {
+	c := &Config{}
+	c.SetDefaults()
+	c.Topic = map[string]*struct {
+		DefaultFetchSize int32
+		MaxFetchSize     int32
+		MinRequiredAcks  CfgRequiredAcks
+	}{
+		"small": {DefaultFetchSize: 1024},
+		"large": {DefaultFetchSize: 1048576, MaxFetchSize: 16777216},
+	}
+
+	testCases := []struct {
+		topic       string
+		defaultSize int32
+		maxSize     int32
+	}{
+		{"other", c.Consumer.DefaultFetchSize, c.Consumer.MaxFetchSize},
+		{"small", 1024, c.Consumer.MaxFetchSize},
+		{"large", 1048576, 16777216},
+	}
+
+	for _, tc := range testCases {
+		defaultSize, maxSize := c.FetchSize(tc.topic)
+
+		if defaultSize != tc.defaultSize || maxSize != tc.maxSize {
+			t.Fatalf("%s: expected %d/%d, got %d/%d", tc.topic, tc.defaultSize, tc.maxSize, defaultSize, maxSize)
+		}
+	}
+}
+
+func TestConfigTopicAllowed(t *testing.T) {
+	c := &Config{}
+	c.SetDefaults()
+
+	if !c.TopicAllowed("__consumer_offsets") {
+		t.Fatalf("expected all topics allowed by default")
+	}
+
+	for _, s := range []string{"events", "team-*"} {
+		var pattern CfgTopicPattern
+		if err := pattern.UnmarshalText([]byte(s)); err != nil {
+			t.Fatalf("unable to parse pattern %q: %s", s, err)
+		}
+		c.Broker.TopicAllowlist = append(c.Broker.TopicAllowlist, pattern)
+	}
+
+	testCases := []struct {
+		topic   string
+		allowed bool
+	}{
+		{"events", true},
+		{"events-internal", false},
+		{"team-a", true},
+		{"__consumer_offsets", false},
+	}
+
+	for _, tc := range testCases {
+		if allowed := c.TopicAllowed(tc.topic); allowed != tc.allowed {
+			t.Fatalf("%s: expected %v, got %v", tc.topic, tc.allowed, allowed)
+		}
+	}
+
+	var pattern CfgTopicPattern
+	if err := pattern.UnmarshalText([]byte("team-[")); err == nil {
+		t.Fatalf("expected error for bad pattern")
+	}
+}
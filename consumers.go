@@ -0,0 +1,61 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"sync"
+)
+
+// TopicConsumers tracks the number of running consume requests per topic.
+type TopicConsumers struct {
+	sync.Mutex
+
+	active map[string]int64
+}
+
+// NewTopicConsumers creates new TopicConsumers object.
+func NewTopicConsumers() *TopicConsumers {
+	return &TopicConsumers{
+		active: make(map[string]int64),
+	}
+}
+
+// Acquire registers a new consumer of topic. It returns false if there are
+// already limit consumers. Set limit to 0 to disable it.
+func (c *TopicConsumers) Acquire(topic string, limit int64) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if limit > 0 && c.active[topic] >= limit {
+		return false
+	}
+	c.active[topic]++
+	return true
+}
+
+// Release unregisters the consumer of topic.
+func (c *TopicConsumers) Release(topic string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.active[topic]--; c.active[topic] <= 0 {
+		delete(c.active, topic)
+	}
+}
+
+// Info returns the number of consumers per topic.
+func (c *TopicConsumers) Info() map[string]int64 {
+	c.Lock()
+	defer c.Unlock()
+
+	res := make(map[string]int64, len(c.active))
+	for topic, n := range c.active {
+		res[topic] = n
+	}
+	return res
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTopicConsumers(t *testing.T) {
+	consumers := NewTopicConsumers()
+
+	if !consumers.Acquire("test", 2) || !consumers.Acquire("test", 2) {
+		t.Fatalf("unable to acquire consumers below the limit")
+	}
+
+	if consumers.Acquire("test", 2) {
+		t.Fatalf("expected the limit to be reached")
+	}
+
+	if !consumers.Acquire("other", 2) {
+		t.Fatalf("the limit of other topic should not be affected")
+	}
+
+	if n := consumers.Info()["test"]; n != 2 {
+		t.Fatalf("expected 2 consumers, got %d", n)
+	}
+
+	consumers.Release("test")
+
+	if !consumers.Acquire("test", 2) {
+		t.Fatalf("unable to acquire released consumer")
+	}
+
+	if !consumers.Acquire("test", 0) {
+		t.Fatalf("unable to acquire consumer without limit")
+	}
+
+	consumers.Release("other")
+
+	if _, ok := consumers.Info()["other"]; ok {
+		t.Fatalf("expected topic without consumers to be removed")
+	}
+}
@@ -0,0 +1,62 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func (s *Server) corsAllowedOrigin(origin string) bool {
+	for _, allowed := range s.Config().CORS.AllowOrigin {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// corsHandler adds CORS headers to the response. It returns true if
+// the request was a preflight request and the response is complete.
+func (s *Server) corsHandler(w *HTTPResponse, r *http.Request) bool {
+	if !s.Config().CORS.Enabled {
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || !s.corsAllowedOrigin(origin) {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	methods := s.Config().CORS.AllowMethods
+	if len(methods) == 0 {
+		methods = []string{"GET", "POST", "PUT"}
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+	if len(s.Config().CORS.AllowHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(s.Config().CORS.AllowHeaders, ", "))
+	} else if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+
+	if s.Config().CORS.MaxAge.Duration > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.FormatInt(int64(s.Config().CORS.MaxAge.Seconds()), 10))
+	}
+
+	s.rawResponse(w, http.StatusNoContent, nil)
+	return true
+}
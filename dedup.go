@@ -0,0 +1,58 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+// keyWindow collects the encoded messages and keeps only the latest
+// version of each key. The messages without key are all kept.
+type keyWindow struct {
+	entries [][][]byte
+	latest  map[string]int
+	size    int64
+}
+
+func newKeyWindow() *keyWindow {
+	return &keyWindow{
+		latest: make(map[string]int),
+	}
+}
+
+// Add appends the values of message with key. The previous version of
+// the key is dropped.
+func (w *keyWindow) Add(key []byte, values [][]byte) {
+	for _, value := range values {
+		w.size += int64(len(value))
+	}
+
+	if key != nil {
+		if i, ok := w.latest[string(key)]; ok {
+			for _, value := range w.entries[i] {
+				w.size -= int64(len(value))
+			}
+			w.entries[i] = nil
+		}
+		w.latest[string(key)] = len(w.entries)
+	}
+
+	w.entries = append(w.entries, values)
+}
+
+// Size returns the total size of kept values.
+func (w *keyWindow) Size() int64 {
+	return w.size
+}
+
+// Values returns the kept values in the order of offsets.
+func (w *keyWindow) Values() [][]byte {
+	var res [][]byte
+
+	for _, values := range w.entries {
+		res = append(res, values...)
+	}
+
+	return res
+}
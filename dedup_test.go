@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyWindow(t *testing.T) {
+	w := newKeyWindow()
+
+	w.Add([]byte("a"), [][]byte{[]byte(`1`)})
+	w.Add([]byte("b"), [][]byte{[]byte(`2`)})
+	w.Add(nil, [][]byte{[]byte(`3`)})
+	w.Add([]byte("a"), [][]byte{[]byte(`4`), []byte(`5`)})
+	w.Add(nil, [][]byte{[]byte(`6`)})
+	w.Add([]byte("b"), [][]byte{[]byte(`null`)})
+
+	var values []string
+	for _, v := range w.Values() {
+		values = append(values, string(v))
+	}
+
+	if s := strings.Join(values, ","); s != "3,4,5,6,null" {
+		t.Fatalf("Unexpected values: %s", s)
+	}
+
+	if n := w.Size(); n != 8 {
+		t.Fatalf("Expected size 8, got %d", n)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// envelopeFields are the names of meta fields added to the produced
+// messages by Producer.Envelope.
+var envelopeFields = []string{"timestamp", "remote_addr", "request_id"}
+
+// messageEnvelope wraps the produced message.
+type messageEnvelope struct {
+	Meta    map[string]string `json:"meta"`
+	Payload json.RawMessage   `json:"payload"`
+
+	// PayloadEncoding is "base64" if the payload isn't JSON.
+	PayloadEncoding string `json:"payload_encoding,omitempty"`
+}
+
+// envelopeMeta returns the meta fields of request. The fields without
+// value are omitted.
+func envelopeMeta(r *http.Request, fields []CfgEnvelopeField, now time.Time) map[string]string {
+	names := envelopeFields
+
+	if len(fields) > 0 {
+		names = make([]string, len(fields))
+		for i, f := range fields {
+			names[i] = f.Name
+		}
+	}
+
+	meta := make(map[string]string, len(names))
+
+	for _, name := range names {
+		var value string
+
+		switch name {
+		case "timestamp":
+			value = now.UTC().Format(time.RFC3339Nano)
+		case "remote_addr":
+			value = r.RemoteAddr
+			if host, _, err := net.SplitHostPort(value); err == nil {
+				value = host
+			}
+		case "request_id":
+			value = r.Header.Get("X-Request-Id")
+		}
+
+		if value != "" {
+			meta[name] = value
+		}
+	}
+
+	return meta
+}
+
+// wrapMessage returns the message in the envelope. The payload which is
+// not JSON is encoded as base64 string.
+func wrapMessage(msg []byte, meta map[string]string) ([]byte, error) {
+	res := &messageEnvelope{
+		Meta:    meta,
+		Payload: msg,
+	}
+
+	if !json.Valid(msg) {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		res.Payload = b
+		res.PayloadEncoding = "base64"
+	}
+
+	return json.Marshal(res)
+}
+
+// envelope wraps the message if Producer.Envelope is enabled. Tombstones
+// are kept as is.
+func envelope(r *http.Request, cfg *Config, msg []byte) ([]byte, error) {
+	if !cfg.Producer.Envelope || msg == nil {
+		return msg, nil
+	}
+	return wrapMessage(msg, envelopeMeta(r, cfg.Producer.EnvelopeMeta, time.Now()))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeMeta(t *testing.T) {
+	r := httptest.NewRequest("POST", "/v1/topics/test/0", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Request-Id", "req-1")
+
+	now := time.Date(2017, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	meta := envelopeMeta(r, nil, now)
+	if len(meta) != 3 || meta["timestamp"] != "2017-01-02T03:04:05.000000006Z" || meta["remote_addr"] != "192.0.2.1" || meta["request_id"] != "req-1" {
+		t.Fatalf("unexpected meta: %v", meta)
+	}
+
+	meta = envelopeMeta(r, []CfgEnvelopeField{{Name: "request_id"}}, now)
+	if len(meta) != 1 || meta["request_id"] != "req-1" {
+		t.Fatalf("unexpected meta: %v", meta)
+	}
+
+	// The fields without value are omitted.
+	r.Header.Del("X-Request-Id")
+
+	if meta = envelopeMeta(r, nil, now); len(meta) != 2 {
+		t.Fatalf("unexpected meta: %v", meta)
+	}
+
+	var f CfgEnvelopeField
+	if err := f.UnmarshalText([]byte("hostname")); err == nil {
+		t.Fatal("expected error for unknown field")
+	}
+}
+
+func TestWrapMessage(t *testing.T) {
+	meta := map[string]string{"request_id": "req-1"}
+
+	testCases := []struct {
+		msg    string
+		result string
+	}{
+		{`{"a":1}`, `{"meta":{"request_id":"req-1"},"payload":{"a":1}}`},
+		{"\xff\x00", `{"meta":{"request_id":"req-1"},"payload":"/wA=","payload_encoding":"base64"}`},
+	}
+
+	for _, tc := range testCases {
+		b, err := wrapMessage([]byte(tc.msg), meta)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tc.msg, err)
+		}
+		if string(b) != tc.result {
+			t.Fatalf("%q: expected %s, got %s", tc.msg, tc.result, b)
+		}
+	}
+}
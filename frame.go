@@ -0,0 +1,57 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// FrameHeaderSize is the size of length prefix of framed record.
+const FrameHeaderSize = 4
+
+// FrameError is returned when the message value isn't a sequence of
+// length-prefixed records.
+type FrameError struct {
+	Offset int
+	Reason string
+}
+
+func (e FrameError) Error() string {
+	return fmt.Sprintf("malformed frame at byte %d: %s", e.Offset, e.Reason)
+}
+
+// splitFrames splits the value into records. Each record is prefixed by
+// its length as 4-byte big-endian integer. The empty value has no records.
+func splitFrames(value []byte) ([][]byte, error) {
+	var records [][]byte
+
+	for pos := 0; pos < len(value); {
+		if len(value)-pos < FrameHeaderSize {
+			return nil, FrameError{
+				Offset: pos,
+				Reason: fmt.Sprintf("%d bytes left for the length prefix", len(value)-pos),
+			}
+		}
+
+		size := binary.BigEndian.Uint32(value[pos:])
+		pos += FrameHeaderSize
+
+		if uint64(size) > uint64(len(value)-pos) {
+			return nil, FrameError{
+				Offset: pos - FrameHeaderSize,
+				Reason: fmt.Sprintf("record length %d exceeds %d bytes left", size, len(value)-pos),
+			}
+		}
+
+		records = append(records, value[pos:pos+int(size)])
+		pos += int(size)
+	}
+
+	return records, nil
+}
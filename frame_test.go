@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func frame(records ...string) []byte {
+	var b []byte
+	for _, r := range records {
+		n := len(r)
+		b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		b = append(b, r...)
+	}
+	return b
+}
+
+func TestSplitFrames(t *testing.T) {
+	records, err := splitFrames(frame(`{"a":1}`, ``, `[2]`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expect := []string{`{"a":1}`, ``, `[2]`}
+
+	if len(records) != len(expect) {
+		t.Fatalf("Expected %d records, got %d", len(expect), len(records))
+	}
+	for i := range expect {
+		if !bytes.Equal(records[i], []byte(expect[i])) {
+			t.Fatalf("Record %d: expected %q, got %q", i, expect[i], records[i])
+		}
+	}
+
+	records, err = splitFrames(nil)
+	if err != nil || len(records) != 0 {
+		t.Fatalf("Expected no records, got %d: %v", len(records), err)
+	}
+}
+
+func TestSplitFramesMalformed(t *testing.T) {
+	testCases := [][]byte{
+		// Short length prefix.
+		{0, 0},
+		// Length beyond the value.
+		{0, 0, 0, 5, 'a', 'b'},
+		// Garbage after the valid record.
+		append(frame(`1`), 0, 0, 0),
+		// The huge length.
+		{0xff, 0xff, 0xff, 0xff, 'a'},
+	}
+
+	for i, tc := range testCases {
+		if _, err := splitFrames(tc); err == nil {
+			t.Fatalf("Case %d: expected error", i)
+		} else if _, ok := err.(FrameError); !ok {
+			t.Fatalf("Case %d: unexpected error type: %T", i, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"github.com/facebookgo/metrics"
+
+	log "github.com/Sirupsen/logrus"
+
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+)
+
+// GraphiteReporter periodically sends metrics to graphite using plaintext protocol.
+type GraphiteReporter struct {
+	Address  string
+	Prefix   string
+	Interval time.Duration
+
+	server *Server
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewGraphiteReporter creates new GraphiteReporter object.
+func NewGraphiteReporter(s *Server) *GraphiteReporter {
+	return &GraphiteReporter{
+		Address:  s.Config().Metrics.GraphiteAddress,
+		Prefix:   s.Config().Metrics.GraphitePrefix,
+		Interval: s.Config().Metrics.GraphiteInterval.Duration,
+		server:   s,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs reporter in background.
+func (g *GraphiteReporter) Start() {
+	go func() {
+		defer close(g.done)
+
+		for {
+			select {
+			case <-time.After(g.Interval):
+			case <-g.stop:
+				return
+			}
+
+			if err := g.report(time.Now()); err != nil {
+				log.Errorln("Unable to send metrics to graphite:", err)
+			}
+		}
+	}()
+}
+
+// Stop stops reporter and waits for the last report to finish.
+func (g *GraphiteReporter) Stop() {
+	close(g.stop)
+	<-g.done
+}
+
+func (g *GraphiteReporter) report(now time.Time) error {
+	conn, err := net.DialTimeout("tcp", g.Address, g.Interval)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	ts := now.Unix()
+
+	g.writeClient(w, g.Prefix+".kafka", g.server.Client, ts)
+	for name, client := range g.server.Clusters {
+		g.writeClient(w, g.Prefix+".clusters."+name+".kafka", client, ts)
+	}
+
+	for name, metric := range g.server.Stats.HTTPResponseTime.All() {
+		g.writeTimer(w, g.Prefix+".response."+name, metric, ts)
+	}
+
+	for name, metric := range g.server.Stats.MessageSize {
+		g.writeHistogram(w, g.Prefix+".messagesize."+name, metric, ts)
+	}
+
+	for name, metric := range g.server.Stats.ResponseCache {
+		fmt.Fprintf(w, "%s.responsecache.%s %d %d\n", g.Prefix, name, metric.Count(), ts)
+	}
+
+	g.writeHistogram(w, g.Prefix+".fetchresizes", g.server.Stats.FetchResizes, ts)
+
+	for topic, n := range g.server.Consumers.Info() {
+		fmt.Fprintf(w, "%s.consumers.%s %d %d\n", g.Prefix, topic, n, ts)
+	}
+
+	if g.server.Runtime != nil {
+		rs := g.server.Runtime.Last()
+		fmt.Fprintf(w, "%s.runtime.goroutines %d %d\n", g.Prefix, rs.Goroutines, ts)
+		fmt.Fprintf(w, "%s.runtime.descriptors %d %d\n", g.Prefix, rs.UsedDescriptors, ts)
+		fmt.Fprintf(w, "%s.runtime.heapalloc %d %d\n", g.Prefix, rs.HeapAlloc, ts)
+		fmt.Fprintf(w, "%s.runtime.heapsys %d %d\n", g.Prefix, rs.HeapSys, ts)
+		fmt.Fprintf(w, "%s.runtime.numgc %d %d\n", g.Prefix, rs.NumGC, ts)
+		fmt.Fprintf(w, "%s.runtime.lastgcpause %d %d\n", g.Prefix, rs.LastGCPause, ts)
+	}
+
+	for code, metric := range g.server.Stats.HTTPStatus {
+		fmt.Fprintf(w, "%s.status.%d %d %d\n", g.Prefix, code, metric.Count(), ts)
+	}
+
+	return w.Flush()
+}
+
+func (g *GraphiteReporter) writeClient(w *bufio.Writer, prefix string, client *KafkaClient, ts int64) {
+	for name, metric := range client.Counters {
+		fmt.Fprintf(w, "%s.counters.%s %d %d\n", prefix, name, metric.Count(), ts)
+	}
+	for name, metric := range client.Timings.All() {
+		g.writeTimer(w, prefix+".timings."+name, metric, ts)
+	}
+}
+
+func (g *GraphiteReporter) writeTimer(w *bufio.Writer, prefix string, metric metrics.Timer, ts int64) {
+	fmt.Fprintf(w, "%s.count %d %d\n", prefix, metric.Count(), ts)
+	fmt.Fprintf(w, "%s.min %d %d\n", prefix, metric.Min(), ts)
+	fmt.Fprintf(w, "%s.max %d %d\n", prefix, metric.Max(), ts)
+	fmt.Fprintf(w, "%s.mean %.2f %d\n", prefix, metric.Mean(), ts)
+	fmt.Fprintf(w, "%s.rate1 %.2f %d\n", prefix, metric.Rate1(), ts)
+	fmt.Fprintf(w, "%s.p75 %.2f %d\n", prefix, metric.Percentile(0.75), ts)
+	fmt.Fprintf(w, "%s.p95 %.2f %d\n", prefix, metric.Percentile(0.95), ts)
+	fmt.Fprintf(w, "%s.p99 %.2f %d\n", prefix, metric.Percentile(0.99), ts)
+}
+
+func (g *GraphiteReporter) writeHistogram(w *bufio.Writer, prefix string, metric metrics.Histogram, ts int64) {
+	fmt.Fprintf(w, "%s.count %d %d\n", prefix, metric.Count(), ts)
+	fmt.Fprintf(w, "%s.min %d %d\n", prefix, metric.Min(), ts)
+	fmt.Fprintf(w, "%s.max %d %d\n", prefix, metric.Max(), ts)
+	fmt.Fprintf(w, "%s.mean %.2f %d\n", prefix, metric.Mean(), ts)
+	fmt.Fprintf(w, "%s.p75 %.2f %d\n", prefix, metric.Percentile(0.75), ts)
+	fmt.Fprintf(w, "%s.p95 %.2f %d\n", prefix, metric.Percentile(0.95), ts)
+	fmt.Fprintf(w, "%s.p99 %.2f %d\n", prefix, metric.Percentile(0.99), ts)
+}
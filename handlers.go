@@ -8,12 +8,29 @@
 package main
 
 import (
+	"github.com/optiopay/kafka/proto"
+
 	log "github.com/Sirupsen/logrus"
 
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // KafkaParameters contains information about placement in Kafka. Used in GET/POST response.
@@ -21,6 +38,66 @@ type kafkaParameters struct {
 	Topic     string `json:"topic"`
 	Partition int32  `json:"partition"`
 	Offset    int64  `json:"offset"`
+	Limit     int32  `json:"limit,omitempty"`
+	Clamped   bool   `json:"clamped,omitempty"`
+	Order     string `json:"order,omitempty"`
+	Consumer  string `json:"consumer,omitempty"`
+
+	// Until is the offset before which the messages are read instead of
+	// the limit.
+	Until *int64 `json:"until,omitempty"`
+
+	// LastOffset is the offset of the last message read up to Until or
+	// -1 if there are none.
+	LastOffset *int64 `json:"last_offset,omitempty"`
+
+	// Checksum is CRC32 (IEEE) of the produced message in hex.
+	Checksum string `json:"crc32,omitempty"`
+
+	// KeyHash is FNV-1a hash of the message key in hex. It is returned
+	// by the dry run only.
+	KeyHash string `json:"key_hash,omitempty"`
+	DryRun  bool   `json:"dry_run,omitempty"`
+
+	// Tombstone is set if the message with null value was produced.
+	Tombstone bool `json:"tombstone,omitempty"`
+}
+
+// ConsumerCommitResult contains the result of commit of partition offset. Used in POST response.
+type consumerCommitResult struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ProduceBatchResult contains the result of message from batch. Used in POST response.
+type produceBatchResult struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Checksum  string `json:"crc32,omitempty"`
+	Success   bool   `json:"success"`
+	Code      int    `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ProduceTransactionResult contains the result of transactional produce. Used in POST response.
+type produceTransactionResult struct {
+	Topic           string `json:"topic"`
+	Partition       int32  `json:"partition"`
+	Offset          int64  `json:"offset"`
+	Count           int    `json:"count"`
+	TransactionalID string `json:"transactional_id"`
+	ProducerID      int64  `json:"producer_id"`
+	ProducerEpoch   int16  `json:"producer_epoch"`
+}
+
+// batchEntry is the message of batch in POST request.
+type batchEntry struct {
+	Key   *string         `json:"key"`
+	Value json.RawMessage `json:"value"`
 }
 
 // ConsumerOffsetInfo contains information about consumer group offset of a topic partition. Used in GET/POST response.
@@ -30,6 +107,47 @@ type consumerOffsetInfo struct {
 	Partition int32  `json:"partition"`
 	Offset    int64  `json:"offset"`
 	Metadata  string `json:"metadata"`
+	Retention string `json:"retention,omitempty"`
+}
+
+// ResponseMessage contains the message with its placement in Kafka. Used in GET response.
+type responseMessage struct {
+	Offset int64           `json:"offset"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+
+	// ValueEncoding is "base64" if the value isn't JSON.
+	ValueEncoding string `json:"value_encoding,omitempty"`
+}
+
+// ResponsePartitionMessage contains the message with its partition and offset. Used in GET response of topic.
+type responsePartitionMessage struct {
+	Partition int32           `json:"partition"`
+	Offset    int64           `json:"offset"`
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
+}
+
+func newPartitionMessage(partition int32, msg *proto.Message) responsePartitionMessage {
+	return responsePartitionMessage{
+		Partition: partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+		Value:     msg.Value,
+	}
+}
+
+// TopicMessagesQuery contains parameters of reading from all partitions of topic.
+type topicMessagesQuery struct {
+	Topic    string `json:"topic"`
+	Limit    int32  `json:"limit"`
+	Strategy string `json:"strategy"`
+}
+
+// ResponseTopicMessages contains messages read from all partitions of topic.
+type responseTopicMessages struct {
+	Query    topicMessagesQuery         `json:"query"`
+	Messages []responsePartitionMessage `json:"messages"`
 }
 
 // ResponsePartitionInfo contains information about Kafka partition.
@@ -42,580 +160,3856 @@ type responsePartitionInfo struct {
 	Writable     bool    `json:"writable"`
 	ReplicasNum  int     `json:"replicasnum"`
 	Replicas     []int32 `json:"replicas"`
-}
 
-// ResponseTopicListInfo contains information about Kafka topic.
-type responseTopicListInfo struct {
-	Topic      string `json:"topic"`
-	Partitions int    `json:"partitions"`
+	// The metadata API does not report these values separately. The high-watermark
+	// is the newest offset and the log-start offset is the oldest one. They are
+	// omitted only if the offsets are unknown, so the empty partition has zeros.
+	HighWatermark  *int64 `json:"highwatermark,omitempty"`
+	LogStartOffset *int64 `json:"logstartoffset,omitempty"`
+
+	Error string `json:"error,omitempty"`
 }
 
-func httpStatusError(err error) int {
-	if _, ok := err.(KhpError); ok {
-		return http.StatusServiceUnavailable
-	}
-	if err == KafkaErrUnknownTopicOrPartition {
-		return http.StatusNotFound
-	}
-	return http.StatusInternalServerError
+// ResponsePartitionOffsets contains oldest and newest offsets of Kafka partition.
+type responsePartitionOffsets struct {
+	Topic        string `json:"topic"`
+	Partition    int32  `json:"partition"`
+	OffsetOldest int64  `json:"offsetfrom"`
+	OffsetNewest int64  `json:"offsetto"`
 }
 
-func (s *Server) rootHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	s.rawResponse(w, http.StatusOK, []byte(`<!DOCTYPE html>
-<html>
-  <head>
-    <meta charset="utf-8">
-    <link href="http://yastatic.net/bootstrap/3.3.1/css/bootstrap.min.css" rel="stylesheet">
-    <title>Endpoints | Kafka API v1</title>
-  </head>
-  <body>
-    <div class="container"><h2>Kafka API v1</h2><br>
-        <table class="table">
-          <tr>
-            <th class="text-right">Write to Kafka</th>
-            <td>POST</td>
-            <td><code>{schema}://{host}/v1/topics/{topic}/{partition}</code></td>
-          </tr>
-          <tr>
-            <th class="text-right">Read from Kafka by absolute position</th>
-            <td>GET</td>
-            <td>
-               <code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}</code>
-            </td>
-          </tr>
-          <tr>
-            <th class="text-right">Read data relative to the beginning or end of the queue</th>
-            <td>GET</td>
-            <td>
-               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?relative={position}&limit={limit}</code></p>
-               The <b>{position}</b> can be positive or negative.
-            </td>
-          </tr>
-          <tr>
-            <th class="text-right">Obtain topic list</th>
-            <td>GET</td>
-            <td><code>{schema}://{host}/v1/info/topics</code></td>
-          </tr>
-          <tr>
-            <th class="text-right">Obtain information about all partitions in topic</th>
-            <td>GET</td>
-            <td><code>{schema}://{host}/v1/info/topics/{topic}</code></td>
-          </tr>
-          <tr>
-            <th class="text-right">Obtain information about partition</th>
-            <td>GET</td>
-            <td><code>{schema}://{host}/v1/info/topics/{topic}/{partition}</code></td>
-          </tr>
-        </table>
-    </div>
-  </body>
-</html>`))
+// ResponseTopicOffsets contains offsets of all partitions in Kafka topic.
+type responseTopicOffsets struct {
+	Topic      string                     `json:"topic"`
+	Messages   int64                      `json:"messages"`
+	Partitions []responsePartitionOffsets `json:"partitions"`
 }
 
-func (s *Server) pingHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
-	w.WriteHeader(http.StatusOK)
+// ResponseMessageSize contains estimated message sizes of topics.
+type responseMessageSize struct {
+	Description string            `json:"description"`
+	Samples     int               `json:"samples"`
+	Percentile  float64           `json:"percentile"`
+	MaxTopics   int               `json:"max_topics"`
+	Topics      []MessageSizeInfo `json:"topics"`
 }
 
-func (s *Server) notFoundHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
-	s.errorResponse(w, http.StatusNotFound, "404 page not found")
+// ResponsePoolInfo contains information about the pool of connections.
+type responsePoolInfo struct {
+	Size    int64 `json:"size"`
+	MaxSize int64 `json:"maxsize"`
 }
 
-func (s *Server) notAllowedHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
-	s.errorResponse(w, http.StatusMethodNotAllowed, "405 Method Not Allowed")
+// ResponsePoolStatus contains the state of connection pool.
+type responsePoolStatus struct {
+	Size            int64 `json:"size"`
+	Free            int64 `json:"free"`
+	Dead            int64 `json:"dead"`
+	Reconnecting    int64 `json:"reconnecting"`
+	Reconnects      int64 `json:"reconnects"`
+	ReconnectErrors int64 `json:"reconnect_errors"`
 }
 
-func (s *Server) validRequest(w *HTTPResponse, p *url.Values, checkTopic bool) bool {
-	topic := p.Get("topic")
+// ResponseClusterInfo contains summary of Kafka cluster.
+type responseClusterInfo struct {
+	Brokers           int       `json:"brokers"`
+	Topics            int       `json:"topics"`
+	Partitions        int       `json:"partitions"`
+	OfflinePartitions int       `json:"offlinepartitions"`
+	Controller        int32     `json:"controller"`
+	Updated           time.Time `json:"updated"`
+}
 
-	if topic == "" {
-		s.errorResponse(w, http.StatusBadRequest, "Topic name required")
-		return false
-	}
+// ResponseUnderReplicated contains the partition which has less in-sync
+// replicas than assigned ones.
+type responseUnderReplicated struct {
+	Topic     string  `json:"topic"`
+	Partition int32   `json:"partition"`
+	Leader    int32   `json:"leader"`
+	Replicas  []int32 `json:"replicas"`
+	Isrs      []int32 `json:"isrs"`
+}
 
-	meta, err := s.Client.FetchMetadata()
-	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
-		return false
-	}
+// ResponseReadyInfo contains the readiness of the instance.
+type responseReadyInfo struct {
+	Ready          bool             `json:"ready"`
+	MinHealthy     int64            `json:"minhealthy"`
+	AliveBrokers   int64            `json:"alivebrokers"`
+	MetadataCached bool             `json:"metadatacached"`
+	Clusters       map[string]int64 `json:"clusters"`
+}
 
-	found, err := meta.inTopics(topic)
-	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get topic: %v", err)
-		return false
-	}
+// ResponseReloadInfo contains the result of configuration reload.
+type responseReloadInfo struct {
+	Changed []string `json:"changed"`
+	Restart []string `json:"restart"`
+}
 
-	if !checkTopic {
-		return true
-	}
+// ResponseMetricsReset contains the time of metrics reset.
+type responseMetricsReset struct {
+	Reset time.Time `json:"reset"`
+}
 
-	if !found {
-		s.errorResponse(w, http.StatusBadRequest, "Topic unknown")
-		return false
-	}
+// ResponseTopicListInfo contains information about Kafka topic.
+type responseTopicListInfo struct {
+	Topic      string `json:"topic"`
+	Partitions int    `json:"partitions"`
+	Error      string `json:"error,omitempty"`
+}
 
-	if p.Get("partition") == "" {
-		return true
-	}
+// ResponseMessageFields contains the requested fields of message. Used in GET response.
+type responseMessageFields struct {
+	Offset *int64          `json:"offset,omitempty"`
+	Key    *string         `json:"key,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
 
-	partition := toInt32(p.Get("partition"))
+	// ValueEncoding is "base64" if the value isn't JSON.
+	ValueEncoding string `json:"value_encoding,omitempty"`
+}
 
-	parts, err := meta.Partitions(topic)
-	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get partitions: %v", err)
-		return false
-	}
+// MessageFields selects the fields of message in the GET response.
+// If no field is selected, the raw value is returned.
+type messageFields struct {
+	Offset bool
+	Key    bool
+	Value  bool
 
-	if !inSlice(partition, parts) {
-		s.errorResponse(w, http.StatusBadRequest, "Unknown partition for the specified topic")
-		return false
-	}
+	// Base64 encodes the value as a JSON string, so the response is
+	// valid for any binary payload.
+	Base64 bool
 
-	return true
+	// Framed splits the value into length-prefixed records.
+	Framed bool
 }
 
-func (s *Server) sendHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
-	defer s.Stats.HTTPResponseTime["POST"].Start().Stop()
+// allMessageFields is used for the envelope form.
+var allMessageFields = messageFields{Offset: true, Key: true, Value: true}
 
-	kafka := &kafkaParameters{
-		Topic:     p.Get("topic"),
-		Partition: toInt32(p.Get("partition")),
-		Offset:    -1,
-	}
+// parseMessageFields parses the comma separated list of fields.
+func parseMessageFields(s string) (messageFields, error) {
+	var fields messageFields
 
-	msg, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		s.errorResponse(w, http.StatusBadRequest, "Unable to read body: %s", err)
-		return
+	if s == "" {
+		return fields, nil
 	}
 
-	if int32(len(msg)) > s.Cfg.Consumer.MaxFetchSize {
-		s.errorResponse(w, http.StatusBadRequest, "Message too large: Body size should be less than %d, but it is %d", s.Cfg.Consumer.MaxFetchSize, int32(len(msg)))
-		return
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "offset":
+			fields.Offset = true
+		case "key":
+			fields.Key = true
+		case "value":
+			fields.Value = true
+		default:
+			return fields, fmt.Errorf("unknown field: %s", name)
+		}
 	}
 
-	var m json.RawMessage
-	if err = json.Unmarshal(msg, &m); err != nil {
-		s.errorResponse(w, http.StatusBadRequest, "Message must be JSON")
-		return
-	}
+	return fields, nil
+}
 
-	if !s.validRequest(w, p, !s.Cfg.Broker.AllowTopicCreation) {
-		return
-	}
+// encodeMessage returns the message representation for the GET response.
+func encodeMessage(msg *proto.Message, fields messageFields) ([]byte, error) {
+	value := json.RawMessage(msg.Value)
 
-	producer, err := s.Client.NewProducer(s.Cfg)
-	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to make producer: %v", err)
-		return
+	// The tombstone is kept null.
+	if fields.Base64 && msg.Value != nil {
+		b, err := json.Marshal(msg.Value)
+		if err != nil {
+			return nil, err
+		}
+		value = b
 	}
-	defer producer.Close()
 
-	kafka.Offset, err = producer.SendMessage(kafka.Topic, kafka.Partition, msg)
-	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to store your data: %v", err)
-		return
-	}
+	selected := fields
+	selected.Base64 = false
+	selected.Framed = false
 
-	s.MessageSize.Put(kafka.Topic, int32(len(msg)))
-	s.successResponse(w, kafka)
-}
+	if selected == (messageFields{}) {
+		// The tombstone has no value.
+		if value == nil {
+			return []byte(`null`), nil
+		}
+		return value, nil
+	}
 
-func (s *Server) getHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
-	defer s.Stats.HTTPResponseTime["GET"].Start().Stop()
+	// The value which is not JSON can't be embedded, so it is encoded as
+	// base64 string like the payload of envelope.
+	var encoding string
 
-	var (
-		varsLength   string
-		varsOffset   string
-		varsRelative string
-	)
+	if value != nil && !json.Valid(value) {
+		b, err := json.Marshal(msg.Value)
+		if err != nil {
+			return nil, err
+		}
+		value = b
+		encoding = "base64"
+	}
 
-	if varsLength = p.Get("limit"); varsLength == "" {
-		varsLength = "1"
+	if selected == allMessageFields {
+		return json.Marshal(&responseMessage{
+			Offset:        msg.Offset,
+			Key:           string(msg.Key),
+			Value:         value,
+			ValueEncoding: encoding,
+		})
 	}
 
-	varsOffset = p.Get("offset")
-	varsRelative = p.Get("relative")
+	res := &responseMessageFields{}
 
-	query := kafkaParameters{
-		Topic:     p.Get("topic"),
-		Partition: toInt32(p.Get("partition")),
-		Offset:    -1,
+	if fields.Offset {
+		res.Offset = &msg.Offset
 	}
-
-	length := toInt32(varsLength)
-	if length <= 0 {
-		length = 1
+	if fields.Key {
+		key := string(msg.Key)
+		res.Key = &key
+	}
+	if fields.Value {
+		res.Value = value
+		res.ValueEncoding = encoding
 	}
 
-	if !s.validRequest(w, p, true) {
-		return
+	return json.Marshal(res)
+}
+
+// encodeMessages returns the representation of message for the GET
+// response. The framed message gives one value per record, each with
+// offset and key of the message.
+func encodeMessages(msg *proto.Message, fields messageFields) ([][]byte, error) {
+	if !fields.Framed {
+		value, err := encodeMessage(msg, fields)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{value}, nil
 	}
 
-	offsetFrom, offsetTo, err := s.Client.GetOffsets(query.Topic, query.Partition)
+	records, err := splitFrames(msg.Value)
 	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get offset: %v", err)
-		return
+		return nil, err
 	}
 
-	if varsRelative != "" {
-		relative := toInt64(varsRelative)
+	values := make([][]byte, len(records))
+	record := *msg
 
-		if relative >= 0 {
-			query.Offset = offsetFrom + relative
-		} else {
-			query.Offset = offsetTo + relative
+	for i := range records {
+		record.Value = records[i]
+
+		values[i], err = encodeMessage(&record, fields)
+		if err != nil {
+			return nil, err
 		}
-	} else if varsOffset != "" {
-		query.Offset = toInt64(varsOffset)
-	} else {
-		// Set default value
-		query.Offset = offsetFrom
 	}
 
-	if query.Offset < offsetFrom || query.Offset >= offsetTo {
-		s.errorOutOfRange(w, query.Topic, query.Partition, offsetFrom, offsetTo)
-		return
-	}
+	return values, nil
+}
 
-	queryStr, err := json.Marshal(query)
-	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to marshal json: %v", err)
-		return
+// encodeStatusError returns the HTTP status for encodeMessages error.
+func encodeStatusError(err error) int {
+	if _, ok := err.(FrameError); ok {
+		return http.StatusUnprocessableEntity
 	}
+	return http.StatusInternalServerError
+}
 
-	cfg := *s.Cfg
-	offset := query.Offset
-	size := s.MessageSize.Get(query.Topic, s.Cfg.Consumer.DefaultFetchSize)
-	maxSize := 0
-
-	notEnoughSize := false
-	successSent := false
-
-ConsumeLoop:
-	for {
-		cfg.Consumer.MaxFetchSize = size * length
+func httpStatusError(err error) int {
+	if _, ok := err.(KhpError); ok {
+		return http.StatusServiceUnavailable
+	}
+	if err == KafkaErrUnknownTopicOrPartition {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
 
-		if cfg.Consumer.MaxFetchSize > s.Cfg.Consumer.MaxFetchSize {
-			cfg.Consumer.MaxFetchSize = s.Cfg.Consumer.MaxFetchSize
-		}
+func (s *Server) rootHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	s.rawResponse(w, http.StatusOK, []byte(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <link href="http://yastatic.net/bootstrap/3.3.1/css/bootstrap.min.css" rel="stylesheet">
+    <title>Endpoints | Kafka API v1</title>
+  </head>
+  <body>
+    <div class="container"><h2>Kafka API v1</h2><br>
+        <table class="table">
+          <tr>
+            <th class="text-right">Write to Kafka</th>
+            <td>POST</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?acks={level}</code></p>
+               The optional <b>{level}</b> is one of none, leader or all.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Write to Kafka by key</th>
+            <td>POST</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}?key={key}</code></p>
+               The partition is chosen by the routing table of the topic or by the hash of <b>{key}</b>.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Write stream of messages to Kafka</th>
+            <td>POST</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/produce?partition={partition}</code></p>
+               The body contains newline-delimited JSON messages.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Write batch of messages to Kafka</th>
+            <td>POST</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}/batch</code></p>
+               The body is a JSON array of <b>{"key":{key},"value":{message}}</b>. The result of each message is returned.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Write batch of messages in transaction</th>
+            <td>POST</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}/transaction?transactional_id={id}</code></p>
+               The messages are either all committed or all aborted.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Write to Kafka by content type</th>
+            <td>POST</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}?by_content_type=true&key={key}</code></p>
+               The topic is chosen by the <b>Content-Type</b> header of request.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Validate message</th>
+            <td>POST</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?dry_run=true</code></p>
+               The message is validated but not written to Kafka.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Write tombstone</th>
+            <td>POST</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?tombstone=true&key={key}</code></p>
+               The message with null value removes the key from the compacted topic.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read from Kafka by absolute position</th>
+            <td>GET</td>
+            <td>
+               <code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}</code>
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read data relative to the beginning or end of the queue</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?relative={position}&limit={limit}</code></p>
+               The <b>{position}</b> can be positive or negative.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read data starting from the time</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?timestamp={timestamp}&limit={limit}</code></p>
+               The <b>{timestamp}</b> is in milliseconds.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read the range of offsets</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&until={until}&maxbytes={maxbytes}</code></p>
+               The messages before the <b>{until}</b> offset are read regardless of limit.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read messages with their offsets and keys</th>
+            <td>GET</td>
+            <td>
+               <code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}&envelope=true</code>
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read binary messages with their offsets and keys</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}&envelope=true&value_encoding=base64</code></p>
+               The value is encoded as a base64 string.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read length-prefixed records of messages</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}&frame=length-prefixed</code></p>
+               Each record is returned as a separate message.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read the latest message of each key</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}&dedup_by_key=true</code></p>
+               The older messages with the same key are dropped within the window.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read only the selected fields of messages</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}&fields={fields}</code></p>
+               The <b>{fields}</b> is a comma separated list of <b>offset</b>, <b>key</b> and <b>value</b>.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read from consumer group position</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?consumer={consumer}&limit={limit}&commit={bool}</code></p>
+               The reading starts from the offset committed by <b>{consumer}</b>. The new position is committed if <b>commit</b> is true.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read the newest messages first</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}&order=desc</code></p>
+               The messages up to the <b>{offset}</b> (the newest by default) are returned in reverse order.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read from Kafka as NDJSON</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}&output=ndjson</code></p>
+               One message per line without the surrounding object.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read from Kafka without streaming</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}&buffered=true</code></p>
+               The response is sent at once with <b>Content-Length</b>.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read from the oldest available message if the offset is removed</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}&on_underflow={mode}</code></p>
+               The <b>{mode}</b> is <b>error</b> (default) or <b>clamp</b>.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read from Kafka within the time limit</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}&deadline={duration}</code></p>
+               The messages read before the <b>deadline</b> are returned with the <b>truncated</b> flag.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read from all partitions of topic</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}?relative={position}&limit={limit}&strategy={strategy}</code></p>
+               The <b>{strategy}</b> is <b>roundrobin</b> (default) or <b>sequential</b>.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Read from Kafka and commit consumer group offset</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/topics/{topic}/{partition}?offset={offset}&limit={limit}&commit_as={consumer}&commit_wait={bool}</code></p>
+               The offset is committed in background unless <b>commit_wait</b> is true.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain consumer group list</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/consumers</code></td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain state and members of consumer group</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/consumers/{consumer}/describe</code></td>
+          </tr>
+          <tr>
+            <th class="text-right">Commit consumer group offsets of several partitions</th>
+            <td>POST</td>
+            <td>
+               <p><code>{schema}://{host}/v1/consumers/{consumer}/commit?retention={duration}</code></p>
+               The body is an array of <b>{"topic":{topic},"partition":{partition},"offset":{offset}}</b>.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain oldest and newest offsets of partition</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/topics/{topic}/{partition}/offsets</code></td>
+          </tr>
+          <tr>
+            <th class="text-right">Receive one message by offset</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/topics/{topic}/{partition}/messages/{offset}</code></td>
+          </tr>
+          <tr>
+            <th class="text-right">Receive the newest message</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/topics/{topic}/{partition}/latest</code></td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain state of connection pool</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/status/pool</code></td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain summary of cluster</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/info/cluster</code></td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain under-replicated partitions</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/info/under-replicated</code></td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain topic list</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/info/topics?prefix={prefix}&offset={offset}&limit={limit}</code></p>
+               The parameters are optional. The topics are sorted by name.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain estimated message sizes of topics</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/info/messagesize</code></td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain information about all partitions in topic</th>
+            <td>GET</td>
+            <td>
+               <p><code>{schema}://{host}/v1/info/topics/{topic}?strict={bool}</code></p>
+               Errors are reported per partition unless <b>strict</b> is true.
+            </td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain offsets of all partitions in topic</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/info/topics/{topic}/offsets</code></td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain information about partition</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/info/topics/{topic}/{partition}</code></td>
+          </tr>
+          <tr>
+            <th class="text-right">Obtain API versions supported by broker</th>
+            <td>GET</td>
+            <td><code>{schema}://{host}/v1/info/apiversions</code></td>
+          </tr>
+        </table>
+    </div>
+  </body>
+</html>`))
+}
+
+func (s *Server) pingHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) readyHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	minHealthy := s.Config().Broker.MinHealthy
+
+	res := &responseReadyInfo{
+		Ready:          true,
+		MinHealthy:     minHealthy,
+		AliveBrokers:   s.Client.AliveBrokers(),
+		MetadataCached: s.Client.MetadataCached(),
+		Clusters:       make(map[string]int64),
+	}
+
+	if res.AliveBrokers < minHealthy {
+		res.Ready = false
+	}
+
+	for name, client := range s.Clusters {
+		alive := client.AliveBrokers()
+		if alive < minHealthy {
+			res.Ready = false
+		}
+		if !client.MetadataCached() {
+			res.MetadataCached = false
+		}
+		res.Clusters[name] = alive
+	}
+
+	reason := "Not enough alive brokers"
+
+	// The first requests must not wait for metadata.
+	if res.Ready && !res.MetadataCached {
+		res.Ready = false
+		reason = "Metadata isn't cached yet"
+	}
+
+	if !res.Ready {
+		b, err := json.Marshal(res)
+		if err != nil {
+			s.errorResponse(w, http.StatusInternalServerError, "Unable to marshal json: %v", err)
+			return
+		}
+
+		w.HTTPError = reason
+
+		s.beginResponse(w, http.StatusServiceUnavailable)
+		w.Write(b)
+		s.endResponseError(w)
+		return
+	}
+
+	s.successResponse(w, res)
+}
+
+func (s *Server) notFoundHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	s.errorResponse(w, http.StatusNotFound, "404 page not found")
+}
+
+func (s *Server) notAllowedHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	s.errorResponse(w, http.StatusMethodNotAllowed, "405 Method Not Allowed")
+}
+
+// requestConfig returns a copy of the server configuration with operation
+// timeouts overridden by X-Request-Timeout header.
+func (s *Server) requestConfig(w *HTTPResponse, r *http.Request) (*Config, bool) {
+	cfg := *s.Config()
+
+	if value := r.Header.Get("X-Request-Timeout"); value != "" && s.Config().Global.MaxRequestTimeout.Duration > 0 {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			s.errorResponse(w, http.StatusBadRequest, "Bad X-Request-Timeout header: %s", value)
+			return nil, false
+		}
+
+		if timeout > s.Config().Global.MaxRequestTimeout.Duration {
+			timeout = s.Config().Global.MaxRequestTimeout.Duration
+		}
+
+		cfg.Consumer.GetMessageTimeout.Duration = timeout
+		cfg.Producer.SendMessageTimeout.Duration = timeout
+		cfg.OffsetCoordinator.CommitOffsetTimeout.Duration = timeout
+		cfg.OffsetCoordinator.FetchOffsetTimeout.Duration = timeout
+	}
+
+	// No operation may last longer than the rest of the request.
+	if deadline, ok := r.Context().Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			s.errorResponse(w, http.StatusGatewayTimeout, "Request timeout exceeded")
+			return nil, false
+		}
+
+		for _, timeout := range []*time.Duration{
+			&cfg.Consumer.GetMessageTimeout.Duration,
+			&cfg.Producer.SendMessageTimeout.Duration,
+			&cfg.OffsetCoordinator.CommitOffsetTimeout.Duration,
+			&cfg.OffsetCoordinator.FetchOffsetTimeout.Duration,
+		} {
+			if *timeout <= 0 || *timeout > remaining {
+				*timeout = remaining
+			}
+		}
+	}
+
+	return &cfg, true
+}
+
+// requestDeadline returns the time by which the whole request must be
+// completed or zero if it is not limited. The limit is the X-Request-Timeout
+// header capped by Global.MaxRequestTimeout or Global.TotalRequestTimeout,
+// whichever is less.
+func (s *Server) requestDeadline(r *http.Request) time.Time {
+	timeout := s.Config().Global.TotalRequestTimeout.Duration
+
+	if value := r.Header.Get("X-Request-Timeout"); value != "" && s.Config().Global.MaxRequestTimeout.Duration > 0 {
+		// The bad header is reported by requestConfig.
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			if d > s.Config().Global.MaxRequestTimeout.Duration {
+				d = s.Config().Global.MaxRequestTimeout.Duration
+			}
+			if timeout <= 0 || d < timeout {
+				timeout = d
+			}
+		}
+	}
+
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// clusterClient returns the client of Kafka cluster specified in the request.
+func (s *Server) clusterClient(p *url.Values) *KafkaClient {
+	if client, ok := s.Clusters[p.Get("cluster")]; ok {
+		return client
+	}
+	return s.Client
+}
+
+func (s *Server) adminAuthorized(w *HTTPResponse, r *http.Request) bool {
+	if s.Config().Admin.Password == "" {
+		s.errorResponse(w, http.StatusForbidden, "Admin API disabled")
+		return false
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(user), []byte(s.Config().Admin.User)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.Config().Admin.Password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="kafka-http-proxy"`)
+		s.errorResponse(w, http.StatusUnauthorized, "Authorization required")
+		return false
+	}
+
+	return true
+}
+
+// setPlacementHeaders duplicates the placement of the message in the
+// response headers, so clients don't have to parse the body.
+func setPlacementHeaders(w *HTTPResponse, kafka *kafkaParameters) {
+	w.Header().Set("X-Kafka-Partition", strconv.FormatInt(int64(kafka.Partition), 10))
+	w.Header().Set("X-Kafka-Offset", strconv.FormatInt(kafka.Offset, 10))
+}
+
+func (s *Server) validRequest(w *HTTPResponse, p *url.Values, checkTopic bool) bool {
+	client := s.clusterClient(p)
+
+	topic := p.Get("topic")
+
+	if topic == "" {
+		s.errorResponse(w, http.StatusBadRequest, "Topic name required")
+		return false
+	}
+
+	// The topics out of the allowlist must look like they don't exist.
+	if !s.Config().TopicAllowed(topic) {
+		s.errorResponse(w, http.StatusNotFound, "Topic unknown")
+		return false
+	}
+
+	meta, err := client.FetchMetadata()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
+		return false
+	}
+
+	found, err := meta.inTopics(topic)
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get topic: %v", err)
+		return false
+	}
+
+	if !checkTopic {
+		return true
+	}
+
+	if !found {
+		s.errorResponse(w, http.StatusBadRequest, "Topic unknown")
+		return false
+	}
+
+	if p.Get("partition") == "" {
+		return true
+	}
+
+	partition := toInt32(p.Get("partition"))
+
+	parts, err := meta.Partitions(topic)
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get partitions: %v", err)
+		return false
+	}
+
+	// The partition may be added after the metadata was cached.
+	if !inSlice(partition, parts) && client.MetadataCachePeriod > 0 {
+		meta, err = client.ForceRefreshMetadata()
+		if err != nil {
+			s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
+			return false
+		}
+
+		parts, err = meta.Partitions(topic)
+		if err != nil {
+			s.errorResponse(w, httpStatusError(err), "Unable to get partitions: %v", err)
+			return false
+		}
+	}
+
+	if !inSlice(partition, parts) {
+		s.errorResponse(w, http.StatusBadRequest, "Unknown partition for the specified topic")
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) sendHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("POST").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	kafka := &kafkaParameters{
+		Topic:     p.Get("topic"),
+		Partition: toInt32(p.Get("partition")),
+		Offset:    -1,
+	}
+
+	cfg, ok := s.requestConfig(w, r)
+	if !ok {
+		return
+	}
+
+	// The body of the mapped media type is stored as is if it is not JSON.
+	jsonBody := true
+
+	if toBool(p.Get("by_content_type")) {
+		topic, err := contentTypeTopic(s.Config().ContentType, r.Header.Get("Content-Type"))
+		if err != nil {
+			s.errorResponse(w, http.StatusUnsupportedMediaType, "Unable to resolve topic: %v", err)
+			return
+		}
+		kafka.Topic = topic
+		p.Set("topic", topic)
+
+		jsonBody = isJSONMediaType(r.Header.Get("Content-Type"))
+	}
+
+	if !s.requestAcks(w, cfg, kafka.Topic, p) {
+		return
+	}
+
+	if pattern := cfg.Broker.TopicNamePattern.Regexp; pattern != nil && !pattern.MatchString(kafka.Topic) {
+		s.errorResponse(w, http.StatusBadRequest, "Topic name %q does not match the pattern %q", kafka.Topic, pattern.String())
+		return
+	}
+
+	var body io.Reader = r.Body
+
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			s.errorResponse(w, http.StatusBadRequest, "Unable to read gzip body: %s", err)
+			return
+		}
+		defer gz.Close()
+
+		// Don't decompress more than one byte over the limit to
+		// protect against decompression bombs.
+		body = io.LimitReader(gz, int64(s.Config().Consumer.MaxFetchSize)+1)
+	default:
+		s.errorResponse(w, http.StatusUnsupportedMediaType, "Unsupported Content-Encoding: %s", encoding)
+		return
+	}
+
+	msg, err := ioutil.ReadAll(body)
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, "Unable to read body: %s", err)
+		return
+	}
+
+	if int32(len(msg)) > s.Config().Consumer.MaxFetchSize {
+		s.errorResponse(w, http.StatusBadRequest, "Message too large: Body size should be less than %d, but it is %d", s.Config().Consumer.MaxFetchSize, int32(len(msg)))
+		return
+	}
+
+	if toBool(p.Get("tombstone")) {
+		if p.Get("key") == "" {
+			s.errorResponse(w, http.StatusBadRequest, "Key required for tombstone")
+			return
+		}
+
+		if len(msg) > 0 {
+			s.errorResponse(w, http.StatusBadRequest, "Tombstone must have empty body")
+			return
+		}
+
+		// The null value removes the key from the compacted topic.
+		msg = nil
+		kafka.Tombstone = true
+	} else if jsonBody {
+		var m json.RawMessage
+		if err = json.Unmarshal(msg, &m); err != nil {
+			s.errorResponse(w, http.StatusBadRequest, "Message must be JSON")
+			return
+		}
+
+		errs, err := s.Schemas.Validate(kafka.Topic, msg)
+		if err != nil {
+			s.errorResponse(w, http.StatusBadRequest, "Unable to validate message: %v", err)
+			return
+		}
+
+		if len(errs) > 0 {
+			s.errorValidation(w, kafka.Topic, errs)
+			return
+		}
+	}
+
+	var key []byte
+
+	if value := p.Get("key"); value != "" {
+		key = []byte(value)
+	}
+
+	// The partition is chosen by the key if it isn't specified.
+	chosen := p.Get("partition") == ""
+
+	if chosen {
+		if kafka.Partition, ok = s.partitionByKey(w, client, kafka.Topic, key); !ok {
+			return
+		}
+		p.Set("partition", strconv.FormatInt(int64(kafka.Partition), 10))
+	}
+
+	if !s.validRequest(w, p, !s.Config().Broker.AllowTopicCreation) {
+		return
+	}
+
+	meta, err := client.FetchMetadata()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
+		return
+	}
+
+	// The topic may not exist yet if topic creation is allowed.
+	if parts, err := meta.Partitions(kafka.Topic); err == nil && inSlice(kafka.Partition, parts) {
+		wp, err := meta.WritablePartitions(kafka.Topic)
+		if err != nil {
+			s.errorResponse(w, httpStatusError(err), "Unable to get writable partitions: %v", err)
+			return
+		}
+
+		if !inSlice(kafka.Partition, wp) {
+			fallback, ok := fallbackPartition(kafka.Partition, wp)
+			if !chosen || !cfg.Producer.FallbackOnNoLeader || !ok {
+				s.errorResponse(w, http.StatusServiceUnavailable, "Partition has no leader")
+				return
+			}
+
+			log.Debugf("Partition %s/%d has no leader, fall back to %d", kafka.Topic, kafka.Partition, fallback)
+			kafka.Partition = fallback
+		}
+	}
+
+	if msg, err = envelope(r, cfg, msg); err != nil {
+		s.errorResponse(w, http.StatusInternalServerError, "Unable to wrap message: %v", err)
+		return
+	}
+
+	if toBool(p.Get("dry_run")) {
+		kafka.DryRun = true
+		kafka.Checksum = fmt.Sprintf("%08x", crc32.ChecksumIEEE(msg))
+
+		if key != nil {
+			kafka.KeyHash = fmt.Sprintf("%08x", keyHash(cfg.Producer.Partitioner.Name, string(key)))
+		}
+
+		setPlacementHeaders(w, kafka)
+		s.successResponse(w, kafka)
+		return
+	}
+
+	var idempotencyKey string
+
+	if key := r.Header.Get("Idempotency-Key"); key != "" && s.Idempotency.Enabled() {
+		idempotencyKey = p.Get("cluster") + "/" + kafka.Topic + "/" + p.Get("partition") + "/" + key
+
+		if entry, ok := s.Idempotency.Reserve(idempotencyKey); !ok {
+			switch {
+			case entry.pending:
+				s.errorResponse(w, http.StatusConflict, "Request with the same Idempotency-Key is in progress")
+			case entry.timeout != nil:
+				w.Header().Set("X-Idempotent-Replay", "true")
+				s.errorWriteTimeout(w, entry.result.Topic, entry.result.Partition, *entry.timeout)
+			default:
+				w.Header().Set("X-Idempotent-Replay", "true")
+				setPlacementHeaders(w, &entry.result)
+				s.successResponse(w, &entry.result)
+			}
+			return
+		}
+
+		// The key is forgotten if the message is not stored for sure.
+		defer s.Idempotency.Release(idempotencyKey)
+	}
+
+	message := &proto.Message{
+		Key:   key,
+		Value: msg,
+	}
+
+	span := s.startKafkaSpan(r, "SendMessage", kafka.Topic, kafka.Partition)
+
+	if linger := cfg.Producer.BatchLinger.Duration; linger > 0 {
+		batchKey := p.Get("cluster") + "/" + kafka.Topic + "/" + strconv.Itoa(int(kafka.Partition)) + "/" + strconv.Itoa(int(cfg.Producer.RequiredAcks.Value))
+
+		// The batch is produced with the settings of the request which
+		// has opened it.
+		batch, pos := s.Batcher.Add(batchKey, message, linger, cfg.Producer.BatchSize, func(messages []*proto.Message) (int64, error) {
+			return s.produceMessages(client, cfg, kafka.Topic, kafka.Partition, messages...)
+		})
+
+		select {
+		case <-batch.Done():
+			kafka.Offset, err = batch.Result()
+
+			// The offset is unknown if the broker doesn't acknowledge.
+			if err == nil && cfg.Producer.RequiredAcks.Value != proto.RequiredAcksNone {
+				kafka.Offset += int64(pos)
+			}
+		case <-r.Context().Done():
+			err = client.brokerError(KhpErrorWriteTimeout, "Write timeout", -1, kafka.Topic, kafka.Partition)
+		}
+	} else {
+		kafka.Offset, err = s.produceMessages(client, cfg, kafka.Topic, kafka.Partition, message)
+	}
+
+	// The leader election may last longer than the producer retries.
+	if (err == KafkaErrNotLeaderForPartition || err == KafkaErrLeaderNotAvailable) && chosen && cfg.Producer.FallbackOnNoLeader {
+		if fallback, ok := s.writableFallback(client, kafka.Topic, kafka.Partition); ok {
+			log.Debugf("Partition %s/%d has lost the leader, fall back to %d: %v", kafka.Topic, kafka.Partition, fallback, err)
+
+			kafka.Partition = fallback
+			kafka.Offset, err = s.produceMessages(client, cfg, kafka.Topic, kafka.Partition, message)
+		}
+	}
+
+	span.SetAttribute("messaging.kafka.offset", kafka.Offset)
+	span.SetError(err)
+	span.Finish()
+
+	if e, ok := err.(KhpError); ok && e.Errno == KhpErrorWriteTimeout {
+		if idempotencyKey != "" {
+			s.Idempotency.PutTimeout(idempotencyKey, *kafka, e)
+		}
+		s.errorWriteTimeout(w, kafka.Topic, kafka.Partition, e)
+		return
+	}
+	if err != nil {
+		if isMetadataError(err) {
+			client.InvalidateMetadata()
+		}
+		s.errorResponse(w, httpStatusError(err), "Unable to store your data: %v", err)
+		return
+	}
+
+	kafka.Checksum = fmt.Sprintf("%08x", crc32.ChecksumIEEE(msg))
+
+	if idempotencyKey != "" {
+		s.Idempotency.Put(idempotencyKey, *kafka)
+	}
+
+	s.MessageSize.Put(p.Get("cluster"), kafka.Topic, int32(len(msg)))
+	s.Stats.MessageSize["Produce"].Update(int64(len(msg)))
+
+	setPlacementHeaders(w, kafka)
+	s.successResponse(w, kafka)
+}
+
+// fallbackPartition returns the writable partition which follows the
+// partition in the order of IDs. The first one follows the last.
+func fallbackPartition(partition int32, writable []int32) (int32, bool) {
+	next, first := int32(-1), int32(-1)
+
+	for _, id := range writable {
+		if id == partition {
+			continue
+		}
+		if first < 0 || id < first {
+			first = id
+		}
+		if id > partition && (next < 0 || id < next) {
+			next = id
+		}
+	}
+
+	if next >= 0 {
+		return next, true
+	}
+	return first, first >= 0
+}
+
+// writableFallback returns the fallback partition from the cached metadata.
+func (s *Server) writableFallback(client *KafkaClient, topic string, partition int32) (int32, bool) {
+	meta, err := client.FetchMetadata()
+	if err != nil {
+		return -1, false
+	}
+
+	wp, err := meta.WritablePartitions(topic)
+	if err != nil {
+		return -1, false
+	}
+
+	return fallbackPartition(partition, wp)
+}
+
+// requestAcks applies the acks parameter to the config of request. The
+// level can't be lower than Topic.MinRequiredAcks of the topic. The
+// minimum is also used if Producer.RequiredAcks is lower.
+func (s *Server) requestAcks(w *HTTPResponse, cfg *Config, topic string, p *url.Values) bool {
+	min := cfg.MinRequiredAcks(topic)
+
+	acks := p.Get("acks")
+	if acks == "" {
+		if acksDurability(cfg.Producer.RequiredAcks.Value) < acksDurability(min) {
+			cfg.Producer.RequiredAcks.Value = min
+		}
+		return true
+	}
+
+	value, err := ParseRequiredAcks(acks)
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, "Bad acks parameter: %v", err)
+		return false
+	}
+
+	if acksDurability(value) < acksDurability(min) {
+		s.errorResponse(w, http.StatusBadRequest, "Acknowledgment level %s is lower than %s required for topic", acks, RequiredAcksName(min))
+		return false
+	}
+
+	cfg.Producer.RequiredAcks.Value = value
+	return true
+}
+
+// produceMessages sends the messages to the partition in one request.
+// The producer gives up after Producer.RetryLimit, so the messages are
+// sent through another connection once the new leader is known.
+func (s *Server) produceMessages(client *KafkaClient, cfg *Config, topic string, partition int32, messages ...*proto.Message) (offset int64, err error) {
+	for retry := 0; ; retry++ {
+		var producer *KafkaProducer
+
+		producer, err = client.NewProducer(cfg)
+		if err != nil {
+			return
+		}
+
+		offset, err = producer.SendMessages(topic, partition, messages...)
+
+		if err != KafkaErrNotLeaderForPartition && err != KafkaErrLeaderNotAvailable {
+			producer.Close()
+			return
+		}
+
+		if retry >= cfg.Producer.LeaderRetryLimit {
+			producer.Close()
+			return
+		}
+
+		log.Debugf("Leader of %s/%d has changed, retry with new metadata: %v", topic, partition, err)
+
+		// The kafka library keeps metadata per connection, so the connection
+		// which knows the old leader is renewed.
+		if err := producer.Renew(); err != nil {
+			log.Errorf("Unable to renew connection: %v", err)
+		}
+		producer.Close()
+
+		if _, err := client.RefreshMetadata(); err != nil {
+			log.Errorf("Unable to refresh metadata: %v", err)
+		}
+	}
+}
+
+// streamHandler produces the newline-delimited messages of request body
+// through one producer, so the connection to Kafka is taken once for all
+// of them. The next message is read only after the previous one is stored.
+// The results are written as newline-delimited JSON in the same order.
+// HTTP/1.x server stops reading the body once the response is started, so
+// the full-duplex mode is enabled for it. If the writer doesn't support it,
+// the results are sent at once when the whole body is read and their size
+// is limited by Consumer.MaxBufferedSize.
+//
+// The whole body must be read within Global.ReadTimeout of the server, so
+// the stream is cut by it like any other request.
+func (s *Server) streamHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("ProduceStream").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	topic := p.Get("topic")
+
+	cfg, ok := s.requestConfig(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.requestAcks(w, cfg, topic, p) {
+		return
+	}
+
+	if pattern := cfg.Broker.TopicNamePattern.Regexp; pattern != nil && !pattern.MatchString(topic) {
+		s.errorResponse(w, http.StatusBadRequest, "Topic name %q does not match the pattern %q", topic, pattern.String())
+		return
+	}
+
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		s.errorResponse(w, http.StatusUnsupportedMediaType, "Unsupported Content-Encoding: %s", encoding)
+		return
+	}
+
+	var key []byte
+
+	if value := p.Get("key"); value != "" {
+		key = []byte(value)
+	}
+
+	partition := toInt32(p.Get("partition"))
+
+	if p.Get("partition") == "" {
+		if partition, ok = s.partitionByKey(w, client, topic, key); !ok {
+			return
+		}
+		p.Set("partition", strconv.FormatInt(int64(partition), 10))
+	}
+
+	if !s.validRequest(w, p, !s.Config().Broker.AllowTopicCreation) {
+		return
+	}
+
+	producer, err := client.NewProducer(cfg)
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to make producer: %v", err)
+		return
+	}
+	defer func() {
+		producer.Close()
+	}()
+
+	// The message is sent again through another connection once the new
+	// leader is known, as in the sendHandler.
+	send := func(msg []byte) (int64, error) {
+		for retry := 0; ; retry++ {
+			offset, err := producer.SendMessage(topic, partition, key, msg)
+			if err != KafkaErrNotLeaderForPartition && err != KafkaErrLeaderNotAvailable || retry >= cfg.Producer.LeaderRetryLimit {
+				return offset, err
+			}
+
+			log.Debugf("Leader of %s/%d has changed, retry with new metadata: %v", topic, partition, err)
+
+			// The connection which knows the old leader is renewed as
+			// in the produceMessages.
+			if err := producer.Renew(); err != nil {
+				log.Errorf("Unable to renew connection: %v", err)
+			}
+			producer.Close()
+
+			if _, err := client.RefreshMetadata(); err != nil {
+				log.Errorf("Unable to refresh metadata: %v", err)
+			}
+
+			// The closed producer is kept on failure, so the deferred
+			// Close has something to close.
+			next, err := client.NewProducer(cfg)
+			if err != nil {
+				return -1, err
+			}
+			producer = next
+		}
+	}
+
+	var buffered *bufferedResponse
+
+	if r.ProtoMajor < 2 && http.NewResponseController(w.ResponseWriter).EnableFullDuplex() != nil {
+		buffered = &bufferedResponse{
+			ResponseWriter: w.ResponseWriter,
+		}
+		w.ResponseWriter = buffered
+
+		defer func() {
+			if err := buffered.Send(); err != nil {
+				log.Errorln("Unable to send response:", err)
+			}
+		}()
+	}
+
+	s.Stats.HTTPStatus[http.StatusOK].Inc(1)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	s.rawResponse(w, http.StatusOK, nil)
+
+	writeResult := func(v interface{}) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			log.Errorln("Unable to marshal result:", err)
+			return
+		}
+		w.Write(append(b, '\n'))
+		flushResponse(w)
+	}
+
+	writeError := func(status int, format string, args ...interface{}) {
+		writeResult(&JSONErrorData{
+			Code:    status,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), int(s.Config().Consumer.MaxFetchSize)+1)
+
+	for scanner.Scan() {
+		if !s.connIsAlive(r) {
+			return
+		}
+
+		// The rest of stream is not read if the results can't be kept.
+		if buffered != nil && int64(buffered.buf.Len()) >= cfg.Consumer.MaxBufferedSize {
+			writeError(http.StatusRequestEntityTooLarge, "Response too large: Results size should be less than %d", cfg.Consumer.MaxBufferedSize)
+			return
+		}
+
+		msg := bytes.TrimSpace(scanner.Bytes())
+		if len(msg) == 0 {
+			continue
+		}
+
+		var m json.RawMessage
+		if err := json.Unmarshal(msg, &m); err != nil {
+			writeError(http.StatusBadRequest, "Message must be JSON")
+			continue
+		}
+
+		errs, err := s.Schemas.Validate(topic, msg)
+		if err != nil {
+			writeError(http.StatusBadRequest, "Unable to validate message: %v", err)
+			continue
+		}
+
+		if len(errs) > 0 {
+			writeError(422, "Message does not match the schema: %s", strings.Join(errs, "; "))
+			continue
+		}
+
+		if msg, err = envelope(r, cfg, msg); err != nil {
+			writeError(http.StatusInternalServerError, "Unable to wrap message: %v", err)
+			continue
+		}
+
+		offset, err := send(msg)
+		if err != nil {
+			if isMetadataError(err) {
+				client.InvalidateMetadata()
+			}
+			// The rest of messages is not produced to keep the order.
+			writeError(httpStatusError(err), "Unable to store your data: %v", err)
+			return
+		}
+
+		s.MessageSize.Put(p.Get("cluster"), topic, int32(len(msg)))
+		s.Stats.MessageSize["Produce"].Update(int64(len(msg)))
+
+		writeResult(&kafkaParameters{
+			Topic:     topic,
+			Partition: partition,
+			Offset:    offset,
+			Checksum:  fmt.Sprintf("%08x", crc32.ChecksumIEEE(msg)),
+		})
+	}
+
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		writeError(http.StatusBadRequest, "Message too large: Body size should be less than %d", s.Config().Consumer.MaxFetchSize)
+	} else if err != nil {
+		log.Debugf("Unable to read stream of %s/%d: %v", topic, partition, err)
+		writeError(http.StatusBadRequest, "Unable to read body: %v", err)
+	}
+}
+
+// sendBatchHandler produces the JSON array of messages to the partition in
+// one request. Each message is checked separately and the valid ones are
+// produced. If the broker rejects the request because of too large message,
+// the messages are sent one by one, so only that message fails. If any
+// message fails, 207 is returned with the result of each message.
+func (s *Server) sendBatchHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("ProduceBatch").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	topic := p.Get("topic")
+	partition := toInt32(p.Get("partition"))
+
+	cfg, ok := s.requestConfig(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.requestAcks(w, cfg, topic, p) {
+		return
+	}
+
+	if pattern := cfg.Broker.TopicNamePattern.Regexp; pattern != nil && !pattern.MatchString(topic) {
+		s.errorResponse(w, http.StatusBadRequest, "Topic name %q does not match the pattern %q", topic, pattern.String())
+		return
+	}
+
+	if !s.validRequest(w, p, !s.Config().Broker.AllowTopicCreation) {
+		return
+	}
+
+	entries, ok := s.readBatch(w, r)
+	if !ok {
+		return
+	}
+
+	res := make([]produceBatchResult, len(entries))
+
+	var (
+		messages []*proto.Message
+		indexes  []int
+	)
+
+	for i, e := range entries {
+		res[i] = produceBatchResult{
+			Topic:     topic,
+			Partition: partition,
+			Offset:    -1,
+		}
+
+		if len(e.Value) == 0 {
+			res[i].Code = http.StatusBadRequest
+			res[i].Error = "Message must be JSON"
+			continue
+		}
+
+		errs, err := s.Schemas.Validate(topic, e.Value)
+		if err != nil {
+			res[i].Code = http.StatusBadRequest
+			res[i].Error = fmt.Sprintf("Unable to validate message: %v", err)
+			continue
+		}
+
+		if len(errs) > 0 {
+			res[i].Code = 422
+			res[i].Error = fmt.Sprintf("Message does not match the schema: %s", strings.Join(errs, "; "))
+			continue
+		}
+
+		value, err := envelope(r, cfg, e.Value)
+		if err != nil {
+			res[i].Code = http.StatusInternalServerError
+			res[i].Error = fmt.Sprintf("Unable to wrap message: %v", err)
+			continue
+		}
+
+		msg := &proto.Message{
+			Value: value,
+		}
+		if e.Key != nil && *e.Key != "" {
+			msg.Key = []byte(*e.Key)
+		}
+
+		res[i].Checksum = fmt.Sprintf("%08x", crc32.ChecksumIEEE(value))
+
+		messages = append(messages, msg)
+		indexes = append(indexes, i)
+	}
+
+	// produce sends the messages in one request, so they fail or succeed
+	// together.
+	produce := func(indexes []int, messages []*proto.Message) error {
+		span := s.startKafkaSpan(r, "SendMessage", topic, partition)
+		span.SetAttribute("messaging.batch.message_count", len(messages))
+
+		offset, err := s.produceMessages(client, cfg, topic, partition, messages...)
+
+		span.SetAttribute("messaging.kafka.offset", offset)
+		span.SetError(err)
+		span.Finish()
+
+		if err != nil && isMetadataError(err) {
+			client.InvalidateMetadata()
+		}
+
+		for n, i := range indexes {
+			if err != nil {
+				res[i].Code = httpStatusError(err)
+				if e, ok := err.(KhpError); ok && e.Errno == KhpErrorWriteTimeout {
+					res[i].Code = http.StatusGatewayTimeout
+				}
+				res[i].Error = fmt.Sprintf("Unable to store your data: %v", err)
+				continue
+			}
+
+			res[i].Success = true
+			res[i].Offset = offset
+
+			// The offset is unknown if the broker doesn't acknowledge.
+			if cfg.Producer.RequiredAcks.Value != proto.RequiredAcksNone {
+				res[i].Offset += int64(n)
+			}
+
+			s.MessageSize.Put(p.Get("cluster"), topic, int32(len(messages[n].Value)))
+			s.Stats.MessageSize["Produce"].Update(int64(len(messages[n].Value)))
+		}
+		return err
+	}
+
+	if len(messages) > 0 {
+		// The broker rejects the whole request, so the messages are
+		// sent again one by one to find the large ones.
+		if err := produce(indexes, messages); err == KafkaErrMessageSizeTooLarge && len(messages) > 1 {
+			for n, i := range indexes {
+				produce([]int{i}, messages[n:n+1])
+			}
+		}
+	}
+
+	status := http.StatusOK
+
+	for i := range res {
+		if !res[i].Success {
+			status = http.StatusMultiStatus
+			break
+		}
+	}
+
+	s.statusResponse(w, status, res)
+}
+
+// readBatch reads the JSON array of messages from the request body.
+// The whole batch is limited like the single message.
+func (s *Server) readBatch(w *HTTPResponse, r *http.Request) ([]batchEntry, bool) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(s.Config().Consumer.MaxFetchSize)+1))
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, "Unable to read body: %s", err)
+		return nil, false
+	}
+
+	if int32(len(body)) > s.Config().Consumer.MaxFetchSize {
+		s.errorResponse(w, http.StatusBadRequest, "Batch too large: Body size should be less than %d", s.Config().Consumer.MaxFetchSize)
+		return nil, false
+	}
+
+	var entries []batchEntry
+
+	if err = json.Unmarshal(body, &entries); err != nil {
+		s.errorResponse(w, http.StatusBadRequest, "Request body must be JSON array")
+		return nil, false
+	}
+
+	if len(entries) == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "Messages must be provided")
+		return nil, false
+	}
+
+	return entries, true
+}
+
+// sendTransactionHandler writes the batch of messages in one Kafka
+// transaction. Unlike the batch, the invalid message rejects the whole
+// request and nothing is written.
+func (s *Server) sendTransactionHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("ProduceTransaction").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	topic := p.Get("topic")
+	partition := toInt32(p.Get("partition"))
+	txnID := p.Get("transactional_id")
+
+	if txnID == "" {
+		s.errorResponse(w, http.StatusBadRequest, "Transactional ID must be provided")
+		return
+	}
+
+	// The transaction is always acknowledged by all replicas.
+	if acks := p.Get("acks"); acks != "" {
+		if value, err := ParseRequiredAcks(acks); err != nil || value != proto.RequiredAcksAll {
+			s.errorResponse(w, http.StatusBadRequest, "Transaction requires acks=all")
+			return
+		}
+	}
+
+	cfg, ok := s.requestConfig(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.validRequest(w, p, true) {
+		return
+	}
+
+	entries, ok := s.readBatch(w, r)
+	if !ok {
+		return
+	}
+
+	messages := make([]*proto.Message, len(entries))
+
+	for i, e := range entries {
+		if len(e.Value) == 0 {
+			s.errorResponse(w, http.StatusBadRequest, "Message %d must be JSON", i)
+			return
+		}
+
+		errs, err := s.Schemas.Validate(topic, e.Value)
+		if err != nil {
+			s.errorResponse(w, http.StatusBadRequest, "Unable to validate message %d: %v", i, err)
+			return
+		}
+
+		if len(errs) > 0 {
+			s.errorResponse(w, 422, "Message %d does not match the schema: %s", i, strings.Join(errs, "; "))
+			return
+		}
+
+		value, err := envelope(r, cfg, e.Value)
+		if err != nil {
+			s.errorResponse(w, http.StatusInternalServerError, "Unable to wrap message: %v", err)
+			return
+		}
+
+		messages[i] = &proto.Message{
+			Value: value,
+		}
+		if e.Key != nil && *e.Key != "" {
+			messages[i].Key = []byte(*e.Key)
+		}
+	}
+
+	// The whole transaction is limited by the request deadline.
+	deadline, _ := r.Context().Deadline()
+
+	txn, err := client.ProduceTransaction(cfg, txnID, topic, partition, messages, deadline)
+	if e, ok := err.(KhpError); ok && e.Errno == KhpErrorWriteTimeout {
+		s.errorWriteTimeout(w, topic, partition, e)
+		return
+	}
+	if err != nil {
+		status := httpStatusError(err)
+
+		if e, ok := err.(KafkaTxnError); ok {
+			switch {
+			case e.Errno == KafkaTxnErrNotLeaderForPartition:
+				client.InvalidateMetadata()
+				status = http.StatusServiceUnavailable
+			case e.Retriable():
+				status = http.StatusServiceUnavailable
+			case e.Errno == KafkaTxnErrInvalidProducerEpoch:
+				// The newer request with the same transactional ID.
+				status = http.StatusConflict
+			}
+		}
+
+		s.errorResponse(w, status, "Unable to store your data: %v", err)
+		return
+	}
+
+	for _, msg := range messages {
+		s.MessageSize.Put(p.Get("cluster"), topic, int32(len(msg.Value)))
+		s.Stats.MessageSize["Produce"].Update(int64(len(msg.Value)))
+	}
+
+	s.successResponse(w, &produceTransactionResult{
+		Topic:           topic,
+		Partition:       partition,
+		Offset:          txn.Offset,
+		Count:           len(messages),
+		TransactionalID: txnID,
+		ProducerID:      txn.ProducerID,
+		ProducerEpoch:   txn.ProducerEpoch,
+	})
+}
+
+// partitionByKey returns the partition for the message key from the routing
+// table of topic or by the hash of key.
+func (s *Server) partitionByKey(w *HTTPResponse, client *KafkaClient, topic string, key []byte) (int32, bool) {
+	if key == nil {
+		s.errorResponse(w, http.StatusBadRequest, "Key must be provided to choose partition")
+		return -1, false
+	}
+
+	meta, err := client.FetchMetadata()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
+		return -1, false
+	}
+
+	parts, err := meta.Partitions(topic)
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get partitions: %v", err)
+		return -1, false
+	}
+
+	if len(parts) == 0 {
+		s.errorResponse(w, http.StatusServiceUnavailable, "Topic has no partitions")
+		return -1, false
+	}
+
+	var routes []CfgRoute
+	if routing, ok := s.Config().Routing[topic]; ok {
+		routes = routing.Route
+	}
+
+	return keyPartition(routes, s.Config().Producer.Partitioner.Name, string(key), int32(len(parts))), true
+}
+
+func (s *Server) getHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("GET").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	var (
+		varsLength    string
+		varsOffset    string
+		varsRelative  string
+		varsTimestamp string
+	)
+
+	if varsLength = p.Get("limit"); varsLength == "" {
+		varsLength = "1"
+	}
+
+	varsOffset = p.Get("offset")
+	varsRelative = p.Get("relative")
+	varsTimestamp = p.Get("timestamp")
+
+	if varsTimestamp != "" {
+		if varsOffset != "" || varsRelative != "" {
+			s.errorResponse(w, http.StatusBadRequest, "Offset can't be specified with timestamp")
+			return
+		}
+
+		if ts, err := strconv.ParseInt(varsTimestamp, 10, 64); err != nil || ts < 0 {
+			s.errorResponse(w, http.StatusBadRequest, "Bad timestamp parameter: %s", varsTimestamp)
+			return
+		}
+	}
+
+	fields, err := parseMessageFields(p.Get("fields"))
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, "Bad fields parameter: %v", err)
+		return
+	}
+
+	if toBool(p.Get("envelope")) {
+		fields = allMessageFields
+	}
+
+	switch encoding := p.Get("value_encoding"); encoding {
+	case "", "json":
+	case "base64":
+		fields.Base64 = true
+	default:
+		s.errorResponse(w, http.StatusBadRequest, "Unknown value encoding: %s", encoding)
+		return
+	}
+
+	switch frame := p.Get("frame"); frame {
+	case "", "none":
+	case "length-prefixed":
+		fields.Framed = true
+	default:
+		s.errorResponse(w, http.StatusBadRequest, "Unknown frame: %s", frame)
+		return
+	}
+
+	commitAs := p.Get("commit_as")
+	commitWait := toBool(p.Get("commit_wait"))
+
+	// The position of consumer group is used instead of offset.
+	consumer := p.Get("consumer")
+
+	if consumer != "" && (varsOffset != "" || varsRelative != "" || varsTimestamp != "") {
+		s.errorResponse(w, http.StatusBadRequest, "Offset can't be specified with consumer group")
+		return
+	}
+
+	if consumer != "" && commitAs == "" && toBool(p.Get("commit")) {
+		commitAs = consumer
+	}
+
+	buffered := toBool(p.Get("buffered"))
+	bufferedSize := int64(0)
+
+	var bufferedResp *bufferedResponse
+
+	if buffered {
+		bufferedResp = &bufferedResponse{
+			ResponseWriter: w.ResponseWriter,
+		}
+		w.ResponseWriter = bufferedResp
+
+		defer func() {
+			if err := bufferedResp.Send(); err != nil {
+				log.Errorln("Unable to send response:", err)
+			}
+		}()
+	}
+
+	ndjson := false
+
+	switch output := p.Get("output"); output {
+	case "", "json":
+	case "ndjson":
+		ndjson = true
+	default:
+		s.errorResponse(w, http.StatusBadRequest, "Bad output parameter: %s", output)
+		return
+	}
+
+	descending := false
+
+	switch order := p.Get("order"); order {
+	case "":
+	case "asc":
+	case "desc":
+		descending = true
+	default:
+		s.errorResponse(w, http.StatusBadRequest, "Bad order parameter: %s", order)
+		return
+	}
+
+	if descending && commitAs != "" {
+		s.errorResponse(w, http.StatusBadRequest, "Unable to commit offset of messages in descending order")
+		return
+	}
+
+	if descending && consumer != "" {
+		s.errorResponse(w, http.StatusBadRequest, "Unable to read from consumer group position in descending order")
+		return
+	}
+
+	var dedup *keyWindow
+
+	if toBool(p.Get("dedup_by_key")) {
+		if descending {
+			s.errorResponse(w, http.StatusBadRequest, "Unable to deduplicate messages in descending order")
+			return
+		}
+		dedup = newKeyWindow()
+	}
+
+	clampUnderflow := false
+
+	switch p.Get("on_underflow") {
+	case "", "error":
+	case "clamp":
+		clampUnderflow = true
+	default:
+		s.errorResponse(w, http.StatusBadRequest, "Bad on_underflow parameter: %s", p.Get("on_underflow"))
+		return
+	}
+
+	query := kafkaParameters{
+		Topic:     p.Get("topic"),
+		Partition: toInt32(p.Get("partition")),
+		Offset:    -1,
+		Order:     p.Get("order"),
+		Consumer:  consumer,
+	}
+
+	// The range until the offset is read regardless of limit, but its size
+	// is limited by maxbytes and Consumer.MaxRangeSize.
+	rangeSize := s.Config().Consumer.MaxRangeSize
+
+	if value := p.Get("until"); value != "" {
+		until, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || until < 0 {
+			s.errorResponse(w, http.StatusBadRequest, "Bad until parameter: %s", value)
+			return
+		}
+
+		if descending {
+			s.errorResponse(w, http.StatusBadRequest, "Unable to read until offset in descending order")
+			return
+		}
+
+		query.Until = &until
+	}
+
+	if value := p.Get("maxbytes"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			s.errorResponse(w, http.StatusBadRequest, "Bad maxbytes parameter: %s", value)
+			return
+		}
+
+		if query.Until == nil {
+			s.errorResponse(w, http.StatusBadRequest, "The maxbytes parameter requires until")
+			return
+		}
+
+		if n < rangeSize {
+			rangeSize = n
+		}
+	}
+
+	length := toInt32(varsLength)
+	if length <= 0 {
+		length = 1
+	}
+
+	if s.Config().Consumer.MaxLimit > 0 && length > s.Config().Consumer.MaxLimit {
+		length = s.Config().Consumer.MaxLimit
+	}
+	query.Limit = length
+
+	if query.Until != nil {
+		query.Limit = 0
+	}
+
+	cfg, ok := s.requestConfig(w, r)
+	if !ok {
+		return
+	}
+
+	var deadline time.Time
+
+	if value := p.Get("deadline"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			s.errorResponse(w, http.StatusBadRequest, "Bad deadline parameter: %s", value)
+			return
+		}
+		deadline = time.Now().Add(d)
+	}
+
+	// The truncated flag is returned only if the deadline was requested or
+	// the response was cut by Global.MaxResponseTime or by the time limit
+	// of request.
+	requestedDeadline := !deadline.IsZero()
+	forcedDeadline := false
+
+	if d := s.Config().Global.MaxResponseTime.Duration; d > 0 {
+		if limit := time.Now().Add(d); deadline.IsZero() || limit.Before(deadline) {
+			deadline = limit
+			forcedDeadline = true
+		}
+	}
+
+	// The messages read before the end of request are returned.
+	if limit, ok := r.Context().Deadline(); ok && (deadline.IsZero() || limit.Before(deadline)) {
+		deadline = limit
+		forcedDeadline = true
+	}
+
+	// The rejected request must not load the brokers, so the consumer is
+	// registered before any request to Kafka.
+	if !s.Consumers.Acquire(query.Topic, s.Config().Consumer.MaxTopicConsumers) {
+		s.errorResponse(w, http.StatusTooManyRequests, "Too many consumers of topic")
+		return
+	}
+	defer s.Consumers.Release(query.Topic)
+
+	if !s.validRequest(w, p, true) {
+		return
+	}
+
+	span := s.startKafkaSpan(r, "GetOffsets", query.Topic, query.Partition)
+	offsetFrom, offsetTo, err := client.GetOffsets(query.Topic, query.Partition)
+	span.SetError(err)
+	span.Finish()
+
+	if err != nil {
+		if isMetadataError(err) {
+			client.InvalidateMetadata()
+		}
+		s.errorResponse(w, httpStatusError(err), "Unable to get offset: %v", err)
+		return
+	}
+
+	if consumer != "" {
+		query.Offset, err = s.fetchConsumed(client, cfg, consumer, query.Topic, query.Partition)
+		if err != nil {
+			s.errorResponse(w, httpStatusError(err), "Unable to fetch offset: %v", err)
+			return
+		}
+
+		// The group has not committed yet.
+		if query.Offset < 0 {
+			query.Offset = offsetFrom
+		}
+
+		// The committed messages may be already removed by retention.
+		if query.Offset < offsetFrom {
+			query.Offset = offsetFrom
+			query.Clamped = true
+		}
+	} else if varsRelative != "" {
+		relative := toInt64(varsRelative)
+
+		if relative >= 0 {
+			query.Offset = offsetFrom + relative
+		} else {
+			query.Offset = offsetTo + relative
+		}
+	} else if varsOffset != "" {
+		query.Offset = toInt64(varsOffset)
+	} else if varsTimestamp != "" {
+		query.Offset, err = client.OffsetByTime(query.Topic, query.Partition, toInt64(varsTimestamp))
+		if err != nil {
+			if isMetadataError(err) {
+				client.InvalidateMetadata()
+			}
+			s.errorResponse(w, httpStatusError(err), "Unable to get offset by timestamp: %v", err)
+			return
+		}
+
+		// There are no messages after the timestamp.
+		if query.Offset < 0 {
+			s.errorOutOfRange(w, query.Topic, query.Partition, offsetFrom, offsetTo)
+			return
+		}
+	} else if descending && offsetTo > offsetFrom {
+		// Start from the newest message
+		query.Offset = offsetTo - 1
+	} else {
+		// Set default value
+		query.Offset = offsetFrom
+	}
+
+	if clampUnderflow && query.Offset < offsetFrom {
+		query.Offset = offsetFrom
+		query.Clamped = true
+	}
+
+	// Reading the tail of an empty partition is not an error, there is
+	// just nothing there yet. The same is true for the consumer group
+	// which has read everything.
+	empty := (offsetFrom == offsetTo || consumer != "") && query.Offset == offsetTo
+
+	if !empty && (query.Offset < offsetFrom || query.Offset >= offsetTo) {
+		s.errorOutOfRange(w, query.Topic, query.Partition, offsetFrom, offsetTo)
+		return
+	}
+
+	if query.Until != nil {
+		if *query.Until < offsetTo {
+			offsetTo = *query.Until
+		}
+
+		// The length only sizes the fetch requests.
+		length = math.MaxInt32
+		if n := offsetTo - query.Offset; n < int64(length) {
+			length = int32(n)
+		}
+	}
+
+	queryStr, err := json.Marshal(query)
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to marshal json: %v", err)
+		return
+	}
+
+	// The last offset of range is known only after the messages, so the
+	// query is written at the end then.
+	headQuery := queryStr
+	if query.Until != nil {
+		headQuery = nil
+	}
+
+	if descending {
+		s.writeDescending(w, client, cfg, p.Get("cluster"), &query, queryStr, fields, offsetFrom, empty, ndjson)
+		return
+	}
+
+	offset := query.Offset
+
+	span = s.startKafkaSpan(r, "GetMessage", query.Topic, query.Partition)
+	span.SetAttribute("messaging.kafka.offset", offset)
+
+	defer func() {
+		span.SetAttribute("messaging.kafka.offset.end", offset)
+		span.Finish()
+	}()
+	defaultFetchSize, maxFetchSize := s.Config().FetchSize(query.Topic)
+	size := s.MessageSize.Get(p.Get("cluster"), query.Topic, defaultFetchSize)
+	ratio := s.MessageSize.Ratio(p.Get("cluster"), query.Topic)
+	maxSize := 0
+
+	notEnoughSize := false
+	successSent := false
+	truncated := false
+
+	fetched := false
+	resizes := int64(0)
+
+	rangeRead := int64(0)
+
+	var (
+		cacheKey string
+		cacheHit bool
+		cached   []byte
+	)
+
+	// The cached messages are kept in the JSON array form.
+	if s.ResponseCache.Enabled() && !empty && !ndjson && query.Until == nil && dedup == nil {
+		cacheKey = ResponseCacheKey(p.Get("cluster"), query.Topic, query.Partition, query.Offset, query.Limit, fields)
+
+		if entry, ok := s.ResponseCache.Get(cacheKey); ok {
+			s.Stats.ResponseCache["Hits"].Inc(1)
+
+			successSent = true
+			cacheHit = true
+			offset = entry.Offset
+
+			s.beginMessages(w, queryStr, false)
+			w.Write(entry.Messages)
+		} else {
+			s.Stats.ResponseCache["Misses"].Inc(1)
+		}
+	}
+
+	// failResponse reports the error if the messages are not sent yet. The
+	// buffered messages are discarded, the client gets the error instead of
+	// the incomplete response.
+	failResponse := func(status int, format string, args ...interface{}) {
+		if successSent && bufferedResp != nil {
+			s.Stats.HTTPStatus[http.StatusOK].Dec(1)
+
+			bufferedResp.Reset()
+			w.ResponseLength = 0
+			successSent = false
+		}
+
+		if !successSent {
+			s.errorResponse(w, status, format, args...)
+		}
+	}
+
+	// writeValue writes the message and returns how long it took.
+	writeValue := func(value []byte) time.Duration {
+		start := time.Now()
+
+		if !successSent {
+			successSent = true
+			s.beginMessages(w, headQuery, ndjson)
+		} else if !ndjson {
+			w.Write([]byte(`,`))
+		}
+
+		w.Write(value)
+
+		if ndjson {
+			w.Write([]byte("\n"))
+			flushResponse(w)
+		}
+
+		if cacheKey != "" {
+			if len(cached) > 0 {
+				cached = append(cached, ',')
+			}
+			cached = append(cached, value...)
+		}
+
+		return time.Since(start)
+	}
+
+	// When the client reads slowly, the messages are collected and written
+	// after the broker is released, so the client doesn't hold it and
+	// the proxy never fetches more than one chunk ahead.
+	slowThreshold := s.Config().Consumer.SlowWriteThreshold.Duration
+	slowWrites := false
+
+	var (
+		pending     [][]byte
+		pendingSize int64
+	)
+
+	writePending := func() {
+		fast := len(pending) > 0
+		for _, value := range pending {
+			if d := writeValue(value); d > slowThreshold {
+				fast = false
+			}
+		}
+		pending = nil
+		pendingSize = 0
+
+		// The client which has read the whole chunk without delay is
+		// no longer slow, so the messages are streamed again.
+		if slowWrites && fast {
+			log.Debugf("Client of %s/%d is fast again", query.Topic, query.Partition)
+			slowWrites = false
+		}
+	}
+
+ConsumeLoop:
+	for !cacheHit && offset < offsetTo {
+		if !deadline.IsZero() {
+			remaining := deadline.Sub(time.Now())
+			if remaining <= 0 {
+				truncated = true
+				break ConsumeLoop
+			}
+			if remaining < cfg.Consumer.GetMessageTimeout.Duration {
+				cfg.Consumer.GetMessageTimeout.Duration = remaining
+			}
+		}
+
+		// Compressed messages take less space in the fetch response.
+		fetchSize := int64(float64(size) * float64(length) * ratio)
+
+		if fetchSize > int64(maxFetchSize) {
+			fetchSize = int64(maxFetchSize)
+		}
+		if fetchSize < int64(s.Config().Consumer.MinFetchSize) {
+			fetchSize = int64(s.Config().Consumer.MinFetchSize)
+		}
+		cfg.Consumer.MaxFetchSize = int32(fetchSize)
+
+		consumer, err := client.NewConsumer(cfg, query.Topic, query.Partition, offset)
+		if err != nil {
+			if isMetadataError(err) {
+				client.InvalidateMetadata()
+			}
+			failResponse(httpStatusError(err), "Unable to make consumer: %v", err)
+			return
+		}
+		defer consumer.Close()
+
+		consumer.Deadline = deadline
+		fetched = true
+
+		for {
+			if !s.connIsAlive(r) {
+				consumer.Close()
+				return
+			}
+
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				truncated = true
+				consumer.Close()
+				break ConsumeLoop
+			}
+
+			msg, err := consumer.Message()
+			if err != nil {
+				if err == KafkaErrNoData {
+					fetchedSize, decodedSize := consumer.FetchedSize()
+					s.MessageSize.PutRatio(p.Get("cluster"), query.Topic, fetchedSize, decodedSize)
+					notEnoughSize = true
+					break
+				}
+				if e, ok := err.(KhpError); ok && e.Errno == KhpErrorReadTimeout && !deadline.IsZero() && !time.Now().Before(deadline) {
+					truncated = true
+					consumer.Close()
+					break ConsumeLoop
+				}
+				if isMetadataError(err) {
+					client.InvalidateMetadata()
+				}
+				failResponse(httpStatusError(err), "Unable to get message: %v", err)
+				consumer.Close()
+				return
+			}
+
+			values, err := encodeMessages(msg, fields)
+			if err != nil {
+				failResponse(encodeStatusError(err), "Unable to encode message %d: %v", msg.Offset, err)
+				consumer.Close()
+				return
+			}
+
+			valuesSize := 0
+			for _, value := range values {
+				valuesSize += len(value)
+			}
+
+			// The deduplicated messages are written when the window is read.
+			if dedup != nil {
+				dedup.Add(msg.Key, values)
+				values = nil
+			}
+
+			for _, value := range values {
+				if slowWrites {
+					pending = append(pending, value)
+					pendingSize += int64(len(value))
+				} else if d := writeValue(value); slowThreshold > 0 && d > slowThreshold {
+					log.Debugf("Slow client of %s/%d, write took %s", query.Topic, query.Partition, d)
+					slowWrites = true
+				}
+			}
+
+			// The fetch of compressed batch may start before the offset,
+			// but such messages are dropped by the kafka library, so
+			// msg.Offset is absolute and every message counts.
+			offset = msg.Offset + 1
+			length--
+			s.Stats.MessageSize["Consume"].Update(int64(len(msg.Value)))
+
+			if len(msg.Value) > maxSize {
+				maxSize = len(msg.Value)
+			}
+
+			if offset >= offsetTo || length == 0 {
+				consumer.Close()
+				break ConsumeLoop
+			}
+
+			if buffered {
+				bufferedSize += int64(valuesSize)
+				if bufferedSize >= s.Config().Consumer.MaxBufferedSize {
+					consumer.Close()
+					break ConsumeLoop
+				}
+			}
+
+			if query.Until != nil {
+				rangeRead += int64(valuesSize)
+				if rangeRead >= rangeSize {
+					consumer.Close()
+					break ConsumeLoop
+				}
+			}
+
+			if dedup != nil && dedup.Size() >= s.Config().Consumer.MaxBufferedSize {
+				consumer.Close()
+				break ConsumeLoop
+			}
+
+			if slowWrites && pendingSize >= int64(cfg.Consumer.MaxFetchSize) {
+				break
+			}
+		}
+		consumer.Close()
+		writePending()
+
+		if notEnoughSize {
+			resizes++
+
+			// The fetch size is limited by maxFetchSize, so growing the
+			// message size after that only repeats the same fetch.
+			if cfg.Consumer.MaxFetchSize >= maxFetchSize {
+				break ConsumeLoop
+			}
+
+			// Kafka returns the compressed batch only as a whole. If
+			// it didn't fit, the estimated ratio is of no use.
+			if ratio < 1 {
+				ratio = 1
+			}
+
+			size += defaultFetchSize
+			notEnoughSize = false
+		}
+	}
+
+	writePending()
+
+	if dedup != nil {
+		for _, value := range dedup.Values() {
+			writeValue(value)
+		}
+	}
+
+	if fetched {
+		s.Stats.FetchResizes.Update(resizes)
+	}
+
+	if !successSent {
+		s.beginMessages(w, headQuery, ndjson)
+	}
+
+	if !ndjson {
+		w.Write([]byte(`]`))
+	}
+
+	if truncated && forcedDeadline {
+		log.Warnf("Response of %s was truncated by the time limit at offset %d of %s/%d", r.URL, offset, query.Topic, query.Partition)
+	}
+
+	if (requestedDeadline || truncated) && !ndjson {
+		w.Write([]byte(`,"truncated":` + strconv.FormatBool(truncated)))
+	}
+
+	// The range may end earlier at the tail or at the size limit.
+	if query.Until != nil && !ndjson {
+		lastOffset := int64(-1)
+		if offset > query.Offset {
+			lastOffset = offset - 1
+		}
+		query.LastOffset = &lastOffset
+
+		// The query is marshalled above already, so it can't fail.
+		queryStr, _ = json.Marshal(query)
+
+		w.Write([]byte(`,"query":`))
+		w.Write(queryStr)
+	}
+
+	if commitAs != "" && offset > query.Offset {
+		if commitWait {
+			err := s.commitConsumed(client, cfg, commitAs, query.Topic, query.Partition, offset)
+			if err != nil {
+				log.Errorf("Unable to commit offset %d of %s/%d for %s: %v", offset, query.Topic, query.Partition, commitAs, err)
+			}
+			if !ndjson {
+				w.Write([]byte(`,"committed":` + strconv.FormatBool(err == nil)))
+			}
+		} else {
+			go func() {
+				err := s.commitConsumed(client, cfg, commitAs, query.Topic, query.Partition, offset)
+				if err != nil {
+					log.Errorf("Unable to commit offset %d of %s/%d for %s: %v", offset, query.Topic, query.Partition, commitAs, err)
+				}
+			}()
+		}
+	}
+
+	if !ndjson {
+		w.Write([]byte(`}`))
+		s.endResponseSuccess(w)
+	}
+
+	if maxSize > 0 {
+		s.MessageSize.Put(p.Get("cluster"), query.Topic, int32(maxSize))
+	}
+
+	// The complete read below the tail is immutable and can be cached.
+	if cacheKey != "" && !cacheHit && !truncated && length == 0 && offset <= offsetTo {
+		s.ResponseCache.Put(cacheKey, ResponseCacheEntry{
+			Messages: cached,
+			Offset:   offset,
+		})
+	}
+}
+
+// beginMessages writes the beginning of GET response. In the NDJSON form
+// there is nothing around messages, so only the headers are sent. The nil
+// queryStr is written by the caller after the messages.
+func (s *Server) beginMessages(w *HTTPResponse, queryStr []byte, ndjson bool) {
+	if ndjson {
+		s.Stats.HTTPStatus[http.StatusOK].Inc(1)
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		s.rawResponse(w, http.StatusOK, nil)
+		return
+	}
+
+	s.beginResponse(w, http.StatusOK)
+	w.Write([]byte(`{`))
+	if queryStr == nil {
+		w.Write([]byte(`"messages":[`))
+		return
+	}
+	w.Write([]byte(`"query":`))
+	w.Write(queryStr)
+	w.Write([]byte(`,"messages":[`))
+}
+
+// flushResponse sends the buffered data to the client if it's possible.
+func flushResponse(w *HTTPResponse) {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writeDescending reads the window of messages which ends at query.Offset
+// and writes them from the newest to the oldest. Kafka can only fetch
+// forward, so the window is collected first.
+func (s *Server) writeDescending(w *HTTPResponse, client *KafkaClient, cfg *Config, cluster string, query *kafkaParameters, queryStr []byte, fields messageFields, offsetFrom int64, empty bool, ndjson bool) {
+	var msgs []*proto.Message
+
+	if !empty {
+		start := query.Offset - int64(query.Limit) + 1
+		if start < offsetFrom {
+			start = offsetFrom
+		}
+
+		var err error
+
+		msgs, err = s.consumePartition(client, cfg, cluster, query.Topic, query.Partition, start, query.Offset+1, query.Limit, nil)
+		if err != nil {
+			if isMetadataError(err) {
+				client.InvalidateMetadata()
+			}
+			s.errorResponse(w, httpStatusError(err), "Unable to get message: %v", err)
+			return
+		}
+	}
+
+	values := make([][]byte, 0, len(msgs))
+	size := int64(0)
+
+	// The newest messages are kept if the window doesn't fit.
+DescendingLoop:
+	for i := len(msgs) - 1; i >= 0; i-- {
+		records, err := encodeMessages(msgs[i], fields)
+		if err != nil {
+			s.errorResponse(w, encodeStatusError(err), "Unable to encode message %d: %v", msgs[i].Offset, err)
+			return
+		}
+
+		for j := len(records) - 1; j >= 0; j-- {
+			size += int64(len(records[j]))
+			if size > s.Config().Consumer.MaxBufferedSize && len(values) > 0 {
+				break DescendingLoop
+			}
+
+			values = append(values, records[j])
+		}
+	}
+
+	s.beginMessages(w, queryStr, ndjson)
+
+	for i, value := range values {
+		if ndjson {
+			w.Write(value)
+			w.Write([]byte("\n"))
+			continue
+		}
+		if i > 0 {
+			w.Write([]byte(`,`))
+		}
+		w.Write(value)
+	}
+
+	if !ndjson {
+		w.Write([]byte(`]}`))
+		s.endResponseSuccess(w)
+	}
+}
+
+// fetchConsumed returns the offset committed by the consumer group or -1.
+func (s *Server) fetchConsumed(client *KafkaClient, cfg *Config, consumer string, topic string, partition int32) (int64, error) {
+	offsetCoordinator, err := client.NewOffsetCoordinator(cfg, consumer)
+	if err != nil {
+		return -1, err
+	}
+	defer offsetCoordinator.Close()
+
+	offset, _, err := offsetCoordinator.FetchOffset(topic, partition)
+	return offset, err
+}
+
+// commitConsumed commits the offset of the next message to be consumed by the consumer group.
+func (s *Server) commitConsumed(client *KafkaClient, cfg *Config, consumer string, topic string, partition int32, offset int64) error {
+	offsetCoordinator, err := client.NewOffsetCoordinator(cfg, consumer)
+	if err != nil {
+		return err
+	}
+	defer offsetCoordinator.Close()
+
+	return offsetCoordinator.CommitOffset(topic, partition, offset, 0)
+}
+
+const (
+	// ConsumeRoundRobin reads messages from partitions in turn.
+	ConsumeRoundRobin = "roundrobin"
+
+	// ConsumeSequential reads partitions one after another.
+	ConsumeSequential = "sequential"
+)
+
+// assignPartitionQuotas distributes the limit of messages between partitions
+// with the given number of available messages.
+func assignPartitionQuotas(available []int64, limit int32, strategy string) []int32 {
+	quotas := make([]int32, len(available))
+
+	if strategy == ConsumeSequential {
+		for i := range available {
+			if limit == 0 {
+				break
+			}
+			quotas[i] = limit
+			if int64(quotas[i]) > available[i] {
+				quotas[i] = int32(available[i])
+			}
+			limit -= quotas[i]
+		}
+		return quotas
+	}
+
+	for limit > 0 {
+		assigned := false
+		for i := range available {
+			if limit == 0 {
+				break
+			}
+			if int64(quotas[i]) < available[i] {
+				quotas[i]++
+				limit--
+				assigned = true
+			}
+		}
+		if !assigned {
+			break
+		}
+	}
+	return quotas
+}
+
+// consumePartition reads up to count messages from partition starting at offset.
+// If buffered is not nil, the size of messages is added to it and reading
+// stops when it reaches Consumer.MaxBufferedSize.
+func (s *Server) consumePartition(client *KafkaClient, settings *Config, cluster, topic string, partition int32, offset int64, offsetTo int64, count int32, buffered *int64) ([]*proto.Message, error) {
+	var msgs []*proto.Message
+
+	// The fetch size is changed, so the partitions can be read in parallel
+	// only with own copy of config.
+	cfg := *settings
+
+	// The other partitions may have already filled the buffer.
+	if buffered != nil && atomic.LoadInt64(buffered) >= s.Config().Consumer.MaxBufferedSize {
+		return nil, nil
+	}
+
+	defaultFetchSize, maxFetchSize := s.Config().FetchSize(topic)
+	size := s.MessageSize.Get(cluster, topic, defaultFetchSize)
+
+	for int32(len(msgs)) < count && offset < offsetTo {
+		fetchSize := int64(size) * int64(count-int32(len(msgs)))
+
+		if fetchSize > int64(maxFetchSize) {
+			fetchSize = int64(maxFetchSize)
+		}
+		if fetchSize < int64(s.Config().Consumer.MinFetchSize) {
+			fetchSize = int64(s.Config().Consumer.MinFetchSize)
+		}
+		cfg.Consumer.MaxFetchSize = int32(fetchSize)
+
+		consumer, err := client.NewConsumer(&cfg, topic, partition, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		notEnoughSize := false
+
+		for int32(len(msgs)) < count && offset < offsetTo {
+			msg, err := consumer.Message()
+			if err == KafkaErrNoData {
+				notEnoughSize = true
+				break
+			}
+			if err != nil {
+				consumer.Close()
+				return nil, err
+			}
+
+			msgs = append(msgs, msg)
+			offset = msg.Offset + 1
+
+			s.Stats.MessageSize["Consume"].Update(int64(len(msg.Value)))
+
+			if buffered != nil && atomic.AddInt64(buffered, int64(len(msg.Value))) >= s.Config().Consumer.MaxBufferedSize {
+				consumer.Close()
+				return msgs, nil
+			}
+		}
+		consumer.Close()
+
+		if notEnoughSize {
+			if cfg.Consumer.MaxFetchSize >= maxFetchSize {
+				break
+			}
+			size += defaultFetchSize
+		}
+	}
+
+	return msgs, nil
+}
+
+func (s *Server) getTopicMessagesHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("GetTopicMessages").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	query := topicMessagesQuery{
+		Topic:    p.Get("topic"),
+		Limit:    toInt32(p.Get("limit")),
+		Strategy: p.Get("strategy"),
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = 1
+	}
+
+	if s.Config().Consumer.MaxLimit > 0 && query.Limit > s.Config().Consumer.MaxLimit {
+		query.Limit = s.Config().Consumer.MaxLimit
+	}
+
+	if query.Strategy == "" {
+		query.Strategy = ConsumeRoundRobin
+	}
+
+	if query.Strategy != ConsumeRoundRobin && query.Strategy != ConsumeSequential {
+		s.errorResponse(w, http.StatusBadRequest, "Unknown strategy: %s", query.Strategy)
+		return
+	}
+
+	cfg, ok := s.requestConfig(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.validRequest(w, p, true) {
+		return
+	}
+
+	meta, err := client.FetchMetadata()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
+		return
+	}
+
+	parts, err := meta.Partitions(query.Topic)
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get partitions: %v", err)
+		return
+	}
+
+	offsets := make([]int64, len(parts))
+	offsetsTo := make([]int64, len(parts))
+	available := make([]int64, len(parts))
+
+	for i, partition := range parts {
+		offsetFrom, offsetTo, err := client.GetOffsets(query.Topic, partition)
+		if err != nil {
+			if isMetadataError(err) {
+				client.InvalidateMetadata()
+			}
+			s.errorResponse(w, httpStatusError(err), "Unable to get offset: %v", err)
+			return
+		}
+
+		offsets[i] = offsetFrom
+
+		if varsRelative := p.Get("relative"); varsRelative != "" {
+			relative := toInt64(varsRelative)
+
+			if relative >= 0 {
+				offsets[i] = offsetFrom + relative
+			} else {
+				offsets[i] = offsetTo + relative
+			}
+
+			if offsets[i] < offsetFrom {
+				offsets[i] = offsetFrom
+			} else if offsets[i] > offsetTo {
+				offsets[i] = offsetTo
+			}
+		}
+
+		offsetsTo[i] = offsetTo
+		available[i] = offsetTo - offsets[i]
+	}
+
+	quotas := assignPartitionQuotas(available, query.Limit, query.Strategy)
+
+	// Each reader takes a connection from the pool, so the readers are
+	// limited by the free connections.
+	readers := s.Config().Consumer.PartitionReaders
+	if free := int(client.Counters["FreeBrokers"].Count()); free < readers {
+		readers = free
+	}
+	if readers < 1 {
+		readers = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		buffered int64
+	)
+
+	batches := make([][]*proto.Message, len(parts))
+	errs := make([]error, len(parts))
+	next := make(chan int)
+
+	for n := 0; n < readers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				batches[i], errs[i] = s.consumePartition(client, cfg, p.Get("cluster"), query.Topic, parts[i], offsets[i], offsetsTo[i], quotas[i], &buffered)
+			}
+		}()
+	}
+
+	alive := true
+
+	for i := range parts {
+		if quotas[i] == 0 {
+			continue
+		}
+
+		if atomic.LoadInt64(&buffered) >= s.Config().Consumer.MaxBufferedSize {
+			break
+		}
+
+		if alive = s.connIsAlive(r); !alive {
+			break
+		}
+
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	if !alive {
+		return
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			if isMetadataError(err) {
+				client.InvalidateMetadata()
+			}
+			s.errorResponse(w, httpStatusError(err), "Unable to get message: %v", err)
+			return
+		}
+	}
+
+	res := &responseTopicMessages{
+		Query:    query,
+		Messages: []responsePartitionMessage{},
+	}
+
+	// Merge the messages in the order they would be read by the strategy.
+	if query.Strategy == ConsumeSequential {
+		for i, batch := range batches {
+			for _, msg := range batch {
+				res.Messages = append(res.Messages, newPartitionMessage(parts[i], msg))
+			}
+		}
+	} else {
+		for round := 0; ; round++ {
+			added := false
+
+			for i, batch := range batches {
+				if round < len(batch) {
+					res.Messages = append(res.Messages, newPartitionMessage(parts[i], batch[round]))
+					added = true
+				}
+			}
+
+			if !added {
+				break
+			}
+		}
+	}
+
+	s.successResponse(w, res)
+}
+
+func (s *Server) getGroupListHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("GetGroupList").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	groups, failed, err := client.ListGroups()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to list consumer groups: %v", err)
+		return
+	}
+
+	if groups == nil {
+		groups = []KafkaGroup{}
+	}
+
+	if len(failed) == 0 {
+		s.successResponse(w, groups)
+		return
+	}
+
+	// The groups of unavailable brokers are missing from the list.
+	brokers := make([]string, len(failed))
+	for i, e := range failed {
+		log.Errorf("Unable to list consumer groups: %v", e)
+		brokers[i] = e.Broker
+	}
+
+	w.Header().Set("X-Kafka-Failed-Brokers", strings.Join(brokers, ","))
+	s.statusResponse(w, http.StatusMultiStatus, groups)
+}
+
+func (s *Server) getAPIVersionsHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("GetAPIVersions").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	versions, err := client.APIVersions()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get API versions: %v", err)
+		return
+	}
+
+	s.successResponse(w, versions)
+}
+
+func (s *Server) describeGroupHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("DescribeGroup").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	group, err := client.DescribeGroup(p.Get("consumer"))
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to describe consumer group: %v", err)
+		return
+	}
+
+	s.successResponse(w, group)
+}
+
+// consumerGroup returns the consumer group from URL or Consumer.DefaultGroup.
+func (s *Server) consumerGroup(w *HTTPResponse, cfg *Config, p *url.Values) (string, bool) {
+	group := p.Get("consumer")
+	if group == "" {
+		group = cfg.Consumer.DefaultGroup
+	}
+
+	if group == "" {
+		s.errorResponse(w, http.StatusBadRequest, "Consumer name must be provided")
+		return "", false
+	}
+
+	return group, true
+}
+
+func (s *Server) getOffsetHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("FetchOffset").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	kafka := &consumerOffsetInfo{
+		Topic:     p.Get("topic"),
+		Partition: toInt32(p.Get("partition")),
+		Offset:    -1,
+	}
+
+	cfg, ok := s.requestConfig(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.validRequest(w, p, true) {
+		return
+	}
+
+	if kafka.Consumer, ok = s.consumerGroup(w, cfg, p); !ok {
+		return
+	}
+
+	offsetCoordinator, err := client.NewOffsetCoordinator(cfg, kafka.Consumer)
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to make offset coordinator: %v", err)
+		return
+	}
+	defer offsetCoordinator.Close()
+
+	span := s.startKafkaSpan(r, "FetchOffset", kafka.Topic, kafka.Partition)
+	span.SetAttribute("messaging.consumer.group.name", kafka.Consumer)
+
+	kafka.Offset, kafka.Metadata, err = offsetCoordinator.FetchOffset(kafka.Topic, kafka.Partition)
+
+	span.SetError(err)
+	span.Finish()
+
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to fetch offset: %v", err)
+		return
+	}
+
+	s.successResponse(w, kafka)
+}
+
+func (s *Server) commitOffsetHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("CommitOffset").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	msg, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, "Unable to read body: %s", err)
+		return
+	}
+
+	kafka := &consumerOffsetInfo{
+		Offset:    -1,
+	}
+
+	if err = json.Unmarshal(msg, &kafka); err != nil {
+		s.errorResponse(w, http.StatusBadRequest, "Request body must be JSON")
+		return
+	}
+
+	if kafka.Offset < 0 {
+		s.errorResponse(w, http.StatusBadRequest, "Offset must be provided not less than 0")
+		return
+	}
+
+	var retention time.Duration
+
+	if kafka.Retention != "" {
+		retention, err = time.ParseDuration(kafka.Retention)
+		if err != nil || retention <= 0 {
+			s.errorResponse(w, http.StatusBadRequest, "Bad retention: %s", kafka.Retention)
+			return
+		}
+	}
+
+	kafka.Topic = p.Get("topic")
+	kafka.Partition = toInt32(p.Get("partition"))
+
+	cfg, ok := s.requestConfig(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.validRequest(w, p, true) {
+		return
+	}
+
+	if kafka.Consumer, ok = s.consumerGroup(w, cfg, p); !ok {
+		return
+	}
+
+	offsetCoordinator, err := client.NewOffsetCoordinator(cfg, kafka.Consumer)
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to make offset coordinator: %v", err)
+		return
+	}
+	defer offsetCoordinator.Close()
+
+	span := s.startKafkaSpan(r, "CommitOffset", kafka.Topic, kafka.Partition)
+	span.SetAttribute("messaging.consumer.group.name", kafka.Consumer)
+	span.SetAttribute("messaging.kafka.offset", kafka.Offset)
+
+	err = offsetCoordinator.CommitOffset(kafka.Topic, kafka.Partition, kafka.Offset, retention)
+
+	span.SetError(err)
+	span.Finish()
+
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to commit offset: %v", err)
+		return
+	}
+	s.successResponse(w, kafka)
+}
+
+// commitOffsetsHandler commits the offsets of several partitions in one
+// request to the coordinator. The invalid entries and the partitions
+// rejected by the coordinator are reported without failing the others.
+func (s *Server) commitOffsetsHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("CommitOffsets").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	group, ok := s.consumerGroup(w, s.Config(), p)
+	if !ok {
+		return
+	}
+
+	msg, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, "Unable to read body: %s", err)
+		return
+	}
+
+	var entries []struct {
+		Topic     string `json:"topic"`
+		Partition int32  `json:"partition"`
+		Offset    *int64 `json:"offset"`
+	}
+
+	if err = json.Unmarshal(msg, &entries); err != nil {
+		s.errorResponse(w, http.StatusBadRequest, "Request body must be JSON array")
+		return
+	}
+
+	if len(entries) == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "Offsets must be provided")
+		return
+	}
+
+	var retention time.Duration
+
+	if value := p.Get("retention"); value != "" {
+		retention, err = time.ParseDuration(value)
+		if err != nil || retention <= 0 {
+			s.errorResponse(w, http.StatusBadRequest, "Bad retention: %s", value)
+			return
+		}
+	}
+
+	meta, err := client.FetchMetadata()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
+		return
+	}
+
+	res := make([]consumerCommitResult, len(entries))
+
+	var (
+		offsets []KafkaOffsetCommit
+		indexes []int
+	)
+
+	type topicPartition struct {
+		topic     string
+		partition int32
+	}
+
+	// The coordinator would commit the partition repeated in request only
+	// once, so the later entries are rejected.
+	seen := make(map[topicPartition]struct{}, len(entries))
+
+	for i, e := range entries {
+		res[i] = consumerCommitResult{
+			Topic:     e.Topic,
+			Partition: e.Partition,
+			Offset:    -1,
+		}
+
+		if e.Offset == nil || *e.Offset < 0 {
+			res[i].Error = "Offset must be provided not less than 0"
+			continue
+		}
+		res[i].Offset = *e.Offset
+
+		found, _ := meta.inTopics(e.Topic)
+		if !found || !s.Config().TopicAllowed(e.Topic) {
+			res[i].Error = "Topic unknown"
+			continue
+		}
+
+		if parts, err := meta.Partitions(e.Topic); err != nil || !inSlice(e.Partition, parts) {
+			res[i].Error = "Unknown partition for the specified topic"
+			continue
+		}
+
+		key := topicPartition{e.Topic, e.Partition}
+		if _, ok := seen[key]; ok {
+			res[i].Error = "Duplicate partition in request"
+			continue
+		}
+		seen[key] = struct{}{}
+
+		offsets = append(offsets, KafkaOffsetCommit{
+			Topic:     e.Topic,
+			Partition: e.Partition,
+			Offset:    *e.Offset,
+		})
+		indexes = append(indexes, i)
+	}
+
+	if len(offsets) > 0 {
+		if err := client.CommitOffsets(group, offsets, retention); err != nil {
+			s.errorResponse(w, httpStatusError(err), "Unable to commit offsets: %v", err)
+			return
+		}
+	}
+
+	for n, o := range offsets {
+		if o.Err != nil {
+			res[indexes[n]].Error = o.Err.Error()
+		} else {
+			res[indexes[n]].Success = true
+		}
+	}
+
+	s.successResponse(w, res)
+}
+
+func (s *Server) getPartitionOffsetsHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	client := s.clusterClient(p)
+
+	if !s.validRequest(w, p, true) {
+		return
+	}
+
+	defer s.Stats.HTTPResponseTime.Get("GetPartitionOffsets").Start().Stop()
+
+	res := &responsePartitionOffsets{
+		Topic:     p.Get("topic"),
+		Partition: toInt32(p.Get("partition")),
+	}
+
+	var err error
+
+	res.OffsetOldest, res.OffsetNewest, err = client.GetOffsets(res.Topic, res.Partition)
+	if err != nil {
+		if isMetadataError(err) {
+			client.InvalidateMetadata()
+		}
+		s.errorResponse(w, httpStatusError(err), "Unable to get offset: %v", err)
+		return
+	}
+
+	s.successResponse(w, res)
+}
+
+func (s *Server) getMessageHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	client := s.clusterClient(p)
+
+	cfg, ok := s.requestConfig(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.validRequest(w, p, true) {
+		return
+	}
+
+	defer s.Stats.HTTPResponseTime.Get("GetMessage").Start().Stop()
+
+	topic := p.Get("topic")
+	partition := toInt32(p.Get("partition"))
+	offset := toInt64(p.Get("offset"))
+
+	offsetFrom, offsetTo, err := client.GetOffsets(topic, partition)
+	if err != nil {
+		if isMetadataError(err) {
+			client.InvalidateMetadata()
+		}
+		s.errorResponse(w, httpStatusError(err), "Unable to get offset: %v", err)
+		return
+	}
+
+	if p.Get("offset") == "latest" {
+		offset = offsetTo - 1
+	}
+
+	if offset < offsetFrom || offset >= offsetTo {
+		s.errorResponse(w, http.StatusNotFound, "Message not found")
+		return
+	}
+
+	// Only one message is needed, so the fetch size is not multiplied
+	// by the limit as in the getHandler.
+	defaultFetchSize, maxFetchSize := s.Config().FetchSize(topic)
+	size := s.MessageSize.Get(p.Get("cluster"), topic, defaultFetchSize)
+
+	for {
+		cfg.Consumer.MaxFetchSize = size
+
+		if cfg.Consumer.MaxFetchSize > maxFetchSize {
+			cfg.Consumer.MaxFetchSize = maxFetchSize
+		}
+		if cfg.Consumer.MaxFetchSize < s.Config().Consumer.MinFetchSize {
+			cfg.Consumer.MaxFetchSize = s.Config().Consumer.MinFetchSize
+		}
+
+		consumer, err := client.NewConsumer(cfg, topic, partition, offset)
+		if err != nil {
+			if isMetadataError(err) {
+				client.InvalidateMetadata()
+			}
+			s.errorResponse(w, httpStatusError(err), "Unable to make consumer: %v", err)
+			return
+		}
+
+		msg, err := consumer.Message()
+		consumer.Close()
+
+		if err == KafkaErrNoData && cfg.Consumer.MaxFetchSize < maxFetchSize {
+			size = cfg.Consumer.MaxFetchSize + defaultFetchSize
+			continue
+		}
+		if err != nil {
+			if isMetadataError(err) {
+				client.InvalidateMetadata()
+			}
+			s.errorResponse(w, httpStatusError(err), "Unable to get message: %v", err)
+			return
+		}
+
+		// The message was removed by log compaction and the broker returned the next one.
+		if msg.Offset != offset {
+			s.errorResponse(w, http.StatusNotFound, "Message not found")
+			return
+		}
+
+		s.MessageSize.Put(p.Get("cluster"), topic, int32(len(msg.Value)))
+		s.Stats.MessageSize["Consume"].Update(int64(len(msg.Value)))
+
+		s.successResponse(w, &responseMessage{
+			Offset: msg.Offset,
+			Key:    string(msg.Key),
+			Value:  msg.Value,
+		})
+		return
+	}
+}
+
+func (s *Server) getClusterInfoHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("GetClusterInfo").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	meta, err := client.FetchMetadata()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
+		return
+	}
+
+	topics := 0
+	for _, topic := range meta.Topics() {
+		if s.Config().TopicAllowed(topic) {
+			topics++
+		}
+	}
+
+	res := &responseClusterInfo{
+		Brokers:    meta.Brokers(),
+		Topics:     topics,
+		Controller: meta.ControllerID(),
+		Updated:    time.Unix(0, meta.Updated).UTC(),
+	}
+	res.Partitions, res.OfflinePartitions = meta.PartitionsCount()
+
+	s.metadataResponse(w, r, meta, res)
+}
+
+func (s *Server) getUnderReplicatedHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("GetUnderReplicated").Start().Stop()
+
+	client := s.clusterClient(p)
+
+	meta, err := client.FetchMetadata()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
+		return
+	}
+
+	var topics []string
+	for _, topic := range meta.Topics() {
+		if s.Config().TopicAllowed(topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+
+	res := []responseUnderReplicated{}
 
-		consumer, err := s.Client.NewConsumer(&cfg, query.Topic, query.Partition, offset)
+	for _, topic := range topics {
+		parts, err := meta.UnderReplicated(topic)
 		if err != nil {
-			if !successSent {
-				s.errorResponse(w, httpStatusError(err), "Unable to make consumer: %v", err)
-			}
+			s.errorResponse(w, httpStatusError(err), "Unable to get partitions of %s: %v", topic, err)
 			return
 		}
-		defer consumer.Close()
 
-		for {
-			if !s.connIsAlive(w) {
-				consumer.Close()
-				return
+		for _, partition := range parts {
+			info := responseUnderReplicated{
+				Topic:     topic,
+				Partition: partition,
 			}
 
-			msg, err := consumer.Message()
+			if info.Leader, err = meta.Leader(topic, partition); err == nil {
+				info.Replicas, err = meta.AssignedReplicas(topic, partition)
+			}
+			if err == nil {
+				info.Isrs, err = meta.Replicas(topic, partition)
+			}
 			if err != nil {
-				if err == KafkaErrNoData {
-					notEnoughSize = true
-					break
-				}
-				if !successSent {
-					s.errorResponse(w, httpStatusError(err), "Unable to get message: %v", err)
-				}
-				consumer.Close()
+				s.errorResponse(w, httpStatusError(err), "Unable to get replicas of %s/%d: %v", topic, partition, err)
 				return
 			}
 
-			if !successSent {
-				successSent = true
-
-				s.beginResponse(w, http.StatusOK)
-				w.Write([]byte(`{`))
-				w.Write([]byte(`"query":`))
-				w.Write(queryStr)
-				w.Write([]byte(`,"messages":[`))
-			} else {
-				w.Write([]byte(`,`))
+			if info.Isrs == nil {
+				info.Isrs = make([]int32, 0)
 			}
 
-			w.Write(msg.Value)
+			res = append(res, info)
+		}
+	}
 
-			offset = msg.Offset + 1
-			length--
+	s.metadataResponse(w, r, meta, res)
+}
 
-			if len(msg.Value) > maxSize {
-				maxSize = len(msg.Value)
-			}
+func (s *Server) getTopicListHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	defer s.Stats.HTTPResponseTime.Get("GetTopicList").Start().Stop()
 
-			if offset >= offsetTo || length == 0 {
-				consumer.Close()
-				break ConsumeLoop
-			}
+	client := s.clusterClient(p)
+	cfg := s.Config()
+
+	prefix := p.Get("prefix")
+
+	limit, offset := -1, 0
+
+	if value := p.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			s.errorResponse(w, http.StatusBadRequest, "Bad limit parameter: %s", value)
+			return
 		}
-		consumer.Close()
+		limit = n
+	}
 
-		if notEnoughSize {
-			if size >= s.Cfg.Consumer.MaxFetchSize {
-				break ConsumeLoop
-			}
+	if value := p.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			s.errorResponse(w, http.StatusBadRequest, "Bad offset parameter: %s", value)
+			return
+		}
+		offset = n
+	}
 
-			size += s.Cfg.Consumer.DefaultFetchSize
-			notEnoughSize = false
+	res := []responseTopicListInfo{}
+
+	meta, err := client.FetchMetadata()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
+		return
+	}
+
+	var topics []string
+
+	for _, topic := range meta.Topics() {
+		if strings.HasPrefix(topic, prefix) && cfg.TopicAllowed(topic) {
+			topics = append(topics, topic)
 		}
 	}
 
-	if !successSent {
-		s.beginResponse(w, http.StatusOK)
-		w.Write([]byte(`{`))
-		w.Write([]byte(`"query":`))
-		w.Write(queryStr)
-		w.Write([]byte(`,"messages":[`))
+	// The order of topics in metadata may change, so the pages are taken
+	// from the sorted list.
+	sort.Strings(topics)
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(topics)))
+
+	if offset > len(topics) {
+		offset = len(topics)
+	}
+	topics = topics[offset:]
+
+	if limit >= 0 && limit < len(topics) {
+		topics = topics[:limit]
 	}
 
-	w.Write([]byte(`]}`))
-	s.endResponseSuccess(w)
+	for _, topic := range topics {
+		info := &responseTopicListInfo{
+			Topic: topic,
+		}
 
-	if maxSize > 0 {
-		s.MessageSize.Put(query.Topic, int32(maxSize))
+		parts, err := meta.Partitions(topic)
+		if err != nil {
+			info.Error = fmt.Sprintf("Unable to get partitions: %v", err)
+		}
+		info.Partitions = len(parts)
+
+		res = append(res, *info)
 	}
+
+	s.metadataResponse(w, r, meta, res)
 }
 
-func (s *Server) getOffsetHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
-	defer s.Stats.HTTPResponseTime["FetchOffset"].Start().Stop()
+// partitionInfo collects information about partition. On failure it also
+// returns the description of the failed operation.
+func (s *Server) partitionInfo(client *KafkaClient, meta *KafkaMetadata, topic string, partition int32, writable []int32) (*responsePartitionInfo, string, error) {
+	var err error
 
-	kafka := &consumerOffsetInfo{
-		Consumer:  p.Get("consumer"),
-		Topic:     p.Get("topic"),
-		Partition: toInt32(p.Get("partition")),
-		Offset:    -1,
+	res := &responsePartitionInfo{
+		Topic:     topic,
+		Partition: partition,
+		Writable:  inSlice(partition, writable),
 	}
 
-	if !s.validRequest(w, p, true) {
-		return
+	res.Leader, err = meta.Leader(res.Topic, res.Partition)
+	if err != nil {
+		return res, "Unable to get broker", err
 	}
 
-	if kafka.Consumer == "" {
-		s.errorResponse(w, http.StatusBadRequest, "Consumer name must be provided")
-		return
+	if err := meta.PartitionError(res.Topic, res.Partition); err != nil {
+		res.Error = fmt.Sprintf("Partition metadata: %v", err)
 	}
 
-	offsetCoordinator, err := s.Client.NewOffsetCoordinator(s.Cfg, kafka.Consumer)
+	res.Replicas, err = meta.Replicas(res.Topic, res.Partition)
 	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to make offset coordinator: %v", err)
-		return
+		if err != KafkaErrReplicaNotAvailable {
+			return res, "Unable to get replicas", err
+		}
+		log.Printf("Error: Unable to get replicas: %v\n", err)
+		res.Replicas = make([]int32, 0)
 	}
-	defer offsetCoordinator.Close()
+	res.ReplicasNum = len(res.Replicas)
 
-	kafka.Offset, kafka.Metadata, err = offsetCoordinator.FetchOffset(kafka.Topic, kafka.Partition)
+	res.OffsetOldest, res.OffsetNewest, err = client.GetOffsets(res.Topic, res.Partition)
 	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to fetch offset: %v", err)
-		return
+		return res, "Unable to get offset", err
 	}
+	res.HighWatermark = &res.OffsetNewest
+	res.LogStartOffset = &res.OffsetOldest
 
-	s.successResponse(w, kafka)
+	return res, "", nil
 }
 
-func (s *Server) commitOffsetHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
-	defer s.Stats.HTTPResponseTime["CommitOffset"].Start().Stop()
+func (s *Server) getPartitionInfoHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	client := s.clusterClient(p)
 
-	msg, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		s.errorResponse(w, http.StatusBadRequest, "Unable to read body: %s", err)
+	if !s.validRequest(w, p, true) {
 		return
 	}
 
-	kafka := &consumerOffsetInfo{
-		Offset:    -1,
+	defer s.Stats.HTTPResponseTime.Get("GetPartitionInfo").Start().Stop()
+
+	meta, err := client.FetchMetadata()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
+		return
 	}
 
-	if err = json.Unmarshal(msg, &kafka); err != nil {
-		s.errorResponse(w, http.StatusBadRequest, "Request body must be JSON")
+	wp, err := meta.WritablePartitions(p.Get("topic"))
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get writable partitions: %v", err)
 		return
 	}
 
-	if kafka.Offset < 0 {
-		s.errorResponse(w, http.StatusBadRequest, "Offset must be provided not less than 0")
+	res, errMsg, err := s.partitionInfo(client, meta, p.Get("topic"), toInt32(p.Get("partition")), wp)
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "%s: %v", errMsg, err)
 		return
 	}
 
-	kafka.Consumer = p.Get("consumer")
-	kafka.Topic = p.Get("topic")
-	kafka.Partition = toInt32(p.Get("partition"))
+	s.metadataResponse(w, r, meta, res)
+}
+
+func (s *Server) getTopicInfoHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	client := s.clusterClient(p)
 
 	if !s.validRequest(w, p, true) {
 		return
 	}
 
-	if kafka.Consumer == "" {
-		s.errorResponse(w, http.StatusBadRequest, "Consumer name must be provided")
+	defer s.Stats.HTTPResponseTime.Get("GetTopicInfo").Start().Stop()
+
+	strict := toBool(p.Get("strict"))
+
+	meta, err := client.FetchMetadata()
+	if err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
 		return
 	}
 
-	offsetCoordinator, err := s.Client.NewOffsetCoordinator(s.Cfg, kafka.Consumer)
+	writable, err := meta.WritablePartitions(p.Get("topic"))
 	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to make offset coordinator: %v", err)
+		s.errorResponse(w, httpStatusError(err), "Unable to get writable partitions: %v", err)
 		return
 	}
-	defer offsetCoordinator.Close()
 
-	err = offsetCoordinator.CommitOffset(kafka.Topic, kafka.Partition, kafka.Offset)
+	parts, err := meta.Partitions(p.Get("topic"))
 	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to commit offset: %v", err)
+		s.errorResponse(w, httpStatusError(err), "Unable to get partitions: %v", err)
 		return
 	}
-	s.successResponse(w, kafka)
-}
 
-func (s *Server) getTopicListHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
-	defer s.Stats.HTTPResponseTime["GetTopicList"].Start().Stop()
+	type partitionResult struct {
+		info   *responsePartitionInfo
+		errMsg string
+		err    error
+	}
 
-	res := []responseTopicListInfo{}
+	results := make([]partitionResult, len(parts))
 
-	meta, err := s.Client.FetchMetadata()
-	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
-		return
+	workers := client.FreeBrokers()
+	if workers > len(parts) {
+		workers = len(parts)
+	}
+	if workers < 1 {
+		workers = 1
 	}
 
-	topics, err := meta.Topics()
-	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get topics: %v", err)
-		return
+	jobs := make(chan int)
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res := &results[i]
+				res.info, res.errMsg, res.err = s.partitionInfo(client, meta, p.Get("topic"), parts[i], writable)
+			}
+		}()
 	}
 
-	for _, topic := range topics {
-		parts, err := meta.Partitions(topic)
-		if err != nil {
-			s.errorResponse(w, httpStatusError(err), "Unable to get partitions: %v", err)
-			return
+	cancelled := false
+	for i := range parts {
+		if !s.connIsAlive(r) {
+			cancelled = true
+			break
 		}
-		info := &responseTopicListInfo{
-			Topic:      topic,
-			Partitions: len(parts),
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if cancelled {
+		return
+	}
+
+	res := []responsePartitionInfo{}
+
+	for _, r := range results {
+		if r.err != nil {
+			if strict {
+				s.errorResponse(w, httpStatusError(r.err), "%s: %v", r.errMsg, r.err)
+				return
+			}
+			r.info.Error = fmt.Sprintf("%s: %v", r.errMsg, r.err)
 		}
-		res = append(res, *info)
+		res = append(res, *r.info)
 	}
 
-	s.successResponse(w, res)
+	s.metadataResponse(w, r, meta, res)
 }
 
-func (s *Server) getPartitionInfoHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+func (s *Server) getTopicOffsetsHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	client := s.clusterClient(p)
+
 	if !s.validRequest(w, p, true) {
 		return
 	}
 
-	defer s.Stats.HTTPResponseTime["GetPartitionInfo"].Start().Stop()
+	defer s.Stats.HTTPResponseTime.Get("GetTopicOffsets").Start().Stop()
 
-	res := &responsePartitionInfo{
-		Topic:     p.Get("topic"),
-		Partition: toInt32(p.Get("partition")),
-	}
+	topic := p.Get("topic")
 
-	meta, err := s.Client.FetchMetadata()
+	meta, err := client.FetchMetadata()
 	if err != nil {
 		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
 		return
 	}
 
-	res.Leader, err = meta.Leader(res.Topic, res.Partition)
+	parts, err := meta.Partitions(topic)
 	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get broker: %v", err)
+		s.errorResponse(w, httpStatusError(err), "Unable to get partitions: %v", err)
 		return
 	}
 
-	res.Replicas, err = meta.Replicas(res.Topic, res.Partition)
-	if err != nil {
-		if err != KafkaErrReplicaNotAvailable {
-			s.errorResponse(w, httpStatusError(err), "Unable to get replicas: %v", err)
+	type offsetsResult struct {
+		offsets responsePartitionOffsets
+		err     error
+	}
+
+	results := make([]offsetsResult, len(parts))
+
+	workers := client.FreeBrokers()
+	if workers > len(parts) {
+		workers = len(parts)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res := &results[i]
+				res.offsets.Topic = topic
+				res.offsets.Partition = parts[i]
+				res.offsets.OffsetOldest, res.offsets.OffsetNewest, res.err = client.GetOffsets(topic, parts[i])
+			}
+		}()
+	}
+
+	cancelled := false
+	for i := range parts {
+		if !s.connIsAlive(r) {
+			cancelled = true
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if cancelled {
+		return
+	}
+
+	res := &responseTopicOffsets{
+		Topic:      topic,
+		Partitions: []responsePartitionOffsets{},
+	}
+
+	for _, r := range results {
+		if r.err != nil {
+			if isMetadataError(r.err) {
+				client.InvalidateMetadata()
+			}
+			s.errorResponse(w, httpStatusError(r.err), "Unable to get offset of partition %d: %v", r.offsets.Partition, r.err)
 			return
 		}
-		log.Printf("Error: Unable to get replicas: %v\n", err)
-		res.Replicas = make([]int32, 0)
+		res.Messages += r.offsets.OffsetNewest - r.offsets.OffsetOldest
+		res.Partitions = append(res.Partitions, r.offsets)
 	}
-	res.ReplicasNum = len(res.Replicas)
 
-	res.OffsetOldest, res.OffsetNewest, err = s.Client.GetOffsets(res.Topic, res.Partition)
+	s.successResponse(w, res)
+}
+
+func (s *Server) getMessageSizeHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	s.successResponse(w, &responseMessageSize{
+		Description: "The estimate is a percentile of message sizes seen on produce and consume. " +
+			"Sizes are kept in a uniform random sample per topic of cluster, so the old values are gradually replaced. " +
+			"The average is a moving average of message sizes. The least recently used topics are evicted " +
+			"when there are more than max_topics of them. The ratio is a moving average of fetched bytes " +
+			"per decoded message byte and is used to size fetch requests of compressed topics.",
+		Samples:    MessageSizeSamples,
+		Percentile: MessageSizePercentile,
+		MaxTopics:  s.MessageSize.MaxTopics,
+		Topics:     s.MessageSize.Info(),
+	})
+}
+
+func (s *Server) getPoolHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	s.successResponse(w, &responsePoolInfo{
+		Size:    s.Client.PoolSize(),
+		MaxSize: s.Client.MaxPoolSize(),
+	})
+}
+
+func (s *Server) pingBrokerHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	client := s.clusterClient(p)
+
+	meta, err := client.FetchMetadata()
 	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get offset: %v", err)
+		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
 		return
 	}
 
-	wp, err := meta.WritablePartitions(res.Topic)
-	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get writable partitions: %v", err)
+	nodeID := toInt32(p.Get("broker"))
+
+	addr, ok := meta.brokerAddress(nodeID)
+	if !ok {
+		s.errorResponse(w, http.StatusNotFound, "Unknown broker")
 		return
 	}
 
-	res.Writable = inSlice(res.Partition, wp)
+	s.successResponse(w, client.PingBroker(nodeID, addr))
+}
 
-	s.successResponse(w, res)
+func (s *Server) getPoolStatusHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	client := s.clusterClient(p)
+
+	s.successResponse(w, &responsePoolStatus{
+		Size:            client.PoolSize(),
+		Free:            client.Counters["FreeBrokers"].Count(),
+		Dead:            client.Counters["DeadBrokers"].Count(),
+		Reconnecting:    client.Counters["Reconnecting"].Count(),
+		Reconnects:      client.Counters["Reconnects"].Count(),
+		ReconnectErrors: client.Counters["ReconnectErrors"].Count(),
+	})
 }
 
-func (s *Server) getTopicInfoHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
-	if !s.validRequest(w, p, true) {
+func (s *Server) resizePoolHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	msg, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, "Unable to read body: %s", err)
 		return
 	}
 
-	defer s.Stats.HTTPResponseTime["GetTopicInfo"].Start().Stop()
+	req := &responsePoolInfo{}
 
-	res := []responsePartitionInfo{}
+	if err = json.Unmarshal(msg, req); err != nil {
+		s.errorResponse(w, http.StatusBadRequest, "Request body must be JSON")
+		return
+	}
 
-	meta, err := s.Client.FetchMetadata()
-	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get metadata: %v", err)
+	if req.Size <= 0 || req.Size > s.Client.MaxPoolSize() {
+		s.errorResponse(w, http.StatusBadRequest, "Pool size must be between 1 and %d", s.Client.MaxPoolSize())
 		return
 	}
 
-	writable, err := meta.WritablePartitions(p.Get("topic"))
+	log.Infof("Resizing pool of connections from %d to %d", s.Client.PoolSize(), req.Size)
+
+	if err = s.Client.ResizePool(req.Size); err != nil {
+		s.errorResponse(w, httpStatusError(err), "Unable to resize pool: %v", err)
+		return
+	}
+
+	s.successResponse(w, &responsePoolInfo{
+		Size:    s.Client.PoolSize(),
+		MaxSize: s.Client.MaxPoolSize(),
+	})
+}
+
+func (s *Server) reloadHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	next, err := loadConfig()
 	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get writable partitions: %v", err)
+		s.errorResponse(w, http.StatusInternalServerError, "Bad config: %v", err)
 		return
 	}
 
-	parts, err := meta.Partitions(p.Get("topic"))
+	cfg, changed, restart := MergeConfig(s.Config(), next)
+
+	level, err := logLevel(cfg)
 	if err != nil {
-		s.errorResponse(w, httpStatusError(err), "Unable to get partitions: %v", err)
+		s.errorResponse(w, http.StatusInternalServerError, "Bad config: %v", err)
 		return
 	}
 
-	for partition := range parts {
-		if !s.connIsAlive(w) {
-			return
-		}
+	s.SetConfig(cfg)
+	log.SetLevel(level)
 
-		r := &responsePartitionInfo{
-			Topic:     p.Get("topic"),
-			Partition: int32(partition),
-			Writable:  inSlice(int32(partition), writable),
-		}
+	for _, name := range changed {
+		log.Infof("Config option %s changed", name)
+	}
 
-		r.Leader, err = meta.Leader(r.Topic, r.Partition)
-		if err != nil {
-			s.errorResponse(w, httpStatusError(err), "Unable to get broker: %v", err)
-			return
-		}
+	for _, name := range restart {
+		log.Warnf("Config option %s changed, but requires restart", name)
+	}
 
-		r.Replicas, err = meta.Replicas(r.Topic, r.Partition)
-		if err != nil {
-			if err != KafkaErrReplicaNotAvailable {
-				s.errorResponse(w, httpStatusError(err), "Unable to get replicas: %v", err)
-				return
-			}
-			log.Printf("Error: Unable to get replicas: %v\n", err)
-			r.Replicas = make([]int32, 0)
-		}
-		r.ReplicasNum = len(r.Replicas)
+	s.successResponse(w, &responseReloadInfo{
+		Changed: changed,
+		Restart: restart,
+	})
+}
 
-		r.OffsetOldest, r.OffsetNewest, err = s.Client.GetOffsets(r.Topic, r.Partition)
-		if err != nil {
-			s.errorResponse(w, httpStatusError(err), "Unable to get offset: %v", err)
-			return
-		}
+func (s *Server) resetMetricsHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	s.Stats.Reset()
 
-		res = append(res, *r)
+	s.Client.ResetStatistics()
+	for _, client := range s.Clusters {
+		client.ResetStatistics()
 	}
 
-	s.successResponse(w, res)
+	log.Info("Metrics were reset")
+
+	s.successResponse(w, &responseMetricsReset{
+		Reset: time.Now(),
+	})
+}
+
+// goroutinesHandler writes the stacks of all goroutines in the form of
+// /debug/pprof/goroutine. The debug parameter is 2 (full stacks) by
+// default or 1 (goroutines with the same stack are grouped).
+func (s *Server) goroutinesHandler(w *HTTPResponse, r *http.Request, p *url.Values) {
+	debug := 2
+
+	switch v := p.Get("debug"); v {
+	case "", "2":
+	case "1":
+		debug = 1
+	default:
+		s.errorResponse(w, http.StatusBadRequest, "Bad debug parameter: %s", v)
+		return
+	}
+
+	s.Stats.HTTPStatus[http.StatusOK].Inc(1)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	s.rawResponse(w, http.StatusOK, nil)
+
+	if err := pprof.Lookup("goroutine").WriteTo(w, debug); err != nil {
+		log.Errorln("Unable to write goroutines:", err)
+	}
 }
@@ -0,0 +1,4134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/optiopay/kafka/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func newTestServer(t *testing.T, srv *KafkaServer) *Server {
+	cfg := &Config{}
+	cfg.SetDefaults()
+	cfg.Kafka.Broker = []string{srv.Address()}
+	cfg.Broker.NumConns = 1
+	cfg.Broker.MetadataCachePeriod.Duration = 0
+
+	setLogFormat(cfg)
+
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("unable to make client: %s", err)
+	}
+
+	schemas, err := NewSchemaRegistry(cfg)
+	if err != nil {
+		t.Fatalf("unable to make schema registry: %s", err)
+	}
+
+	s := &Server{
+		Client:      client,
+		Clusters:    make(map[string]*KafkaClient),
+		Stats:       NewMetricStats(),
+		MessageSize: NewTopicMessageSize(),
+		Schemas:     schemas,
+		Idempotency: NewIdempotencyCache(0, 0),
+
+		ResponseCache: NewResponseCache(0, 0),
+		Consumers:     NewTopicConsumers(),
+		Batcher:       NewProduceBatcher(),
+	}
+	s.SetConfig(cfg)
+
+	return s
+}
+
+func handleTestMetadata(srv *KafkaServer) {
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		host, port := srv.HostPort()
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}},
+						{ID: 1, Leader: -1, Err: proto.ErrLeaderNotAvailable},
+					},
+				},
+			},
+		}
+	})
+}
+
+func TestValidRequestNewPartition(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	var (
+		requests int32
+		expanded int32
+	)
+
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		host, port := srv.HostPort()
+
+		atomic.AddInt32(&requests, 1)
+
+		partitions := []proto.MetadataRespPartition{
+			{ID: 0, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}},
+		}
+		if atomic.LoadInt32(&expanded) == 1 {
+			partitions = append(partitions, proto.MetadataRespPartition{ID: 1, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}})
+		}
+
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{Name: "test", Partitions: partitions},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Client.MetadataCachePeriod = time.Minute
+	s.Client.MetadataRefreshWait = 0
+
+	if _, err := s.Client.RefreshMetadata(); err != nil {
+		t.Fatalf("Unable to get metadata: %v", err)
+	}
+
+	atomic.StoreInt32(&expanded, 1)
+
+	valid := func(partition string) bool {
+		p := url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{partition},
+		}
+		return s.validRequest(&HTTPResponse{ResponseWriter: httptest.NewRecorder()}, &p, true)
+	}
+
+	if !valid("1") {
+		t.Fatalf("The new partition must be found after refresh")
+	}
+
+	// The fresh metadata isn't requested again.
+	s.Client.MetadataRefreshWait = time.Minute
+	n := atomic.LoadInt32(&requests)
+
+	for i := 0; i < 3; i++ {
+		if valid("5") {
+			t.Fatalf("Unexpected partition")
+		}
+	}
+
+	if v := atomic.LoadInt32(&requests); v != n {
+		t.Fatalf("Expected no metadata requests, got %d", v-n)
+	}
+}
+
+func TestSendHandlerHeaders(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: 42},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Idempotency = NewIdempotencyCache(time.Minute, 10)
+
+	for i, replay := range []string{"", "true"} {
+		r := httptest.NewRequest("POST", "/v1/topics/test/0", bytes.NewBufferString(`{"a":1}`))
+		r.Header.Set("Idempotency-Key", "key")
+
+		rec := httptest.NewRecorder()
+		w := &HTTPResponse{ResponseWriter: rec}
+
+		s.sendHandler(w, r, &url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		})
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d: %s", i, rec.Code, rec.Body.String())
+		}
+
+		if v := rec.Header().Get("X-Idempotent-Replay"); v != replay {
+			t.Fatalf("request %d: expected replay header %q, got %q", i, replay, v)
+		}
+
+		if v := rec.Header().Get("X-Kafka-Partition"); v != "0" {
+			t.Fatalf("request %d: expected partition header 0, got %q", i, v)
+		}
+
+		if v := rec.Header().Get("X-Kafka-Offset"); v != "42" {
+			t.Fatalf("request %d: expected offset header 42, got %q", i, v)
+		}
+	}
+
+	// The key of request in progress is not produced again.
+	s.Idempotency.Reserve("/test/0/pending")
+
+	r := httptest.NewRequest("POST", "/v1/topics/test/0", bytes.NewBufferString(`{"a":1}`))
+	r.Header.Set("Idempotency-Key", "pending")
+
+	rec := httptest.NewRecorder()
+	s.sendHandler(&HTTPResponse{ResponseWriter: rec}, r, &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	})
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected status 409, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSendHandlerNoLeader(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	r := httptest.NewRequest("POST", "/v1/topics/test/1", bytes.NewBufferString(`{"a":1}`))
+	rec := httptest.NewRecorder()
+	w := &HTTPResponse{ResponseWriter: rec}
+
+	s.sendHandler(w, r, &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"1"},
+	})
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSendHandlerFallbackOnNoLeader(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	partitions := make(chan int32, 1)
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		part := req.Topics[0].Partitions[0]
+		partitions <- part.ID
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: part.ID, Offset: 7},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Routing = map[string]*struct {
+		Route []CfgRoute
+	}{
+		"test": {Route: []CfgRoute{{Prefix: "tenant-", Partition: 1}}},
+	}
+
+	send := func(uri string, p *url.Values) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", uri, bytes.NewBufferString(`{"a":1}`)), p)
+		return rec
+	}
+
+	keyed := func() *url.Values {
+		return &url.Values{
+			"topic": []string{"test"},
+			"key":   []string{"tenant-a"},
+		}
+	}
+
+	if rec := send("/v1/topics/test?key=tenant-a", keyed()); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 without fallback, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	s.Config().Producer.FallbackOnNoLeader = true
+
+	rec := send("/v1/topics/test?key=tenant-a", keyed())
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Kafka-Partition") != "0" {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if part := <-partitions; part != 0 {
+		t.Fatalf("expected message in partition 0, got %d", part)
+	}
+
+	if !strings.Contains(rec.Body.String(), `"partition":0`) {
+		t.Fatalf("expected partition 0 in response: %s", rec.Body.String())
+	}
+
+	// The partition of request is never changed.
+	rec = send("/v1/topics/test/1", &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"1"},
+	})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 for explicit partition, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestFallbackPartition(t *testing.T) {
+	testCases := []struct {
+		partition int32
+		writable  []int32
+		expected  int32
+		ok        bool
+	}{
+		{1, []int32{0, 2, 3}, 2, true},
+		{3, []int32{2, 0, 1}, 0, true},
+		{0, []int32{0}, -1, false},
+		{0, nil, -1, false},
+	}
+
+	for _, tc := range testCases {
+		part, ok := fallbackPartition(tc.partition, tc.writable)
+		if part != tc.expected || ok != tc.ok {
+			t.Fatalf("fallbackPartition(%d, %v): expected %d/%v, got %d/%v", tc.partition, tc.writable, tc.expected, tc.ok, part, ok)
+		}
+	}
+}
+
+func TestSendHandlerLeaderRetry(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	produceCallCount := 0
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		produceCallCount++
+
+		part := proto.ProduceRespPartition{ID: 0, Offset: 42}
+		if produceCallCount == 1 {
+			part = proto.ProduceRespPartition{ID: 0, Offset: -1, Err: proto.ErrNotLeaderForPartition}
+		}
+
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name:       "test",
+					Partitions: []proto.ProduceRespPartition{part},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Producer.RetryLimit = 1
+
+	r := httptest.NewRequest("POST", "/v1/topics/test/0", bytes.NewBufferString(`{"a":1}`))
+	rec := httptest.NewRecorder()
+	w := &HTTPResponse{ResponseWriter: rec}
+
+	s.sendHandler(w, r, &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if produceCallCount != 2 {
+		t.Fatalf("expected 2 produce requests, got %d", produceCallCount)
+	}
+
+	// The connection with the old metadata is renewed.
+	if n := s.Client.Counters["Reconnects"].Count(); n != 1 {
+		t.Fatalf("expected 1 reconnect, got %d", n)
+	}
+}
+
+func TestSendHandlerGzip(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+
+		resp := &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: 42},
+					},
+				},
+			},
+		}
+
+		if v := req.Topics[0].Partitions[0].Messages[0].Value; string(v) != `{"a":1}` {
+			resp.Topics[0].Partitions[0].Err = proto.ErrInvalidMessage
+		}
+
+		return resp
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	gzipBody := func(b []byte) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		gz.Write(b)
+		gz.Close()
+		return buf
+	}
+
+	testCases := []struct {
+		body []byte
+		code int
+	}{
+		{[]byte(`{"a":1}`), http.StatusOK},
+		{[]byte(`"` + strings.Repeat("a", int(s.Config().Consumer.MaxFetchSize)) + `"`), http.StatusBadRequest},
+	}
+
+	for i, tc := range testCases {
+		r := httptest.NewRequest("POST", "/v1/topics/test/0", gzipBody(tc.body))
+		r.Header.Set("Content-Encoding", "gzip")
+
+		rec := httptest.NewRecorder()
+		w := &HTTPResponse{ResponseWriter: rec}
+
+		s.sendHandler(w, r, &url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		})
+
+		if rec.Code != tc.code {
+			t.Fatalf("request %d: expected status %d, got %d: %s", i, tc.code, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestGetMessageHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(0)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		// The message 4 was removed by compaction.
+		offset := req.Topics[0].Partitions[0].FetchOffset
+		if offset == 4 {
+			offset = 5
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{
+							ID:        0,
+							TipOffset: 10,
+							Messages: []*proto.Message{
+								{Offset: offset, Key: []byte("k"), Value: []byte(fmt.Sprintf(`{"a":%d}`, offset))},
+							},
+						},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	testCases := []struct {
+		offset string
+		code   int
+		body   string
+	}{
+		{"5", http.StatusOK, `{"data":{"offset":5,"key":"k","value":{"a":5}},"status":"success"}`},
+		{"4", http.StatusNotFound, ""},
+		{"10", http.StatusNotFound, ""},
+		{"latest", http.StatusOK, `{"data":{"offset":9,"key":"k","value":{"a":9}},"status":"success"}`},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", "/v1/topics/test/0/messages/"+tc.offset, nil)
+		rec := httptest.NewRecorder()
+		w := &HTTPResponse{ResponseWriter: rec}
+
+		s.getMessageHandler(w, r, &url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+			"offset":    []string{tc.offset},
+		})
+
+		if rec.Code != tc.code {
+			t.Fatalf("offset %s: expected status %d, got %d: %s", tc.offset, tc.code, rec.Code, rec.Body.String())
+		}
+
+		if tc.body != "" && rec.Body.String() != tc.body {
+			t.Fatalf("offset %s: unexpected body: %s", tc.offset, rec.Body.String())
+		}
+	}
+}
+
+func TestAssignPartitionQuotas(t *testing.T) {
+	testCases := []struct {
+		available []int64
+		limit     int32
+		strategy  string
+		quotas    []int32
+	}{
+		{[]int64{10, 10, 10}, 4, ConsumeRoundRobin, []int32{2, 1, 1}},
+		{[]int64{0, 1, 10}, 5, ConsumeRoundRobin, []int32{0, 1, 4}},
+		{[]int64{1, 1}, 5, ConsumeRoundRobin, []int32{1, 1}},
+		{[]int64{10, 10, 10}, 4, ConsumeSequential, []int32{4, 0, 0}},
+		{[]int64{2, 1, 10}, 5, ConsumeSequential, []int32{2, 1, 2}},
+	}
+
+	for _, tc := range testCases {
+		quotas := assignPartitionQuotas(tc.available, tc.limit, tc.strategy)
+
+		if len(quotas) != len(tc.quotas) {
+			t.Fatalf("%s %v/%d: expected %v, got %v", tc.strategy, tc.available, tc.limit, tc.quotas, quotas)
+		}
+
+		for i := range quotas {
+			if quotas[i] != tc.quotas[i] {
+				t.Fatalf("%s %v/%d: expected %v, got %v", tc.strategy, tc.available, tc.limit, tc.quotas, quotas)
+			}
+		}
+	}
+}
+
+func TestGetTopicMessagesHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		host, port := srv.HostPort()
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}},
+						{ID: 1, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(0)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: req.Topics[0].Partitions[0].ID, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		part := req.Topics[0].Partitions[0]
+
+		var msgs []*proto.Message
+		for i := part.FetchOffset; i < 10; i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Value: []byte(fmt.Sprintf(`{"p":%d}`, part.ID))})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: part.ID, TipOffset: 10, Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	get := func(limit string) []responsePartitionMessage {
+		p := url.Values{
+			"topic": []string{"test"},
+			"limit": []string{limit},
+		}
+
+		rec := httptest.NewRecorder()
+		s.getTopicMessagesHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test?"+p.Encode(), nil), &p)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		var res struct {
+			Data responseTopicMessages `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("unable to decode response: %s: %s", err, rec.Body.String())
+		}
+		return res.Data.Messages
+	}
+
+	msgs := get("4")
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 messages, got %+v", msgs)
+	}
+	for i, msg := range msgs {
+		if msg.Partition != int32(i%2) || msg.Offset != int64(i/2) {
+			t.Fatalf("unexpected order of messages: %+v", msgs)
+		}
+	}
+
+	// The reading stops when the size of messages is reached.
+	s.Config().Consumer.MaxBufferedSize = 2 * int64(len(`{"p":0}`))
+
+	if msgs := get("10"); len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %+v", msgs)
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	msg := &proto.Message{Offset: 7, Key: []byte("k"), Value: []byte(`{"a":1}`)}
+
+	testCases := []struct {
+		fields string
+		result string
+	}{
+		{"", `{"a":1}`},
+		{"key", `{"key":"k"}`},
+		{"key,offset", `{"offset":7,"key":"k"}`},
+		{"offset,key,value", `{"offset":7,"key":"k","value":{"a":1}}`},
+	}
+
+	for _, tc := range testCases {
+		fields, err := parseMessageFields(tc.fields)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", tc.fields, err)
+		}
+
+		b, err := encodeMessage(msg, fields)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", tc.fields, err)
+		}
+
+		if string(b) != tc.result {
+			t.Fatalf("%q: expected %s, got %s", tc.fields, tc.result, b)
+		}
+	}
+
+	if _, err := parseMessageFields("offset,crc"); err == nil {
+		t.Fatalf("expected error for unknown field")
+	}
+}
+
+func TestEncodeMessageBase64(t *testing.T) {
+	msg := &proto.Message{Offset: 7, Key: []byte("k"), Value: []byte{0xff, 0xfe, '"', 0x00}}
+
+	testCases := []struct {
+		fields messageFields
+		result string
+	}{
+		{messageFields{Base64: true}, `"//4iAA=="`},
+		{messageFields{Value: true, Base64: true}, `{"value":"//4iAA=="}`},
+		{messageFields{Offset: true, Key: true, Value: true, Base64: true}, `{"offset":7,"key":"k","value":"//4iAA=="}`},
+	}
+
+	for _, tc := range testCases {
+		b, err := encodeMessage(msg, tc.fields)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %s", tc.fields, err)
+		}
+
+		if string(b) != tc.result {
+			t.Fatalf("%+v: expected %s, got %s", tc.fields, tc.result, b)
+		}
+	}
+
+	// The tombstone is still null.
+	b, err := encodeMessage(&proto.Message{Offset: 7, Key: []byte("k")}, messageFields{Offset: true, Key: true, Value: true, Base64: true})
+	if err != nil || string(b) != `{"offset":7,"key":"k","value":null}` {
+		t.Fatalf("unexpected encoded tombstone: %s: %v", b, err)
+	}
+}
+
+func TestEncodeMessageNotJSON(t *testing.T) {
+	msg := &proto.Message{Offset: 7, Key: []byte("k"), Value: []byte("plain text")}
+
+	testCases := []struct {
+		fields messageFields
+		result string
+	}{
+		{messageFields{}, `plain text`},
+		{messageFields{Value: true}, `{"value":"cGxhaW4gdGV4dA==","value_encoding":"base64"}`},
+		{messageFields{Offset: true}, `{"offset":7}`},
+		{allMessageFields, `{"offset":7,"key":"k","value":"cGxhaW4gdGV4dA==","value_encoding":"base64"}`},
+	}
+
+	for _, tc := range testCases {
+		b, err := encodeMessage(msg, tc.fields)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %s", tc.fields, err)
+		}
+
+		if string(b) != tc.result {
+			t.Fatalf("%+v: expected %s, got %s", tc.fields, tc.result, b)
+		}
+	}
+}
+
+func TestGetHandlerEmptyPartition(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{3}},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	testCases := []struct {
+		offset    string
+		underflow string
+		code      int
+		body      string
+	}{
+		{"3", "", http.StatusOK, `{"data":{"query":{"topic":"test","partition":0,"offset":3,"limit":1},"messages":[]},"status":"success"}`},
+		{"2", "", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"4", "", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"2", "error", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"2", "clamp", http.StatusOK, `{"data":{"query":{"topic":"test","partition":0,"offset":3,"limit":1,"clamped":true},"messages":[]},"status":"success"}`},
+		{"4", "clamp", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"2", "skip", http.StatusBadRequest, ""},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", "/v1/topics/test/0?offset="+tc.offset, nil)
+		rec := httptest.NewRecorder()
+		w := &HTTPResponse{ResponseWriter: rec}
+
+		s.getHandler(w, r, &url.Values{
+			"topic":        []string{"test"},
+			"partition":    []string{"0"},
+			"offset":       []string{tc.offset},
+			"on_underflow": []string{tc.underflow},
+		})
+
+		if rec.Code != tc.code {
+			t.Fatalf("offset %s: expected status %d, got %d: %s", tc.offset, tc.code, rec.Code, rec.Body.String())
+		}
+
+		if tc.body != "" && rec.Body.String() != tc.body {
+			t.Fatalf("offset %s: unexpected body: %s", tc.offset, rec.Body.String())
+		}
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Broker.MinHealthy = 1
+
+	rec := httptest.NewRecorder()
+	s.readyHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/ready", nil), &url.Values{})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	brokerID, err := s.Client.getBroker()
+	if err != nil {
+		t.Fatalf("unable to get broker: %s", err)
+	}
+
+	// Keep the connection broken.
+	srv.Close()
+	s.Client.deadBroker(brokerID)
+
+	if alive := s.Client.AliveBrokers(); alive != 0 {
+		t.Fatalf("expected no alive brokers, got %d", alive)
+	}
+
+	rec = httptest.NewRecorder()
+	s.readyHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/ready", nil), &url.Values{})
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusServiceUnavailable, rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadyHandlerMetadata(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Client.MetadataCachePeriod = time.Minute
+
+	rec := httptest.NewRecorder()
+	s.readyHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/ready", nil), &url.Values{})
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusServiceUnavailable, rec.Code, rec.Body.String())
+	}
+
+	if _, err := s.Client.RefreshMetadata(); err != nil {
+		t.Fatalf("unable to get metadata: %s", err)
+	}
+
+	rec = httptest.NewRecorder()
+	s.readyHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/ready", nil), &url.Values{})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+}
+
+func TestGoroutinesHandler(t *testing.T) {
+	s := &Server{
+		Stats: NewMetricStats(),
+	}
+
+	rec := httptest.NewRecorder()
+	s.goroutinesHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/admin/debug/goroutines", nil), &url.Values{})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("unexpected Content-Type: %s", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "TestGoroutinesHandler") {
+		t.Fatalf("the stack of test is not found: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.goroutinesHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/admin/debug/goroutines?debug=3", nil), &url.Values{"debug": {"3"}})
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestGetTopicOffsetsHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		host, port := srv.HostPort()
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}},
+						{ID: 1, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		part := req.Topics[0].Partitions[0]
+
+		// Partition N has messages from N to 10*(N+1).
+		offset := int64(part.ID)
+		if part.TimeMs == -1 {
+			offset = int64(10 * (part.ID + 1))
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: part.ID, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	rec := httptest.NewRecorder()
+
+	s.getTopicOffsetsHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/info/topics/test/offsets", nil), &url.Values{
+		"topic": []string{"test"},
+	})
+
+	expected := `{"data":{"topic":"test","messages":29,"partitions":[` +
+		`{"topic":"test","partition":0,"offsetfrom":0,"offsetto":10},` +
+		`{"topic":"test","partition":1,"offsetfrom":1,"offsetto":20}]},"status":"success"}`
+
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestConnIsAliveHTTP2(t *testing.T) {
+	s := &Server{}
+
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("expected HTTP/2 request, got %s", r.Proto)
+		}
+		close(started)
+
+		for s.connIsAlive(r) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(stopped)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("unable to make request: %s", err)
+	}
+
+	go func() {
+		if resp, err := ts.Client().Do(req.WithContext(ctx)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("cancelled stream is not detected")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cl := s.newConnTrack(r)
+			defer s.closeConnTrack(cl)
+
+			close(started)
+			<-r.Context().Done()
+			close(stopped)
+		}),
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+
+	s.addHTTPServer(httpServer)
+	go httpServer.Serve(ln)
+
+	go func() {
+		if resp, err := http.Get("http://" + ln.Addr().String()); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-started
+
+	if aborted := s.Drain(100 * time.Millisecond); aborted != 1 {
+		t.Fatalf("expected 1 aborted request, got %d", aborted)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request is not aborted")
+	}
+}
+
+func TestGetHandlerBuffered(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{
+							ID:        0,
+							TipOffset: 10,
+							Messages: []*proto.Message{
+								{Offset: 5, Value: []byte(`{"a":5}`)},
+							},
+						},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	rec := httptest.NewRecorder()
+
+	s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?buffered=true", nil), &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+		"buffered":  []string{"true"},
+	})
+
+	expected := `{"data":{"query":{"topic":"test","partition":0,"offset":5,"limit":1},"messages":[{"a":5}]},"status":"success"}`
+
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if v := rec.Header().Get("Content-Length"); v != strconv.Itoa(len(expected)) {
+		t.Fatalf("expected Content-Length %d, got %q", len(expected), v)
+	}
+}
+
+func TestGetHandlerBufferedError(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{
+							ID:        0,
+							TipOffset: 10,
+							Messages: []*proto.Message{
+								{Offset: 5, Value: frame(`{"a":5}`)},
+								{Offset: 6, Value: []byte("\x00\x00\x00\x09{}")},
+							},
+						},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	rec := httptest.NewRecorder()
+
+	s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?buffered=true&limit=2&frame=length-prefixed", nil), &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+		"limit":     []string{"2"},
+		"buffered":  []string{"true"},
+		"frame":     []string{"length-prefixed"},
+	})
+
+	// The message written before the error is not sent.
+	if rec.Code != http.StatusUnprocessableEntity || strings.Contains(rec.Body.String(), `"messages"`) {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if v := rec.Header().Get("Content-Length"); v != strconv.Itoa(rec.Body.Len()) {
+		t.Fatalf("expected Content-Length %d, got %q", rec.Body.Len(), v)
+	}
+
+	if n := s.Stats.HTTPStatus[http.StatusOK].Count(); n != 0 {
+		t.Fatalf("expected no successful responses, got %d", n)
+	}
+}
+
+func TestGetHandlerUntil(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		var msgs []*proto.Message
+		for i := req.Topics[0].Partitions[0].FetchOffset; i < 10; i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Value: []byte(fmt.Sprintf(`{"a":%d}`, i))})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 10, Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	testCases := []struct {
+		params   url.Values
+		code     int
+		expected string
+	}{
+		{
+			params:   url.Values{"offset": {"5"}, "until": {"8"}, "limit": {"1"}},
+			code:     http.StatusOK,
+			expected: `{"data":{"messages":[{"a":5},{"a":6},{"a":7}],"query":{"topic":"test","partition":0,"offset":5,"until":8,"last_offset":7}},"status":"success"}`,
+		},
+		{
+			params:   url.Values{"offset": {"8"}, "until": {"100"}},
+			code:     http.StatusOK,
+			expected: `{"data":{"messages":[{"a":8},{"a":9}],"query":{"topic":"test","partition":0,"offset":8,"until":100,"last_offset":9}},"status":"success"}`,
+		},
+		{
+			params:   url.Values{"offset": {"5"}, "until": {"8"}, "maxbytes": {"7"}},
+			code:     http.StatusOK,
+			expected: `{"data":{"messages":[{"a":5}],"query":{"topic":"test","partition":0,"offset":5,"until":8,"last_offset":5}},"status":"success"}`,
+		},
+		{
+			params:   url.Values{"offset": {"5"}, "until": {"5"}},
+			code:     http.StatusOK,
+			expected: `{"data":{"messages":[],"query":{"topic":"test","partition":0,"offset":5,"until":5,"last_offset":-1}},"status":"success"}`,
+		},
+		{
+			params: url.Values{"until": {"x"}},
+			code:   http.StatusBadRequest,
+		},
+		{
+			params: url.Values{"maxbytes": {"10"}},
+			code:   http.StatusBadRequest,
+		},
+		{
+			params: url.Values{"until": {"8"}, "order": {"desc"}},
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		p := url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		}
+		for k, v := range tc.params {
+			p[k] = v
+		}
+
+		rec := httptest.NewRecorder()
+		s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?"+p.Encode(), nil), &p)
+
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected status %d, got %d: %s", tc.params, tc.code, rec.Code, rec.Body.String())
+		}
+		if tc.expected != "" && rec.Body.String() != tc.expected {
+			t.Fatalf("%v: unexpected response: %s", tc.params, rec.Body.String())
+		}
+	}
+}
+
+func TestGetHandlerFramed(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	values := [][]byte{
+		frame(`{"a":0}`, `{"b":0}`),
+		frame(`{"a":1}`),
+		{0, 0, 0, 9, '{', '}'},
+	}
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(0)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = int64(len(values))
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		var msgs []*proto.Message
+		for i := req.Topics[0].Partitions[0].FetchOffset; i < int64(len(values)); i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Value: values[i]})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: int64(len(values)), Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	testCases := []struct {
+		params   url.Values
+		code     int
+		expected string
+	}{
+		{
+			params:   url.Values{"offset": {"0"}, "limit": {"2"}, "frame": {"length-prefixed"}},
+			code:     http.StatusOK,
+			expected: `"messages":[{"a":0},{"b":0},{"a":1}]`,
+		},
+		{
+			params:   url.Values{"offset": {"0"}, "limit": {"1"}, "frame": {"length-prefixed"}, "fields": {"offset,value"}},
+			code:     http.StatusOK,
+			expected: `"messages":[{"offset":0,"value":{"a":0}},{"offset":0,"value":{"b":0}}]`,
+		},
+		{
+			params:   url.Values{"offset": {"1"}, "limit": {"2"}, "frame": {"length-prefixed"}, "order": {"desc"}},
+			code:     http.StatusOK,
+			expected: `"messages":[{"a":1},{"b":0},{"a":0}]`,
+		},
+		{
+			params: url.Values{"offset": {"2"}, "frame": {"length-prefixed"}},
+			code:   http.StatusUnprocessableEntity,
+		},
+		{
+			params: url.Values{"offset": {"0"}, "frame": {"varint"}},
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		p := url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		}
+		for k, v := range tc.params {
+			p[k] = v
+		}
+
+		rec := httptest.NewRecorder()
+		s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?"+p.Encode(), nil), &p)
+
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected status %d, got %d: %s", tc.params, tc.code, rec.Code, rec.Body.String())
+		}
+		if tc.expected != "" && !strings.Contains(rec.Body.String(), tc.expected) {
+			t.Fatalf("%v: unexpected response: %s", tc.params, rec.Body.String())
+		}
+	}
+}
+
+func TestGetHandlerDedupByKey(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	keys := []string{"a", "b", "a", "c", "b", "a"}
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(0)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = int64(len(keys))
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		var msgs []*proto.Message
+		for i := req.Topics[0].Partitions[0].FetchOffset; i < int64(len(keys)); i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Key: []byte(keys[i]), Value: []byte(fmt.Sprintf(`{"v":%d}`, i))})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: int64(len(keys)), Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	testCases := []struct {
+		params   url.Values
+		code     int
+		expected string
+	}{
+		{
+			params:   url.Values{"offset": {"0"}, "limit": {"6"}, "dedup_by_key": {"true"}},
+			code:     http.StatusOK,
+			expected: `"messages":[{"v":3},{"v":4},{"v":5}]`,
+		},
+		{
+			params:   url.Values{"offset": {"0"}, "limit": {"3"}, "dedup_by_key": {"true"}, "fields": {"offset,key"}},
+			code:     http.StatusOK,
+			expected: `"messages":[{"offset":1,"key":"b"},{"offset":2,"key":"a"}]`,
+		},
+		{
+			params:   url.Values{"offset": {"0"}, "limit": {"6"}},
+			code:     http.StatusOK,
+			expected: `"messages":[{"v":0},{"v":1},{"v":2},{"v":3},{"v":4},{"v":5}]`,
+		},
+		{
+			params: url.Values{"offset": {"5"}, "dedup_by_key": {"true"}, "order": {"desc"}},
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		p := url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		}
+		for k, v := range tc.params {
+			p[k] = v
+		}
+
+		rec := httptest.NewRecorder()
+		s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?"+p.Encode(), nil), &p)
+
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected status %d, got %d: %s", tc.params, tc.code, rec.Code, rec.Body.String())
+		}
+		if tc.expected != "" && !strings.Contains(rec.Body.String(), tc.expected) {
+			t.Fatalf("%v: unexpected response: %s", tc.params, rec.Body.String())
+		}
+	}
+}
+
+func TestGetHandlerDescending(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		var msgs []*proto.Message
+		for i := req.Topics[0].Partitions[0].FetchOffset; i < 10; i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Value: []byte(fmt.Sprintf(`{"a":%d}`, i))})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 10, Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	testCases := []struct {
+		params   url.Values
+		code     int
+		expected string
+	}{
+		{
+			params:   url.Values{"limit": []string{"3"}},
+			code:     http.StatusOK,
+			expected: `{"data":{"query":{"topic":"test","partition":0,"offset":9,"limit":3,"order":"desc"},"messages":[{"a":9},{"a":8},{"a":7}]},"status":"success"}`,
+		},
+		{
+			params:   url.Values{"limit": []string{"3"}, "offset": []string{"6"}},
+			code:     http.StatusOK,
+			expected: `{"data":{"query":{"topic":"test","partition":0,"offset":6,"limit":3,"order":"desc"},"messages":[{"a":6},{"a":5}]},"status":"success"}`,
+		},
+		{
+			params: url.Values{"commit_as": []string{"group"}},
+			code:   http.StatusBadRequest,
+		},
+		{
+			params:   url.Values{"limit": []string{"3"}, "output": []string{"ndjson"}},
+			code:     http.StatusOK,
+			expected: "{\"a\":9}\n{\"a\":8}\n{\"a\":7}\n",
+		},
+		{
+			params:   url.Values{"limit": []string{"3"}, "offset": []string{"5"}, "order": []string{"asc"}, "output": []string{"ndjson"}},
+			code:     http.StatusOK,
+			expected: "{\"a\":5}\n{\"a\":6}\n{\"a\":7}\n",
+		},
+		{
+			params: url.Values{"output": []string{"xml"}},
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		p := url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+			"order":     []string{"desc"},
+		}
+		for k, v := range tc.params {
+			p[k] = v
+		}
+
+		rec := httptest.NewRecorder()
+
+		s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?"+p.Encode(), nil), &p)
+
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected %d, got %d: %s", tc.params, tc.code, rec.Code, rec.Body.String())
+		}
+
+		if tc.expected != "" && rec.Body.String() != tc.expected {
+			t.Fatalf("%v: unexpected response: %s", tc.params, rec.Body.String())
+		}
+	}
+}
+
+// encodeTestMessage appends the message to the message set of version 0.
+func encodeTestMessage(buf *bytes.Buffer, offset int64, compression proto.Compression, value []byte) {
+	var body bytes.Buffer
+
+	enc := proto.NewEncoder(&body)
+	enc.EncodeInt8(0) // magic byte
+	enc.EncodeInt8(int8(compression))
+	enc.EncodeBytes(nil)
+	enc.EncodeBytes(value)
+
+	enc = proto.NewEncoder(buf)
+	enc.EncodeInt64(offset)
+	enc.EncodeInt32(int32(4 + body.Len()))
+	enc.EncodeUint32(crc32.ChecksumIEEE(body.Bytes()))
+	buf.Write(body.Bytes())
+}
+
+// gzipTestBatch returns the gzip compressed batch of messages with the
+// offsets from first to last.
+func gzipTestBatch(first, last int64) []byte {
+	var inner bytes.Buffer
+	for i := first; i <= last; i++ {
+		encodeTestMessage(&inner, i, proto.CompressionNone, []byte(fmt.Sprintf(`{"a":%d}`, i)))
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(inner.Bytes())
+	gz.Close()
+
+	// The wrapper message has the offset of the last message in batch.
+	var batch bytes.Buffer
+	encodeTestMessage(&batch, last, proto.CompressionGzip, compressed.Bytes())
+
+	return batch.Bytes()
+}
+
+// rawFetchResp is the fetch response of the test partition with the already
+// encoded message set.
+type rawFetchResp struct {
+	CorrelationID int32
+	TipOffset     int64
+	MessageSet    []byte
+}
+
+func (r *rawFetchResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := proto.NewEncoder(&buf)
+	enc.EncodeInt32(0) // size placeholder
+	enc.EncodeInt32(r.CorrelationID)
+	enc.EncodeArrayLen(1)
+	enc.EncodeString("test")
+	enc.EncodeArrayLen(1)
+	enc.EncodeInt32(0)
+	enc.EncodeInt16(0)
+	enc.EncodeInt64(r.TipOffset)
+	enc.EncodeBytes(r.MessageSet)
+
+	if err := enc.Err(); err != nil {
+		return nil, err
+	}
+
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[:4], uint32(len(b)-4))
+
+	return b, nil
+}
+
+func TestGetHandlerCompressedBatches(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(0)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 12
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+
+	// The messages are stored in batches of three. As Kafka does, the
+	// whole batch is returned from its start and the message set is
+	// cut by the fetch size.
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		part := req.Topics[0].Partitions[0]
+
+		var set []byte
+		for first := part.FetchOffset - part.FetchOffset%3; first < 12; first += 3 {
+			set = append(set, gzipTestBatch(first, first+2)...)
+		}
+		if int(part.MaxBytes) < len(set) {
+			set = set[:part.MaxBytes]
+		}
+
+		return &rawFetchResp{
+			CorrelationID: req.CorrelationID,
+			TipOffset:     12,
+			MessageSet:    set,
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	cfg := s.Config()
+	cfg.Consumer.DefaultFetchSize = 16
+	cfg.Consumer.MaxFetchSize = int32(len(gzipTestBatch(0, 2)) * 2)
+	cfg.Consumer.RetryLimit = 1
+	cfg.Consumer.RetryWait.Duration = 0
+
+	testCases := []struct {
+		offset   string
+		limit    string
+		expected string
+	}{
+		{
+			offset:   "4",
+			limit:    "1",
+			expected: `[{"a":4}]`,
+		},
+		{
+			offset:   "4",
+			limit:    "5",
+			expected: `[{"a":4},{"a":5},{"a":6},{"a":7},{"a":8}]`,
+		},
+		{
+			offset:   "9",
+			limit:    "10",
+			expected: `[{"a":9},{"a":10},{"a":11}]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		// The estimated compression ratio is much better than real.
+		s.MessageSize = NewTopicMessageSize()
+		s.MessageSize.PutRatio("", "test", 1, 1000)
+
+		p := url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+			"offset":    []string{tc.offset},
+			"limit":     []string{tc.limit},
+		}
+
+		rec := httptest.NewRecorder()
+
+		s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?"+p.Encode(), nil), &p)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s/%s: expected %d, got %d: %s", tc.offset, tc.limit, http.StatusOK, rec.Code, rec.Body.String())
+		}
+
+		var res struct {
+			Data struct {
+				Messages json.RawMessage `json:"messages"`
+			} `json:"data"`
+		}
+
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s/%s: unable to decode response: %v: %s", tc.offset, tc.limit, err, rec.Body.String())
+		}
+
+		if string(res.Data.Messages) != tc.expected {
+			t.Fatalf("%s/%s: unexpected messages: %s", tc.offset, tc.limit, res.Data.Messages)
+		}
+	}
+
+	if n := s.Stats.FetchResizes.Count(); n != int64(len(testCases)) {
+		t.Fatalf("expected %d values of fetch resizes, got %d", len(testCases), n)
+	}
+
+	if s.Stats.FetchResizes.Percentile(1) == 0 {
+		t.Fatalf("expected fetch resizes to be recorded")
+	}
+}
+
+// slowResponseWriter delays every write to emulate the slow client.
+type slowResponseWriter struct {
+	*httptest.ResponseRecorder
+
+	delay   time.Duration
+	onWrite func()
+}
+
+func (w *slowResponseWriter) Write(b []byte) (int, error) {
+	w.onWrite()
+	time.Sleep(w.delay)
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestGetHandlerSlowClient(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		var msgs []*proto.Message
+		for i := req.Topics[0].Partitions[0].FetchOffset; i < 10; i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Value: []byte(fmt.Sprintf(`{"a":%d}`, i))})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 10, Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Consumer.SlowWriteThreshold.Duration = time.Millisecond
+
+	writes := 0
+	busyWrites := 0
+
+	rec := &slowResponseWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		delay:            5 * time.Millisecond,
+		onWrite: func() {
+			// The beginning of response and the first message are written
+			// while the broker is in use.
+			if writes++; writes > 6 && s.Client.FreeBrokers() == 0 {
+				busyWrites++
+			}
+		},
+	}
+
+	p := url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+		"limit":     []string{"5"},
+	}
+
+	s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?limit=5", nil), &p)
+
+	expected := `{"data":{"query":{"topic":"test","partition":0,"offset":5,"limit":5},"messages":[{"a":5},{"a":6},{"a":7},{"a":8},{"a":9}]},"status":"success"}`
+
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if busyWrites > 0 {
+		t.Fatalf("expected the broker to be released for slow client, got %d writes with busy broker", busyWrites)
+	}
+}
+
+func TestGetHandlerSlowClientRecovers(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(0)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		var msgs []*proto.Message
+		for i := req.Topics[0].Partitions[0].FetchOffset; i < 10; i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Value: []byte(fmt.Sprintf(`{"a":%d}`, i))})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 10, Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Consumer.SlowWriteThreshold.Duration = time.Millisecond
+
+	// Every message of slow client is a chunk of its own.
+	s.Config().Consumer.MinFetchSize = 1
+	s.Config().Consumer.DefaultFetchSize = 1
+	s.Config().Consumer.MaxFetchSize = 1
+
+	writes := 0
+	released := false
+	busyWrites := 0
+
+	rec := &slowResponseWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		delay:            5 * time.Millisecond,
+	}
+	rec.onWrite = func() {
+		// The client is slow only at the beginning of response.
+		if writes++; writes > 2 {
+			rec.delay = 0
+		}
+
+		// After the broker was released for slow client, the messages
+		// are written while it's in use only if the client is fast.
+		if s.Client.FreeBrokers() > 0 {
+			released = true
+		} else if released {
+			busyWrites++
+		}
+	}
+
+	p := url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+		"limit":     []string{"10"},
+	}
+
+	s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?limit=10", nil), &p)
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `{"a":0},{"a":1}`) || !strings.Contains(rec.Body.String(), `{"a":9}]`) {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if busyWrites == 0 {
+		t.Fatalf("expected the messages to be streamed again after the client became fast")
+	}
+}
+
+func TestGetHandlerMaxResponseTime(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		var msgs []*proto.Message
+		for i := req.Topics[0].Partitions[0].FetchOffset; i < 10; i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Value: []byte(fmt.Sprintf(`{"a":%d}`, i))})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 10, Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Global.MaxResponseTime.Duration = 50 * time.Millisecond
+	s.Config().Consumer.SlowWriteThreshold.Duration = 0
+
+	rec := &slowResponseWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		delay:            10 * time.Millisecond,
+		onWrite:          func() {},
+	}
+
+	p := url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+		"limit":     []string{"5"},
+	}
+
+	s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?limit=5", nil), &p)
+
+	var res struct {
+		Data struct {
+			Messages  []json.RawMessage `json:"messages"`
+			Truncated bool              `json:"truncated"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("unable to decode response: %s: %s", err, rec.Body.String())
+	}
+
+	if !res.Data.Truncated || len(res.Data.Messages) == 0 || len(res.Data.Messages) >= 5 {
+		t.Fatalf("expected truncated response: %s", rec.Body.String())
+	}
+}
+
+func TestGetHandlerRequestDeadline(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		var msgs []*proto.Message
+		for i := req.Topics[0].Partitions[0].FetchOffset; i < 10; i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Value: []byte(fmt.Sprintf(`{"a":%d}`, i))})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 10, Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Consumer.SlowWriteThreshold.Duration = 0
+
+	// The deadline of request expires while the messages are written.
+	deadline := time.Now().Add(200 * time.Millisecond)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	rec := &slowResponseWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		delay:            10 * time.Millisecond,
+	}
+	rec.onWrite = func() {
+		if rec.Body.Len() > 0 {
+			time.Sleep(time.Until(deadline))
+		}
+	}
+
+	p := url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+		"limit":     []string{"5"},
+	}
+
+	r := httptest.NewRequest("GET", "/v1/topics/test/0?limit=5", nil).WithContext(ctx)
+
+	s.getHandler(&HTTPResponse{ResponseWriter: rec, deadline: deadline}, r, &p)
+
+	var res struct {
+		Data struct {
+			Messages  []json.RawMessage `json:"messages"`
+			Truncated bool              `json:"truncated"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("unable to decode response: %s: %s", err, rec.Body.String())
+	}
+
+	if !res.Data.Truncated || len(res.Data.Messages) == 0 || len(res.Data.Messages) >= 5 {
+		t.Fatalf("expected truncated response: %s", rec.Body.String())
+	}
+}
+
+// testLogHook collects the error messages of log.
+type testLogHook struct {
+	sync.Mutex
+	messages []string
+}
+
+func (h *testLogHook) Levels() []log.Level {
+	return []log.Level{log.ErrorLevel}
+}
+
+func (h *testLogHook) Fire(e *log.Entry) error {
+	h.Lock()
+	defer h.Unlock()
+	h.messages = append(h.messages, e.Message)
+	return nil
+}
+
+func TestGetHandlerDeadlineNotLogged(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		// The rest of messages is never returned.
+		if req.Topics[0].Partitions[0].FetchOffset >= 7 {
+			return nil
+		}
+
+		var msgs []*proto.Message
+		for i := req.Topics[0].Partitions[0].FetchOffset; i < 7; i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Value: []byte(fmt.Sprintf(`{"a":%d}`, i))})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 10, Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	hook := &testLogHook{}
+
+	hooks := log.StandardLogger().Hooks
+	log.StandardLogger().Hooks = make(log.LevelHooks)
+	log.AddHook(hook)
+	defer func() { log.StandardLogger().Hooks = hooks }()
+
+	p := url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+		"limit":     []string{"5"},
+		"deadline":  []string{"200ms"},
+	}
+
+	rec := httptest.NewRecorder()
+	s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?"+p.Encode(), nil), &p)
+
+	var res struct {
+		Data struct {
+			Messages  []json.RawMessage `json:"messages"`
+			Truncated bool              `json:"truncated"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("unable to decode response: %s: %s", err, rec.Body.String())
+	}
+
+	if rec.Code != http.StatusOK || !res.Data.Truncated || len(res.Data.Messages) != 2 {
+		t.Fatalf("expected truncated response: %d: %s", rec.Code, rec.Body.String())
+	}
+
+	hook.Lock()
+	defer hook.Unlock()
+
+	for _, msg := range hook.messages {
+		if strings.Contains(msg, "Read timeout") {
+			t.Fatalf("expected no error log of read timeout at deadline, got %q", msg)
+		}
+	}
+}
+
+func TestGetHandlerTopicConsumers(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	var requests int32
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		atomic.AddInt32(&requests, 1)
+
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Consumer.MaxTopicConsumers = 1
+
+	if !s.Consumers.Acquire("test", 1) {
+		t.Fatalf("unable to acquire consumer")
+	}
+
+	p := url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	}
+
+	rec := httptest.NewRecorder()
+
+	s.getHandler(&HTTPResponse{ResponseWriter: rec, client: s.Client}, httptest.NewRequest("GET", "/v1/topics/test/0", nil), &p)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if v := rec.Header().Get("Retry-After"); v != "1" {
+		t.Fatalf("unexpected Retry-After: %q", v)
+	}
+
+	if n := s.Consumers.Info()["test"]; n != 1 {
+		t.Fatalf("expected 1 consumer, got %d", n)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("expected no offset requests of rejected consumer, got %d", n)
+	}
+}
+
+func TestSendHandlerTopicNamePattern(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	if err := s.Config().Broker.TopicNamePattern.UnmarshalText([]byte("^team-")); err != nil {
+		t.Fatalf("unable to parse pattern: %s", err)
+	}
+
+	r := httptest.NewRequest("POST", "/v1/topics/test/0", bytes.NewBufferString(`{"a":1}`))
+	rec := httptest.NewRecorder()
+	w := &HTTPResponse{ResponseWriter: rec}
+
+	s.sendHandler(w, r, &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	})
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if !strings.Contains(rec.Body.String(), `^team-`) {
+		t.Fatalf("expected pattern in response: %s", rec.Body.String())
+	}
+}
+
+func TestUnderReplicatedHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		host, port := srv.HostPort()
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1, 2, 3}, Isrs: []int32{1, 3}},
+						{ID: 1, Leader: 1, Replicas: []int32{1, 2}, Isrs: []int32{1, 2}},
+					},
+				},
+				{
+					Name: "other",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: -1, Replicas: []int32{2}, Err: proto.ErrLeaderNotAvailable},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	rec := httptest.NewRecorder()
+	s.getUnderReplicatedHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/info/under-replicated", nil), &url.Values{})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	expected := `{"data":[` +
+		`{"topic":"other","partition":0,"leader":-1,"replicas":[2],"isrs":[]},` +
+		`{"topic":"test","partition":0,"leader":1,"replicas":[1,2,3],"isrs":[1,3]}` +
+		`],"status":"success"}`
+	if rec.Body.String() != expected {
+		t.Fatalf("unexpected response: %s", rec.Body.String())
+	}
+}
+
+func TestTopicAllowlist(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Broker.TopicAllowlist = []CfgTopicPattern{{Pattern: "team-*"}}
+
+	rec := httptest.NewRecorder()
+	s.getTopicListHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics", nil), &url.Values{})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if expected := `{"data":[],"status":"success"}`; rec.Body.String() != expected {
+		t.Fatalf("unexpected response: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.getTopicInfoHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/info/topics/test", nil), &url.Values{
+		"topic": []string{"test"},
+	})
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/0", bytes.NewBufferString(`{"a":1}`)), &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	})
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTopicListPagination(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		host, port := srv.HostPort()
+
+		resp := &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+			},
+		}
+		for _, name := range []string{"team-c", "other", "team-a", "team-b"} {
+			resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
+				Name: name,
+				Partitions: []proto.MetadataRespPartition{
+					{ID: 0, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}},
+				},
+			})
+		}
+		return resp
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	testCases := []struct {
+		params url.Values
+		code   int
+		topics string
+		total  string
+	}{
+		{url.Values{}, http.StatusOK, "other,team-a,team-b,team-c", "4"},
+		{url.Values{"prefix": {"team-"}}, http.StatusOK, "team-a,team-b,team-c", "3"},
+		{url.Values{"prefix": {"team-"}, "offset": {"1"}, "limit": {"1"}}, http.StatusOK, "team-b", "3"},
+		{url.Values{"prefix": {"team-"}, "offset": {"5"}}, http.StatusOK, "", "3"},
+		{url.Values{"limit": {"0"}}, http.StatusOK, "", "4"},
+		{url.Values{"limit": {"-1"}}, http.StatusBadRequest, "", ""},
+		{url.Values{"offset": {"x"}}, http.StatusBadRequest, "", ""},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		s.getTopicListHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/info/topics?"+tc.params.Encode(), nil), &tc.params)
+
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected status %d, got %d: %s", tc.params, tc.code, rec.Code, rec.Body.String())
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+
+		var resp struct {
+			Data []responseTopicListInfo `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%v: unable to parse response: %v", tc.params, err)
+		}
+
+		var topics []string
+		for _, info := range resp.Data {
+			topics = append(topics, info.Topic)
+		}
+
+		if got := strings.Join(topics, ","); got != tc.topics {
+			t.Fatalf("%v: expected topics %q, got %q", tc.params, tc.topics, got)
+		}
+		if got := rec.Header().Get("X-Total-Count"); got != tc.total {
+			t.Fatalf("%v: expected total %s, got %s", tc.params, tc.total, got)
+		}
+	}
+}
+
+func TestSendHandlerRouting(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	keys := make(chan string, 1)
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		part := req.Topics[0].Partitions[0]
+		keys <- string(part.Messages[0].Key)
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: part.ID, Offset: 7},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Routing = map[string]*struct {
+		Route []CfgRoute
+	}{
+		"test": {Route: []CfgRoute{{Prefix: "tenant-", Partition: 0}}},
+	}
+
+	rec := httptest.NewRecorder()
+
+	s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test?key=tenant-a", bytes.NewBufferString(`{"a":1}`)), &url.Values{
+		"topic": []string{"test"},
+		"key":   []string{"tenant-a"},
+	})
+
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Kafka-Partition") != "0" {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if key := <-keys; key != "tenant-a" {
+		t.Fatalf("expected key tenant-a, got %q", key)
+	}
+
+	checksum := fmt.Sprintf(`"crc32":"%08x"`, crc32.ChecksumIEEE([]byte(`{"a":1}`)))
+	if !strings.Contains(rec.Body.String(), checksum) {
+		t.Fatalf("expected %s in response: %s", checksum, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+
+	s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test", bytes.NewBufferString(`{"a":1}`)), &url.Values{
+		"topic": []string{"test"},
+	})
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	var offset int64
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		part := req.Topics[0].Partitions[0]
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: part.ID, Offset: atomic.AddInt64(&offset, 1)},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	rec := httptest.NewRecorder()
+
+	body := "{\"a\":1}\n\n{\"a\":\n{\"a\":2}"
+
+	s.streamHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/produce?partition=0", bytes.NewBufferString(body)), &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	})
+
+	expected := fmt.Sprintf("{\"topic\":\"test\",\"partition\":0,\"offset\":1,\"crc32\":\"%08x\"}\n", crc32.ChecksumIEEE([]byte(`{"a":1}`))) +
+		"{\"code\":400,\"message\":\"Message must be JSON\"}\n" +
+		fmt.Sprintf("{\"topic\":\"test\",\"partition\":0,\"offset\":2,\"crc32\":\"%08x\"}\n", crc32.ChecksumIEEE([]byte(`{"a":2}`)))
+
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if n := s.Client.FreeBrokers(); n != 1 {
+		t.Fatalf("expected the broker to be released, got %d free", n)
+	}
+}
+
+func TestStreamHandlerFullDuplex(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	var offset int64
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		part := req.Topics[0].Partitions[0]
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: part.ID, Offset: atomic.AddInt64(&offset, 1)},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.streamHandler(&HTTPResponse{ResponseWriter: w}, r, &url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		})
+	}))
+	defer ts.Close()
+
+	body, stream := io.Pipe()
+	defer stream.Close()
+
+	go stream.Write([]byte("{\"a\":1}\n"))
+
+	resp, err := http.Post(ts.URL, "application/x-ndjson", body)
+	if err != nil {
+		t.Fatalf("unable to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	results := bufio.NewReader(resp.Body)
+
+	// The result is returned before the end of request body.
+	line, err := results.ReadString('\n')
+	if err != nil || !strings.Contains(line, `"offset":1`) {
+		t.Fatalf("unexpected first result %q: %v", line, err)
+	}
+
+	stream.Write([]byte("{\"a\":2}\n"))
+	stream.Close()
+
+	line, err = results.ReadString('\n')
+	if err != nil || !strings.Contains(line, `"offset":2`) {
+		t.Fatalf("unexpected second result %q: %v", line, err)
+	}
+}
+
+func TestStreamHandlerLeaderRetry(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	var produced int32
+
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+
+		part := proto.ProduceRespPartition{ID: 0, Offset: 42}
+		if atomic.AddInt32(&produced, 1) == 1 {
+			part = proto.ProduceRespPartition{ID: 0, Offset: -1, Err: proto.ErrNotLeaderForPartition}
+		}
+
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name:       "test",
+					Partitions: []proto.ProduceRespPartition{part},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Producer.RetryLimit = 1
+
+	rec := httptest.NewRecorder()
+
+	s.streamHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/produce?partition=0", bytes.NewBufferString("{\"a\":1}\n")), &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	})
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"offset":42`) {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The connection with the old metadata is renewed.
+	if n := s.Client.Counters["Reconnects"].Count(); n != 1 {
+		t.Fatalf("expected 1 reconnect, got %d", n)
+	}
+
+	if n := s.Stats.HTTPResponseTime.Get("ProduceStream").Count(); n != 1 {
+		t.Fatalf("expected 1 timing of ProduceStream, got %d", n)
+	}
+}
+
+func TestStreamHandlerBuffered(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	var offset int64
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		part := req.Topics[0].Partitions[0]
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: part.ID, Offset: atomic.AddInt64(&offset, 1)},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	stream := func(body io.Reader) string {
+		rec := httptest.NewRecorder()
+
+		s.streamHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/produce?partition=0", body), &url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		})
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+
+	// The error of body is reported after the results.
+	res := stream(io.MultiReader(strings.NewReader("{\"a\":1}\n"), iotest.ErrReader(errors.New("connection reset"))))
+
+	if lines := strings.Split(strings.TrimSpace(res), "\n"); len(lines) != 2 || lines[1] != `{"code":400,"message":"Unable to read body: connection reset"}` {
+		t.Fatalf("unexpected results: %s", res)
+	}
+
+	// The stream stops when the results can't be buffered anymore.
+	s.Config().Consumer.MaxBufferedSize = 10
+
+	res = stream(strings.NewReader("{\"a\":2}\n{\"a\":3}\n"))
+
+	if lines := strings.Split(strings.TrimSpace(res), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"offset":2`) || !strings.Contains(lines[1], `"code":413`) {
+		t.Fatalf("unexpected results: %s", res)
+	}
+
+	if n := atomic.LoadInt64(&offset); n != 2 {
+		t.Fatalf("expected 2 produced messages, got %d", n)
+	}
+}
+func TestSendHandlerDryRun(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	var produced int32
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		atomic.AddInt32(&produced, 1)
+		return nil
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Routing = map[string]*struct {
+		Route []CfgRoute
+	}{
+		"test": {Route: []CfgRoute{{Prefix: "tenant-", Partition: 0}}},
+	}
+
+	rec := httptest.NewRecorder()
+
+	s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test?key=tenant-a&dry_run=true", bytes.NewBufferString(`{"a":1}`)), &url.Values{
+		"topic":   []string{"test"},
+		"key":     []string{"tenant-a"},
+		"dry_run": []string{"true"},
+	})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	expected := fmt.Sprintf(`{"data":{"topic":"test","partition":0,"offset":-1,"crc32":"%08x","key_hash":"%08x","dry_run":true},"status":"success"}`,
+		crc32.ChecksumIEEE([]byte(`{"a":1}`)), keyHash(PartitionerFNV1a, "tenant-a"))
+
+	if rec.Body.String() != expected {
+		t.Fatalf("unexpected response: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+
+	s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/0?dry_run=true", bytes.NewBufferString(`{"a":`)), &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+		"dry_run":   []string{"true"},
+	})
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if n := atomic.LoadInt32(&produced); n != 0 {
+		t.Fatalf("expected no produce requests, got %d", n)
+	}
+}
+
+func TestSendHandlerByContentType(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	values := make(chan []byte, 1)
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		part := req.Topics[0].Partitions[0]
+		values <- part.Messages[0].Value
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: part.ID, Offset: 7},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().ContentType = map[string]*struct{ Topic string }{
+		"application/vnd.events+json": {Topic: "test"},
+		"application/x-protobuf":      {Topic: "test"},
+	}
+
+	send := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v1/topics/any/0?by_content_type=true", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+
+		rec := httptest.NewRecorder()
+		s.sendHandler(&HTTPResponse{ResponseWriter: rec}, r, &url.Values{
+			"topic":           []string{"any"},
+			"partition":       []string{"0"},
+			"by_content_type": []string{"true"},
+		})
+		return rec
+	}
+
+	if rec := send("application/vnd.events+json", []byte("\x08\x96\x01")); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for JSON type, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := send("application/x-protobuf", []byte("\x08\x96\x01"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if v := <-values; string(v) != "\x08\x96\x01" {
+		t.Fatalf("expected binary value, got %q", v)
+	}
+
+	if !strings.Contains(rec.Body.String(), `"topic":"test"`) {
+		t.Fatalf("expected resolved topic in response: %s", rec.Body.String())
+	}
+}
+
+func TestSendHandlerTombstone(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	produced := make(chan *proto.Message, 1)
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		produced <- req.Topics[0].Partitions[0].Messages[0]
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: 42},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	testCases := []struct {
+		params url.Values
+		body   string
+		code   int
+	}{
+		{
+			params: url.Values{"tombstone": []string{"true"}, "key": []string{"k"}},
+			code:   http.StatusOK,
+		},
+		{
+			params: url.Values{"tombstone": []string{"true"}},
+			code:   http.StatusBadRequest,
+		},
+		{
+			params: url.Values{"tombstone": []string{"true"}, "key": []string{"k"}},
+			body:   `{"a":1}`,
+			code:   http.StatusBadRequest,
+		},
+		{
+			params: url.Values{"key": []string{"k"}},
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		p := url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		}
+		for k, v := range tc.params {
+			p[k] = v
+		}
+
+		rec := httptest.NewRecorder()
+
+		s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/0?"+p.Encode(), bytes.NewBufferString(tc.body)), &p)
+
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected %d, got %d: %s", tc.params, tc.code, rec.Code, rec.Body.String())
+		}
+
+		if tc.code != http.StatusOK {
+			continue
+		}
+
+		if expected := `{"data":{"topic":"test","partition":0,"offset":42,"crc32":"00000000","tombstone":true},"status":"success"}`; rec.Body.String() != expected {
+			t.Fatalf("%v: unexpected response: %s", tc.params, rec.Body.String())
+		}
+
+		msg := <-produced
+		if string(msg.Key) != "k" || len(msg.Value) != 0 {
+			t.Fatalf("%v: unexpected message: %q=%q", tc.params, msg.Key, msg.Value)
+		}
+	}
+
+	// The tombstone is consumed as null.
+	value, err := encodeMessage(&proto.Message{Key: []byte("k")}, messageFields{})
+	if err != nil || string(value) != `null` {
+		t.Fatalf("unexpected encoded tombstone: %s: %v", value, err)
+	}
+}
+
+func TestSendHandlerBatch(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	batches := make(chan int, 2)
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		batches <- len(req.Topics[0].Partitions[0].Messages)
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: 42},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	// The concurrent requests need their own connections.
+	if err := s.Client.ResizePool(8); err != nil {
+		t.Fatalf("unable to resize pool: %v", err)
+	}
+
+	s.Config().Producer.BatchLinger.Duration = 5 * time.Second
+	s.Config().Producer.BatchSize = 3
+
+	var wg sync.WaitGroup
+
+	offsets := make(chan int64, 3)
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			p := url.Values{
+				"topic":     []string{"test"},
+				"partition": []string{"0"},
+			}
+			rec := httptest.NewRecorder()
+
+			s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/0", bytes.NewBufferString(`{}`)), &p)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+				return
+			}
+
+			var resp struct {
+				Data kafkaParameters `json:"data"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Errorf("unable to parse response: %v", err)
+				return
+			}
+			offsets <- resp.Data.Offset
+		}()
+	}
+	wg.Wait()
+	close(offsets)
+
+	// The full batch is produced without waiting for the linger.
+	if n := <-batches; n != 3 {
+		t.Fatalf("expected one batch of 3 messages, got %d", n)
+	}
+
+	seen := make(map[int64]bool)
+	for offset := range offsets {
+		seen[offset] = true
+	}
+	if len(seen) != 3 || !seen[42] || !seen[43] || !seen[44] {
+		t.Fatalf("unexpected offsets: %v", seen)
+	}
+
+	// The batch is produced after the linger if it isn't full.
+	s.Config().Producer.BatchLinger.Duration = 10 * time.Millisecond
+
+	p := url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	}
+	rec := httptest.NewRecorder()
+
+	s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/0", bytes.NewBufferString(`{}`)), &p)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := <-batches; n != 1 {
+		t.Fatalf("expected batch of 1 message, got %d", n)
+	}
+}
+
+func TestSendHandlerEnvelope(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	produced := make(chan *proto.Message, 1)
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		produced <- req.Topics[0].Partitions[0].Messages[0]
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: 42},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Producer.Envelope = true
+	s.Config().Producer.EnvelopeMeta = []CfgEnvelopeField{{Name: "remote_addr"}, {Name: "request_id"}}
+
+	r := httptest.NewRequest("POST", "/v1/topics/test/0", bytes.NewBufferString(`{"a":1}`))
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Request-Id", "req-1")
+
+	rec := httptest.NewRecorder()
+	s.sendHandler(&HTTPResponse{ResponseWriter: rec}, r, &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	expected := `{"meta":{"remote_addr":"192.0.2.1","request_id":"req-1"},"payload":{"a":1}}`
+
+	if msg := <-produced; string(msg.Value) != expected {
+		t.Fatalf("unexpected message: %s", msg.Value)
+	}
+
+	// The checksum is of the stored message.
+	if crc := fmt.Sprintf(`"crc32":"%08x"`, crc32.ChecksumIEEE([]byte(expected))); !strings.Contains(rec.Body.String(), crc) {
+		t.Fatalf("expected %s in response: %s", crc, rec.Body.String())
+	}
+}
+
+func TestSendHandlerMinRequiredAcks(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	acks := make(chan int16, 1)
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		acks <- req.RequiredAcks
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: 42},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Producer.RequiredAcks.Value = proto.RequiredAcksLocal
+	s.Config().Topic = map[string]*struct {
+		DefaultFetchSize int32
+		MaxFetchSize     int32
+		MinRequiredAcks  CfgRequiredAcks
+	}{
+		"test": {MinRequiredAcks: CfgRequiredAcks{Value: proto.RequiredAcksAll}},
+	}
+
+	testCases := []struct {
+		acks     string
+		code     int
+		produced int16
+	}{
+		{"none", http.StatusBadRequest, 0},
+		{"1", http.StatusBadRequest, 0},
+		{"all", http.StatusOK, proto.RequiredAcksAll},
+		// The default level is raised to the minimum of topic.
+		{"", http.StatusOK, proto.RequiredAcksAll},
+	}
+
+	for _, tc := range testCases {
+		p := url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		}
+		if tc.acks != "" {
+			p.Set("acks", tc.acks)
+		}
+
+		rec := httptest.NewRecorder()
+		s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/0?"+p.Encode(), bytes.NewBufferString(`{}`)), &p)
+
+		if rec.Code != tc.code {
+			t.Fatalf("%q: expected status %d, got %d: %s", tc.acks, tc.code, rec.Code, rec.Body.String())
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if v := <-acks; v != tc.produced {
+			t.Fatalf("%q: expected acks %d, got %d", tc.acks, tc.produced, v)
+		}
+	}
+}
+
+func TestSendHandlerAcksNone(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		return nil
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	p := url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+		"acks":      []string{"none"},
+	}
+
+	rec := httptest.NewRecorder()
+	s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/0?"+p.Encode(), bytes.NewBufferString(`{}`)), &p)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The offset is unknown without acknowledgment.
+	if v := rec.Header().Get("X-Kafka-Offset"); v != "-1" {
+		t.Fatalf("expected offset -1, got %q: %s", v, rec.Body.String())
+	}
+}
+
+func TestSendBatchHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	produced := make(chan []*proto.Message, 3)
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		produced <- req.Topics[0].Partitions[0].Messages
+
+		// The request with too large message is rejected as a whole.
+		var err error
+		for _, msg := range req.Topics[0].Partitions[0].Messages {
+			if len(msg.Value) > 10 {
+				err = proto.ErrMessageSizeTooLarge
+			}
+		}
+
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: 42, Err: err},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Producer.RetryLimit = 1
+
+	send := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.sendBatchHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/0/batch", bytes.NewBufferString(body)), &url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		})
+		return rec
+	}
+
+	rec := send(`[{"key":"a","value":{"a":1}},{"value":[2]}]`)
+
+	if expected := `{"data":[{"topic":"test","partition":0,"offset":42,"crc32":"` + fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(`{"a":1}`))) +
+		`","success":true},{"topic":"test","partition":0,"offset":43,"crc32":"` + fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(`[2]`))) +
+		`","success":true}],"status":"success"}`; rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	msgs := <-produced
+	if len(msgs) != 2 || string(msgs[0].Key) != "a" || msgs[1].Key != nil {
+		t.Fatalf("expected 2 messages in one request, got %+v", msgs)
+	}
+
+	// The invalid message is skipped and the rest is produced.
+	rec = send(`[{"key":"a"},{"value":{"b":2}}]`)
+
+	var resp struct {
+		Data []produceBatchResult `json:"data"`
+	}
+
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("expected status 207, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unable to parse response: %v", err)
+	}
+	if r := resp.Data; len(r) != 2 || r[0].Success || r[0].Code != http.StatusBadRequest || !r[1].Success || r[1].Offset != 42 {
+		t.Fatalf("unexpected results: %+v", r)
+	}
+	if msgs := <-produced; len(msgs) != 1 {
+		t.Fatalf("expected 1 produced message, got %d", len(msgs))
+	}
+
+	// Only the too large message fails, the rest is sent again alone.
+	rec = send(`[{"value":1},{"value":"too large message"}]`)
+
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("expected status 207, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp.Data = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unable to parse response: %v", err)
+	}
+	if r := resp.Data; len(r) != 2 || !r[0].Success || r[0].Offset != 42 || r[1].Success || r[1].Error == "" || r[1].Offset != -1 {
+		t.Fatalf("unexpected results: %+v", r)
+	}
+	for _, n := range []int{2, 1, 1} {
+		if msgs := <-produced; len(msgs) != n {
+			t.Fatalf("expected %d produced messages, got %d", n, len(msgs))
+		}
+	}
+
+	for _, body := range []string{`{"value":1}`, `[]`} {
+		if rec := send(body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status 400, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestResetMetricsHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Stats.HTTPStatus[200].Inc(1)
+	s.Stats.HTTPResponseTime.Get("GET").Update(time.Second)
+	s.Client.Timings.Get("GetMetadata").Update(time.Second)
+	s.Client.Counters["FetchRetries"].Inc(1)
+
+	alive := s.Client.AliveBrokers()
+
+	rec := httptest.NewRecorder()
+	s.resetMetricsHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/admin/metrics/reset", nil), &url.Values{})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The successful response itself is counted after reset.
+	if n := s.Stats.HTTPStatus[200].Count(); n != 1 {
+		t.Fatalf("expected 1 response, got %d", n)
+	}
+
+	if n := s.Stats.HTTPResponseTime.Get("GET").Count(); n != 0 {
+		t.Fatalf("expected empty timer, got %d", n)
+	}
+
+	if n := s.Client.Timings.Get("GetMetadata").Count(); n != 0 {
+		t.Fatalf("expected empty client timer, got %d", n)
+	}
+
+	if n := s.Client.Counters["FetchRetries"].Count(); n != 0 {
+		t.Fatalf("expected no retries, got %d", n)
+	}
+
+	if n := s.Client.AliveBrokers(); n != alive {
+		t.Fatalf("pool counters were reset: %d != %d", n, alive)
+	}
+}
+
+func TestGetHandlerConsumer(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	committed := int64(7)
+	commits := make(chan int64, 1)
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		var msgs []*proto.Message
+		for i := req.Topics[0].Partitions[0].FetchOffset; i < 10; i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Value: []byte(fmt.Sprintf(`{"a":%d}`, i))})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 10, Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(ConsumerMetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ConsumerMetadataReq)
+		host, port := srv.HostPort()
+		return &proto.ConsumerMetadataResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+	srv.Handle(OffsetFetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetFetchReq)
+		return &proto.OffsetFetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetFetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetFetchRespPartition{
+						{ID: 0, Offset: atomic.LoadInt64(&committed)},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(OffsetCommitRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetCommitReq)
+		commits <- req.Topics[0].Partitions[0].Offset
+		return &proto.OffsetCommitResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetCommitRespTopic{
+				{
+					Name:       "test",
+					Partitions: []proto.OffsetCommitRespPartition{{ID: 0}},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	get := func(params url.Values) *httptest.ResponseRecorder {
+		p := url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+			"consumer":  []string{"group"},
+		}
+		for k, v := range params {
+			p[k] = v
+		}
+
+		rec := httptest.NewRecorder()
+		s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?"+p.Encode(), nil), &p)
+		return rec
+	}
+
+	rec := get(url.Values{"limit": []string{"2"}, "commit": []string{"true"}, "commit_wait": []string{"true"}})
+
+	expected := `{"data":{"query":{"topic":"test","partition":0,"offset":7,"limit":2,"consumer":"group"},"messages":[{"a":7},{"a":8}],"committed":true},"status":"success"}`
+
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if offset := <-commits; offset != 9 {
+		t.Fatalf("expected commit of offset 9, got %d", offset)
+	}
+
+	// The committed messages are removed by retention.
+	atomic.StoreInt64(&committed, 3)
+
+	rec = get(nil)
+
+	expected = `{"data":{"query":{"topic":"test","partition":0,"offset":5,"limit":1,"clamped":true,"consumer":"group"},"messages":[{"a":5}]},"status":"success"}`
+
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The group has read everything.
+	atomic.StoreInt64(&committed, 10)
+
+	rec = get(nil)
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"messages":[]`) {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = get(url.Values{"offset": []string{"5"}})
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPoolStatusHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	poolStatus := func() string {
+		rec := httptest.NewRecorder()
+		s.getPoolStatusHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/status/pool", nil), &url.Values{})
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+
+	expected := `{"data":{"size":1,"free":1,"dead":0,"reconnecting":0,"reconnects":0,"reconnect_errors":0},"status":"success"}`
+
+	if res := poolStatus(); res != expected {
+		t.Fatalf("unexpected status: %s", res)
+	}
+
+	brokerID, err := s.Client.getBroker()
+	if err != nil {
+		t.Fatalf("unable to get broker: %s", err)
+	}
+	s.Client.deadBroker(brokerID)
+
+	expected = `{"data":{"size":1,"free":1,"dead":0,"reconnecting":0,"reconnects":1,"reconnect_errors":0},"status":"success"}`
+
+	var res string
+
+	for i := 0; i < 100; i++ {
+		if res = poolStatus(); res == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("unexpected status after reconnect: %s", res)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, spanID, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spanID != "00f067aa0ba902b7" {
+		t.Fatalf("unexpected result: %q %q %v", traceID, spanID, ok)
+	}
+
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+	} {
+		if _, _, ok := parseTraceparent(value); ok {
+			t.Fatalf("%q: expected invalid header", value)
+		}
+	}
+}
+
+func TestErrorResponseRetryAfter(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	errorResponse := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.errorResponse(&HTTPResponse{ResponseWriter: rec, client: s.Client}, http.StatusServiceUnavailable, "no brokers available")
+		return rec
+	}
+
+	if rec := errorResponse(); rec.Header().Get("Retry-After") != "" {
+		t.Fatalf("unexpected Retry-After with free brokers: %s", rec.Header().Get("Retry-After"))
+	}
+
+	brokerID, err := s.Client.getBroker()
+	if err != nil {
+		t.Fatalf("unable to get broker: %s", err)
+	}
+	defer s.Client.freeBroker(brokerID)
+
+	if rec := errorResponse(); rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("unexpected Retry-After: %q", rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestSendHandlerRequestTimeout(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		return nil
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	send := func(timeout string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v1/topics/test/0", bytes.NewBufferString(`{"a":1}`))
+		r.Header.Set("X-Request-Timeout", timeout)
+
+		rec := httptest.NewRecorder()
+		s.sendHandler(&HTTPResponse{ResponseWriter: rec}, r, &url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		})
+		return rec
+	}
+
+	start := time.Now()
+
+	// The broker never responds, so the request fails by the timeout of
+	// header instead of Producer.SendMessageTimeout.
+	if rec := send("100ms"); rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status 504, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("expected the request to fail by the timeout of header, took %s", d)
+	}
+
+	if rec := send("bad"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCorsHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	request := func(method string, origin string) (*httptest.ResponseRecorder, bool) {
+		r := httptest.NewRequest(method, "/v1/topics/test/0", nil)
+		r.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+			r.Header.Set("Access-Control-Request-Headers", "Content-Type")
+		}
+
+		rec := httptest.NewRecorder()
+		done := s.corsHandler(&HTTPResponse{ResponseWriter: rec}, r)
+		return rec, done
+	}
+
+	// CORS is disabled by default.
+	if rec, done := request("OPTIONS", "http://example.com"); done || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("unexpected CORS response: %v", rec.Header())
+	}
+
+	s.Config().CORS.Enabled = true
+	s.Config().CORS.AllowOrigin = []string{"http://example.com"}
+
+	rec, done := request("OPTIONS", "http://example.com")
+	if !done || rec.Code != http.StatusNoContent {
+		t.Fatalf("expected preflight response 204, got %d", rec.Code)
+	}
+
+	for name, value := range map[string]string{
+		"Access-Control-Allow-Origin":  "http://example.com",
+		"Access-Control-Allow-Methods": "GET, POST, PUT",
+		"Access-Control-Allow-Headers": "Content-Type",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if v := rec.Header().Get(name); v != value {
+			t.Fatalf("expected %s: %q, got %q", name, value, v)
+		}
+	}
+
+	// The actual request is handled as usual with the header of origin.
+	if rec, done := request("GET", "http://example.com"); done || rec.Header().Get("Access-Control-Allow-Origin") != "http://example.com" {
+		t.Fatalf("unexpected CORS response: %v", rec.Header())
+	}
+
+	if rec, done := request("OPTIONS", "http://other.com"); done || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("unexpected CORS response for unknown origin: %v", rec.Header())
+	}
+}
+
+func TestGraphiteReporter(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer ln.Close()
+
+	lines := make(chan []string, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var res []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			res = append(res, scanner.Text())
+		}
+		lines <- res
+	}()
+
+	s.Config().Metrics.GraphiteAddress = ln.Addr().String()
+	s.Config().Metrics.GraphiteInterval.Duration = time.Second
+
+	s.Stats.HTTPStatus[200].Inc(1)
+
+	g := NewGraphiteReporter(s)
+	if err := g.report(time.Unix(100, 0)); err != nil {
+		t.Fatalf("unable to report: %s", err)
+	}
+
+	sent := make(map[string]bool)
+	for _, line := range <-lines {
+		sent[line] = true
+	}
+
+	for _, line := range []string{
+		"kafka-http-proxy.kafka.counters.AliveBrokers 1 100",
+		"kafka-http-proxy.kafka.timings.GetMetadata.count 0 100",
+		"kafka-http-proxy.status.200 1 100",
+		"kafka-http-proxy.response.GET.count 0 100",
+	} {
+		if !sent[line] {
+			t.Fatalf("expected %q in report: %v", line, sent)
+		}
+	}
+
+	// The reporter is stopped before the first report.
+	g = NewGraphiteReporter(s)
+	g.Start()
+	g.Stop()
+}
+
+func TestRequestDeadline(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Global.TotalRequestTimeout.Duration = time.Minute
+
+	testCases := []struct {
+		header  string
+		timeout time.Duration
+	}{
+		{"", time.Minute},
+		{"2s", 2 * time.Second},
+		{"1h", s.Config().Global.MaxRequestTimeout.Duration},
+		{"bad", time.Minute},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", "/v1/topics/test/0", nil)
+		if tc.header != "" {
+			r.Header.Set("X-Request-Timeout", tc.header)
+		}
+
+		deadline := s.requestDeadline(r)
+
+		if d := time.Until(deadline); d > tc.timeout || d < tc.timeout-time.Second {
+			t.Fatalf("%q: expected timeout %s, got %s", tc.header, tc.timeout, d)
+		}
+	}
+
+	// The timeouts of operations are cut to the time left.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	cfg, ok := s.requestConfig(&HTTPResponse{ResponseWriter: httptest.NewRecorder()}, httptest.NewRequest("GET", "/v1/topics/test/0", nil).WithContext(ctx))
+	if !ok {
+		t.Fatalf("unexpected failure of request config")
+	}
+
+	if d := cfg.Consumer.GetMessageTimeout.Duration; d > time.Second {
+		t.Fatalf("expected GetMessageTimeout to be cut, got %s", d)
+	}
+
+	if d := cfg.OffsetCoordinator.CommitOffsetTimeout.Duration; d > time.Second {
+		t.Fatalf("expected CommitOffsetTimeout to be cut, got %s", d)
+	}
+
+	// The request is over.
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+
+	rec := httptest.NewRecorder()
+
+	if _, ok := s.requestConfig(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0", nil).WithContext(ctx)); ok || rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status 504, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The failure of Kafka is reported as timeout after the deadline.
+	rec = httptest.NewRecorder()
+
+	s.errorResponse(&HTTPResponse{ResponseWriter: rec, deadline: time.Now()}, http.StatusServiceUnavailable, "Read timeout")
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status 504, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPrefersPlainText(t *testing.T) {
+	testCases := []struct {
+		accept string
+		plain  bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{"text/plain", true},
+		{"text/*", true},
+		{"text/plain;q=0.5, application/json", false},
+		{"text/plain, application/json;q=0.5", true},
+		{"text/html, */*;q=0.1", false},
+		{"text/*;q=0.9, text/plain;q=0", false},
+	}
+
+	for _, tc := range testCases {
+		if plain := prefersPlainText(tc.accept); plain != tc.plain {
+			t.Fatalf("%q: expected %v, got %v", tc.accept, tc.plain, plain)
+		}
+	}
+}
+
+func TestErrorResponsePlainText(t *testing.T) {
+	s := &Server{Stats: NewMetricStats()}
+
+	r := httptest.NewRequest("GET", "/v1/topics/test/0", nil)
+	r.Header.Set("Accept", "text/plain")
+
+	rec := httptest.NewRecorder()
+	s.errorResponse(newHTTPResponse(rec, r), http.StatusNotFound, "Topic %s not found", "test")
+
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "Topic test not found\n" {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("unexpected Content-Type: %s", ct)
+	}
+
+	rec = httptest.NewRecorder()
+	s.errorResponse(newHTTPResponse(rec, httptest.NewRequest("GET", "/v1/topics/test/0", nil)), http.StatusNotFound, "Not found")
+
+	if rec.Body.String() != `{"data":{"code":404,"message":"Not found"},"status":"error"}` {
+		t.Fatalf("unexpected response: %s", rec.Body.String())
+	}
+}
+
+func TestPartitionInfoHandlerEmpty(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{0}},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	rec := httptest.NewRecorder()
+	s.getPartitionInfoHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/info/topics/test/0", nil), &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The offsets of empty partition are zeros, not missing.
+	for _, field := range []string{`"highwatermark":0`, `"logstartoffset":0`} {
+		if !strings.Contains(rec.Body.String(), field) {
+			t.Fatalf("expected %s in response: %s", field, rec.Body.String())
+		}
+	}
+}
+
+func TestPartitionOffsetsHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	var fetches int32
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		atomic.AddInt32(&fetches, 1)
+		return nil
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	get := func(partition string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.getPartitionOffsetsHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/"+partition+"/offsets", nil), &url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{partition},
+		})
+		return rec
+	}
+
+	rec := get("0")
+
+	expected := `{"data":{"topic":"test","partition":0,"offsetfrom":5,"offsetto":10},"status":"success"}`
+
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The offsets are read without consuming.
+	if n := atomic.LoadInt32(&fetches); n != 0 {
+		t.Fatalf("expected no fetch requests, got %d", n)
+	}
+
+	if rec := get("7"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,150 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type idempotencyEntry struct {
+	key     string
+	expires time.Time
+	result  kafkaParameters
+
+	// pending is true while the request which has reserved the key is
+	// producing the message.
+	pending bool
+
+	// timeout is the error of request which has timed out. The message may
+	// or may not be stored, so it is not produced again.
+	timeout *KhpError
+}
+
+// IdempotencyCache keeps results of recent produce requests by client supplied keys.
+type IdempotencyCache struct {
+	sync.Mutex
+
+	TTL     time.Duration
+	MaxSize int
+
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// NewIdempotencyCache creates new IdempotencyCache object.
+func NewIdempotencyCache(ttl time.Duration, maxSize int) *IdempotencyCache {
+	return &IdempotencyCache{
+		TTL:     ttl,
+		MaxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Enabled returns true if produce requests should be deduplicated.
+func (c *IdempotencyCache) Enabled() bool {
+	return c.TTL > 0 && c.MaxSize > 0
+}
+
+// expire removes outdated entries. The entries have the same TTL, so
+// they expire in the order of insertion.
+func (c *IdempotencyCache) expire(now time.Time) {
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		entry := e.Value.(*idempotencyEntry)
+		if c.order.Len() <= c.MaxSize && now.Before(entry.expires) {
+			break
+		}
+		c.order.Remove(e)
+		delete(c.entries, entry.key)
+	}
+}
+
+// Get returns the result of produce request stored with the key.
+func (c *IdempotencyCache) Get(key string) (kafkaParameters, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.expire(time.Now())
+
+	if e, ok := c.entries[key]; ok {
+		if entry := e.Value.(*idempotencyEntry); !entry.pending && entry.timeout == nil {
+			return entry.result, true
+		}
+	}
+	return kafkaParameters{}, false
+}
+
+// Reserve marks the key as being produced and returns true. If the key is
+// already known, its entry is returned instead, so the concurrent requests
+// with the same key don't produce the message twice.
+func (c *IdempotencyCache) Reserve(key string) (idempotencyEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+
+	if e, ok := c.entries[key]; ok {
+		return *e.Value.(*idempotencyEntry), false
+	}
+
+	c.store(now, &idempotencyEntry{
+		key:     key,
+		pending: true,
+	})
+
+	return idempotencyEntry{}, true
+}
+
+// Release forgets the reserved key if the message is not stored, so the
+// request can be repeated.
+func (c *IdempotencyCache) Release(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok && e.Value.(*idempotencyEntry).pending {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// Put stores the result of produce request with the key.
+func (c *IdempotencyCache) Put(key string, result kafkaParameters) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.store(time.Now(), &idempotencyEntry{
+		key:    key,
+		result: result,
+	})
+}
+
+// PutTimeout stores the write timeout of produce request with the key.
+func (c *IdempotencyCache) PutTimeout(key string, result kafkaParameters, e KhpError) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.store(time.Now(), &idempotencyEntry{
+		key:     key,
+		result:  result,
+		timeout: &e,
+	})
+}
+
+func (c *IdempotencyCache) store(now time.Time, entry *idempotencyEntry) {
+	if e, ok := c.entries[entry.key]; ok {
+		c.order.Remove(e)
+	}
+
+	entry.expires = now.Add(c.TTL)
+	c.entries[entry.key] = c.order.PushBack(entry)
+
+	c.expire(now)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	cache := NewIdempotencyCache(time.Hour, 2)
+
+	if !cache.Enabled() {
+		t.Fatalf("cache should be enabled")
+	}
+
+	cache.Put("a", kafkaParameters{Topic: "test", Partition: 1, Offset: 10})
+	cache.Put("b", kafkaParameters{Topic: "test", Partition: 1, Offset: 11})
+
+	res, ok := cache.Get("a")
+	if !ok || res.Offset != 10 {
+		t.Fatalf("expected offset 10, got %#v", res)
+	}
+
+	cache.Put("c", kafkaParameters{Topic: "test", Partition: 1, Offset: 12})
+
+	if _, ok := cache.Get("a"); ok {
+		t.Fatalf("oldest key should be evicted")
+	}
+
+	if res, ok := cache.Get("c"); !ok || res.Offset != 12 {
+		t.Fatalf("expected offset 12, got %#v", res)
+	}
+}
+
+func TestIdempotencyCacheExpire(t *testing.T) {
+	cache := NewIdempotencyCache(10*time.Millisecond, 10)
+
+	cache.Put("a", kafkaParameters{Topic: "test", Partition: 1, Offset: 10})
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := cache.Get("a"); ok {
+		t.Fatalf("key should be expired")
+	}
+}
+
+func TestIdempotencyCacheReserve(t *testing.T) {
+	cache := NewIdempotencyCache(time.Hour, 10)
+
+	if _, ok := cache.Reserve("a"); !ok {
+		t.Fatalf("new key should be reserved")
+	}
+
+	if entry, ok := cache.Reserve("a"); ok || !entry.pending {
+		t.Fatalf("reserved key should be pending, got %#v", entry)
+	}
+
+	if _, ok := cache.Get("a"); ok {
+		t.Fatalf("pending key should have no result")
+	}
+
+	// The failed request can be repeated.
+	cache.Release("a")
+
+	if _, ok := cache.Reserve("a"); !ok {
+		t.Fatalf("released key should be reserved again")
+	}
+
+	cache.PutTimeout("a", kafkaParameters{Topic: "test", Partition: 1}, KhpError{Errno: KhpErrorWriteTimeout, NodeID: 2})
+
+	// The stored result is not released.
+	cache.Release("a")
+
+	entry, ok := cache.Reserve("a")
+	if ok || entry.pending || entry.timeout == nil || entry.timeout.NodeID != 2 || entry.result.Partition != 1 {
+		t.Fatalf("expected write timeout, got %#v", entry)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"github.com/optiopay/kafka/proto"
+
+	"fmt"
+	"io"
+	"time"
+)
+
+// KafkaAPIVersionsReqKind is the ApiVersions request. It is supported
+// since Kafka 0.10.0.
+const KafkaAPIVersionsReqKind = 18
+
+// APIVersionsCachePeriod is how long the API versions of cluster are
+// cached. They change only when the brokers are upgraded.
+const APIVersionsCachePeriod = 10 * time.Minute
+
+var kafkaAPINames = map[int16]string{
+	0:  "Produce",
+	1:  "Fetch",
+	2:  "ListOffsets",
+	3:  "Metadata",
+	4:  "LeaderAndIsr",
+	5:  "StopReplica",
+	6:  "UpdateMetadata",
+	7:  "ControlledShutdown",
+	8:  "OffsetCommit",
+	9:  "OffsetFetch",
+	10: "FindCoordinator",
+	11: "JoinGroup",
+	12: "Heartbeat",
+	13: "LeaveGroup",
+	14: "SyncGroup",
+	15: "DescribeGroups",
+	16: "ListGroups",
+	17: "SaslHandshake",
+	18: "ApiVersions",
+	19: "CreateTopics",
+	20: "DeleteTopics",
+	21: "DeleteRecords",
+	22: "InitProducerId",
+	23: "OffsetForLeaderEpoch",
+	24: "AddPartitionsToTxn",
+	25: "AddOffsetsToTxn",
+	26: "EndTxn",
+	27: "WriteTxnMarkers",
+	28: "TxnOffsetCommit",
+	29: "DescribeAcls",
+	30: "CreateAcls",
+	31: "DeleteAcls",
+	32: "DescribeConfigs",
+	33: "AlterConfigs",
+}
+
+// KafkaAPIVersion describes the range of versions supported for API key.
+type KafkaAPIVersion struct {
+	Key        int16  `json:"key"`
+	Name       string `json:"name,omitempty"`
+	MinVersion int16  `json:"min_version"`
+	MaxVersion int16  `json:"max_version"`
+}
+
+// KafkaAPIVersions contains the API versions supported by broker.
+type KafkaAPIVersions struct {
+	Broker   string            `json:"broker"`
+	Versions []KafkaAPIVersion `json:"versions"`
+}
+
+// readAPIVersionsResp decodes the body of ApiVersions response.
+func readAPIVersionsResp(r io.Reader) ([]KafkaAPIVersion, error) {
+	dec := proto.NewDecoder(r)
+
+	if errno := dec.DecodeInt16(); errno != 0 {
+		return nil, fmt.Errorf("kafka error %d", errno)
+	}
+
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+
+	// The version is three int16 fields.
+	if err := checkArrayLen(r, n, 6); err != nil {
+		return nil, err
+	}
+
+	versions := make([]KafkaAPIVersion, n)
+	for i := range versions {
+		versions[i].Key = dec.DecodeInt16()
+		versions[i].MinVersion = dec.DecodeInt16()
+		versions[i].MaxVersion = dec.DecodeInt16()
+		versions[i].Name = kafkaAPINames[versions[i].Key]
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// GetAPIVersions requests the supported API versions from the first
+// configured broker which answers.
+func (k *KafkaClient) GetAPIVersions() (*KafkaAPIVersions, error) {
+	defer k.Timings.Get("APIVersions").Start().Stop()
+
+	err := error(KhpError{
+		Errno:   KhpErrorNoBrokers,
+		message: "No brokers configured",
+	})
+
+	for _, addr := range k.brokerAddrs {
+		var r io.Reader
+
+		r, err = k.kafkaRequest(addr, KafkaAPIVersionsReqKind, 0, nil)
+		if err != nil {
+			continue
+		}
+
+		versions, err := readAPIVersionsResp(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return &KafkaAPIVersions{
+			Broker:   addr,
+			Versions: versions,
+		}, nil
+	}
+
+	return nil, err
+}
+
+// APIVersions returns the supported API versions but use internal cache.
+func (k *KafkaClient) APIVersions() (*KafkaAPIVersions, error) {
+	k.apiVersions.Lock()
+	defer k.apiVersions.Unlock()
+
+	if k.apiVersions.versions != nil && time.Since(k.apiVersions.updated) < APIVersionsCachePeriod {
+		return k.apiVersions.versions, nil
+	}
+
+	versions, err := k.GetAPIVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	k.apiVersions.versions = versions
+	k.apiVersions.updated = time.Now()
+
+	return versions, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+type testAPIVersionsResp struct {
+	CorrelationID int32
+	Versions      []KafkaAPIVersion
+}
+
+func (r *testAPIVersionsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(int16(0))
+	enc.EncodeArrayLen(len(r.Versions))
+	for _, v := range r.Versions {
+		enc.Encode(v.Key)
+		enc.Encode(v.MinVersion)
+		enc.Encode(v.MaxVersion)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func TestAPIVersionsHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	requests := 0
+
+	handleTestMetadata(srv)
+	srv.Handle(APIVersionsRequest, func(request Serializable) Serializable {
+		req := request.(*RawRequest)
+		requests++
+		return &testAPIVersionsResp{
+			CorrelationID: req.CorrelationID,
+			Versions: []KafkaAPIVersion{
+				{Key: 0, MinVersion: 0, MaxVersion: 3},
+				{Key: 1000, MinVersion: 0, MaxVersion: 1},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	expected := `{"data":{"broker":"` + srv.Address() + `","versions":[{"key":0,"name":"Produce","min_version":0,"max_version":3},{"key":1000,"min_version":0,"max_version":1}]},"status":"success"}`
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+
+		s.getAPIVersionsHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/info/apiversions", nil), &url.Values{})
+
+		if rec.Code != http.StatusOK || rec.Body.String() != expected {
+			t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	if requests != 1 {
+		t.Fatalf("expected API versions to be cached, got %d requests", requests)
+	}
+}
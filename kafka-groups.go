@@ -0,0 +1,693 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"github.com/optiopay/kafka/proto"
+
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The group requests are not wrapped by the kafka library, so they are
+// sent over separate short connections.
+const (
+	KafkaOffsetCommitReqKind     = 8
+	KafkaGroupCoordinatorReqKind = 10
+	KafkaDescribeGroupsReqKind   = 15
+	KafkaListGroupsReqKind       = 16
+)
+
+// kafkaMaxResponseSize limits the response read over separate connection.
+// It is the default of socket.request.max.bytes of Kafka, so the broken
+// size field doesn't make the proxy allocate gigabytes.
+const kafkaMaxResponseSize = 100 * 1024 * 1024
+
+// KafkaGroup describes the consumer group.
+type KafkaGroup struct {
+	Name         string `json:"group"`
+	ProtocolType string `json:"protocol_type"`
+}
+
+// KafkaGroupAssignment contains the partitions of topic assigned to the member.
+type KafkaGroupAssignment struct {
+	Topic      string  `json:"topic"`
+	Partitions []int32 `json:"partitions"`
+}
+
+// KafkaGroupMember describes the member of consumer group.
+type KafkaGroupMember struct {
+	MemberID   string `json:"member_id"`
+	ClientID   string `json:"client_id"`
+	ClientHost string `json:"client_host"`
+
+	// Assignment is decoded only for the groups of consumer protocol type.
+	Assignment []KafkaGroupAssignment `json:"assignment"`
+}
+
+// KafkaGroupDescription describes the state of consumer group.
+type KafkaGroupDescription struct {
+	Name         string             `json:"group"`
+	State        string             `json:"state"`
+	ProtocolType string             `json:"protocol_type"`
+	Protocol     string             `json:"protocol"`
+	Coordinator  int32              `json:"coordinator"`
+	Members      []KafkaGroupMember `json:"members"`
+}
+
+type kafkaGroupsByName []KafkaGroup
+
+func (a kafkaGroupsByName) Len() int           { return len(a) }
+func (a kafkaGroupsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a kafkaGroupsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+var kafkaGroupErrors = []*proto.KafkaError{
+	proto.ErrUnknown,
+	proto.ErrOffsetLoadInProgress,
+	proto.ErrNoCoordinator,
+	proto.ErrNotCoordinator,
+	proto.ErrGroupAuthorizationFailed,
+	proto.ErrClusterAuthorizationFailed,
+	proto.ErrUnknownTopicOrPartition,
+	proto.ErrRequestTimeout,
+	proto.ErrOffsetMetadataTooLarge,
+	proto.ErrIllegalGeneration,
+	proto.ErrUnknownConsumerID,
+	proto.ErrRebalanceInProgress,
+	proto.ErrInvalidCommitOffsetSize,
+	proto.ErrTopicAuthorizationFailed,
+}
+
+// kafkaGroupError converts error code of the group response.
+func kafkaGroupError(errno int16) error {
+	if errno == 0 {
+		return nil
+	}
+	for _, err := range kafkaGroupErrors {
+		if err.Errno() == int(errno) {
+			return err
+		}
+	}
+	return fmt.Errorf("unknown kafka error %d", errno)
+}
+
+var kafkaCorrelationID int32
+
+// kafkaRequest sends the request of given version to broker and returns
+// the response body after the correlation ID.
+func (k *KafkaClient) kafkaRequest(addr string, kind int16, version int16, body []byte) (io.Reader, error) {
+	return k.kafkaRequestTimeout(addr, kind, version, body, k.GetMetadataTimeout)
+}
+
+// kafkaRequestTimeout is kafkaRequest with the timeout of round trip
+// other than GetMetadataTimeout.
+func (k *KafkaClient) kafkaRequestTimeout(addr string, kind int16, version int16, body []byte, timeout time.Duration) (io.Reader, error) {
+	conn, err := net.DialTimeout("tcp", addr, k.brokerConf.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	correlationID := atomic.AddInt32(&kafkaCorrelationID, 1)
+
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(kind)
+	enc.Encode(version)
+	enc.Encode(correlationID)
+	enc.Encode(k.brokerConf.ClientID)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	buf.Write(body)
+
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := int32(binary.BigEndian.Uint32(header[0:]))
+	if size < 4 {
+		return nil, proto.ErrNotEnoughData
+	}
+
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != correlationID {
+		return nil, fmt.Errorf("correlation ID mismatch: expected %d, got %d", correlationID, id)
+	}
+
+	if size > kafkaMaxResponseSize {
+		return nil, fmt.Errorf("response of %d bytes is too large", size)
+	}
+
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(resp), nil
+}
+
+// brokerAddresses returns addresses of all brokers in cluster.
+func (m *KafkaMetadata) brokerAddresses() []string {
+	var addrs []string
+
+	for _, b := range m.Metadata.Brokers {
+		addrs = append(addrs, net.JoinHostPort(b.Host, strconv.Itoa(int(b.Port))))
+	}
+
+	return addrs
+}
+
+// checkArrayLen checks the array length decoded from the response against
+// the rest of response, where each element takes at least elemSize bytes,
+// so the broken length doesn't make the proxy allocate more than it has read.
+func checkArrayLen(r io.Reader, n int, elemSize int) error {
+	if n < 0 {
+		return proto.ErrInvalidArrayLen
+	}
+	if b, ok := r.(interface {
+		Len() int
+	}); ok && n > b.Len()/elemSize {
+		return proto.ErrInvalidArrayLen
+	}
+	return nil
+}
+
+// readListGroupsResp decodes the body of ListGroups response.
+func readListGroupsResp(r io.Reader) ([]KafkaGroup, error) {
+	dec := proto.NewDecoder(r)
+
+	if err := kafkaGroupError(dec.DecodeInt16()); err != nil {
+		return nil, err
+	}
+
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+
+	// The group is two strings, each has at least the int16 length.
+	if err := checkArrayLen(r, n, 4); err != nil {
+		return nil, err
+	}
+
+	groups := make([]KafkaGroup, n)
+	for i := range groups {
+		groups[i].Name = dec.DecodeString()
+		groups[i].ProtocolType = dec.DecodeString()
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// KafkaBrokerError is the failed request to one of brokers.
+type KafkaBrokerError struct {
+	Broker string
+	Err    error
+}
+
+func (e KafkaBrokerError) Error() string {
+	return fmt.Sprintf("broker %s: %v", e.Broker, e.Err)
+}
+
+// GetGroups returns consumer groups from all brokers. Every broker knows
+// only the groups it coordinates, so the request is sent to each of them.
+// The groups of available brokers are returned with the errors of the
+// others. The error is returned only if no broker has responded.
+func (k *KafkaClient) GetGroups() ([]KafkaGroup, []KafkaBrokerError, error) {
+	defer k.Timings.Get("ListGroups").Start().Stop()
+
+	meta, err := k.FetchMetadata()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addrs := meta.brokerAddresses()
+
+	type result struct {
+		groups []KafkaGroup
+		err    error
+	}
+
+	results := make([]result, len(addrs))
+
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+
+			r, err := k.kafkaRequest(addr, KafkaListGroupsReqKind, 0, nil)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			results[i].groups, results[i].err = readListGroupsResp(r)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	var groups []KafkaGroup
+	var failed []KafkaBrokerError
+
+	for i, res := range results {
+		if res.err != nil {
+			failed = append(failed, KafkaBrokerError{Broker: addrs[i], Err: res.err})
+			continue
+		}
+		groups = append(groups, res.groups...)
+	}
+
+	if len(failed) > 0 && len(failed) == len(addrs) {
+		return nil, nil, failed[0]
+	}
+
+	sort.Sort(kafkaGroupsByName(groups))
+
+	return groups, failed, nil
+}
+
+// ListGroups returns consumer groups but use internal cache. The brokers
+// are requested without the lock, so the slow broker doesn't block the
+// cached list. Only the complete list is cached.
+func (k *KafkaClient) ListGroups() ([]KafkaGroup, []KafkaBrokerError, error) {
+	k.groups.Lock()
+	list, updated := k.groups.list, k.groups.updated
+	k.groups.Unlock()
+
+	if k.MetadataCachePeriod > 0 && time.Since(updated) < k.MetadataCachePeriod {
+		return list, nil, nil
+	}
+
+	groups, failed, err := k.GetGroups()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(failed) == 0 {
+		k.groups.Lock()
+		k.groups.list = groups
+		k.groups.updated = time.Now()
+		k.groups.Unlock()
+	}
+
+	return groups, failed, nil
+}
+
+// readGroupCoordinatorResp decodes the body of GroupCoordinator response.
+func readGroupCoordinatorResp(r io.Reader) (int32, string, error) {
+	dec := proto.NewDecoder(r)
+
+	if err := kafkaGroupError(dec.DecodeInt16()); err != nil {
+		return -1, "", err
+	}
+
+	id := dec.DecodeInt32()
+	host := dec.DecodeString()
+	port := dec.DecodeInt32()
+
+	if err := dec.Err(); err != nil {
+		return -1, "", err
+	}
+	return id, net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// readGroupAssignment decodes the member assignment of consumer protocol.
+func readGroupAssignment(b []byte) ([]KafkaGroupAssignment, error) {
+	res := []KafkaGroupAssignment{}
+
+	if len(b) == 0 {
+		return res, nil
+	}
+
+	dec := proto.NewDecoder(bytes.NewReader(b))
+
+	// version
+	_ = dec.DecodeInt16()
+
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < n; i++ {
+		a := KafkaGroupAssignment{
+			Topic: dec.DecodeString(),
+		}
+
+		parts, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+
+		a.Partitions = make([]int32, parts)
+		for j := range a.Partitions {
+			a.Partitions[j] = dec.DecodeInt32()
+		}
+
+		res = append(res, a)
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// readDescribeGroupsResp decodes the body of DescribeGroups response for
+// the single group.
+func readDescribeGroupsResp(r io.Reader) (*KafkaGroupDescription, error) {
+	dec := proto.NewDecoder(r)
+
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+
+	if n != 1 {
+		return nil, fmt.Errorf("expected one group, got %d", n)
+	}
+
+	if err := kafkaGroupError(dec.DecodeInt16()); err != nil {
+		return nil, err
+	}
+
+	res := &KafkaGroupDescription{
+		Name:         dec.DecodeString(),
+		State:        dec.DecodeString(),
+		ProtocolType: dec.DecodeString(),
+		Protocol:     dec.DecodeString(),
+		Members:      []KafkaGroupMember{},
+	}
+
+	members, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < members; i++ {
+		m := KafkaGroupMember{
+			MemberID:   dec.DecodeString(),
+			ClientID:   dec.DecodeString(),
+			ClientHost: dec.DecodeString(),
+		}
+
+		// member metadata
+		_ = dec.DecodeBytes()
+
+		assignment := dec.DecodeBytes()
+
+		if err := dec.Err(); err != nil {
+			return nil, err
+		}
+
+		if res.ProtocolType == "consumer" {
+			m.Assignment, err = readGroupAssignment(assignment)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode assignment of %s: %v", m.MemberID, err)
+			}
+		}
+
+		res.Members = append(res.Members, m)
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// groupCoordinator returns ID and address of the group coordinator. Any
+// broker can answer, so the configured brokers are asked in turn. It doesn't
+// take a connection from the pool, because the caller may already hold one.
+func (k *KafkaClient) groupCoordinator(group string, timeout time.Duration) (int32, string, error) {
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+	enc.Encode(group)
+
+	if enc.Err() != nil {
+		return -1, "", enc.Err()
+	}
+
+	err := error(KhpError{
+		Errno:   KhpErrorNoBrokers,
+		message: "No brokers configured",
+	})
+
+	for _, addr := range k.brokerAddrs {
+		var r io.Reader
+
+		r, err = k.kafkaRequestTimeout(addr, KafkaGroupCoordinatorReqKind, 0, buf.Bytes(), timeout)
+		if err != nil {
+			continue
+		}
+
+		return readGroupCoordinatorResp(r)
+	}
+
+	return -1, "", err
+}
+
+// DescribeGroup returns the state and members of consumer group from
+// the group coordinator.
+func (k *KafkaClient) DescribeGroup(group string) (*KafkaGroupDescription, error) {
+	defer k.Timings.Get("DescribeGroup").Start().Stop()
+
+	coordinatorID, coordinator, err := k.groupCoordinator(group, k.GetMetadataTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+	enc.EncodeArrayLen(1)
+	enc.Encode(group)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	r, err := k.kafkaRequest(coordinator, KafkaDescribeGroupsReqKind, 0, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := readDescribeGroupsResp(r)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Coordinator = coordinatorID
+
+	return res, nil
+}
+
+// readOffsetCommitResp decodes the body of OffsetCommit response for
+// the single partition.
+func readOffsetCommitResp(r io.Reader) error {
+	dec := proto.NewDecoder(r)
+
+	topics, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < topics; i++ {
+		_ = dec.DecodeString()
+
+		parts, err := dec.DecodeArrayLen()
+		if err != nil {
+			return err
+		}
+
+		for j := 0; j < parts; j++ {
+			_ = dec.DecodeInt32()
+
+			if err := kafkaGroupError(dec.DecodeInt16()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return dec.Err()
+}
+
+// commitOffsetRetention commits consumer group offset which is kept by
+// the coordinator for the retention time. The kafka library sends only
+// the first version of request which has no retention. The requests are
+// sent over own connections which are closed after the timeout.
+func (k *KafkaClient) commitOffsetRetention(group, topic string, partition int32, offset int64, retention time.Duration, timeout time.Duration) error {
+	_, coordinator, err := k.groupCoordinator(group, timeout)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+
+	enc.Encode(group)
+	// generation ID and member ID of simple consumer
+	enc.Encode(int32(-1))
+	enc.Encode("")
+	enc.Encode(int64(retention / time.Millisecond))
+	enc.EncodeArrayLen(1)
+	enc.Encode(topic)
+	enc.EncodeArrayLen(1)
+	enc.Encode(partition)
+	enc.Encode(offset)
+	enc.Encode("")
+
+	if enc.Err() != nil {
+		return enc.Err()
+	}
+
+	r, err := k.kafkaRequestTimeout(coordinator, KafkaOffsetCommitReqKind, proto.KafkaV2, buf.Bytes(), timeout)
+	if err != nil {
+		return err
+	}
+
+	return readOffsetCommitResp(r)
+}
+
+// KafkaOffsetCommit is the offset of topic partition to be committed.
+type KafkaOffsetCommit struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+
+	// Err is the error of the partition returned by the coordinator.
+	Err error
+}
+
+// CommitOffsets commits the offsets of several partitions in one request
+// to the coordinator. The errors of partitions are set in the offsets
+// and the returned error means that the whole request failed. The offsets
+// are kept for the retention time or for the default retention of broker
+// if the retention is zero. Each partition must be in the offsets once.
+func (k *KafkaClient) CommitOffsets(group string, offsets []KafkaOffsetCommit, retention time.Duration) error {
+	defer k.Timings.Get("CommitOffsets").Start().Stop()
+
+	_, coordinator, err := k.groupCoordinator(group, k.GetMetadataTimeout)
+	if err != nil {
+		return err
+	}
+
+	var topics []string
+	partitions := make(map[string][]int)
+
+	for i, o := range offsets {
+		if _, ok := partitions[o.Topic]; !ok {
+			topics = append(topics, o.Topic)
+		}
+		partitions[o.Topic] = append(partitions[o.Topic], i)
+	}
+
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+
+	enc.Encode(group)
+	// generation ID and member ID of simple consumer
+	enc.Encode(int32(-1))
+	enc.Encode("")
+
+	// The default retention of broker is used for -1.
+	if retention > 0 {
+		enc.Encode(int64(retention / time.Millisecond))
+	} else {
+		enc.Encode(int64(-1))
+	}
+
+	enc.EncodeArrayLen(len(topics))
+	for _, topic := range topics {
+		enc.Encode(topic)
+		enc.EncodeArrayLen(len(partitions[topic]))
+		for _, i := range partitions[topic] {
+			enc.Encode(offsets[i].Partition)
+			enc.Encode(offsets[i].Offset)
+			enc.Encode("")
+		}
+	}
+
+	if enc.Err() != nil {
+		return enc.Err()
+	}
+
+	r, err := k.kafkaRequest(coordinator, KafkaOffsetCommitReqKind, proto.KafkaV2, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return readOffsetCommitResults(r, offsets)
+}
+
+// readOffsetCommitResults decodes the body of OffsetCommit response and sets
+// the errors of partitions in the offsets.
+func readOffsetCommitResults(r io.Reader, offsets []KafkaOffsetCommit) error {
+	for i := range offsets {
+		offsets[i].Err = fmt.Errorf("no response for partition")
+	}
+
+	dec := proto.NewDecoder(r)
+
+	topics, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < topics; i++ {
+		topic := dec.DecodeString()
+
+		parts, err := dec.DecodeArrayLen()
+		if err != nil {
+			return err
+		}
+
+		for j := 0; j < parts; j++ {
+			partition := dec.DecodeInt32()
+			err := kafkaGroupError(dec.DecodeInt16())
+
+			for n := range offsets {
+				if offsets[n].Topic == topic && offsets[n].Partition == partition {
+					offsets[n].Err = err
+					break
+				}
+			}
+		}
+	}
+
+	return dec.Err()
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+type testListGroupsResp struct {
+	CorrelationID int32
+	Err           int16
+	Groups        []KafkaGroup
+}
+
+func (r *testListGroupsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.Err)
+	enc.EncodeArrayLen(len(r.Groups))
+	for _, g := range r.Groups {
+		enc.Encode(g.Name)
+		enc.Encode(g.ProtocolType)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func TestListGroups(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ListGroupsRequest, func(request Serializable) Serializable {
+		req := request.(*RawRequest)
+		return &testListGroupsResp{
+			CorrelationID: req.CorrelationID,
+			Groups: []KafkaGroup{
+				{Name: "b", ProtocolType: "consumer"},
+				{Name: "a", ProtocolType: "consumer"},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	groups, _, err := s.Client.ListGroups()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(groups) != 2 || groups[0].Name != "a" || groups[1].Name != "b" {
+		t.Fatalf("unexpected groups: %#v", groups)
+	}
+}
+
+func TestListGroupsError(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ListGroupsRequest, func(request Serializable) Serializable {
+		req := request.(*RawRequest)
+		return &testListGroupsResp{
+			CorrelationID: req.CorrelationID,
+			Err:           int16(proto.ErrNoCoordinator.Errno()),
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	if _, _, err := s.Client.ListGroups(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestListGroupsPartial(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	// The second broker is unavailable.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	downPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		host, port := srv.HostPort()
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+				{NodeID: 2, Host: "127.0.0.1", Port: int32(downPort)},
+			},
+		}
+	})
+	srv.Handle(ListGroupsRequest, func(request Serializable) Serializable {
+		req := request.(*RawRequest)
+		return &testListGroupsResp{
+			CorrelationID: req.CorrelationID,
+			Groups: []KafkaGroup{
+				{Name: "a", ProtocolType: "consumer"},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	rec := httptest.NewRecorder()
+	s.getGroupListHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/consumers", nil), &url.Values{})
+
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("expected status 207, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if v := rec.Header().Get("X-Kafka-Failed-Brokers"); v != net.JoinHostPort("127.0.0.1", strconv.Itoa(downPort)) {
+		t.Fatalf("unexpected failed brokers: %q", v)
+	}
+
+	if !strings.Contains(rec.Body.String(), `"group":"a"`) {
+		t.Fatalf("expected groups of available broker: %s", rec.Body.String())
+	}
+}
+
+// testHugeResp claims the size which is larger than any Kafka response.
+type testHugeResp struct {
+	CorrelationID int32
+}
+
+func (r *testHugeResp) Bytes() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, 1<<31-1)
+	binary.BigEndian.PutUint32(b[4:], uint32(r.CorrelationID))
+	return b, nil
+}
+
+func TestListGroupsHugeResponse(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ListGroupsRequest, func(request Serializable) Serializable {
+		return &testHugeResp{CorrelationID: request.(*RawRequest).CorrelationID}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	if _, _, err := s.Client.ListGroups(); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("expected error of too large response, got %v", err)
+	}
+}
+
+func TestReadListGroupsRespArrayLen(t *testing.T) {
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+	enc.Encode(int16(0))
+	enc.EncodeArrayLen(1000)
+	enc.Encode("a")
+	enc.Encode("consumer")
+
+	if _, err := readListGroupsResp(bytes.NewReader(buf.Bytes())); err != proto.ErrInvalidArrayLen {
+		t.Fatalf("expected invalid array length, got %v", err)
+	}
+
+	buf.Reset()
+	enc.Encode(int16(0))
+	enc.EncodeArrayLen(1)
+	enc.Encode("a")
+	enc.Encode("consumer")
+
+	groups, err := readListGroupsResp(bytes.NewReader(buf.Bytes()))
+	if err != nil || len(groups) != 1 || groups[0].Name != "a" {
+		t.Fatalf("unexpected result: %#v, %v", groups, err)
+	}
+}
+
+type testDescribeGroupsResp struct {
+	CorrelationID int32
+	Group         KafkaGroupDescription
+}
+
+func (r *testDescribeGroupsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeArrayLen(1)
+	enc.Encode(int16(0))
+	enc.Encode(r.Group.Name)
+	enc.Encode(r.Group.State)
+	enc.Encode(r.Group.ProtocolType)
+	enc.Encode(r.Group.Protocol)
+	enc.EncodeArrayLen(len(r.Group.Members))
+	for _, m := range r.Group.Members {
+		enc.Encode(m.MemberID)
+		enc.Encode(m.ClientID)
+		enc.Encode(m.ClientHost)
+		enc.EncodeBytes(nil)
+
+		var assignment bytes.Buffer
+		aenc := proto.NewEncoder(&assignment)
+		aenc.Encode(int16(0))
+		aenc.EncodeArrayLen(len(m.Assignment))
+		for _, a := range m.Assignment {
+			aenc.Encode(a.Topic)
+			aenc.Encode(a.Partitions)
+		}
+		aenc.EncodeBytes(nil)
+
+		enc.EncodeBytes(assignment.Bytes())
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func TestDescribeGroup(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ConsumerMetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ConsumerMetadataReq)
+		host, port := srv.HostPort()
+		return &proto.ConsumerMetadataResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+	srv.Handle(DescribeGroupsRequest, func(request Serializable) Serializable {
+		req := request.(*RawRequest)
+		return &testDescribeGroupsResp{
+			CorrelationID: req.CorrelationID,
+			Group: KafkaGroupDescription{
+				Name:         "group",
+				State:        "Stable",
+				ProtocolType: "consumer",
+				Protocol:     "range",
+				Members: []KafkaGroupMember{
+					{
+						MemberID:   "member-1",
+						ClientID:   "client",
+						ClientHost: "/127.0.0.1",
+						Assignment: []KafkaGroupAssignment{
+							{Topic: "test", Partitions: []int32{0, 1}},
+						},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	group, err := s.Client.DescribeGroup("group")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if group.State != "Stable" || group.Coordinator != 1 || len(group.Members) != 1 {
+		t.Fatalf("unexpected group: %#v", group)
+	}
+
+	assignment := group.Members[0].Assignment
+	if len(assignment) != 1 || assignment[0].Topic != "test" || len(assignment[0].Partitions) != 2 {
+		t.Fatalf("unexpected assignment: %#v", assignment)
+	}
+}
+
+func TestCommitOffsetRetention(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ConsumerMetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ConsumerMetadataReq)
+		host, port := srv.HostPort()
+		return &proto.ConsumerMetadataResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+
+	commits := make(chan *proto.OffsetCommitReq, 2)
+
+	srv.Handle(OffsetCommitRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetCommitReq)
+		commits <- req
+		return &proto.OffsetCommitResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetCommitRespTopic{
+				{
+					Name:       "test",
+					Partitions: []proto.OffsetCommitRespPartition{{ID: 0}},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	testCases := []struct {
+		body      string
+		version   int16
+		retention int64
+	}{
+		{`{"offset":5}`, proto.KafkaV0, 0},
+		{`{"offset":5,"retention":"72h"}`, proto.KafkaV2, 72 * 3600 * 1000},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+
+		s.commitOffsetHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("PUT", "/v1/consumers/group/topics/test/0", bytes.NewBufferString(tc.body)), &url.Values{
+			"consumer":  []string{"group"},
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		})
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected response %d: %s", tc.body, rec.Code, rec.Body.String())
+		}
+
+		req := <-commits
+
+		if req.Version != tc.version || req.RetentionTime != tc.retention || req.Topics[0].Partitions[0].Offset != 5 {
+			t.Fatalf("%s: unexpected commit: %#v", tc.body, req)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+
+	s.commitOffsetHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("PUT", "/v1/consumers/group/topics/test/0", bytes.NewBufferString(`{"offset":5,"retention":"-1h"}`)), &url.Values{
+		"consumer":  []string{"group"},
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	})
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestCommitOffsetRetentionTimeout(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ConsumerMetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ConsumerMetadataReq)
+		host, port := srv.HostPort()
+		return &proto.ConsumerMetadataResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+	srv.Handle(OffsetCommitRequest, func(request Serializable) Serializable {
+		return nil
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().OffsetCoordinator.CommitOffsetTimeout.Duration = 100 * time.Millisecond
+
+	alive := s.Client.AliveBrokers()
+
+	rec := httptest.NewRecorder()
+
+	s.commitOffsetHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("PUT", "/v1/consumers/group/topics/test/0", bytes.NewBufferString(`{"offset":5,"retention":"1h"}`)), &url.Values{
+		"consumer":  []string{"group"},
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	})
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d, got %d: %s", http.StatusServiceUnavailable, rec.Code, rec.Body.String())
+	}
+
+	// Only the own connection of commit is closed.
+	if n := s.Client.AliveBrokers(); n != alive {
+		t.Fatalf("expected %d alive brokers, got %d", alive, n)
+	}
+
+	if n := s.Client.Counters["DeadBrokers"].Count(); n != 0 {
+		t.Fatalf("expected no dead brokers, got %d", n)
+	}
+}
+
+func TestCommitOffsetDefaultGroup(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ConsumerMetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ConsumerMetadataReq)
+		host, port := srv.HostPort()
+		return &proto.ConsumerMetadataResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+
+	commits := make(chan *proto.OffsetCommitReq, 1)
+
+	srv.Handle(OffsetCommitRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetCommitReq)
+		commits <- req
+		return &proto.OffsetCommitResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetCommitRespTopic{
+				{
+					Name:       "test",
+					Partitions: []proto.OffsetCommitRespPartition{{ID: 0}},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	commit := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.commitOffsetHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("PUT", "/v1/consumers/topics/test/0", bytes.NewBufferString(`{"offset":5}`)), &url.Values{
+			"consumer":  []string{""},
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		})
+		return rec
+	}
+
+	if rec := commit(); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+
+	s.Config().Consumer.DefaultGroup = "tools"
+
+	if rec := commit(); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if req := <-commits; req.ConsumerGroup != "tools" {
+		t.Fatalf("expected group tools, got %q", req.ConsumerGroup)
+	}
+}
+
+func TestCommitOffsets(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ConsumerMetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ConsumerMetadataReq)
+		host, port := srv.HostPort()
+		return &proto.ConsumerMetadataResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+
+	commits := make(chan *proto.OffsetCommitReq, 1)
+
+	srv.Handle(OffsetCommitRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetCommitReq)
+		commits <- req
+		return &proto.OffsetCommitResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetCommitRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetCommitRespPartition{
+						{ID: 0},
+						{ID: 1, Err: proto.ErrInvalidCommitOffsetSize},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	body := `[{"topic":"test","partition":0,"offset":5},{"topic":"test","partition":1,"offset":6},{"topic":"other","partition":0,"offset":1},{"topic":"test","partition":0},{"topic":"test","partition":1,"offset":7}]`
+
+	rec := httptest.NewRecorder()
+
+	s.commitOffsetsHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/consumers/group/commit", bytes.NewBufferString(body)), &url.Values{
+		"consumer": []string{"group"},
+	})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	expected := `{"data":[` +
+		`{"topic":"test","partition":0,"offset":5,"success":true},` +
+		`{"topic":"test","partition":1,"offset":6,"success":false,"error":"` + proto.ErrInvalidCommitOffsetSize.Error() + `"},` +
+		`{"topic":"other","partition":0,"offset":1,"success":false,"error":"Topic unknown"},` +
+		`{"topic":"test","partition":0,"offset":-1,"success":false,"error":"Offset must be provided not less than 0"},` +
+		`{"topic":"test","partition":1,"offset":7,"success":false,"error":"Duplicate partition in request"}` +
+		`],"status":"success"}`
+
+	if rec.Body.String() != expected {
+		t.Fatalf("unexpected response: %s", rec.Body.String())
+	}
+
+	if n := s.Stats.HTTPResponseTime.Get("CommitOffsets").Count(); n != 1 {
+		t.Fatalf("expected 1 timing of CommitOffsets, got %d", n)
+	}
+
+	req := <-commits
+
+	if req.Version != proto.KafkaV2 || req.RetentionTime != -1 || len(req.Topics) != 1 || len(req.Topics[0].Partitions) != 2 {
+		t.Fatalf("expected one commit of two partitions, got %#v", req)
+	}
+
+	rec = httptest.NewRecorder()
+
+	s.commitOffsetsHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/consumers/group/commit", bytes.NewBufferString(`{"offset":5}`)), &url.Values{
+		"consumer": []string{"group"},
+	})
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -12,10 +12,14 @@ import (
 	cfg "gopkg.in/gcfg.v1"
 	_ "net/http/pprof"
 
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"net/http"
 	"net/url"
 	"os"
@@ -24,6 +28,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -44,6 +49,28 @@ type HTTPResponse struct {
 	HTTPStatus     int
 	HTTPError      string
 	ResponseLength int64
+
+	// client is the Kafka client of request cluster.
+	client *KafkaClient
+
+	// plainErrors is true if the client prefers errors in plain text.
+	plainErrors bool
+
+	// deadline is the time by which the whole request must be completed.
+	deadline time.Time
+}
+
+// deadlineExceeded returns true if the time of request is over.
+func (resp *HTTPResponse) deadlineExceeded() bool {
+	return !resp.deadline.IsZero() && !time.Now().Before(resp.deadline)
+}
+
+func newHTTPResponse(w http.ResponseWriter, r *http.Request) *HTTPResponse {
+	return &HTTPResponse{
+		ResponseWriter: w,
+		HTTPStatus:     http.StatusOK,
+		plainErrors:    prefersPlainText(r.Header.Get("Accept")),
+	}
 }
 
 func (resp *HTTPResponse) Write(b []byte) (n int, err error) {
@@ -54,6 +81,43 @@ func (resp *HTTPResponse) Write(b []byte) (n int, err error) {
 	return
 }
 
+// bufferedResponse collects the response to send it at once with
+// the Content-Length header instead of streaming.
+type bufferedResponse struct {
+	http.ResponseWriter
+
+	status int
+	buf    bytes.Buffer
+}
+
+func (resp *bufferedResponse) WriteHeader(status int) {
+	resp.status = status
+}
+
+func (resp *bufferedResponse) Write(b []byte) (int, error) {
+	return resp.buf.Write(b)
+}
+
+// Reset discards the collected response, so another one can be written
+// instead.
+func (resp *bufferedResponse) Reset() {
+	resp.status = 0
+	resp.buf.Reset()
+}
+
+// Send writes the collected response.
+func (resp *bufferedResponse) Send() error {
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+
+	resp.Header().Set("Content-Length", strconv.Itoa(resp.buf.Len()))
+	resp.ResponseWriter.WriteHeader(resp.status)
+
+	_, err := resp.buf.WriteTo(resp.ResponseWriter)
+	return err
+}
+
 // JSONErrorData is a template for error answers.
 type JSONErrorData struct {
 	// HTTP status code.
@@ -77,6 +141,36 @@ type JSONErrorOutOfRange struct {
 	OffsetNewest int64  `json:"offsetto"`
 }
 
+// JSONErrorValidation contains a template for response if the message does not match the schema.
+type JSONErrorValidation struct {
+	// HTTP status code.
+	Code int `json:"code"`
+
+	// Human readable error message.
+	Message string `json:"message"`
+
+	Topic  string   `json:"topic"`
+	Errors []string `json:"errors"`
+}
+
+// JSONErrorWriteTimeout contains a template for response if it is unknown whether the message was stored.
+type JSONErrorWriteTimeout struct {
+	// HTTP status code.
+	Code int `json:"code"`
+
+	// Human readable error message.
+	Message string `json:"message"`
+
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+
+	// Kafka broker which was in use or -1 if unknown.
+	Broker int32 `json:"broker"`
+
+	// Always null because the message may or may not be committed.
+	Committed *bool `json:"committed"`
+}
+
 // ConnTrack used to track the number of connections.
 type ConnTrack struct {
 	ConnID int64
@@ -85,22 +179,118 @@ type ConnTrack struct {
 
 // Server is a main structure.
 type Server struct {
-	Cfg     *Config
+	cfg     atomic.Value
 	Pidfile *Pidfile
 	Client  *KafkaClient
 
+	// Clusters contains clients of the named Kafka clusters.
+	Clusters map[string]*KafkaClient
+
 	lastConnID int64
 	connsCount int64
 
 	Stats       *MetricStats
 	MessageSize *TopicMessageSize
+	Schemas     *SchemaRegistry
+	Idempotency *IdempotencyCache
+	Graphite    *GraphiteReporter
+	Runtime     *RuntimeCollector
+
+	// Tracer is nil if the tracing is disabled.
+	Tracer *Tracer
+
+	// ResponseCache contains recent consume responses.
+	ResponseCache *ResponseCache
+
+	// Consumers contains the number of running GET requests per topic.
+	Consumers *TopicConsumers
+
+	// Batcher coalesces the messages produced to the same partition.
+	Batcher *ProduceBatcher
+
+	servers struct {
+		sync.Mutex
+		list []*http.Server
+	}
+}
+
+// Config returns the current configuration. The configuration can be
+// replaced on reload, so the result should not be modified.
+func (s *Server) Config() *Config {
+	return s.cfg.Load().(*Config)
+}
+
+// SetConfig replaces the configuration.
+func (s *Server) SetConfig(c *Config) {
+	s.cfg.Store(c)
 }
 
 // Close closes the server.
 func (s *Server) Close() error {
+	if s.Graphite != nil {
+		s.Graphite.Stop()
+	}
+	if s.Tracer != nil {
+		s.Tracer.Stop()
+	}
+	if s.Runtime != nil {
+		s.Runtime.Stop()
+	}
 	return nil
 }
 
+func (s *Server) addHTTPServer(srv *http.Server) {
+	s.servers.Lock()
+	defer s.servers.Unlock()
+
+	s.servers.list = append(s.servers.list, srv)
+}
+
+// Drain stops accepting new requests and waits for the running ones. When
+// the timeout is exceeded, the connections to Kafka and to the clients are
+// closed forcibly. It returns the number of aborted requests.
+func (s *Server) Drain(timeout time.Duration) int64 {
+	s.servers.Lock()
+	servers := s.servers.list
+	s.servers.Unlock()
+
+	ctx := context.Background()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			srv.Shutdown(ctx)
+		}(srv)
+	}
+	wg.Wait()
+
+	if ctx.Err() == nil {
+		return 0
+	}
+
+	aborted := atomic.LoadInt64(&s.connsCount)
+	log.Errorf("Shutdown timeout exceeded, aborting %d requests", aborted)
+
+	s.Client.CloseBrokers()
+	for _, client := range s.Clusters {
+		client.CloseBrokers()
+	}
+
+	for _, srv := range servers {
+		srv.Close()
+	}
+
+	return aborted
+}
+
 func (s *Server) newConnTrack(r *http.Request) ConnTrack {
 	cl := ConnTrack{
 		ConnID: atomic.AddInt64(&s.lastConnID, 1),
@@ -118,17 +308,78 @@ func (s *Server) closeConnTrack(cl ConnTrack) {
 	log.Debugf("Closed connection %d (total=%d)", cl.ConnID, conns)
 }
 
-func (s *Server) connIsAlive(w *HTTPResponse) bool {
-	closeNotify := w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+// connIsAlive returns false if the client has gone. The request context is
+// cancelled both when HTTP/1.1 connection is closed and when HTTP/2 stream
+// is reset. The expired deadline of request doesn't mean that the client
+// has gone, the handlers check it themselves to finish the response.
+func (s *Server) connIsAlive(r *http.Request) bool {
+	return r.Context().Err() != context.Canceled
+}
+
+// acceptQuality returns the quality of media type in the Accept header.
+func acceptQuality(accept string, mediaType string) float64 {
+	quality := 0.0
+	specificity := -1
+
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+
+		n := 0
+		switch {
+		case value == mediaType:
+			n = 2
+		case value == mediaType[:strings.Index(mediaType, "/")+1]+"*":
+			n = 1
+		case value == "*/*":
+			n = 0
+		default:
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
 
-	select {
-	case closed := <-closeNotify:
-		if closed {
-			return false
+		// The most specific media range wins.
+		if n > specificity {
+			quality, specificity = q, n
 		}
-	default:
 	}
-	return true
+	return quality
+}
+
+// prefersPlainText returns true if the Accept header prefers text/plain
+// to application/json. JSON is used if the header is not specified.
+func prefersPlainText(accept string) bool {
+	if accept == "" {
+		return false
+	}
+	return acceptQuality(accept, "text/plain") > acceptQuality(accept, "application/json")
+}
+
+var traceparentRegexp = regexp.MustCompile("^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})")
+
+// parseTraceparent returns the trace ID and the parent span ID from W3C
+// traceparent header, so the request log can be matched with the trace of
+// the client.
+func parseTraceparent(value string) (string, string, bool) {
+	m := traceparentRegexp.FindStringSubmatch(value)
+	if m == nil || m[1] == "ff" {
+		return "", "", false
+	}
+
+	if m[2] == strings.Repeat("0", 32) || m[3] == strings.Repeat("0", 16) {
+		return "", "", false
+	}
+
+	return m[2], m[3], true
 }
 
 func (s *Server) rawResponse(resp *HTTPResponse, status int, b []byte) {
@@ -154,6 +405,12 @@ func (s *Server) endResponseSuccess(w *HTTPResponse) {
 }
 
 func (s *Server) successResponse(w *HTTPResponse, m interface{}) {
+	s.statusResponse(w, http.StatusOK, m)
+}
+
+// statusResponse is like successResponse, but with another successful
+// status such as 207 Multi-Status.
+func (s *Server) statusResponse(w *HTTPResponse, status int, m interface{}) {
 	b, err := json.Marshal(m)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -161,20 +418,53 @@ func (s *Server) successResponse(w *HTTPResponse, m interface{}) {
 		return
 	}
 
-	s.beginResponse(w, http.StatusOK)
+	s.beginResponse(w, status)
 	w.Write(b)
 	s.endResponseSuccess(w)
 }
 
-func (s *Server) errorResponse(w *HTTPResponse, status int, format string, args ...interface{}) {
-	w.HTTPError = fmt.Sprintf(format, args...)
+// metadataResponse is like successResponse, but sets ETag derived from
+// the time of metadata update and the response body. It answers with
+// 304 Not Modified if the client already has the same data.
+func (s *Server) metadataResponse(w *HTTPResponse, r *http.Request, meta *KafkaMetadata, m interface{}) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Errorln("Unable to marshal result:", err)
+		return
+	}
 
-	data := &JSONErrorData{
-		Code:    status,
-		Message: w.HTTPError,
+	etag := fmt.Sprintf(`"%x-%08x"`, meta.Updated, crc32.ChecksumIEEE(b))
+	w.Header().Set("ETag", etag)
+
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			s.Stats.HTTPStatus[http.StatusNotModified].Inc(1)
+			s.rawResponse(w, http.StatusNotModified, nil)
+			return
+		}
 	}
+
+	s.beginResponse(w, http.StatusOK)
+	w.Write(b)
+	s.endResponseSuccess(w)
+}
+
+// writeError sends the error in JSON or, if the client prefers it, as
+// the plain text message.
+func (s *Server) writeError(w *HTTPResponse, status int, message string, data interface{}) {
 	log.Debugf("%+v", data)
 
+	if w.plainErrors {
+		s.Stats.HTTPStatus[status].Inc(1)
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		s.rawResponse(w, status, []byte(message+"\n"))
+		return
+	}
+
 	b, err := json.Marshal(data)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -187,6 +477,32 @@ func (s *Server) errorResponse(w *HTTPResponse, status int, format string, args
 	s.endResponseError(w)
 }
 
+func (s *Server) errorResponse(w *HTTPResponse, status int, format string, args ...interface{}) {
+	w.HTTPError = fmt.Sprintf(format, args...)
+
+	// The operation has failed because the request ran out of time.
+	if status == http.StatusServiceUnavailable && w.deadlineExceeded() {
+		status = http.StatusGatewayTimeout
+	}
+
+	data := &JSONErrorData{
+		Code:    status,
+		Message: w.HTTPError,
+	}
+
+	// The client can't get a connection from the pool or there are
+	// too many consumers of topic.
+	retry := status == http.StatusTooManyRequests ||
+		status == http.StatusServiceUnavailable && w.client != nil && w.client.FreeBrokers() == 0
+
+	if retry && w.client != nil && w.client.MaxRetryAfter > 0 {
+		retryAfter := (w.client.SuggestedRetryAfter() + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter), 10))
+	}
+
+	s.writeError(w, status, data.Message, data)
+}
+
 func (s *Server) errorOutOfRange(w *HTTPResponse, topic string, partition int32, offsetFrom int64, offsetTo int64) {
 	status := http.StatusRequestedRangeNotSatisfiable
 	data := &JSONErrorOutOfRange{
@@ -197,49 +513,102 @@ func (s *Server) errorOutOfRange(w *HTTPResponse, topic string, partition int32,
 		OffsetOldest: offsetFrom,
 		OffsetNewest: offsetTo,
 	}
-	log.Debugf("%+v", data)
 
-	b, err := json.Marshal(data)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Errorln("Unable to marshal result:", err)
-		return
+	s.writeError(w, status, data.Message, data)
+}
+
+func (s *Server) errorValidation(w *HTTPResponse, topic string, errs []string) {
+	status := 422
+	data := &JSONErrorValidation{
+		Code:    status,
+		Message: "Message does not match the schema",
+		Topic:   topic,
+		Errors:  errs,
 	}
 
-	s.beginResponse(w, status)
-	w.Write(b)
-	s.endResponseError(w)
+	s.writeError(w, status, data.Message+": "+strings.Join(errs, "; "), data)
+}
+
+func (s *Server) errorWriteTimeout(w *HTTPResponse, topic string, partition int32, e KhpError) {
+	status := http.StatusGatewayTimeout
+	w.HTTPError = e.Error()
+
+	data := &JSONErrorWriteTimeout{
+		Code:      status,
+		Message:   "Write timeout: the message may or may not be stored",
+		Topic:     topic,
+		Partition: partition,
+		Broker:    e.NodeID,
+		Committed: nil,
+	}
+
+	s.writeError(w, status, data.Message, data)
+}
+
+func clientStatistics(client *KafkaClient) (map[string]int64, map[string]*SnapshotTimer) {
+	kafkaCounters := make(map[string]int64)
+	for name, metric := range client.Counters {
+		kafkaCounters[name] = metric.Count()
+	}
+
+	kafkaStats := make(map[string]*SnapshotTimer)
+	for name, metric := range client.Timings.All() {
+		kafkaStats[name] = GetSnapshot(metric)
+	}
+
+	return kafkaCounters, kafkaStats
 }
 
 func (s *Server) initStatistics() {
 	expvar.Publish("Kafka", expvar.Func(func() interface{} {
 		result := make(map[string]interface{})
 
-		msgSize := make(map[string]float64)
-		for k, v := range s.MessageSize.Topics {
-			msgSize[k] = v.Percentile(0.75)
+		msgSize := make(map[string]int32)
+		for _, info := range s.MessageSize.Info() {
+			if info.Cluster != "" {
+				msgSize[info.Cluster+"/"+info.Topic] = info.Estimate
+				continue
+			}
+			msgSize[info.Topic] = info.Estimate
 		}
 
 		result["MessageSize"] = msgSize
 
-		kafkaCounters := make(map[string]int64)
-		for name, metric := range s.Client.Counters {
-			kafkaCounters[name] = metric.Count()
-		}
-		result["Counters"] = kafkaCounters
+		result["Counters"], result["Timings"] = clientStatistics(s.Client)
 
-		kafkaStats := make(map[string]*SnapshotTimer)
-		for name, metric := range s.Client.Timings {
-			kafkaStats[name] = GetSnapshot(metric)
+		clusters := make(map[string]interface{})
+		for name, client := range s.Clusters {
+			counters, timings := clientStatistics(client)
+			clusters[name] = map[string]interface{}{
+				"Counters": counters,
+				"Timings":  timings,
+			}
 		}
-		result["Timings"] = kafkaStats
+		result["Clusters"] = clusters
 
 		timeStats := make(map[string]*SnapshotTimer)
-		for name, metric := range s.Stats.HTTPResponseTime {
+		for name, metric := range s.Stats.HTTPResponseTime.All() {
 			timeStats[name] = GetSnapshot(metric)
 		}
 		result["Response"] = timeStats
 
+		sizeStats := make(map[string]*SnapshotHistogram)
+		for name, metric := range s.Stats.MessageSize {
+			sizeStats[name] = GetHistogramSnapshot(metric)
+		}
+		result["MessageSizeDistribution"] = sizeStats
+
+		cacheStats := map[string]int64{
+			"Entries": int64(s.ResponseCache.Len()),
+		}
+		for name, metric := range s.Stats.ResponseCache {
+			cacheStats[name] = metric.Count()
+		}
+		result["ResponseCache"] = cacheStats
+		result["FetchResizes"] = GetHistogramSnapshot(s.Stats.FetchResizes)
+
+		result["TopicConsumers"] = s.Consumers.Info()
+
 		httpStatus := make(map[string]int64)
 		for code, metric := range s.Stats.HTTPStatus {
 			httpStatus[fmt.Sprintf("%d", code)] = metric.Count()
@@ -251,16 +620,30 @@ func (s *Server) initStatistics() {
 	}))
 
 	expvar.Publish("runtime", expvar.Func(func() interface{} {
-		return GetRuntimeStat()
+		return s.Runtime.Last()
 	}))
 }
 
 // Run prepare handlers and starts the server.
 func (s *Server) Run() error {
+	s.Runtime = NewRuntimeCollector(s.Config().Metrics.RuntimeInterval.Duration)
+	s.Runtime.Start()
+
 	s.initStatistics()
 
+	if s.Config().Metrics.GraphiteAddress != "" && s.Config().Metrics.GraphiteInterval.Duration > 0 {
+		s.Graphite = NewGraphiteReporter(s)
+		s.Graphite.Start()
+	}
+
+	if s.Config().Tracing.Endpoint != "" && s.Config().Tracing.Interval.Duration > 0 && s.Config().Tracing.BatchSize > 0 {
+		s.Tracer = NewTracer(s)
+		s.Tracer.Start()
+	}
+
 	type httpHandler struct {
 		LimitConns  bool
+		AdminOnly   bool
 		Regexp      *regexp.Regexp
 		GETHandler  func(*HTTPResponse, *http.Request, *url.Values)
 		POSTHandler func(*HTTPResponse, *http.Request, *url.Values)
@@ -269,42 +652,179 @@ func (s *Server) Run() error {
 
 	handlers := []httpHandler{
 		httpHandler{
-			Regexp:      regexp.MustCompile("^/v1/topics/(?P<topic>[A-Za-z0-9_-]+)/(?P<partition>[0-9]+)/?$"),
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?topics/(?P<topic>[A-Za-z0-9_-]+)/(?P<partition>[0-9]+)/?$"),
 			LimitConns:  true,
 			GETHandler:  s.getHandler,
 			POSTHandler: s.sendHandler,
 		},
 		httpHandler{
-			Regexp:      regexp.MustCompile("^/v1/consumers/(?P<consumer>[A-Za-z0-9_-]+)/topics/(?P<topic>[A-Za-z0-9_-]+)/(?P<partition>[0-9]+)/?$"),
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?topics/(?P<topic>[A-Za-z0-9_-]+)/?$"),
+			LimitConns:  true,
+			GETHandler:  s.getTopicMessagesHandler,
+			POSTHandler: s.sendHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?topics/(?P<topic>[A-Za-z0-9_-]+)/produce/?$"),
+			LimitConns:  true,
+			GETHandler:  s.notAllowedHandler,
+			POSTHandler: s.streamHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?topics/(?P<topic>[A-Za-z0-9_-]+)/(?P<partition>[0-9]+)/batch/?$"),
+			LimitConns:  true,
+			GETHandler:  s.notAllowedHandler,
+			POSTHandler: s.sendBatchHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?topics/(?P<topic>[A-Za-z0-9_-]+)/(?P<partition>[0-9]+)/transaction/?$"),
+			LimitConns:  true,
+			GETHandler:  s.notAllowedHandler,
+			POSTHandler: s.sendTransactionHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?topics/(?P<topic>[A-Za-z0-9_-]+)/(?P<partition>[0-9]+)/offsets/?$"),
+			LimitConns:  true,
+			GETHandler:  s.getPartitionOffsetsHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?topics/(?P<topic>[A-Za-z0-9_-]+)/(?P<partition>[0-9]+)/messages/(?P<offset>[0-9]+)/?$"),
+			LimitConns:  true,
+			GETHandler:  s.getMessageHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?topics/(?P<topic>[A-Za-z0-9_-]+)/(?P<partition>[0-9]+)/(?P<offset>latest)/?$"),
+			LimitConns:  true,
+			GETHandler:  s.getMessageHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?consumers/?$"),
+			LimitConns:  true,
+			GETHandler:  s.getGroupListHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?consumers/(?P<consumer>[A-Za-z0-9_-]+)/describe/?$"),
+			LimitConns:  true,
+			GETHandler:  s.describeGroupHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?consumers/(?:(?P<consumer>[A-Za-z0-9_-]+)/)?commit/?$"),
+			LimitConns:  true,
+			GETHandler:  s.notAllowedHandler,
+			POSTHandler: s.commitOffsetsHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?consumers/(?:(?P<consumer>[A-Za-z0-9_-]+)/)?topics/(?P<topic>[A-Za-z0-9_-]+)/(?P<partition>[0-9]+)/?$"),
 			LimitConns:  true,
 			GETHandler:  s.getOffsetHandler,
 			POSTHandler: s.notAllowedHandler,
 			PUTHandler:  s.commitOffsetHandler,
 		},
 		httpHandler{
-			Regexp:      regexp.MustCompile("^/v1/info/topics/(?P<topic>[A-Za-z0-9_-]+)/(?P<partition>[0-9]+)/?$"),
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?info/topics/(?P<topic>[A-Za-z0-9_-]+)/offsets/?$"),
+			LimitConns:  true,
+			GETHandler:  s.getTopicOffsetsHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?info/topics/(?P<topic>[A-Za-z0-9_-]+)/(?P<partition>[0-9]+)/?$"),
 			LimitConns:  true,
 			GETHandler:  s.getPartitionInfoHandler,
 			POSTHandler: s.notAllowedHandler,
 		},
 		httpHandler{
-			Regexp:      regexp.MustCompile("^/v1/info/topics/(?P<topic>[A-Za-z0-9_-]+)/?$"),
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?info/topics/(?P<topic>[A-Za-z0-9_-]+)/?$"),
 			LimitConns:  true,
 			GETHandler:  s.getTopicInfoHandler,
 			POSTHandler: s.notAllowedHandler,
 		},
 		httpHandler{
-			Regexp:      regexp.MustCompile("^/v1/info/topics/?$"),
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?status/pool/?$"),
+			LimitConns:  false,
+			GETHandler:  s.getPoolStatusHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?info/cluster/?$"),
+			LimitConns:  true,
+			GETHandler:  s.getClusterInfoHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?info/under-replicated/?$"),
+			LimitConns:  true,
+			GETHandler:  s.getUnderReplicatedHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?info/apiversions/?$"),
+			LimitConns:  true,
+			GETHandler:  s.getAPIVersionsHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?info/topics/?$"),
 			LimitConns:  true,
 			GETHandler:  s.getTopicListHandler,
 			POSTHandler: s.notAllowedHandler,
 		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/info/messagesize/?$"),
+			LimitConns:  false,
+			GETHandler:  s.getMessageSizeHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/admin/pool/?$"),
+			LimitConns:  false,
+			AdminOnly:   true,
+			GETHandler:  s.getPoolHandler,
+			POSTHandler: s.resizePoolHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/(?:clusters/(?P<cluster>[A-Za-z0-9_-]+)/)?admin/brokers/(?P<broker>[0-9]+)/ping/?$"),
+			LimitConns:  false,
+			AdminOnly:   true,
+			GETHandler:  s.pingBrokerHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/admin/metrics/reset/?$"),
+			LimitConns:  false,
+			AdminOnly:   true,
+			GETHandler:  s.notAllowedHandler,
+			POSTHandler: s.resetMetricsHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/admin/debug/goroutines/?$"),
+			LimitConns:  false,
+			AdminOnly:   true,
+			GETHandler:  s.goroutinesHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/v1/admin/reload/?$"),
+			LimitConns:  false,
+			AdminOnly:   true,
+			GETHandler:  s.notAllowedHandler,
+			POSTHandler: s.reloadHandler,
+		},
 		httpHandler{
 			Regexp:      regexp.MustCompile("^/ping$"),
 			LimitConns:  false,
 			GETHandler:  s.pingHandler,
 			POSTHandler: s.notAllowedHandler,
 		},
+		httpHandler{
+			Regexp:      regexp.MustCompile("^/ready$"),
+			LimitConns:  false,
+			GETHandler:  s.readyHandler,
+			POSTHandler: s.notAllowedHandler,
+		},
 		httpHandler{
 			Regexp:      regexp.MustCompile("^/$"),
 			LimitConns:  false,
@@ -313,83 +833,185 @@ func (s *Server) Run() error {
 		},
 	}
 
-	mux := http.NewServeMux()
-	mux.Handle("/debug/vars", http.DefaultServeMux)
-	mux.Handle("/debug/pprof/", http.DefaultServeMux)
-	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		reqTime := time.Now()
-		resp := &HTTPResponse{w, http.StatusOK, "", 0}
-
-		defer func() {
-			e := log.NewEntry(log.StandardLogger()).WithFields(log.Fields{
-				"stop":    time.Now().String(),
-				"start":   reqTime.String(),
-				"method":  req.Method,
-				"addr":    req.RemoteAddr,
-				"reqlen":  req.ContentLength,
-				"resplen": resp.ResponseLength,
-				"status":  resp.HTTPStatus,
-			})
-
-			if resp.HTTPStatus >= 500 {
-				e = e.WithField("error", resp.HTTPError)
-			}
+	// dispatch returns the handler serving the given routes.
+	dispatch := func(handlers []httpHandler) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			reqTime := time.Now()
+			resp := newHTTPResponse(w, req)
 
-			e.Info(req.URL)
-		}()
+			req, span := s.Tracer.StartRequestSpan(req)
 
-		cl := s.newConnTrack(req)
-		defer s.closeConnTrack(cl)
+			defer func() {
+				span.SetAttribute("http.response.status_code", resp.HTTPStatus)
+				if resp.HTTPStatus >= 500 {
+					span.SetError(errors.New(resp.HTTPError))
+				}
+				span.Finish()
+			}()
+
+			defer func() {
+				e := log.NewEntry(log.StandardLogger()).WithFields(log.Fields{
+					"stop":    time.Now().String(),
+					"start":   reqTime.String(),
+					"method":  req.Method,
+					"addr":    req.RemoteAddr,
+					"reqlen":  req.ContentLength,
+					"resplen": resp.ResponseLength,
+					"status":  resp.HTTPStatus,
+				})
+
+				if resp.HTTPStatus >= 500 {
+					e = e.WithField("error", resp.HTTPError)
+				}
 
-		p := req.URL.Query()
+				if traceID, spanID, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+					e = e.WithFields(log.Fields{
+						"trace_id": traceID,
+						"span_id":  spanID,
+					})
+				}
 
-		for _, a := range handlers {
-			match := a.Regexp.FindStringSubmatch(req.URL.Path)
-			if match == nil {
-				continue
-			}
+				e.Info(req.URL)
+			}()
+
+			cl := s.newConnTrack(req)
+			defer s.closeConnTrack(cl)
 
-			if a.LimitConns && s.Cfg.Global.MaxConns > 0 && cl.Conns >= s.Cfg.Global.MaxConns {
-				s.errorResponse(resp, http.StatusServiceUnavailable, "Too many connections")
+			if s.corsHandler(resp, req) {
 				return
 			}
 
-			for i, name := range a.Regexp.SubexpNames() {
-				if i == 0 {
+			p := req.URL.Query()
+
+			for _, a := range handlers {
+				match := a.Regexp.FindStringSubmatch(req.URL.Path)
+				if match == nil {
 					continue
 				}
-				p.Set(name, match[i])
-			}
 
-			switch req.Method {
-			case "GET":
-				a.GETHandler(resp, req, &p)
-			case "POST":
-				a.POSTHandler(resp, req, &p)
-			case "PUT":
-				a.PUTHandler(resp, req, &p)
-			default:
-				s.notAllowedHandler(resp, req, &p)
+				if a.LimitConns && s.Config().Global.MaxConns > 0 && cl.Conns >= s.Config().Global.MaxConns {
+					s.errorResponse(resp, http.StatusServiceUnavailable, "Too many connections")
+					return
+				}
+
+				if a.AdminOnly && !s.adminAuthorized(resp, req) {
+					return
+				}
+
+				for i, name := range a.Regexp.SubexpNames() {
+					if i == 0 {
+						continue
+					}
+					p.Set(name, match[i])
+				}
+
+				if name := p.Get("cluster"); name != "" {
+					if _, ok := s.Clusters[name]; !ok {
+						s.errorResponse(resp, http.StatusNotFound, "Cluster unknown")
+						return
+					}
+				}
+				resp.client = s.clusterClient(&p)
+
+				if deadline := s.requestDeadline(req); !deadline.IsZero() {
+					ctx, cancel := context.WithDeadline(req.Context(), deadline)
+					defer cancel()
+
+					req = req.WithContext(ctx)
+					resp.deadline = deadline
+				}
+
+				switch req.Method {
+				case "GET":
+					a.GETHandler(resp, req, &p)
+				case "POST":
+					a.POSTHandler(resp, req, &p)
+				case "PUT":
+					a.PUTHandler(resp, req, &p)
+				default:
+					s.notAllowedHandler(resp, req, &p)
+				}
+				return
 			}
+
+			s.notFoundHandler(resp, req, &p)
 			return
 		}
+	}
 
-		s.notFoundHandler(resp, req, &p)
-		return
-	})
+	adminAddress := s.Config().Global.AdminAddress
+
+	var dataHandlers, adminHandlers []httpHandler
+
+	for _, a := range handlers {
+		if a.AdminOnly && adminAddress != "" {
+			adminHandlers = append(adminHandlers, a)
+		} else {
+			dataHandlers = append(dataHandlers, a)
+		}
+	}
+
+	mux := http.NewServeMux()
+	if adminAddress == "" {
+		mux.Handle("/debug/vars", s.adminOnly(http.DefaultServeMux))
+		mux.Handle("/debug/pprof/", s.adminOnly(http.DefaultServeMux))
+	}
+	mux.Handle("/", dispatch(dataHandlers))
 
 	httpServer := &http.Server{
-		Addr:    s.Cfg.Global.Address,
-		Handler: mux,
+		Addr:         s.Config().Global.Address,
+		Handler:      mux,
+		ReadTimeout:  s.Config().Global.ReadTimeout.Duration,
+		WriteTimeout: s.Config().Global.WriteTimeout.Duration,
+		IdleTimeout:  s.Config().Global.IdleTimeout.Duration,
+	}
+
+	errs := make(chan error, 2)
+
+	if adminAddress != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/debug/vars", s.adminOnly(http.DefaultServeMux))
+		adminMux.Handle("/debug/pprof/", s.adminOnly(http.DefaultServeMux))
+		adminMux.Handle("/", dispatch(adminHandlers))
+
+		adminServer := &http.Server{
+			Addr:         adminAddress,
+			Handler:      adminMux,
+			ReadTimeout:  s.Config().Global.ReadTimeout.Duration,
+			WriteTimeout: s.Config().Global.WriteTimeout.Duration,
+			IdleTimeout:  s.Config().Global.IdleTimeout.Duration,
+		}
+
+		s.addHTTPServer(adminServer)
+
+		go func() {
+			errs <- adminServer.ListenAndServe()
+		}()
 	}
 
+	s.addHTTPServer(httpServer)
+
+	go func() {
+		errs <- httpServer.ListenAndServe()
+	}()
+
 	log.Info("Server ready")
-	return httpServer.ListenAndServe()
+	return <-errs
+}
+
+// adminOnly requires the admin credentials for the handler.
+func (s *Server) adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !s.adminAuthorized(newHTTPResponse(w, req), req) {
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
 }
 
 func inSlice(n int32, list []int32) bool {
-	for i := range list {
-		if n == int32(i) {
+	for _, v := range list {
+		if n == v {
 			return true
 		}
 	}
@@ -418,17 +1040,57 @@ func toInt64(s string) int64 {
 	return i
 }
 
-func main() {
-	flag.Parse()
+func toBool(s string) bool {
+	if s == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false
+	}
+	return b
+}
+
+// logFormatter returns the formatter of logs according to the configuration.
+func logFormatter(settings *Config) (log.Formatter, error) {
+	switch settings.Logging.Format {
+	case "", "text":
+		return &log.TextFormatter{
+			FullTimestamp:    settings.Logging.FullTimestamp,
+			DisableTimestamp: settings.Logging.DisableTimestamp,
+			DisableColors:    settings.Logging.DisableColors,
+			DisableSorting:   settings.Logging.DisableSorting,
+		}, nil
+	case "json":
+		return &log.JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown log format: %s", settings.Logging.Format)
+}
+
+// logLevel returns the level of logs according to the configuration.
+// The Logging.Level overrides the deprecated Global.Verbose.
+func logLevel(settings *Config) (log.Level, error) {
+	switch settings.Logging.Level {
+	case "":
+		if settings.Global.Verbose {
+			return log.DebugLevel, nil
+		}
+		return log.InfoLevel, nil
+	case "trace":
+		// There is no more detailed level than debug.
+		return log.DebugLevel, nil
+	}
+	return log.ParseLevel(settings.Logging.Level)
+}
 
+// loadConfig reads the configuration file and applies the command-line options.
+func loadConfig() (*Config, error) {
 	srvConfig := &Config{}
 	srvConfig.SetDefaults()
 
 	if *config != "" {
-		err := cfg.ReadFileInto(srvConfig, *config)
-		if err != nil {
-			fmt.Println("Bad config:", err.Error())
-			os.Exit(1)
+		if err := cfg.ReadFileInto(srvConfig, *config); err != nil {
+			return nil, err
 		}
 	}
 
@@ -444,6 +1106,47 @@ func main() {
 		srvConfig.Kafka.Broker = strings.Split(*brokers, ",")
 	}
 
+	return srvConfig, nil
+}
+
+// connectClient makes the client of Kafka cluster and retries until the
+// brokers are available. The delay between attempts is doubled up to
+// Broker.ReconnectPeriod, so the unavailable cluster does not flood logs.
+func connectClient(cfg *Config, cluster string) *KafkaClient {
+	delay := 100 * time.Millisecond
+
+	for {
+		client, err := NewClient(cfg)
+		if err == nil {
+			return client
+		}
+
+		if cluster == "" {
+			log.Errorf("Unable to make client: %s", err.Error())
+		} else {
+			log.Errorf("Unable to make client for cluster %s: %s", cluster, err.Error())
+		}
+
+		time.Sleep(delay)
+
+		if delay *= 2; delay > cfg.Broker.ReconnectPeriod.Duration {
+			delay = cfg.Broker.ReconnectPeriod.Duration
+		}
+		if delay <= 0 {
+			delay = time.Second
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	srvConfig, err := loadConfig()
+	if err != nil {
+		fmt.Println("Bad config:", err.Error())
+		os.Exit(1)
+	}
+
 	if srvConfig.Global.Address == "" {
 		fmt.Println("Address required")
 		os.Exit(1)
@@ -454,21 +1157,38 @@ func main() {
 		os.Exit(1)
 	}
 
+	for name, cluster := range srvConfig.Cluster {
+		if len(cluster.Broker) == 0 {
+			fmt.Printf("Kafka brokers required for cluster %q\n", name)
+			os.Exit(1)
+		}
+	}
+
+	formatter, err := logFormatter(srvConfig)
+	if err != nil {
+		fmt.Println("Bad config:", err.Error())
+		os.Exit(1)
+	}
+
+	level, err := logLevel(srvConfig)
+	if err != nil {
+		fmt.Println("Bad config:", err.Error())
+		os.Exit(1)
+	}
+
+	schemas, err := NewSchemaRegistry(srvConfig)
+	if err != nil {
+		fmt.Println("Bad schema:", err.Error())
+		os.Exit(1)
+	}
+
 	if *checkConfig {
 		os.Exit(0)
 	}
 
-	log.SetLevel(log.InfoLevel)
-	if srvConfig.Global.Verbose {
-		log.SetLevel(log.DebugLevel)
-	}
+	log.SetLevel(level)
 
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp:    srvConfig.Logging.FullTimestamp,
-		DisableTimestamp: srvConfig.Logging.DisableTimestamp,
-		DisableColors:    srvConfig.Logging.DisableColors,
-		DisableSorting:   srvConfig.Logging.DisableSorting,
-	})
+	log.SetFormatter(formatter)
 
 	pidfile, err := OpenPidfile(srvConfig.Global.Pidfile)
 	if err != nil {
@@ -496,16 +1216,20 @@ func main() {
 	}
 	runtime.GOMAXPROCS(srvConfig.Global.GoMaxProcs)
 
-	var kafkaClient *KafkaClient
-	for {
-		kafkaClient, err = NewClient(srvConfig)
-		if err == nil {
-			break
-		}
-		log.Error("Unable to make client: ", err.Error())
-	}
+	kafkaClient := connectClient(srvConfig, "")
 	defer kafkaClient.Close()
 
+	clusters := make(map[string]*KafkaClient)
+	for name, cluster := range srvConfig.Cluster {
+		clusterConfig := *srvConfig
+		clusterConfig.Kafka.Broker = cluster.Broker
+
+		clusterClient := connectClient(&clusterConfig, name)
+		defer clusterClient.Close()
+
+		clusters[name] = clusterClient
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP)
 	go func() {
@@ -518,17 +1242,41 @@ func main() {
 	}()
 
 	server := &Server{
-		Cfg:         srvConfig,
 		Pidfile:     pidfile,
 		Client:      kafkaClient,
+		Clusters:    clusters,
 		Stats:       NewMetricStats(),
 		MessageSize: NewTopicMessageSize(),
+		Schemas:     schemas,
+		Idempotency: NewIdempotencyCache(srvConfig.Producer.IdempotencyTTL.Duration, srvConfig.Producer.IdempotencyKeys),
+
+		ResponseCache: NewResponseCache(srvConfig.Consumer.ResponseCacheSize, srvConfig.Consumer.ResponseCacheEntries),
+		Consumers:     NewTopicConsumers(),
+		Batcher:       NewProduceBatcher(),
 	}
+	server.SetConfig(srvConfig)
 	defer func() {
 		if err := server.Close(); err != nil {
 			log.Errorln("Failed to close server", err)
 		}
 	}()
 
-	log.Fatal(server.Run())
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, syscall.SIGTERM, syscall.SIGINT)
+
+	drained := make(chan struct{})
+	go func() {
+		sig := <-termChan
+		log.Infof("Got %s, shutting down", sig)
+
+		server.Drain(server.Config().Global.ShutdownTimeout.Duration)
+		close(drained)
+	}()
+
+	if err := server.Run(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-drained
+	log.Info("Server stopped")
 }
@@ -9,39 +9,230 @@ package main
 
 import (
 	"github.com/facebookgo/metrics"
+
+	"container/list"
+	"sort"
+	"sync"
+)
+
+const (
+	// MessageSizeSamples is the number of message sizes kept per topic.
+	MessageSizeSamples = 10000
+
+	// MessageSizePercentile is the percentile of message sizes used as estimate.
+	MessageSizePercentile = 0.75
+
+	// MessageSizeMaxTopics is the number of topics kept by default. The least
+	// recently used topics are evicted first.
+	MessageSizeMaxTopics = 1000
+
+	// AverageSizeWeight is the weight of new value in the moving average of size.
+	AverageSizeWeight = 0.2
+
+	// CompressionRatioWeight is the weight of new value in the moving average of ratio.
+	CompressionRatioWeight = 0.2
+
+	minCompressionRatio = 0.1
+	maxCompressionRatio = 10.0
 )
 
-// TopicMessageSize contains map of topics and their metrics.
+// MessageSizeInfo contains the estimated message size of topic.
+type MessageSizeInfo struct {
+	Cluster  string  `json:"cluster,omitempty"`
+	Topic    string  `json:"topic"`
+	Estimate int32   `json:"estimate"`
+	Average  float64 `json:"average"`
+	Samples  int64   `json:"samples"`
+	Ratio    float64 `json:"ratio"`
+}
+
+type messageSizeInfoByTopic []MessageSizeInfo
+
+func (a messageSizeInfoByTopic) Len() int      { return len(a) }
+func (a messageSizeInfoByTopic) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a messageSizeInfoByTopic) Less(i, j int) bool {
+	if a[i].Cluster != a[j].Cluster {
+		return a[i].Cluster < a[j].Cluster
+	}
+	return a[i].Topic < a[j].Topic
+}
+
+// messageSizeKey identifies the topic. The clusters may have topics with
+// the same name and different messages, so they are estimated separately.
+type messageSizeKey struct {
+	cluster string
+	topic   string
+}
+
+type topicMessageSize struct {
+	key   messageSizeKey
+	sizes metrics.Histogram
+
+	// average is the moving average of message sizes.
+	average float64
+
+	// ratio is the ratio of fetched bytes to decoded message bytes. It is
+	// less than one for compressed topics and zero if unknown.
+	ratio float64
+}
+
+// TopicMessageSize contains the message size estimates of topics. It is safe
+// for concurrent use.
 type TopicMessageSize struct {
-	Topics map[string]metrics.Histogram
+	sync.Mutex
+
+	MaxTopics int
+
+	order  *list.List
+	topics map[messageSizeKey]*list.Element
 }
 
 // NewTopicMessageSize creates a new metric.
 func NewTopicMessageSize() *TopicMessageSize {
-	c := &TopicMessageSize{
-		Topics: make(map[string]metrics.Histogram),
+	return &TopicMessageSize{
+		MaxTopics: MessageSizeMaxTopics,
+		order:     list.New(),
+		topics:    make(map[messageSizeKey]*list.Element),
+	}
+}
+
+// lookup returns the topic and marks it as recently used. If create is
+// true, the unknown topic is added and the least recently used topics are
+// evicted.
+func (c *TopicMessageSize) lookup(cluster, topic string, create bool) *topicMessageSize {
+	key := messageSizeKey{cluster: cluster, topic: topic}
+
+	if e, ok := c.topics[key]; ok {
+		c.order.MoveToBack(e)
+		return e.Value.(*topicMessageSize)
+	}
+
+	if !create {
+		return nil
+	}
+
+	t := &topicMessageSize{
+		key:   key,
+		sizes: metrics.NewHistogram(metrics.NewUniformSample(MessageSizeSamples)),
+	}
+	c.topics[key] = c.order.PushBack(t)
+
+	for c.MaxTopics > 0 && c.order.Len() > c.MaxTopics {
+		e := c.order.Front()
+		c.order.Remove(e)
+		delete(c.topics, e.Value.(*topicMessageSize).key)
 	}
-	return c
+	return t
 }
 
-// Get returns value by topic name.
-func (c *TopicMessageSize) Get(topic string, defval int32) int32 {
-	if val, ok := c.Topics[topic]; ok {
-		ret := int32(val.Percentile(0.75))
-		if ret < 0 {
-			ret = defval
-		}
-		return ret
+// Len returns the number of known topics.
+func (c *TopicMessageSize) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.order.Len()
+}
+
+// Get returns value by cluster and topic name. The default cluster has
+// empty name.
+func (c *TopicMessageSize) Get(cluster, topic string, defval int32) int32 {
+	c.Lock()
+	t := c.lookup(cluster, topic, false)
+	c.Unlock()
+
+	if t == nil {
+		return defval
 	}
-	return defval
+
+	// The histogram has its own lock, so the percentile is calculated
+	// without blocking other topics.
+	ret := int32(t.sizes.Percentile(MessageSizePercentile))
+	if ret < 0 {
+		ret = defval
+	}
+	return ret
 }
 
 // Put adds another raw value to metric.
-func (c *TopicMessageSize) Put(topic string, val int32) {
-	if _, ok := c.Topics[topic]; !ok {
-		c.Topics[topic] = metrics.NewHistogram(metrics.NewUniformSample(10000))
+func (c *TopicMessageSize) Put(cluster, topic string, val int32) {
+	c.Lock()
+	defer c.Unlock()
+
+	t := c.lookup(cluster, topic, true)
+
+	if val <= 0 {
+		return
+	}
+
+	t.sizes.Update(int64(val))
+
+	if t.average == 0 {
+		t.average = float64(val)
+	} else {
+		t.average += AverageSizeWeight * (float64(val) - t.average)
+	}
+}
+
+// Ratio returns the estimated ratio of fetched bytes to decoded message bytes.
+func (c *TopicMessageSize) Ratio(cluster, topic string) float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return ratio(c.lookup(cluster, topic, false))
+}
+
+func ratio(t *topicMessageSize) float64 {
+	if t != nil && t.ratio > 0 {
+		return t.ratio
+	}
+	return 1
+}
+
+// PutRatio adds the number of bytes fetched from Kafka and the number of
+// decoded message bytes to the ratio estimate.
+func (c *TopicMessageSize) PutRatio(cluster, topic string, fetched int64, decoded int64) {
+	if fetched <= 0 || decoded <= 0 {
+		return
+	}
+
+	val := float64(fetched) / float64(decoded)
+
+	if val < minCompressionRatio {
+		val = minCompressionRatio
+	} else if val > maxCompressionRatio {
+		val = maxCompressionRatio
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	t := c.lookup(cluster, topic, true)
+
+	if t.ratio > 0 {
+		val = t.ratio + CompressionRatioWeight*(val-t.ratio)
 	}
-	if val > 0 {
-		c.Topics[topic].Update(int64(val))
+	t.ratio = val
+}
+
+// Info returns estimated message sizes of all known topics.
+func (c *TopicMessageSize) Info() []MessageSizeInfo {
+	c.Lock()
+	defer c.Unlock()
+
+	res := make([]MessageSizeInfo, 0, c.order.Len())
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*topicMessageSize)
+		res = append(res, MessageSizeInfo{
+			Cluster:  t.key.cluster,
+			Topic:    t.key.topic,
+			Estimate: int32(t.sizes.Percentile(MessageSizePercentile)),
+			Average:  t.average,
+			Samples:  t.sizes.Count(),
+			Ratio:    ratio(t),
+		})
 	}
+
+	sort.Sort(messageSizeInfoByTopic(res))
+
+	return res
 }
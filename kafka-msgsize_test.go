@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTopicMessageSize(t *testing.T) {
+	c := NewTopicMessageSize()
+
+	if n := c.Get("", "test", 42); n != 42 {
+		t.Fatalf("expected default value for unknown topic, got %d", n)
+	}
+
+	c.Put("", "test", 100)
+	c.Put("", "test", 200)
+
+	info := c.Info()
+	if len(info) != 1 {
+		t.Fatalf("expected one topic, got %#v", info)
+	}
+
+	if info[0].Samples != 2 || info[0].Average != 120 {
+		t.Fatalf("unexpected estimate: %#v", info[0])
+	}
+
+	if info[0].Ratio != 1 {
+		t.Fatalf("expected ratio 1 without fetches, got %v", info[0].Ratio)
+	}
+}
+
+func TestTopicMessageSizeClusters(t *testing.T) {
+	c := NewTopicMessageSize()
+
+	c.Put("", "test", 100)
+	c.Put("backup", "test", 5000)
+	c.PutRatio("backup", "test", 1, 2)
+
+	if n := c.Get("", "test", 0); n != 100 {
+		t.Fatalf("expected 100 in default cluster, got %d", n)
+	}
+
+	if n := c.Get("backup", "test", 0); n != 5000 {
+		t.Fatalf("expected 5000 in backup cluster, got %d", n)
+	}
+
+	if r := c.Ratio("", "test"); r != 1 {
+		t.Fatalf("expected ratio 1 in default cluster, got %v", r)
+	}
+
+	info := c.Info()
+	if len(info) != 2 || info[0].Cluster != "" || info[1].Cluster != "backup" {
+		t.Fatalf("unexpected info: %#v", info)
+	}
+}
+
+func TestTopicMessageSizeEviction(t *testing.T) {
+	c := NewTopicMessageSize()
+	c.MaxTopics = 2
+
+	c.Put("", "a", 10)
+	c.Put("", "b", 20)
+
+	// Make "a" recently used.
+	if n := c.Get("", "a", 0); n != 10 {
+		t.Fatalf("expected 10, got %d", n)
+	}
+
+	c.PutRatio("", "c", 1, 2)
+
+	if c.Len() != 2 {
+		t.Fatalf("expected 2 topics, got %d", c.Len())
+	}
+
+	if n := c.Get("", "b", -1); n != -1 {
+		t.Fatalf("least recently used topic should be evicted")
+	}
+
+	if n := c.Get("", "a", -1); n != 10 {
+		t.Fatalf("recently used topic should be kept")
+	}
+
+	if r := c.Ratio("", "c"); r != 0.5 {
+		t.Fatalf("expected ratio 0.5, got %v", r)
+	}
+}
+
+func TestTopicMessageSizeConcurrent(t *testing.T) {
+	c := NewTopicMessageSize()
+	c.MaxTopics = 5
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 1000; j++ {
+				topic := fmt.Sprintf("topic-%d", (i+j)%10)
+
+				c.Put("", topic, int32(j+1))
+				c.PutRatio("", topic, int64(j+1), int64(j+2))
+				c.Get("", topic, 0)
+				c.Ratio("", topic)
+
+				if j%100 == 0 {
+					c.Info()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := c.Len(); n != c.MaxTopics {
+		t.Fatalf("expected %d topics, got %d", c.MaxTopics, n)
+	}
+
+	if n := len(c.Info()); n != c.MaxTopics {
+		t.Fatalf("expected %d topics in info, got %d", c.MaxTopics, n)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"github.com/optiopay/kafka/proto"
+
+	"bytes"
+	"fmt"
+)
+
+// The kafka library sends only Offset v0 requests which return the
+// boundaries of log segments instead of the offset of message. The lookup
+// by time is sent as ListOffsets v1 over separate connection to the leader
+// like the group requests. It requires Kafka 0.10.1.
+const KafkaListOffsetsReqKind = 2
+
+var kafkaOffsetErrors = []*proto.KafkaError{
+	proto.ErrUnknown,
+	proto.ErrUnknownTopicOrPartition,
+	proto.ErrLeaderNotAvailable,
+	proto.ErrNotLeaderForPartition,
+	proto.ErrRequestTimeout,
+	proto.ErrTopicAuthorizationFailed,
+}
+
+// kafkaOffsetError converts error code of the ListOffsets response.
+func kafkaOffsetError(errno int16) error {
+	if errno == 0 {
+		return nil
+	}
+	for _, err := range kafkaOffsetErrors {
+		if err.Errno() == int(errno) {
+			return err
+		}
+	}
+	return fmt.Errorf("unknown kafka error %d", errno)
+}
+
+// OffsetByTime returns the offset of the first message of partition with
+// the timestamp greater than or equal to timestamp in milliseconds or -1
+// if there is no such message.
+func (k *KafkaClient) OffsetByTime(topic string, partition int32, timestamp int64) (int64, error) {
+	defer k.Timings.Get("GetOffsetByTime").Start().Stop()
+
+	meta, err := k.FetchMetadata()
+	if err != nil {
+		return -1, err
+	}
+
+	leader, err := meta.leaderAddress(topic, partition)
+	if err != nil {
+		return -1, err
+	}
+
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+
+	enc.Encode(int32(-1)) // replica ID
+	enc.EncodeArrayLen(1)
+	enc.Encode(topic)
+	enc.EncodeArrayLen(1)
+	enc.Encode(partition)
+	enc.Encode(timestamp)
+
+	if enc.Err() != nil {
+		return -1, enc.Err()
+	}
+
+	resp, err := k.kafkaRequestTimeout(leader, KafkaListOffsetsReqKind, proto.KafkaV1, buf.Bytes(), k.GetOffsetsTimeout)
+	if err != nil {
+		return -1, err
+	}
+
+	dec := proto.NewDecoder(resp)
+
+	topics, err := dec.DecodeArrayLen()
+	if err != nil {
+		return -1, err
+	}
+
+	for i := 0; i < topics; i++ {
+		name := dec.DecodeString()
+
+		parts, err := dec.DecodeArrayLen()
+		if err != nil {
+			return -1, err
+		}
+
+		for j := 0; j < parts; j++ {
+			id := dec.DecodeInt32()
+			errno := dec.DecodeInt16()
+			dec.DecodeInt64() // timestamp
+			offset := dec.DecodeInt64()
+
+			if dec.Err() != nil {
+				return -1, dec.Err()
+			}
+
+			if name != topic || id != partition {
+				continue
+			}
+
+			if err := kafkaOffsetError(errno); err != nil {
+				return -1, err
+			}
+			return offset, nil
+		}
+	}
+
+	return -1, proto.ErrUnknownTopicOrPartition
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+func TestGetHandlerTimestamp(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		if req, ok := request.(*RawRequest); ok {
+			dec := proto.NewDecoder(bytes.NewReader(req.Body))
+
+			dec.DecodeInt32()
+			dec.DecodeArrayLen()
+			topic := dec.DecodeString()
+			dec.DecodeArrayLen()
+			partition := dec.DecodeInt32()
+			timestamp := dec.DecodeInt64()
+
+			offset := int64(-1)
+			if timestamp <= 7000 {
+				offset = 7
+			}
+
+			return &testRawResp{
+				CorrelationID: req.CorrelationID,
+				Fields: []interface{}{
+					int32(1),
+					topic,
+					int32(1),
+					partition,
+					int16(0),
+					timestamp,
+					offset,
+				},
+			}
+		}
+
+		req := request.(*proto.OffsetReq)
+		offset := int64(5)
+		if req.Topics[0].Partitions[0].TimeMs == -1 {
+			offset = 10
+		}
+		return &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetRespPartition{
+						{ID: 0, Offsets: []int64{offset}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+
+		var msgs []*proto.Message
+		for i := req.Topics[0].Partitions[0].FetchOffset; i < 10; i++ {
+			msgs = append(msgs, &proto.Message{Offset: i, Value: []byte(fmt.Sprintf(`{"a":%d}`, i))})
+		}
+
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 10, Messages: msgs},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	get := func(p url.Values) *httptest.ResponseRecorder {
+		p.Set("topic", "test")
+		p.Set("partition", "0")
+
+		rec := httptest.NewRecorder()
+		s.getHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/topics/test/0?"+p.Encode(), nil), &p)
+		return rec
+	}
+
+	rec := get(url.Values{"timestamp": []string{"6000"}, "limit": []string{"2"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var res struct {
+		Data struct {
+			Query    kafkaParameters   `json:"query"`
+			Messages []json.RawMessage `json:"messages"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("unable to decode response: %s: %s", err, rec.Body.String())
+	}
+
+	if res.Data.Query.Offset != 7 || len(res.Data.Messages) != 2 || string(res.Data.Messages[0]) != `{"a":7}` {
+		t.Fatalf("unexpected response: %s", rec.Body.String())
+	}
+
+	// There are no messages after the timestamp.
+	if rec := get(url.Values{"timestamp": []string{"8000"}}); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected status 416, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := get(url.Values{"timestamp": []string{"yesterday"}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := get(url.Values{"timestamp": []string{"6000"}, "offset": []string{"5"}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,61 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"github.com/optiopay/kafka/proto"
+
+	"net"
+	"strconv"
+	"time"
+)
+
+// KafkaBrokerPing contains the result of metadata request sent directly
+// to the broker.
+type KafkaBrokerPing struct {
+	Broker  int32  `json:"broker"`
+	Address string `json:"address"`
+	Success bool   `json:"success"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// brokerAddress returns the address of broker by its node ID.
+func (m *KafkaMetadata) brokerAddress(nodeID int32) (string, bool) {
+	for _, b := range m.Metadata.Brokers {
+		if b.NodeID == nodeID {
+			return net.JoinHostPort(b.Host, strconv.Itoa(int(b.Port))), true
+		}
+	}
+	return "", false
+}
+
+// PingBroker sends the metadata request to the broker through a new
+// connection, so the pool is not involved, and measures the round trip.
+func (k *KafkaClient) PingBroker(nodeID int32, addr string) *KafkaBrokerPing {
+	res := &KafkaBrokerPing{
+		Broker:  nodeID,
+		Address: addr,
+	}
+
+	// The metadata of topics is not needed. Version 0 returns all topics
+	// for the empty list, so version 1 is used, where only the null list
+	// means all topics.
+	var topics [4]byte
+
+	start := time.Now()
+	_, err := k.kafkaRequest(addr, proto.MetadataReqKind, 1, topics[:])
+
+	res.Latency = time.Since(start).String()
+	res.Success = err == nil
+
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
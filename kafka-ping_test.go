@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+func TestPingBrokerHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	// The port of closed listener refuses connections.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	deadAddr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		host, port := srv.HostPort()
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+				{NodeID: 2, Host: "127.0.0.1", Port: int32(deadAddr.Port)},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	testCases := []struct {
+		broker  string
+		code    int
+		success bool
+	}{
+		{"1", http.StatusOK, true},
+		{"2", http.StatusOK, false},
+		{"3", http.StatusNotFound, false},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+
+		s.pingBrokerHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("GET", "/v1/admin/brokers/"+tc.broker+"/ping", nil), &url.Values{
+			"broker": []string{tc.broker},
+		})
+
+		if rec.Code != tc.code {
+			t.Fatalf("%s: expected %d, got %d: %s", tc.broker, tc.code, rec.Code, rec.Body.String())
+		}
+
+		if tc.code != http.StatusOK {
+			continue
+		}
+
+		var res struct {
+			Data KafkaBrokerPing `json:"data"`
+		}
+
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: unable to decode response: %v: %s", tc.broker, err, rec.Body.String())
+		}
+
+		if res.Data.Success != tc.success || res.Data.Latency == "" || (res.Data.Error == "") != tc.success {
+			t.Fatalf("%s: unexpected result: %s", tc.broker, rec.Body.String())
+		}
+	}
+}
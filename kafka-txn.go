@@ -0,0 +1,542 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"github.com/optiopay/kafka/proto"
+
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// The transactional requests are not supported by the kafka library, so
+// they are sent over separate short connections like the group requests.
+// They require Kafka 0.11.
+const (
+	KafkaProduceReqKind            = 0
+	KafkaFindCoordinatorReqKind    = 10
+	KafkaInitProducerIDReqKind     = 22
+	KafkaAddPartitionsToTxnReqKind = 24
+	KafkaEndTxnReqKind             = 26
+)
+
+// KafkaCoordinatorTransaction is the key type of FindCoordinator request.
+const KafkaCoordinatorTransaction = 1
+
+// recordBatchTransactional is the attribute of transactional record batch.
+const recordBatchTransactional = 0x10
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// The error codes of transactional responses handled by the proxy.
+const (
+	KafkaTxnErrNotLeaderForPartition int16 = 6
+	KafkaTxnErrInvalidProducerEpoch  int16 = 47
+)
+
+var kafkaTxnErrorNames = map[int16]string{
+	3:                                "unknown topic or partition",
+	KafkaTxnErrNotLeaderForPartition: "not leader for partition",
+	7:                                "request timed out",
+	10:                               "message too large",
+	14:                               "coordinator load in progress",
+	15:                               "coordinator not available",
+	16:                               "not coordinator",
+	19:                               "not enough in-sync replicas",
+	20:                               "written to fewer in-sync replicas than required",
+	29:                               "topic authorization failed",
+	45:                               "out of order sequence number",
+	46:                               "duplicate sequence number",
+	KafkaTxnErrInvalidProducerEpoch:  "producer is fenced by newer epoch",
+	48:                               "invalid transaction state",
+	49:                               "invalid producer ID mapping",
+	50:                               "invalid transaction timeout",
+	51:                               "concurrent transactions",
+	53:                               "transactional ID authorization failed",
+}
+
+// KafkaTxnError is the error code of transactional response.
+type KafkaTxnError struct {
+	Errno int16
+}
+
+func (e KafkaTxnError) Error() string {
+	if name, ok := kafkaTxnErrorNames[e.Errno]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown kafka error %d", e.Errno)
+}
+
+// Retriable returns true if the request may succeed later.
+func (e KafkaTxnError) Retriable() bool {
+	switch e.Errno {
+	case 14, 15, 16, 51:
+		return true
+	}
+	return false
+}
+
+func kafkaTxnError(errno int16) error {
+	if errno == 0 {
+		return nil
+	}
+	return KafkaTxnError{Errno: errno}
+}
+
+// KafkaTransaction is the result of transactional produce.
+type KafkaTransaction struct {
+	ProducerID    int64
+	ProducerEpoch int16
+
+	// Offset is the offset of the first message.
+	Offset int64
+}
+
+// transactionCoordinator returns address of the transaction coordinator.
+// The configured brokers are asked in turn.
+func (k *KafkaClient) transactionCoordinator(txnID string, timeout time.Duration) (string, error) {
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+	enc.Encode(txnID)
+	enc.Encode(int8(KafkaCoordinatorTransaction))
+
+	if enc.Err() != nil {
+		return "", enc.Err()
+	}
+
+	err := error(KhpError{
+		Errno:   KhpErrorNoBrokers,
+		message: "No brokers configured",
+	})
+
+	for _, addr := range k.brokerAddrs {
+		var r io.Reader
+
+		r, err = k.kafkaRequestTimeout(addr, KafkaFindCoordinatorReqKind, proto.KafkaV1, buf.Bytes(), timeout)
+		if err != nil {
+			continue
+		}
+
+		return readFindCoordinatorResp(r)
+	}
+
+	return "", err
+}
+
+// readFindCoordinatorResp decodes the body of FindCoordinator v1 response.
+func readFindCoordinatorResp(r io.Reader) (string, error) {
+	dec := proto.NewDecoder(r)
+
+	// throttle time
+	dec.DecodeInt32()
+
+	errno := dec.DecodeInt16()
+	// error message
+	dec.DecodeString()
+
+	// node ID
+	dec.DecodeInt32()
+	host := dec.DecodeString()
+	port := dec.DecodeInt32()
+
+	if err := dec.Err(); err != nil {
+		return "", err
+	}
+	if err := kafkaTxnError(errno); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// initProducerID gets the producer ID and the new epoch for the
+// transactional ID. The previous producer with the same ID is fenced.
+func (k *KafkaClient) initProducerID(coordinator, txnID string, txnTimeout, timeout time.Duration) (int64, int16, error) {
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+	enc.Encode(txnID)
+	enc.Encode(int32(txnTimeout / time.Millisecond))
+
+	if enc.Err() != nil {
+		return -1, -1, enc.Err()
+	}
+
+	r, err := k.kafkaRequestTimeout(coordinator, KafkaInitProducerIDReqKind, proto.KafkaV0, buf.Bytes(), timeout)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	dec := proto.NewDecoder(r)
+
+	// throttle time
+	dec.DecodeInt32()
+
+	errno := dec.DecodeInt16()
+	producerID := dec.DecodeInt64()
+	epoch := dec.DecodeInt16()
+
+	if err := dec.Err(); err != nil {
+		return -1, -1, err
+	}
+	if err := kafkaTxnError(errno); err != nil {
+		return -1, -1, err
+	}
+	return producerID, epoch, nil
+}
+
+// addPartitionToTxn adds the partition to the transaction.
+func (k *KafkaClient) addPartitionToTxn(coordinator, txnID string, producerID int64, epoch int16, topic string, partition int32, timeout time.Duration) error {
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+	enc.Encode(txnID)
+	enc.Encode(producerID)
+	enc.Encode(epoch)
+	enc.EncodeArrayLen(1)
+	enc.Encode(topic)
+	enc.EncodeArrayLen(1)
+	enc.Encode(partition)
+
+	if enc.Err() != nil {
+		return enc.Err()
+	}
+
+	r, err := k.kafkaRequestTimeout(coordinator, KafkaAddPartitionsToTxnReqKind, proto.KafkaV0, buf.Bytes(), timeout)
+	if err != nil {
+		return err
+	}
+
+	dec := proto.NewDecoder(r)
+
+	// throttle time
+	dec.DecodeInt32()
+
+	var errno int16
+
+	topics, _ := dec.DecodeArrayLen()
+	for i := 0; i < topics; i++ {
+		dec.DecodeString()
+
+		parts, _ := dec.DecodeArrayLen()
+		for j := 0; j < parts; j++ {
+			dec.DecodeInt32()
+			if e := dec.DecodeInt16(); e != 0 {
+				errno = e
+			}
+		}
+	}
+
+	if err := dec.Err(); err != nil {
+		return err
+	}
+	return kafkaTxnError(errno)
+}
+
+// endTxn commits or aborts the transaction.
+func (k *KafkaClient) endTxn(coordinator, txnID string, producerID int64, epoch int16, commit bool, timeout time.Duration) error {
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+	enc.Encode(txnID)
+	enc.Encode(producerID)
+	enc.Encode(epoch)
+
+	if commit {
+		enc.Encode(int8(1))
+	} else {
+		enc.Encode(int8(0))
+	}
+
+	if enc.Err() != nil {
+		return enc.Err()
+	}
+
+	r, err := k.kafkaRequestTimeout(coordinator, KafkaEndTxnReqKind, proto.KafkaV0, buf.Bytes(), timeout)
+	if err != nil {
+		return err
+	}
+
+	dec := proto.NewDecoder(r)
+
+	// throttle time
+	dec.DecodeInt32()
+
+	errno := dec.DecodeInt16()
+
+	if err := dec.Err(); err != nil {
+		return err
+	}
+	return kafkaTxnError(errno)
+}
+
+// putVarint appends the zigzag encoded varint of record.
+func putVarint(buf *bytes.Buffer, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	buf.Write(b[:n])
+}
+
+// putVarBytes appends the length and the bytes or -1 for nil.
+func putVarBytes(buf *bytes.Buffer, b []byte) {
+	if b == nil {
+		putVarint(buf, -1)
+		return
+	}
+	putVarint(buf, int64(len(b)))
+	buf.Write(b)
+}
+
+// encodeRecordBatch returns the record batch (message format v2) of
+// messages. The kafka library writes only the older message sets which
+// can't be transactional.
+func encodeRecordBatch(messages []*proto.Message, producerID int64, epoch int16, transactional bool, now time.Time) []byte {
+	var records bytes.Buffer
+
+	for i, msg := range messages {
+		var rec bytes.Buffer
+
+		// attributes
+		rec.WriteByte(0)
+		// timestamp delta
+		putVarint(&rec, 0)
+		putVarint(&rec, int64(i))
+		putVarBytes(&rec, msg.Key)
+		putVarBytes(&rec, msg.Value)
+		// headers
+		putVarint(&rec, 0)
+
+		putVarint(&records, int64(rec.Len()))
+		records.Write(rec.Bytes())
+	}
+
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+
+	attributes := int16(0)
+	if transactional {
+		attributes |= recordBatchTransactional
+	}
+
+	// The part of batch covered by CRC.
+	var body bytes.Buffer
+	enc := proto.NewEncoder(&body)
+	enc.Encode(attributes)
+	enc.Encode(int32(len(messages) - 1))
+	enc.Encode(timestamp)
+	enc.Encode(timestamp)
+	enc.Encode(producerID)
+	enc.Encode(epoch)
+	// base sequence
+	enc.Encode(int32(0))
+	enc.Encode(int32(len(messages)))
+	body.Write(records.Bytes())
+
+	var batch bytes.Buffer
+	enc = proto.NewEncoder(&batch)
+	// base offset
+	enc.Encode(int64(0))
+	// batch length after this field
+	enc.Encode(int32(4 + 1 + 4 + body.Len()))
+	// partition leader epoch
+	enc.Encode(int32(-1))
+	// magic
+	enc.Encode(int8(2))
+	enc.Encode(crc32.Checksum(body.Bytes(), crc32c))
+	batch.Write(body.Bytes())
+
+	return batch.Bytes()
+}
+
+// produceTxn writes the record batch of transaction to the partition
+// leader and returns the offset of the first message.
+func (k *KafkaClient) produceTxn(leader, txnID string, topic string, partition int32, batch []byte, timeout time.Duration) (int64, error) {
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+	enc.Encode(txnID)
+	// The transaction requires acknowledgment of all replicas.
+	enc.Encode(int16(proto.RequiredAcksAll))
+	enc.Encode(int32(timeout / time.Millisecond))
+	enc.EncodeArrayLen(1)
+	enc.Encode(topic)
+	enc.EncodeArrayLen(1)
+	enc.Encode(partition)
+	enc.Encode(batch)
+
+	if enc.Err() != nil {
+		return -1, enc.Err()
+	}
+
+	r, err := k.kafkaRequestTimeout(leader, KafkaProduceReqKind, proto.KafkaV3, buf.Bytes(), timeout)
+	if err != nil {
+		return -1, err
+	}
+
+	dec := proto.NewDecoder(r)
+
+	offset := int64(-1)
+	errno := int16(0)
+	found := false
+
+	topics, _ := dec.DecodeArrayLen()
+	for i := 0; i < topics; i++ {
+		name := dec.DecodeString()
+
+		parts, _ := dec.DecodeArrayLen()
+		for j := 0; j < parts; j++ {
+			id := dec.DecodeInt32()
+			e := dec.DecodeInt16()
+			base := dec.DecodeInt64()
+			// log append time
+			dec.DecodeInt64()
+
+			if name == topic && id == partition {
+				found = true
+				errno = e
+				offset = base
+			}
+		}
+	}
+
+	if err := dec.Err(); err != nil {
+		return -1, err
+	}
+	if !found {
+		return -1, fmt.Errorf("no response for partition")
+	}
+	if err := kafkaTxnError(errno); err != nil {
+		return -1, err
+	}
+	return offset, nil
+}
+
+// leaderAddress returns address of the partition leader.
+func (m *KafkaMetadata) leaderAddress(topic string, partition int32) (string, error) {
+	leader, err := m.Leader(topic, partition)
+	if err != nil {
+		return "", err
+	}
+
+	for _, b := range m.Metadata.Brokers {
+		if b.NodeID == leader {
+			return net.JoinHostPort(b.Host, strconv.Itoa(int(b.Port))), nil
+		}
+	}
+
+	return "", proto.ErrLeaderNotAvailable
+}
+
+// ProduceTransaction writes the messages to the partition in one
+// transaction of txnID. The messages are either all committed or all
+// aborted. The coordinator requests are retried on the retriable errors
+// RetryLimit times. If deadline is not zero, no request lasts longer than
+// the time left and the timeout is returned as KhpErrorWriteTimeout.
+func (k *KafkaClient) ProduceTransaction(cfg *Config, txnID string, topic string, partition int32, messages []*proto.Message, deadline time.Time) (*KafkaTransaction, error) {
+	defer k.Timings.Get("ProduceTransaction").Start().Stop()
+
+	res, err := k.produceTransaction(cfg, txnID, topic, partition, messages, deadline)
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		err = k.brokerError(KhpErrorWriteTimeout, "Write timeout", -1, topic, partition)
+	}
+	return res, err
+}
+
+func (k *KafkaClient) produceTransaction(cfg *Config, txnID string, topic string, partition int32, messages []*proto.Message, deadline time.Time) (*KafkaTransaction, error) {
+	meta, err := k.FetchMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	leader, err := meta.leaderAddress(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+
+	// timeout returns the timeout of the next request limited by the
+	// deadline. The expired deadline gives the shortest timeout, so the
+	// request fails as timed out.
+	timeout := func(d time.Duration) time.Duration {
+		if deadline.IsZero() {
+			return d
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return time.Nanosecond
+		}
+		if d <= 0 || d > remaining {
+			return remaining
+		}
+		return d
+	}
+
+	var (
+		coordinator string
+		res         KafkaTransaction
+	)
+
+	retry := func(fn func() error) error {
+		var err error
+		for i := 0; ; i++ {
+			if err = fn(); err == nil {
+				return nil
+			}
+			if e, ok := err.(KafkaTxnError); !ok || !e.Retriable() || i >= cfg.Producer.RetryLimit {
+				return err
+			}
+			time.Sleep(cfg.Producer.RetryWait.Duration)
+
+			// The coordinator may have moved.
+			if coordinator, err = k.transactionCoordinator(txnID, timeout(k.GetMetadataTimeout)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if coordinator, err = k.transactionCoordinator(txnID, timeout(k.GetMetadataTimeout)); err != nil {
+		return nil, err
+	}
+
+	txnTimeout := cfg.Producer.TransactionTimeout.Duration
+	sendTimeout := cfg.Producer.SendMessageTimeout.Duration
+
+	err = retry(func() (err error) {
+		res.ProducerID, res.ProducerEpoch, err = k.initProducerID(coordinator, txnID, txnTimeout, timeout(k.GetMetadataTimeout))
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = retry(func() error {
+		return k.addPartitionToTxn(coordinator, txnID, res.ProducerID, res.ProducerEpoch, topic, partition, timeout(k.GetMetadataTimeout))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	batch := encodeRecordBatch(messages, res.ProducerID, res.ProducerEpoch, true, time.Now())
+
+	res.Offset, err = k.produceTxn(leader, txnID, topic, partition, batch, timeout(sendTimeout))
+	if err != nil {
+		// The coordinator aborts the transaction after its timeout anyway.
+		if e := k.endTxn(coordinator, txnID, res.ProducerID, res.ProducerEpoch, false, timeout(sendTimeout)); e != nil {
+			k.brokerConf.Logger.Error("Unable to abort transaction", "txn", txnID, "err", e.Error())
+		}
+		return nil, err
+	}
+
+	err = retry(func() error {
+		return k.endTxn(coordinator, txnID, res.ProducerID, res.ProducerEpoch, true, timeout(sendTimeout))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
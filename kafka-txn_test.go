@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+// testRawResp is the response with the fields encoded in turn. The length
+// of array is int32.
+type testRawResp struct {
+	CorrelationID int32
+	Fields        []interface{}
+}
+
+func (r *testRawResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := proto.NewEncoder(&buf)
+
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	for _, v := range r.Fields {
+		enc.Encode(v)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// readTestRecordBatch checks the record batch and returns its attributes,
+// producer and the values of records.
+func readTestRecordBatch(t *testing.T, b []byte) (int16, int64, []string) {
+	dec := proto.NewDecoder(bytes.NewReader(b))
+
+	dec.DecodeInt64()
+	if n := dec.DecodeInt32(); int(n) != len(b)-12 {
+		t.Fatalf("bad batch length: %d of %d", n, len(b))
+	}
+	dec.DecodeInt32()
+	if magic := dec.DecodeInt8(); magic != 2 {
+		t.Fatalf("bad magic: %d", magic)
+	}
+	if crc := dec.DecodeUint32(); crc != crc32.Checksum(b[21:], crc32c) {
+		t.Fatalf("bad CRC")
+	}
+
+	attributes := dec.DecodeInt16()
+	dec.DecodeInt32()
+	dec.DecodeInt64()
+	dec.DecodeInt64()
+	producerID := dec.DecodeInt64()
+	dec.DecodeInt16()
+	dec.DecodeInt32()
+	count := dec.DecodeInt32()
+
+	if err := dec.Err(); err != nil {
+		t.Fatalf("unable to decode batch: %s", err)
+	}
+
+	records := b[61:]
+	varint := func() int64 {
+		v, n := binary.Varint(records)
+		if n <= 0 {
+			t.Fatalf("bad varint")
+		}
+		records = records[n:]
+		return v
+	}
+
+	var values []string
+
+	for i := int32(0); i < count; i++ {
+		varint()
+		// attributes
+		records = records[1:]
+		varint()
+		if delta := varint(); delta != int64(i) {
+			t.Fatalf("bad offset delta: %d", delta)
+		}
+		if n := varint(); n > 0 {
+			records = records[n:]
+		}
+		n := varint()
+		values = append(values, string(records[:n]))
+		records = records[n:]
+		varint()
+	}
+
+	return attributes, producerID, values
+}
+
+func TestEncodeRecordBatch(t *testing.T) {
+	messages := []*proto.Message{
+		{Key: []byte("k"), Value: []byte(`{"a":1}`)},
+		{Value: []byte(`{"a":2}`)},
+	}
+
+	b := encodeRecordBatch(messages, 7, 1, true, time.Now())
+
+	attributes, producerID, values := readTestRecordBatch(t, b)
+
+	if attributes&recordBatchTransactional == 0 {
+		t.Fatalf("batch is not transactional")
+	}
+	if producerID != 7 {
+		t.Fatalf("unexpected producer ID: %d", producerID)
+	}
+	if len(values) != 2 || values[0] != `{"a":1}` || values[1] != `{"a":2}` {
+		t.Fatalf("unexpected values: %q", values)
+	}
+}
+
+func TestSendTransactionHandler(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	var (
+		inits      int32
+		produceErr int32
+		stall      int32
+	)
+
+	committed := make(chan bool, 1)
+	produced := make(chan []string, 1)
+	host, port := srv.HostPort()
+
+	handleTestMetadata(srv)
+	srv.Handle(ConsumerMetadataRequest, func(request Serializable) Serializable {
+		req := request.(*RawRequest)
+		return &testRawResp{
+			CorrelationID: req.CorrelationID,
+			Fields: []interface{}{
+				int32(0), // throttle time
+				int16(0),
+				"",
+				int32(1),
+				host,
+				int32(port),
+			},
+		}
+	})
+	srv.Handle(InitProducerIDRequest, func(request Serializable) Serializable {
+		req := request.(*RawRequest)
+		errno := int16(0)
+
+		// The first request is retried.
+		if atomic.AddInt32(&inits, 1) == 1 {
+			errno = 51
+		}
+
+		return &testRawResp{
+			CorrelationID: req.CorrelationID,
+			Fields: []interface{}{
+				int32(0), // throttle time
+				errno,
+				int64(7),
+				int16(3),
+			},
+		}
+	})
+	srv.Handle(AddPartitionsToTxnRequest, func(request Serializable) Serializable {
+		req := request.(*RawRequest)
+		return &testRawResp{
+			CorrelationID: req.CorrelationID,
+			Fields: []interface{}{
+				int32(0), // throttle time
+				int32(1),
+				"test",
+				int32(1),
+				int32(0),
+				int16(0),
+			},
+		}
+	})
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*RawRequest)
+
+		dec := proto.NewDecoder(bytes.NewReader(req.Body))
+		if id := dec.DecodeString(); id != "txn" {
+			t.Errorf("unexpected transactional ID: %q", id)
+		}
+		if acks := dec.DecodeInt16(); acks != proto.RequiredAcksAll {
+			t.Errorf("unexpected acks: %d", acks)
+		}
+		dec.DecodeInt32()
+		dec.DecodeArrayLen()
+		dec.DecodeString()
+		dec.DecodeArrayLen()
+		dec.DecodeInt32()
+
+		_, _, values := readTestRecordBatch(t, dec.DecodeBytes())
+		produced <- values
+
+		if atomic.LoadInt32(&stall) == 1 {
+			return nil
+		}
+
+		errno := int16(atomic.LoadInt32(&produceErr))
+
+		return &testRawResp{
+			CorrelationID: req.CorrelationID,
+			Fields: []interface{}{
+				int32(1),
+				"test",
+				int32(1),
+				int32(0),
+				errno,
+				int64(100),
+				int64(-1),
+				int32(0), // throttle time
+			},
+		}
+	})
+	srv.Handle(EndTxnRequest, func(request Serializable) Serializable {
+		req := request.(*RawRequest)
+
+		dec := proto.NewDecoder(bytes.NewReader(req.Body))
+		dec.DecodeString()
+		dec.DecodeInt64()
+		dec.DecodeInt16()
+		committed <- dec.DecodeInt8() == 1
+
+		return &testRawResp{
+			CorrelationID: req.CorrelationID,
+			Fields: []interface{}{
+				int32(0), // throttle time
+				int16(0),
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Producer.RetryWait.Duration = time.Millisecond
+
+	send := func(params url.Values, body string) *httptest.ResponseRecorder {
+		p := url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		}
+		for k, v := range params {
+			p[k] = v
+		}
+
+		rec := httptest.NewRecorder()
+		s.sendTransactionHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/0/transaction?"+p.Encode(), bytes.NewBufferString(body)), &p)
+		return rec
+	}
+
+	body := `[{"key":"k","value":{"a":1}},{"value":{"a":2}}]`
+
+	rec := send(url.Values{"transactional_id": {"txn"}}, body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp struct {
+		Data produceTransactionResult `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unable to decode response: %s", err)
+	}
+
+	expected := produceTransactionResult{
+		Topic:           "test",
+		Partition:       0,
+		Offset:          100,
+		Count:           2,
+		TransactionalID: "txn",
+		ProducerID:      7,
+		ProducerEpoch:   3,
+	}
+	if resp.Data != expected {
+		t.Fatalf("unexpected result: %+v", resp.Data)
+	}
+
+	if values := <-produced; len(values) != 2 || values[1] != `{"a":2}` {
+		t.Fatalf("unexpected values: %q", values)
+	}
+	if !<-committed {
+		t.Fatalf("transaction is not committed")
+	}
+
+	// The failed produce aborts the transaction.
+	atomic.StoreInt32(&produceErr, 19)
+
+	rec = send(url.Values{"transactional_id": {"txn"}}, body)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	<-produced
+	if <-committed {
+		t.Fatalf("transaction is committed")
+	}
+
+	// The transaction doesn't outlast the request deadline.
+	atomic.StoreInt32(&produceErr, 0)
+	atomic.StoreInt32(&stall, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	p := url.Values{
+		"topic":            []string{"test"},
+		"partition":        []string{"0"},
+		"transactional_id": []string{"txn"},
+	}
+	req := httptest.NewRequest("POST", "/v1/topics/test/0/transaction?"+p.Encode(), bytes.NewBufferString(body)).WithContext(ctx)
+
+	start := time.Now()
+	rec = httptest.NewRecorder()
+	s.sendTransactionHandler(&HTTPResponse{ResponseWriter: rec}, req, &p)
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status 504, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("transaction took %s", d)
+	}
+	<-produced
+
+	testCases := []struct {
+		params url.Values
+		body   string
+	}{
+		{url.Values{}, body},
+		{url.Values{"transactional_id": {"txn"}, "acks": {"leader"}}, body},
+		{url.Values{"transactional_id": {"txn"}}, `[]`},
+		{url.Values{"transactional_id": {"txn"}}, `[{"value":{"a":1}},{"key":"k"}]`},
+	}
+
+	for _, tc := range testCases {
+		if rec := send(tc.params, tc.body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%v %s: expected %d, got %d: %s", tc.params, tc.body, http.StatusBadRequest, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -15,7 +15,9 @@ import (
 	log "github.com/Sirupsen/logrus"
 
 	"fmt"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,10 +34,61 @@ var (
 	// KafkaErrUnknownTopicOrPartition is a wrapper over proto.ErrUnknownTopicOrPartition
 	KafkaErrUnknownTopicOrPartition = proto.ErrUnknownTopicOrPartition
 
+	// KafkaErrNotLeaderForPartition is a wrapper over proto.ErrNotLeaderForPartition
+	KafkaErrNotLeaderForPartition = proto.ErrNotLeaderForPartition
+
+	// KafkaErrLeaderNotAvailable is a wrapper over proto.ErrLeaderNotAvailable
+	KafkaErrLeaderNotAvailable = proto.ErrLeaderNotAvailable
+
+	// KafkaErrMessageSizeTooLarge is a wrapper over proto.ErrMessageSizeTooLarge
+	KafkaErrMessageSizeTooLarge = proto.ErrMessageSizeTooLarge
+
 	// KafkaErrNoData is a wrapper over kafka.ErrNoData
 	KafkaErrNoData = kafka.ErrNoData
+
+	// KafkaRequiredAcksAll is a wrapper over proto.RequiredAcksAll
+	KafkaRequiredAcksAll int16 = proto.RequiredAcksAll
+
+	// KafkaRequiredAcksNone is a wrapper over proto.RequiredAcksNone
+	KafkaRequiredAcksNone int16 = proto.RequiredAcksNone
 )
 
+// ParseRequiredAcks converts produce acknowledgment level to the protocol value.
+func ParseRequiredAcks(level string) (int16, error) {
+	switch level {
+	case "none", "0":
+		return proto.RequiredAcksNone, nil
+	case "leader", "1":
+		return proto.RequiredAcksLocal, nil
+	case "all", "-1":
+		return proto.RequiredAcksAll, nil
+	}
+	return 0, fmt.Errorf("unknown acknowledgment level: %s", level)
+}
+
+// RequiredAcksName returns the name of produce acknowledgment level.
+func RequiredAcksName(acks int16) string {
+	switch acks {
+	case proto.RequiredAcksNone:
+		return "none"
+	case proto.RequiredAcksLocal:
+		return "leader"
+	}
+	return "all"
+}
+
+// acksDurability orders the produce acknowledgment levels from the least
+// durable.
+func acksDurability(acks int16) int {
+	switch acks {
+	case proto.RequiredAcksNone:
+		return 0
+	case proto.RequiredAcksLocal:
+		return 1
+	}
+	return 2
+}
+
 const (
 	_ = iota
 	KhpErrorNoBrokers
@@ -51,9 +104,31 @@ const (
 
 type kafkaLogger struct {
 	subsys string
+
+	// retries counts the failed attempts which the kafka library retries.
+	// The library has no hooks, so the attempts are recognized by the
+	// log messages.
+	retries metrics.Counter
+}
+
+// kafkaRetryMessages are logged by the kafka library when a produce or
+// fetch attempt fails and is going to be retried.
+var kafkaRetryMessages = map[string]bool{
+	"Cannot produce messages":                true,
+	"connection died while fetching message": true,
+	"cannot fetch messages: unknown error":   true,
+	"cannot fetch messages":                  true,
+}
+
+func (l *kafkaLogger) countRetry(msg string) {
+	if l.retries != nil && kafkaRetryMessages[msg] {
+		l.retries.Inc(1)
+	}
 }
 
 func (l *kafkaLogger) Debug(msg string, args ...interface{}) {
+	l.countRetry(msg)
+
 	e := log.NewEntry(log.StandardLogger())
 
 	for i := 0; i < len(args); i += 2 {
@@ -65,6 +140,8 @@ func (l *kafkaLogger) Debug(msg string, args ...interface{}) {
 }
 
 func (l *kafkaLogger) Info(msg string, args ...interface{}) {
+	l.countRetry(msg)
+
 	e := log.NewEntry(log.StandardLogger())
 
 	for i := 0; i < len(args); i += 2 {
@@ -76,6 +153,8 @@ func (l *kafkaLogger) Info(msg string, args ...interface{}) {
 }
 
 func (l *kafkaLogger) Warn(msg string, args ...interface{}) {
+	l.countRetry(msg)
+
 	e := log.NewEntry(log.StandardLogger())
 
 	for i := 0; i < len(args); i += 2 {
@@ -87,6 +166,8 @@ func (l *kafkaLogger) Warn(msg string, args ...interface{}) {
 }
 
 func (l *kafkaLogger) Error(msg string, args ...interface{}) {
+	l.countRetry(msg)
+
 	e := log.NewEntry(log.StandardLogger())
 
 	for i := 0; i < len(args); i += 2 {
@@ -101,20 +182,63 @@ func (l *kafkaLogger) Error(msg string, args ...interface{}) {
 type KhpError struct {
 	Errno   int
 	message string
+
+	// BrokerID is the connection from the pool which was in use.
+	BrokerID int64
+
+	// NodeID is the Kafka broker (the partition leader) which was in use
+	// or -1 if unknown.
+	NodeID int32
 }
 
 func (e KhpError) Error() string {
 	return e.message
 }
 
+// brokerError creates KhpError with the identity of the broker which
+// was in use for the partition and logs it.
+func (k *KafkaClient) brokerError(errno int, message string, brokerID int64, topic string, partitionID int32) KhpError {
+	e := k.newBrokerError(errno, message, brokerID, topic, partitionID)
+
+	k.brokerConf.Logger.Error(message, "brokerID", brokerID, "nodeID", e.NodeID, "topic", topic, "partition", partitionID)
+
+	return e
+}
+
+// newBrokerError is brokerError without logging for the expected errors.
+func (k *KafkaClient) newBrokerError(errno int, message string, brokerID int64, topic string, partitionID int32) KhpError {
+	nodeID := k.cachedLeader(topic, partitionID)
+
+	return KhpError{
+		Errno:    errno,
+		message:  fmt.Sprintf("%s (broker %d, connection %d)", message, nodeID, brokerID),
+		BrokerID: brokerID,
+		NodeID:   nodeID,
+	}
+}
+
 // KafkaClient is batch of brokers
 type KafkaClient struct {
 	GetMetadataTimeout  time.Duration
 	MetadataCachePeriod time.Duration
+	MetadataParallelism int
+	MetadataRefreshWait time.Duration
 	GetOffsetsTimeout   time.Duration
 	ReconnectPeriod     time.Duration
+	MaxRetryAfter       time.Duration
+
+	brokerConf  kafka.BrokerConf
+	brokerAddrs []string
+
+	pool struct {
+		sync.RWMutex
+
+		allBrokers   map[int64]*kafka.Broker
+		lastBrokerID int64
+		retire       int64
+	}
 
-	allBrokers    map[int64]*kafka.Broker
+	resizeMu      sync.Mutex
 	deadBrokers   chan int64
 	freeBrokers   chan int64
 	stopReconnect chan struct{}
@@ -124,9 +248,34 @@ type KafkaClient struct {
 
 		lastMetadata       *KafkaMetadata
 		lastUpdateMetadata int64
+		refreshing         int32
+
+		// forcing serializes ForceRefreshMetadata.
+		forcing sync.Mutex
+	}
+
+	groups struct {
+		sync.Mutex
+
+		list    []KafkaGroup
+		updated time.Time
+	}
+
+	apiVersions struct {
+		sync.Mutex
+
+		versions *KafkaAPIVersions
+		updated  time.Time
 	}
 
-	Timings  map[string]metrics.Timer
+	// recoveries contains the times of recent reconnects.
+	recoveries struct {
+		sync.Mutex
+
+		times []time.Time
+	}
+
+	Timings  *Timings
 	Counters map[string]metrics.Counter
 }
 
@@ -145,53 +294,54 @@ func NewClient(settings *Config) (*KafkaClient, error) {
 
 	log.Debug("Gona create broker pool = ", settings.Broker.NumConns)
 
+	maxConns := settings.Broker.MaxNumConns
+	if maxConns < settings.Broker.NumConns {
+		maxConns = settings.Broker.NumConns
+	}
+
 	client := &KafkaClient{
 		GetMetadataTimeout:  settings.Broker.GetMetadataTimeout.Duration,
 		MetadataCachePeriod: settings.Broker.MetadataCachePeriod.Duration,
+		MetadataParallelism: settings.Broker.MetadataParallelism,
+		MetadataRefreshWait: settings.Broker.MetadataRefreshWait.Duration,
 		GetOffsetsTimeout:   settings.Broker.GetOffsetsTimeout.Duration,
 		ReconnectPeriod:     settings.Broker.ReconnectPeriod.Duration,
-		Timings:             NewTimings([]string{"GetMetadata", "GetOffsets", "GetMessage", "SendMessage", "CommitOffset", "FetchOffset"}),
-		Counters:            NewCounters([]string{"DeadBrokers", "FreeBrokers"}),
-		allBrokers:          make(map[int64]*kafka.Broker),
-		deadBrokers:         make(chan int64, settings.Broker.NumConns),
-		freeBrokers:         make(chan int64, settings.Broker.NumConns),
+		MaxRetryAfter:       settings.Broker.MaxRetryAfter.Duration,
+		Timings:             NewTimings([]string{"GetMetadata", "GetOffsets", "GetOffsetByTime", "GetMessage", "SendMessage", "ProduceTransaction", "CommitOffset", "CommitOffsets", "FetchOffset", "ListGroups", "DescribeGroup", "APIVersions"}),
+		Counters:            NewCounters([]string{"DeadBrokers", "FreeBrokers", "AliveBrokers", "Reconnecting", "Reconnects", "ReconnectErrors", "ProduceRetries", "FetchRetries"}),
+		brokerConf:          conf,
+		brokerAddrs:         settings.Kafka.Broker,
+		deadBrokers:         make(chan int64, maxConns),
+		freeBrokers:         make(chan int64, maxConns),
 		stopReconnect:       make(chan struct{}),
 	}
+	client.pool.allBrokers = make(map[int64]*kafka.Broker)
 
-	brokerID := int64(0)
-
-	for brokerID < settings.Broker.NumConns {
-		b, err := kafka.Dial(settings.Kafka.Broker, conf)
-		if err != nil {
-			_ = client.Close()
-			return nil, err
-		}
-
-		client.allBrokers[brokerID] = b
-		client.freeBroker(brokerID)
-		brokerID++
+	if err := client.dialBrokers(settings); err != nil {
+		_ = client.Close()
+		return nil, err
 	}
 
 	if client.MetadataCachePeriod > 0 {
 		go func() {
+			// The cache is filled right away, since the instance isn't
+			// ready until then.
+			wait := time.Duration(0)
+
 			for {
 				select {
-				case <-time.After(client.MetadataCachePeriod):
+				case <-time.After(wait):
 				case <-client.stopReconnect:
 					return
 				}
 
-				meta, err := client.GetMetadata()
-				if err != nil {
+				wait = client.MetadataCachePeriod
+
+				if _, err := client.RefreshMetadata(); err != nil {
 					conf.Logger.Error("Unable to fetch metadata", "err", err.Error())
 					continue
 				}
 
-				client.cache.Lock()
-				client.cache.lastMetadata = meta
-				client.cache.lastUpdateMetadata = time.Now().UnixNano()
-				client.cache.Unlock()
-
 				conf.Logger.Info("Got new metadata by schedule")
 			}
 		}()
@@ -222,16 +372,25 @@ func NewClient(settings *Config) (*KafkaClient, error) {
 				return
 			}
 			client.Counters["DeadBrokers"].Dec(1)
+			client.Counters["Reconnecting"].Inc(1)
 
 			go func(id int64) {
-				client.allBrokers[id].Close()
+				client.broker(id).Close()
 				for {
-					b, goErr := kafka.Dial(settings.Kafka.Broker, conf)
+					b, goErr := kafka.Dial(client.brokerAddrs, client.brokerConf)
 					if goErr == nil {
-						client.allBrokers[id] = b
+						client.pool.Lock()
+						client.pool.allBrokers[id] = b
+						client.pool.Unlock()
+
+						client.Counters["AliveBrokers"].Inc(1)
+						client.Counters["Reconnecting"].Dec(1)
+						client.Counters["Reconnects"].Inc(1)
+						client.recordRecovery(time.Now())
 						client.freeBroker(id)
 						break
 					}
+					client.Counters["ReconnectErrors"].Inc(1)
 					conf.Logger.Error("Unable to reconnect", "brokerID", id, "err", goErr.Error())
 				}
 				conf.Logger.Info("Connection was reset", "brokerID", id)
@@ -242,15 +401,245 @@ func NewClient(settings *Config) (*KafkaClient, error) {
 	return client, nil
 }
 
+// renewBroker replaces the connection with the new one, so its metadata is
+// fetched again. The kafka library has no way to refresh the metadata of
+// connection from outside. The connection must be taken from the pool.
+func (k *KafkaClient) renewBroker(brokerID int64) error {
+	b, err := kafka.Dial(k.brokerAddrs, k.brokerConf)
+	if err != nil {
+		k.Counters["ReconnectErrors"].Inc(1)
+		return err
+	}
+
+	k.pool.Lock()
+	old := k.pool.allBrokers[brokerID]
+	k.pool.allBrokers[brokerID] = b
+	k.pool.Unlock()
+
+	old.Close()
+
+	k.Counters["Reconnects"].Inc(1)
+	return nil
+}
+
 // Close closes all brokers.
 func (k *KafkaClient) Close() error {
 	close(k.stopReconnect)
-	for _, broker := range k.allBrokers {
+	k.CloseBrokers()
+	return nil
+}
+
+// CloseBrokers closes all connections of the pool. The operations in
+// progress fail, but the client is not stopped.
+func (k *KafkaClient) CloseBrokers() {
+	k.pool.RLock()
+	defer k.pool.RUnlock()
+
+	for _, broker := range k.pool.allBrokers {
 		broker.Close()
 	}
+}
+
+func (k *KafkaClient) broker(brokerID int64) *kafka.Broker {
+	k.pool.RLock()
+	defer k.pool.RUnlock()
+
+	return k.pool.allBrokers[brokerID]
+}
+
+// maxDialRetryWait limits the backoff between dial attempts.
+const maxDialRetryWait = 10 * time.Second
+
+// dialBrokers creates the initial connection pool. Failed dials are retried
+// with backoff during DialRetryPeriod. If at least MinConns connections are
+// made, the rest of pool is filled in background.
+func (k *KafkaClient) dialBrokers(settings *Config) error {
+	numConns := settings.Broker.NumConns
+
+	minConns := settings.Broker.MinConns
+	if minConns <= 0 || minConns > numConns {
+		minConns = numConns
+	}
+
+	deadline := time.Now().Add(settings.Broker.DialRetryPeriod.Duration)
+	wait := settings.Broker.DialRetryWait.Duration
+
+	conf := k.brokerConf
+	if settings.Broker.DialRetryPeriod.Duration > 0 {
+		// The backoff replaces the retries of the kafka library.
+		conf.DialRetryLimit = 1
+	}
+
+	for conns := int64(0); conns < numConns; {
+		err := k.dialBroker(conf)
+		if err == nil {
+			conns++
+			continue
+		}
+
+		if conns >= minConns {
+			k.brokerConf.Logger.Error("Unable to fill connection pool, continue in background", "conns", conns, "err", err.Error())
+			go k.fillBrokers(numConns-conns, wait)
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return err
+		}
+
+		k.brokerConf.Logger.Error("Unable to connect, retrying", "conns", conns, "wait", wait, "err", err.Error())
+
+		time.Sleep(wait)
+		wait = nextDialRetryWait(wait)
+	}
+
 	return nil
 }
 
+// fillBrokers adds the connections to pool until success.
+func (k *KafkaClient) fillBrokers(count int64, wait time.Duration) {
+	for count > 0 {
+		select {
+		case <-time.After(wait):
+		case <-k.stopReconnect:
+			return
+		}
+
+		if err := k.addBroker(); err != nil {
+			k.brokerConf.Logger.Error("Unable to connect", "err", err.Error())
+			wait = nextDialRetryWait(wait)
+			continue
+		}
+		count--
+	}
+
+	k.brokerConf.Logger.Info("Connection pool is filled")
+}
+
+func nextDialRetryWait(wait time.Duration) time.Duration {
+	wait *= 2
+	if wait <= 0 || wait > maxDialRetryWait {
+		wait = maxDialRetryWait
+	}
+	return wait
+}
+
+func (k *KafkaClient) addBroker() error {
+	return k.dialBroker(k.brokerConf)
+}
+
+func (k *KafkaClient) dialBroker(conf kafka.BrokerConf) error {
+	b, err := kafka.Dial(k.brokerAddrs, conf)
+	if err != nil {
+		return err
+	}
+
+	k.pool.Lock()
+	brokerID := k.pool.lastBrokerID
+	k.pool.lastBrokerID++
+	k.pool.allBrokers[brokerID] = b
+	k.pool.Unlock()
+
+	k.Counters["AliveBrokers"].Inc(1)
+	k.freeBroker(brokerID)
+	return nil
+}
+
+// retireBroker closes the broker if the pool is waiting to shrink.
+func (k *KafkaClient) retireBroker(brokerID int64) bool {
+	k.pool.Lock()
+
+	if k.pool.retire == 0 {
+		k.pool.Unlock()
+		return false
+	}
+
+	b := k.pool.allBrokers[brokerID]
+	delete(k.pool.allBrokers, brokerID)
+	k.pool.retire--
+	k.pool.Unlock()
+
+	k.Counters["AliveBrokers"].Dec(1)
+
+	b.Close()
+	return true
+}
+
+// PoolSize returns the number of connections in the pool.
+func (k *KafkaClient) PoolSize() int64 {
+	k.pool.RLock()
+	defer k.pool.RUnlock()
+
+	return int64(len(k.pool.allBrokers)) - k.pool.retire
+}
+
+// FreeBrokers returns the number of connections available in the pool.
+func (k *KafkaClient) FreeBrokers() int {
+	return len(k.freeBrokers)
+}
+
+// AliveBrokers returns the number of connections which are not broken,
+// both free and in use.
+func (k *KafkaClient) AliveBrokers() int64 {
+	return k.Counters["AliveBrokers"].Count()
+}
+
+// MaxPoolSize returns the maximum number of connections in the pool.
+func (k *KafkaClient) MaxPoolSize() int64 {
+	return int64(cap(k.freeBrokers))
+}
+
+// ResizePool grows or shrinks the pool of connections. Busy connections
+// are closed when they are returned to the pool.
+func (k *KafkaClient) ResizePool(numConns int64) error {
+	if numConns <= 0 || numConns > k.MaxPoolSize() {
+		return fmt.Errorf("pool size must be between 1 and %d", k.MaxPoolSize())
+	}
+
+	k.resizeMu.Lock()
+	defer k.resizeMu.Unlock()
+
+	for size := k.PoolSize(); size < numConns; size++ {
+		k.pool.Lock()
+		if k.pool.retire > 0 {
+			k.pool.retire--
+			k.pool.Unlock()
+			continue
+		}
+		k.pool.Unlock()
+
+		if err := k.addBroker(); err != nil {
+			return err
+		}
+	}
+
+	for size := k.PoolSize(); size > numConns; size-- {
+		k.pool.Lock()
+		k.pool.retire++
+		k.pool.Unlock()
+
+		select {
+		case brokerID := <-k.freeBrokers:
+			k.Counters["FreeBrokers"].Dec(1)
+			k.retireBroker(brokerID)
+		default:
+		}
+	}
+
+	return nil
+}
+
+// ResetStatistics clears the accumulated timings, reconnect and retry
+// counters. The counters of the connection pool reflect its state and
+// are kept.
+func (k *KafkaClient) ResetStatistics() {
+	k.Timings.Reset()
+	k.Counters["Reconnects"].Clear()
+	k.Counters["ReconnectErrors"].Clear()
+	k.Counters["ProduceRetries"].Clear()
+	k.Counters["FetchRetries"].Clear()
+}
+
 // Broker returns first availiable broker or error.
 func (k *KafkaClient) getBroker() (int64, error) {
 	select {
@@ -267,12 +656,87 @@ func (k *KafkaClient) getBroker() (int64, error) {
 	}
 }
 
+// recoveryRateWindow is the period in which the recovery rate of broken
+// connections is measured.
+const recoveryRateWindow = time.Minute
+
+// recordRecovery remembers the time of reconnect.
+func (k *KafkaClient) recordRecovery(now time.Time) {
+	k.recoveries.Lock()
+	defer k.recoveries.Unlock()
+
+	k.recoveries.times = append(recentRecoveries(k.recoveries.times, now), now)
+}
+
+// recentRecoveries drops the reconnects which are out of the window.
+func recentRecoveries(times []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > recoveryRateWindow {
+		i++
+	}
+	return times[i:]
+}
+
+// SuggestedRetryAfter estimates when a connection becomes free. If there
+// are broken connections, it is the average interval between recent
+// reconnects limited by MaxRetryAfter. Otherwise all connections are just
+// busy and the minimal delay is suggested.
+func (k *KafkaClient) SuggestedRetryAfter() time.Duration {
+	if k.Counters["DeadBrokers"].Count()+k.Counters["Reconnecting"].Count() == 0 {
+		return time.Second
+	}
+
+	k.recoveries.Lock()
+	k.recoveries.times = recentRecoveries(k.recoveries.times, time.Now())
+	n := len(k.recoveries.times)
+	k.recoveries.Unlock()
+
+	if n == 0 {
+		return k.MaxRetryAfter
+	}
+
+	d := recoveryRateWindow / time.Duration(n)
+
+	if d < time.Second {
+		d = time.Second
+	}
+	if d > k.MaxRetryAfter {
+		d = k.MaxRetryAfter
+	}
+	return d
+}
+
+// getBrokers returns up to n availiable brokers. At least one broker is
+// returned or error.
+func (k *KafkaClient) getBrokers(n int) ([]int64, error) {
+	brokerID, err := k.getBroker()
+	if err != nil {
+		return nil, err
+	}
+
+	brokerIDs := []int64{brokerID}
+
+	for len(brokerIDs) < n {
+		brokerID, err := k.getBroker()
+		if err != nil {
+			break
+		}
+		brokerIDs = append(brokerIDs, brokerID)
+	}
+
+	return brokerIDs, nil
+}
+
 func (k *KafkaClient) freeBroker(brokerID int64) {
+	if k.retireBroker(brokerID) {
+		return
+	}
 	k.freeBrokers <- brokerID
 	k.Counters["FreeBrokers"].Inc(1)
 }
 
 func (k *KafkaClient) deadBroker(brokerID int64) {
+	k.Counters["AliveBrokers"].Dec(1)
 	k.deadBrokers <- brokerID
 	k.Counters["DeadBrokers"].Inc(1)
 }
@@ -284,7 +748,7 @@ func (k *KafkaClient) GetOffsets(topic string, partitionID int32) (int64, int64,
 		return 0, 0, err
 	}
 
-	defer k.Timings["GetOffsets"].Start().Stop()
+	defer k.Timings.Get("GetOffsets").Start().Stop()
 
 	type offsetInfo struct {
 		result  int64
@@ -292,8 +756,8 @@ func (k *KafkaClient) GetOffsets(topic string, partitionID int32) (int64, int64,
 	}
 
 	offsets := []offsetInfo{
-		offsetInfo{0, k.allBrokers[brokerID].OffsetEarliest},
-		offsetInfo{0, k.allBrokers[brokerID].OffsetLatest},
+		offsetInfo{0, k.broker(brokerID).OffsetEarliest},
+		offsetInfo{0, k.broker(brokerID).OffsetLatest},
 	}
 
 	results := make(chan error, 2)
@@ -339,10 +803,7 @@ func (k *KafkaClient) GetOffsets(topic string, partitionID int32) (int64, int64,
 			}
 		case <-timeout:
 			isTimeout = true
-			err = KhpError{
-				Errno:   KhpErrorReadTimeout,
-				message: "Read timeout",
-			}
+			err = k.brokerError(KhpErrorReadTimeout, "Read timeout", brokerID, topic, partitionID)
 			break
 		}
 	}
@@ -360,47 +821,207 @@ func (k *KafkaClient) GetOffsets(topic string, partitionID int32) (int64, int64,
 type KafkaMetadata struct {
 	client   *KafkaClient
 	Metadata *proto.MetadataResp
+
+	// Updated is the time (in nanoseconds) when the metadata was received.
+	Updated int64
 }
 
 // GetMetadata returns metadata from kafka.
-func (k *KafkaClient) GetMetadata() (meta *KafkaMetadata, err error) {
-	brokerID, err := k.getBroker()
+func (k *KafkaClient) GetMetadata() (*KafkaMetadata, error) {
+	brokerIDs, err := k.getBrokers(k.MetadataParallelism)
 	if err != nil {
 		return nil, err
 	}
 
-	defer k.Timings["GetMetadata"].Start().Stop()
+	defer k.Timings.Get("GetMetadata").Start().Stop()
 
-	result := make(chan struct{})
+	results := make(chan metadataResult, len(brokerIDs))
 	timeout := make(chan struct{})
 
+	var timer *time.Timer
+
 	if k.GetMetadataTimeout > 0 {
-		timer := time.AfterFunc(k.GetMetadataTimeout, func() { close(timeout) })
-		defer timer.Stop()
+		timer = time.AfterFunc(k.GetMetadataTimeout, func() { close(timeout) })
+	}
+
+	outstanding := make(map[int64]struct{}, len(brokerIDs))
+
+	for _, brokerID := range brokerIDs {
+		outstanding[brokerID] = struct{}{}
+
+		go func(brokerID int64) {
+			resp, err := k.broker(brokerID).Metadata()
+			results <- metadataResult{
+				brokerID: brokerID,
+				resp:     resp,
+				err:      err,
+			}
+		}(brokerID)
 	}
 
 	var kafkaErr error
-	meta = &KafkaMetadata{
-		client: k,
+
+	for len(outstanding) > 0 {
+		select {
+		case res := <-results:
+			delete(outstanding, res.brokerID)
+			k.freeBroker(res.brokerID)
+
+			if res.err != nil {
+				kafkaErr = res.err
+				continue
+			}
+
+			// The slower brokers are released in background.
+			go k.releaseMetadataBrokers(outstanding, results, timeout, timer)
+
+			return &KafkaMetadata{
+				client:   k,
+				Metadata: res.resp,
+				Updated:  time.Now().UnixNano(),
+			}, nil
+		case <-timeout:
+			for brokerID := range outstanding {
+				k.deadBroker(brokerID)
+			}
+			return nil, KhpError{
+				Errno:   KhpErrorMetadataReadTimeout,
+				message: "Read timeout",
+			}
+		}
+	}
+
+	if timer != nil {
+		timer.Stop()
+	}
+	return nil, kafkaErr
+}
+
+type metadataResult struct {
+	brokerID int64
+	resp     *proto.MetadataResp
+	err      error
+}
+
+// releaseMetadataBrokers frees the brokers which respond after the first
+// one and marks dead the ones which don't respond in time.
+func (k *KafkaClient) releaseMetadataBrokers(outstanding map[int64]struct{}, results <-chan metadataResult, timeout <-chan struct{}, timer *time.Timer) {
+	for len(outstanding) > 0 {
+		select {
+		case res := <-results:
+			delete(outstanding, res.brokerID)
+			k.freeBroker(res.brokerID)
+		case <-timeout:
+			for brokerID := range outstanding {
+				k.deadBroker(brokerID)
+			}
+			return
+		}
+	}
+
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// RefreshMetadata returns metadata from kafka and updates internal cache.
+func (k *KafkaClient) RefreshMetadata() (*KafkaMetadata, error) {
+	meta, err := k.GetMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	k.cache.Lock()
+	k.cache.lastMetadata = meta
+	k.cache.lastUpdateMetadata = meta.Updated
+	k.cache.Unlock()
+
+	return meta, nil
+}
+
+// ForceRefreshMetadata bypasses the cache and returns metadata from kafka.
+// The requests waiting for the refresh share one result, and the cached
+// metadata younger than MetadataRefreshWait is returned as is, so
+// the brokers get at most one such request per period.
+func (k *KafkaClient) ForceRefreshMetadata() (*KafkaMetadata, error) {
+	k.cache.forcing.Lock()
+	defer k.cache.forcing.Unlock()
+
+	k.cache.RLock()
+	meta := k.cache.lastMetadata
+	updated := k.cache.lastUpdateMetadata
+	k.cache.RUnlock()
+
+	if meta != nil && time.Now().UnixNano()-updated < int64(k.MetadataRefreshWait) {
+		return meta, nil
+	}
+
+	return k.RefreshMetadata()
+}
+
+// MetadataCached returns true if the metadata is cached or the cache is
+// disabled.
+func (k *KafkaClient) MetadataCached() bool {
+	if k.MetadataCachePeriod <= 0 {
+		return true
+	}
+
+	k.cache.RLock()
+	defer k.cache.RUnlock()
+
+	return k.cache.lastUpdateMetadata > 0
+}
+
+// InvalidateMetadata refreshes the cached metadata in background. It is
+// used when an operation fails because the partition leader has moved.
+func (k *KafkaClient) InvalidateMetadata() {
+	if k.MetadataCachePeriod <= 0 {
+		return
+	}
+
+	// Only one refresh at a time.
+	if !atomic.CompareAndSwapInt32(&k.cache.refreshing, 0, 1) {
+		return
 	}
 
 	go func() {
-		meta.Metadata, kafkaErr = k.allBrokers[brokerID].Metadata()
-		close(result)
-	}()
+		defer atomic.StoreInt32(&k.cache.refreshing, 0)
 
-	select {
-	case <-result:
-		k.freeBroker(brokerID)
-		err = kafkaErr
-	case <-timeout:
-		k.deadBroker(brokerID)
-		err = KhpError{
-			Errno:   KhpErrorMetadataReadTimeout,
-			message: "Read timeout",
+		if _, err := k.RefreshMetadata(); err != nil {
+			k.brokerConf.Logger.Error("Unable to refresh metadata", "err", err.Error())
+			return
 		}
+
+		k.brokerConf.Logger.Info("Got new metadata after invalidation")
+	}()
+}
+
+// isMetadataError returns true if the error means that the metadata
+// of partition is stale.
+func isMetadataError(err error) bool {
+	switch err {
+	case proto.ErrNotLeaderForPartition, proto.ErrLeaderNotAvailable, proto.ErrUnknownTopicOrPartition:
+		return true
 	}
-	return
+	return false
+}
+
+// cachedLeader returns the leader of partition from the cached metadata
+// or -1 if unknown. It never requests metadata from kafka.
+func (k *KafkaClient) cachedLeader(topic string, partitionID int32) int32 {
+	k.cache.RLock()
+	meta := k.cache.lastMetadata
+	k.cache.RUnlock()
+
+	if meta == nil {
+		return -1
+	}
+
+	leader, err := meta.Leader(topic, partitionID)
+	if err != nil {
+		return -1
+	}
+	return leader
 }
 
 // FetchMetadata returns metadata from kafka but use internal cache.
@@ -423,27 +1044,87 @@ func (k *KafkaClient) FetchMetadata() (*KafkaMetadata, error) {
 	return k.GetMetadata()
 }
 
-// Topics returns list of known topics
-func (m *KafkaMetadata) Topics() ([]string, error) {
+// Topics returns list of known topics including topics with errors.
+// Use TopicError to check the state of topic.
+func (m *KafkaMetadata) Topics() []string {
 	var topics []string
 
 	for _, topic := range m.Metadata.Topics {
-		if topic.Err != nil && topic.Err != proto.ErrLeaderNotAvailable {
-			return nil, topic.Err
-		}
 		topics = append(topics, topic.Name)
 	}
 
-	return topics, nil
+	return topics
 }
 
-func (m *KafkaMetadata) inTopics(name string) (bool, error) {
-	for _, topic := range m.Metadata.Topics {
-		if topic.Err != nil {
-			return false, topic.Err
+// Brokers returns the number of brokers in cluster.
+func (m *KafkaMetadata) Brokers() int {
+	return len(m.Metadata.Brokers)
+}
+
+// ControllerID returns the ID of the controller broker or -1 if
+// the metadata response doesn't contain it.
+func (m *KafkaMetadata) ControllerID() int32 {
+	if m.Metadata.Version < proto.KafkaV1 {
+		return -1
+	}
+	return m.Metadata.ControllerID
+}
+
+// PartitionsCount returns the number of partitions of all topics and
+// the number of partitions without a leader.
+func (m *KafkaMetadata) PartitionsCount() (total int, offline int) {
+	for _, t := range m.Metadata.Topics {
+		for _, p := range t.Partitions {
+			total++
+			if p.Leader < 0 || p.Err == proto.ErrLeaderNotAvailable {
+				offline++
+			}
 		}
+	}
+	return
+}
 
-		if name == topic.Name {
+// topicError returns the error of topic metadata. The topic without
+// a leader is not considered broken.
+func topicError(t *proto.MetadataRespTopic) error {
+	if t.Err == proto.ErrLeaderNotAvailable {
+		return nil
+	}
+	return t.Err
+}
+
+// TopicError returns the error of topic from metadata.
+func (m *KafkaMetadata) TopicError(name string) error {
+	for i := range m.Metadata.Topics {
+		if m.Metadata.Topics[i].Name == name {
+			return topicError(&m.Metadata.Topics[i])
+		}
+	}
+	return nil
+}
+
+// PartitionError returns the error of partition from metadata.
+func (m *KafkaMetadata) PartitionError(topic string, partitionID int32) error {
+	for _, t := range m.Metadata.Topics {
+		if t.Name != topic {
+			continue
+		}
+
+		for _, p := range t.Partitions {
+			if p.ID == partitionID {
+				return p.Err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *KafkaMetadata) inTopics(name string) (bool, error) {
+	for i := range m.Metadata.Topics {
+		if name == m.Metadata.Topics[i].Name {
+			if err := topicError(&m.Metadata.Topics[i]); err != nil {
+				return false, err
+			}
 			return true, nil
 		}
 	}
@@ -462,14 +1143,14 @@ func (m *KafkaMetadata) getPartitions(topic string, pType partitionType) ([]int3
 	var partitions []int32
 
 	for _, t := range m.Metadata.Topics {
-		if t.Err != nil {
-			return nil, t.Err
-		}
-
 		if t.Name != topic {
 			continue
 		}
 
+		if err := topicError(&t); err != nil {
+			return nil, err
+		}
+
 		for _, p := range t.Partitions {
 			if pType == writablePartitions && p.Err == proto.ErrLeaderNotAvailable {
 				continue
@@ -494,14 +1175,14 @@ func (m *KafkaMetadata) WritablePartitions(topic string) ([]int32, error) {
 // Leader returns the ID of the node which is the leader for partition.
 func (m *KafkaMetadata) Leader(topic string, partitionID int32) (int32, error) {
 	for _, t := range m.Metadata.Topics {
-		if t.Err != nil {
-			return -1, t.Err
-		}
-
 		if t.Name != topic {
 			continue
 		}
 
+		if err := topicError(&t); err != nil {
+			return -1, err
+		}
+
 		for _, p := range t.Partitions {
 			if p.ID != partitionID {
 				continue
@@ -516,14 +1197,14 @@ func (m *KafkaMetadata) Leader(topic string, partitionID int32) (int32, error) {
 // Replicas returns list of replicas for partition.
 func (m *KafkaMetadata) Replicas(topic string, partitionID int32) ([]int32, error) {
 	for _, t := range m.Metadata.Topics {
-		if t.Err != nil {
-			return nil, t.Err
-		}
-
 		if t.Name != topic {
 			continue
 		}
 
+		if err := topicError(&t); err != nil {
+			return nil, err
+		}
+
 		for _, p := range t.Partitions {
 			if p.ID != partitionID {
 				continue
@@ -536,13 +1217,76 @@ func (m *KafkaMetadata) Replicas(topic string, partitionID int32) ([]int32, erro
 	return isr, nil
 }
 
-// KafkaConsumer is a wrapper around kafka.Consumer.
+// AssignedReplicas returns list of all replicas assigned to partition
+// including the ones which are out of sync.
+func (m *KafkaMetadata) AssignedReplicas(topic string, partitionID int32) ([]int32, error) {
+	for _, t := range m.Metadata.Topics {
+		if t.Name != topic {
+			continue
+		}
+
+		if err := topicError(&t); err != nil {
+			return nil, err
+		}
+
+		for _, p := range t.Partitions {
+			if p.ID != partitionID {
+				continue
+			}
+			return p.Replicas, nil
+		}
+	}
+
+	var replicas []int32
+	return replicas, nil
+}
+
+// UnderReplicated returns list of partitions which have less in-sync
+// replicas than assigned ones.
+func (m *KafkaMetadata) UnderReplicated(topic string) ([]int32, error) {
+	var partitions []int32
+
+	for _, t := range m.Metadata.Topics {
+		if t.Name != topic {
+			continue
+		}
+
+		if err := topicError(&t); err != nil {
+			return nil, err
+		}
+
+		for _, p := range t.Partitions {
+			if len(p.Isrs) < len(p.Replicas) {
+				partitions = append(partitions, p.ID)
+			}
+		}
+	}
+
+	return partitions, nil
+}
+
+// KafkaConsumer is a wrapper around kafka.BatchConsumer. The messages are
+// fetched in batches, so the consumer knows the size of fetch responses.
 type KafkaConsumer struct {
 	client            *KafkaClient
 	brokerID          int64
-	consumer          kafka.Consumer
+	topic             string
+	partitionID       int32
+	consumer          kafka.BatchConsumer
 	opened            bool
 	GetMessageTimeout time.Duration
+
+	// Deadline is the end of request. The read timeout at the deadline is
+	// expected, so it isn't logged as the error of broker.
+	Deadline time.Time
+
+	maxFetchSize int32
+	msgbuf       []*proto.Message
+
+	// fetched is the number of bytes of the full fetch responses and
+	// decoded is the size of message values in them.
+	fetched int64
+	decoded int64
 }
 
 // NewConsumer creates a new Consumer.
@@ -557,7 +1301,8 @@ func (k *KafkaClient) NewConsumer(settings *Config, topic string, partitionID in
 	conf := kafka.NewConsumerConf(topic, partitionID)
 
 	conf.Logger = &kafkaLogger{
-		subsys: "kafka/consumer",
+		subsys:  "kafka/consumer",
+		retries: k.Counters["FetchRetries"],
 	}
 
 	conf.RequestTimeout = settings.Consumer.RequestTimeout.Duration
@@ -569,7 +1314,7 @@ func (k *KafkaClient) NewConsumer(settings *Config, topic string, partitionID in
 	conf.MaxFetchSize = settings.Consumer.MaxFetchSize
 	conf.StartOffset = offset
 
-	consumer, err := k.allBrokers[brokerID].Consumer(conf)
+	consumer, err := k.broker(brokerID).BatchConsumer(conf)
 	if err != nil {
 		k.freeBroker(brokerID)
 		return nil, err
@@ -578,9 +1323,12 @@ func (k *KafkaClient) NewConsumer(settings *Config, topic string, partitionID in
 	return &KafkaConsumer{
 		client:            k,
 		brokerID:          brokerID,
+		topic:             topic,
+		partitionID:       partitionID,
 		consumer:          consumer,
 		opened:            true,
 		GetMessageTimeout: settings.Consumer.GetMessageTimeout.Duration,
+		maxFetchSize:      conf.MaxFetchSize,
 	}, nil
 }
 
@@ -612,37 +1360,70 @@ func (c *KafkaConsumer) Message() (msg *proto.Message, err error) {
 		return
 	}
 
-	defer c.client.Timings["GetMessage"].Start().Stop()
+	defer c.client.Timings.Get("GetMessage").Start().Stop()
 
-	result := make(chan struct{})
-	timeout := make(chan struct{})
+	if len(c.msgbuf) == 0 {
+		result := make(chan struct{})
+		timeout := make(chan struct{})
 
-	if c.GetMessageTimeout > 0 {
-		timer := time.AfterFunc(c.GetMessageTimeout, func() { close(timeout) })
-		defer timer.Stop()
-	}
+		if c.GetMessageTimeout > 0 {
+			timer := time.AfterFunc(c.GetMessageTimeout, func() { close(timeout) })
+			defer timer.Stop()
+		}
 
-	var kafkaMsg *proto.Message
-	var kafkaErr error
+		var kafkaMsgs []*proto.Message
+		var kafkaErr error
 
-	go func() {
-		kafkaMsg, kafkaErr = c.consumer.Consume()
-		close(result)
-	}()
+		go func() {
+			kafkaMsgs, kafkaErr = c.consumer.ConsumeBatch()
+			close(result)
+		}()
 
-	select {
-	case <-result:
-		msg, err = kafkaMsg, kafkaErr
-	case <-timeout:
-		c.Corrupt()
-		err = KhpError{
-			Errno:   KhpErrorReadTimeout,
-			message: "Read timeout",
+		select {
+		case <-result:
+			if kafkaErr != nil {
+				err = kafkaErr
+				return
+			}
+			c.putBatch(kafkaMsgs)
+		case <-timeout:
+			c.Corrupt()
+			if !c.Deadline.IsZero() && !time.Now().Before(c.Deadline) {
+				err = c.client.newBrokerError(KhpErrorReadTimeout, "Read timeout", c.brokerID, c.topic, c.partitionID)
+			} else {
+				err = c.client.brokerError(KhpErrorReadTimeout, "Read timeout", c.brokerID, c.topic, c.partitionID)
+			}
+			return
 		}
 	}
+
+	msg, c.msgbuf = c.msgbuf[0], c.msgbuf[1:]
 	return
 }
 
+// putBatch buffers the messages of one fetch response. The response which
+// ends before the tip of partition has been cut by the fetch size, so its
+// size is known.
+func (c *KafkaConsumer) putBatch(msgs []*proto.Message) {
+	c.msgbuf = msgs
+
+	last := msgs[len(msgs)-1]
+	if last.Offset+1 >= last.TipOffset {
+		return
+	}
+
+	c.fetched += int64(c.maxFetchSize)
+	for _, msg := range msgs {
+		c.decoded += int64(len(msg.Value))
+	}
+}
+
+// FetchedSize returns the number of bytes of the full fetch responses and
+// the size of message values in them.
+func (c *KafkaConsumer) FetchedSize() (fetched int64, decoded int64) {
+	return c.fetched, c.decoded
+}
+
 // KafkaProducer is a wrapper around kafka.Producer.
 type KafkaProducer struct {
 	client             *KafkaClient
@@ -650,6 +1431,7 @@ type KafkaProducer struct {
 	producer           kafka.Producer
 	opened             bool
 	SendMessageTimeout time.Duration
+	RequiredAcks       int16
 }
 
 // NewProducer creates a new Producer.
@@ -662,20 +1444,22 @@ func (k *KafkaClient) NewProducer(settings *Config) (*KafkaProducer, error) {
 	conf := kafka.NewProducerConf()
 
 	conf.Logger = &kafkaLogger{
-		subsys: "kafka/producer",
+		subsys:  "kafka/producer",
+		retries: k.Counters["ProduceRetries"],
 	}
 
 	conf.RequestTimeout = settings.Producer.RequestTimeout.Duration
 	conf.RetryLimit = settings.Producer.RetryLimit
 	conf.RetryWait = settings.Producer.RetryWait.Duration
-	conf.RequiredAcks = proto.RequiredAcksAll
+	conf.RequiredAcks = settings.Producer.RequiredAcks.Value
 
 	return &KafkaProducer{
 		client:             k,
 		brokerID:           brokerID,
-		producer:           k.allBrokers[brokerID].Producer(conf),
+		producer:           k.broker(brokerID).Producer(conf),
 		opened:             true,
 		SendMessageTimeout: settings.Producer.SendMessageTimeout.Duration,
+		RequiredAcks:       settings.Producer.RequiredAcks.Value,
 	}, nil
 }
 
@@ -697,8 +1481,31 @@ func (p *KafkaProducer) Corrupt() {
 	p.opened = false
 }
 
+// Renew reconnects the producer to get the new metadata of cluster. If the
+// connection can't be made, it is marked as broken.
+func (p *KafkaProducer) Renew() error {
+	if !p.opened {
+		return nil
+	}
+	if err := p.client.renewBroker(p.brokerID); err != nil {
+		p.Corrupt()
+		return err
+	}
+	return nil
+}
+
 // SendMessage sends message in kafka.
-func (p *KafkaProducer) SendMessage(topic string, partitionID int32, message []byte) (offset int64, err error) {
+func (p *KafkaProducer) SendMessage(topic string, partitionID int32, key []byte, message []byte) (offset int64, err error) {
+	return p.SendMessages(topic, partitionID, &proto.Message{
+		Key:   key,
+		Value: message,
+	})
+}
+
+// SendMessages sends messages to the partition in one request. It returns
+// the offset of the first message or -1 if the broker doesn't acknowledge
+// the request and the offset is unknown.
+func (p *KafkaProducer) SendMessages(topic string, partitionID int32, messages ...*proto.Message) (offset int64, err error) {
 	if !p.opened {
 		err = KhpError{
 			Errno:   KhpErrorProducerClosed,
@@ -707,7 +1514,7 @@ func (p *KafkaProducer) SendMessage(topic string, partitionID int32, message []b
 		return
 	}
 
-	defer p.client.Timings["SendMessage"].Start().Stop()
+	defer p.client.Timings.Get("SendMessage").Start().Stop()
 
 	result := make(chan struct{})
 	timeout := make(chan struct{})
@@ -721,21 +1528,20 @@ func (p *KafkaProducer) SendMessage(topic string, partitionID int32, message []b
 	var kafkaErr error
 
 	go func() {
-		kafkaOffset, kafkaErr = p.producer.Produce(topic, partitionID, &proto.Message{
-			Value: message,
-		})
+		kafkaOffset, kafkaErr = p.producer.Produce(topic, partitionID, messages...)
 		close(result)
 	}()
 
 	select {
 	case <-result:
 		offset, err = kafkaOffset, kafkaErr
+
+		if err == nil && p.RequiredAcks == proto.RequiredAcksNone {
+			offset = -1
+		}
 	case <-timeout:
 		p.Corrupt()
-		err = KhpError{
-			Errno:   KhpErrorWriteTimeout,
-			message: "Write timeout",
-		}
+		err = p.client.brokerError(KhpErrorWriteTimeout, "Write timeout", p.brokerID, topic, partitionID)
 	}
 	return
 }
@@ -744,6 +1550,7 @@ func (p *KafkaProducer) SendMessage(topic string, partitionID int32, message []b
 type KafkaOffsetCoordinator struct {
 	client              *KafkaClient
 	brokerID            int64
+	consumerGroup       string
 	offsetCoordinator   kafka.OffsetCoordinator
 	opened              bool
 	CommitOffsetTimeout time.Duration
@@ -766,7 +1573,7 @@ func (k *KafkaClient) NewOffsetCoordinator(settings *Config, consumerGroup strin
 	conf.RetryErrLimit = settings.OffsetCoordinator.RetryErrLimit
 	conf.RetryErrWait = settings.OffsetCoordinator.RetryErrWait.Duration
 
-	coordinator, err := k.allBrokers[brokerID].OffsetCoordinator(conf)
+	coordinator, err := k.broker(brokerID).OffsetCoordinator(conf)
 	if err != nil {
 		return nil, err
 	}
@@ -774,6 +1581,7 @@ func (k *KafkaClient) NewOffsetCoordinator(settings *Config, consumerGroup strin
 	return &KafkaOffsetCoordinator{
 		client:              k,
 		brokerID:            brokerID,
+		consumerGroup:       consumerGroup,
 		offsetCoordinator:   coordinator,
 		opened:              true,
 		CommitOffsetTimeout: settings.OffsetCoordinator.CommitOffsetTimeout.Duration,
@@ -800,7 +1608,9 @@ func (p *KafkaOffsetCoordinator) Corrupt() {
 }
 
 // CommitOffset commits consumer group offset of a given topic partition to kafka.
-func (c *KafkaOffsetCoordinator) CommitOffset(topic string, partitionID int32, offset int64) (err error) {
+// The offset is kept for the retention time or for the default retention of
+// broker if the retention is zero.
+func (c *KafkaOffsetCoordinator) CommitOffset(topic string, partitionID int32, offset int64, retention time.Duration) (err error) {
 	if !c.opened {
 		err = KhpError{
 			Errno:   KhpErrorOffsetCoordinatorClosed,
@@ -809,7 +1619,20 @@ func (c *KafkaOffsetCoordinator) CommitOffset(topic string, partitionID int32, o
 		return
 	}
 
-	defer c.client.Timings["CommitOffset"].Start().Stop()
+	defer c.client.Timings.Get("CommitOffset").Start().Stop()
+
+	// The commit with retention doesn't use the connection of pool, so
+	// only its own connection is closed on timeout.
+	if retention > 0 {
+		err = c.client.commitOffsetRetention(c.consumerGroup, topic, partitionID, offset, retention, c.CommitOffsetTimeout)
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			err = KhpError{
+				Errno:   KhpErrorOffsetCommitTimeout,
+				message: "Offset commit timeout",
+			}
+		}
+		return
+	}
 
 	result := make(chan struct{})
 	timeout := make(chan struct{})
@@ -849,7 +1672,7 @@ func (c *KafkaOffsetCoordinator) FetchOffset(topic string, partitionID int32) (o
 		return
 	}
 
-	defer c.client.Timings["FetchOffset"].Start().Stop()
+	defer c.client.Timings.Get("FetchOffset").Start().Stop()
 
 	result := make(chan struct{})
 	timeout := make(chan struct{})
@@ -3,10 +3,12 @@ package main
 import (
 	//	"fmt"
 	//	"net"
-	//	"strings"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/facebookgo/metrics"
 	"github.com/optiopay/kafka/proto"
 
 	log "github.com/Sirupsen/logrus"
@@ -184,6 +186,25 @@ func TestConsumer(t *testing.T) {
 	kafkaClient.Close()
 }
 
+func TestConsumerFetchedSize(t *testing.T) {
+	c := &KafkaConsumer{maxFetchSize: 100}
+
+	// The response cut by the fetch size is counted.
+	c.putBatch([]*proto.Message{
+		{Offset: 0, TipOffset: 10, Value: []byte("12345")},
+		{Offset: 1, TipOffset: 10, Value: []byte("123")},
+	})
+
+	// The size of response which reaches the tip is unknown.
+	c.putBatch([]*proto.Message{
+		{Offset: 9, TipOffset: 10, Value: []byte("1234567890")},
+	})
+
+	if fetched, decoded := c.FetchedSize(); fetched != 100 || decoded != 8 {
+		t.Fatalf("expected 100 bytes fetched and 8 decoded, got %d and %d", fetched, decoded)
+	}
+}
+
 func TestConsumerTimeout(t *testing.T) {
 	srv := NewKafkaServer()
 	srv.Start()
@@ -266,6 +287,14 @@ func TestConsumerTimeout(t *testing.T) {
 		t.Fatalf("expected KhpErrorReadTimeout, got %s", err)
 	}
 
+	if err.(KhpError).BrokerID != consumer.brokerID {
+		t.Fatalf("expected broker connection %d, got %s", consumer.brokerID, err)
+	}
+
+	if !strings.Contains(err.Error(), "connection") {
+		t.Fatalf("expected broker identity in error, got %s", err)
+	}
+
 	if msg != nil {
 		t.Fatalf("unexpected result: %#v", msg)
 	}
@@ -273,3 +302,317 @@ func TestConsumerTimeout(t *testing.T) {
 	consumer.Close()
 	kafkaClient.Close()
 }
+
+func TestResizePool(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	cfg := &Config{}
+	cfg.SetDefaults()
+	cfg.Kafka.Broker = []string{srv.Address()}
+	cfg.Global.Verbose = true
+	cfg.Broker.NumConns = 2
+	cfg.Broker.MaxNumConns = 4
+
+	//log.SetLevel(log.DebugLevel)
+	setLogFormat(cfg)
+
+	kafkaClient, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("unable to make client: %s", err)
+	}
+
+	if err := kafkaClient.ResizePool(5); err == nil {
+		t.Fatalf("resized pool beyond the limit")
+	}
+
+	if err := kafkaClient.ResizePool(4); err != nil {
+		t.Fatalf("unable to resize pool: %s", err)
+	}
+
+	if size := kafkaClient.PoolSize(); size != 4 {
+		t.Fatalf("expected pool size 4, got %d", size)
+	}
+
+	var ids []int64
+	for i := 0; i < 4; i++ {
+		id, err := kafkaClient.getBroker()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := kafkaClient.ResizePool(1); err != nil {
+		t.Fatalf("unable to resize pool: %s", err)
+	}
+
+	if size := kafkaClient.PoolSize(); size != 1 {
+		t.Fatalf("expected pool size 1, got %d", size)
+	}
+
+	for _, id := range ids {
+		kafkaClient.freeBroker(id)
+	}
+
+	if _, err := kafkaClient.getBroker(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := kafkaClient.getBroker(); err == nil {
+		t.Fatalf("got broker, but shouldn't have")
+	}
+
+	kafkaClient.Close()
+}
+
+func TestPartialMetadata(t *testing.T) {
+	meta := &KafkaMetadata{
+		Metadata: &proto.MetadataResp{
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "broken",
+					Err:  proto.ErrUnknown,
+				},
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1},
+						{ID: 1, Leader: -1, Err: proto.ErrLeaderNotAvailable},
+					},
+				},
+			},
+		},
+	}
+
+	if topics := meta.Topics(); len(topics) != 2 {
+		t.Fatalf("expected 2 topics, got %v", topics)
+	}
+
+	if err := meta.TopicError("broken"); err != proto.ErrUnknown {
+		t.Fatalf("expected error of broken topic, got %v", err)
+	}
+
+	parts, err := meta.Partitions("test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("expected 2 partitions, got %v", parts)
+	}
+
+	wp, err := meta.WritablePartitions("test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(wp) != 1 || wp[0] != 0 {
+		t.Fatalf("expected writable partition 0, got %v", wp)
+	}
+
+	if err := meta.PartitionError("test", 1); err != proto.ErrLeaderNotAvailable {
+		t.Fatalf("expected error of partition 1, got %v", err)
+	}
+
+	if _, err := meta.Partitions("broken"); err == nil {
+		t.Fatalf("expected error of broken topic")
+	}
+}
+
+func TestClusterMetadata(t *testing.T) {
+	meta := &KafkaMetadata{
+		Metadata: &proto.MetadataResp{
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1},
+				{NodeID: 2},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1},
+						{ID: 1, Leader: -1, Err: proto.ErrLeaderNotAvailable},
+						{ID: 2, Leader: 2},
+					},
+				},
+			},
+		},
+	}
+
+	if n := meta.Brokers(); n != 2 {
+		t.Fatalf("expected 2 brokers, got %d", n)
+	}
+
+	if id := meta.ControllerID(); id != -1 {
+		t.Fatalf("expected unknown controller, got %d", id)
+	}
+
+	total, offline := meta.PartitionsCount()
+	if total != 3 || offline != 1 {
+		t.Fatalf("expected 3 partitions and 1 offline, got %d and %d", total, offline)
+	}
+}
+
+func TestInvalidateMetadata(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	cfg := &Config{}
+	cfg.SetDefaults()
+	cfg.Kafka.Broker = []string{srv.Address()}
+	cfg.Broker.NumConns = 1
+	cfg.Broker.MetadataCachePeriod.Duration = time.Hour
+
+	setLogFormat(cfg)
+
+	kafkaClient, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("unable to make client: %s", err)
+	}
+	defer kafkaClient.Close()
+
+	kafkaClient.InvalidateMetadata()
+
+	for i := 0; i < 100; i++ {
+		kafkaClient.cache.RLock()
+		updated := kafkaClient.cache.lastUpdateMetadata
+		kafkaClient.cache.RUnlock()
+
+		if updated > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("metadata was not refreshed")
+}
+
+func TestDialRetry(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	addr := srv.Address()
+	srv.Close()
+
+	cfg := &Config{}
+	cfg.SetDefaults()
+	cfg.Kafka.Broker = []string{addr}
+	cfg.Broker.NumConns = 1
+	cfg.Broker.DialRetryPeriod.Duration = 200 * time.Millisecond
+	cfg.Broker.DialRetryWait.Duration = 50 * time.Millisecond
+
+	setLogFormat(cfg)
+
+	start := time.Now()
+
+	if _, err := NewClient(cfg); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if elapsed := time.Since(start); elapsed < cfg.Broker.DialRetryPeriod.Duration {
+		t.Fatalf("expected retries for %s, gave up after %s", cfg.Broker.DialRetryPeriod.Duration, elapsed)
+	}
+}
+
+func TestKafkaLoggerRetries(t *testing.T) {
+	l := &kafkaLogger{
+		subsys:  "test",
+		retries: metrics.NewCounter(),
+	}
+
+	l.Debug("Cannot produce messages", "retry", 0, "topic", "test")
+	l.Debug("cannot fetch messages", "retry", 1)
+	l.Debug("new metadata cached")
+	l.Info("Cannot produce messages", "retry", 1)
+
+	if n := l.retries.Count(); n != 3 {
+		t.Fatalf("expected 3 retries, got %d", n)
+	}
+}
+
+func TestMetadataParallelism(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	var slow int32
+
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		if atomic.CompareAndSwapInt32(&slow, 1, 0) {
+			time.Sleep(500 * time.Millisecond)
+		}
+		host, port := srv.HostPort()
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+			},
+		}
+	})
+
+	cfg := &Config{}
+	cfg.SetDefaults()
+	cfg.Kafka.Broker = []string{srv.Address()}
+	cfg.Broker.NumConns = 2
+	cfg.Broker.MetadataParallelism = 2
+	cfg.Broker.MetadataCachePeriod.Duration = 0
+	cfg.Broker.GetMetadataTimeout.Duration = 5 * time.Second
+
+	setLogFormat(cfg)
+
+	kafkaClient, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("unable to make client: %s", err)
+	}
+	defer kafkaClient.Close()
+
+	atomic.StoreInt32(&slow, 1)
+
+	start := time.Now()
+
+	if _, err := kafkaClient.GetMetadata(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Fatalf("response of the slow broker was awaited: %s", elapsed)
+	}
+
+	// The slow broker returns to the pool when it responds.
+	for i := 0; i < 100; i++ {
+		if kafkaClient.Counters["FreeBrokers"].Count() == 2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("expected 2 free brokers, got %d", kafkaClient.Counters["FreeBrokers"].Count())
+}
+
+func TestSuggestedRetryAfter(t *testing.T) {
+	client := &KafkaClient{
+		Counters:      NewCounters([]string{"DeadBrokers", "Reconnecting"}),
+		MaxRetryAfter: 30 * time.Second,
+	}
+
+	if d := client.SuggestedRetryAfter(); d != time.Second {
+		t.Fatalf("unexpected retry after without dead brokers: %s", d)
+	}
+
+	client.Counters["DeadBrokers"].Inc(1)
+
+	if d := client.SuggestedRetryAfter(); d != 30*time.Second {
+		t.Fatalf("unexpected retry after without recoveries: %s", d)
+	}
+
+	now := time.Now()
+
+	client.recordRecovery(now.Add(-2 * recoveryRateWindow))
+	for i := 0; i < 6; i++ {
+		client.recordRecovery(now)
+	}
+
+	if d := client.SuggestedRetryAfter(); d != 10*time.Second {
+		t.Fatalf("unexpected retry after: %s", d)
+	}
+}
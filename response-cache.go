@@ -0,0 +1,114 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// ResponseCacheEntry contains the encoded messages of consume request.
+type ResponseCacheEntry struct {
+	// Messages is a comma separated list of encoded messages.
+	Messages []byte
+
+	// Offset is the offset of the next message after the last one.
+	Offset int64
+}
+
+type responseCacheItem struct {
+	key   string
+	entry ResponseCacheEntry
+}
+
+// ResponseCache keeps recent consume responses in the immutable part of
+// partitions. The least recently used responses are evicted first.
+type ResponseCache struct {
+	sync.Mutex
+
+	MaxSize    int64
+	MaxEntries int
+
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// NewResponseCache creates new ResponseCache object.
+func NewResponseCache(maxSize int64, maxEntries int) *ResponseCache {
+	return &ResponseCache{
+		MaxSize:    maxSize,
+		MaxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// Enabled returns true if consume responses should be cached.
+func (c *ResponseCache) Enabled() bool {
+	return c.MaxSize > 0 && c.MaxEntries > 0
+}
+
+// ResponseCacheKey returns the cache key of consume request.
+func ResponseCacheKey(cluster, topic string, partition int32, offset int64, limit int32, fields messageFields) string {
+	return fmt.Sprintf("%s/%s/%d/%d/%d/%v", cluster, topic, partition, offset, limit, fields)
+}
+
+// Len returns the number of cached responses.
+func (c *ResponseCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.order.Len()
+}
+
+// Get returns the cached response by the key.
+func (c *ResponseCache) Get(key string) (ResponseCacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToBack(e)
+		return e.Value.(*responseCacheItem).entry, true
+	}
+	return ResponseCacheEntry{}, false
+}
+
+// Put stores the response with the key. The responses larger than
+// the whole cache are ignored.
+func (c *ResponseCache) Put(key string, entry ResponseCacheEntry) {
+	if int64(len(entry.Messages)) > c.MaxSize {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+
+	c.entries[key] = c.order.PushBack(&responseCacheItem{
+		key:   key,
+		entry: entry,
+	})
+	c.size += int64(len(entry.Messages))
+
+	for c.order.Len() > c.MaxEntries || c.size > c.MaxSize {
+		c.remove(c.order.Front())
+	}
+}
+
+func (c *ResponseCache) remove(e *list.Element) {
+	item := e.Value.(*responseCacheItem)
+
+	c.order.Remove(e)
+	delete(c.entries, item.key)
+	c.size -= int64(len(item.entry.Messages))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResponseCache(t *testing.T) {
+	cache := NewResponseCache(1024, 2)
+
+	if !cache.Enabled() {
+		t.Fatalf("cache should be enabled")
+	}
+
+	cache.Put("a", ResponseCacheEntry{Messages: []byte(`{"a":1}`), Offset: 1})
+	cache.Put("b", ResponseCacheEntry{Messages: []byte(`{"b":1}`), Offset: 2})
+
+	// Make "a" recently used.
+	if res, ok := cache.Get("a"); !ok || res.Offset != 1 {
+		t.Fatalf("expected offset 1, got %#v", res)
+	}
+
+	cache.Put("c", ResponseCacheEntry{Messages: []byte(`{"c":1}`), Offset: 3})
+
+	if _, ok := cache.Get("b"); ok {
+		t.Fatalf("least recently used key should be evicted")
+	}
+
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatalf("recently used key should be kept")
+	}
+}
+
+func TestResponseCacheSize(t *testing.T) {
+	cache := NewResponseCache(10, 100)
+
+	cache.Put("a", ResponseCacheEntry{Messages: []byte(`123456`)})
+	cache.Put("b", ResponseCacheEntry{Messages: []byte(`123456`)})
+
+	if _, ok := cache.Get("a"); ok {
+		t.Fatalf("oldest key should be evicted by size")
+	}
+
+	cache.Put("c", ResponseCacheEntry{Messages: []byte(`12345678901`)})
+
+	if _, ok := cache.Get("c"); ok {
+		t.Fatalf("response larger than cache should not be stored")
+	}
+
+	if cache.Len() != 1 {
+		t.Fatalf("expected 1 entry, got %d", cache.Len())
+	}
+}
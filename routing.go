@@ -0,0 +1,133 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"mime"
+	"strings"
+)
+
+// Partitioners are the names of hashes used to choose the partition by key.
+const (
+	PartitionerFNV1a   = "fnv1a"
+	PartitionerMurmur2 = "murmur2"
+)
+
+var partitioners = []string{PartitionerFNV1a, PartitionerMurmur2}
+
+// keyPartition returns the partition for the message key. The longest
+// matching prefix from the routes wins. Otherwise the key is hashed in
+// the same way as kafka.NewHashProducer does or, with murmur2 partitioner,
+// as the default partitioner of Java client does.
+func keyPartition(routes []CfgRoute, partitioner string, key string, numPartitions int32) int32 {
+	found := -1
+
+	for i, route := range routes {
+		if !strings.HasPrefix(key, route.Prefix) {
+			continue
+		}
+		if found < 0 || len(route.Prefix) > len(routes[found].Prefix) {
+			found = i
+		}
+	}
+
+	if found >= 0 {
+		return routes[found].Partition
+	}
+
+	if partitioner == PartitionerMurmur2 {
+		return int32(murmur2([]byte(key))&0x7fffffff) % numPartitions
+	}
+
+	sum := int32(keyHash(partitioner, key))
+	if sum < 0 {
+		sum = -sum
+	}
+	return sum % numPartitions
+}
+
+// keyHash returns the hash of the message key used by partitioner.
+func keyHash(partitioner string, key string) uint32 {
+	if partitioner == PartitionerMurmur2 {
+		return murmur2([]byte(key))
+	}
+
+	hasher := fnv.New32a()
+	hasher.Write([]byte(key))
+	return hasher.Sum32()
+}
+
+// murmur2 returns MurmurHash2 of data with the seed of Kafka clients.
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return h
+}
+
+// contentTypeTopic returns the topic for the Content-Type header from
+// the ContentType section of config.
+func contentTypeTopic(types map[string]*struct{ Topic string }, contentType string) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+
+	for name, value := range types {
+		if strings.EqualFold(name, mediaType) {
+			return value.Topic, nil
+		}
+	}
+	return "", fmt.Errorf("no topic for %s", mediaType)
+}
+
+// isJSONMediaType returns true if the Content-Type header is application/json
+// or any type with the +json suffix.
+func isJSONMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
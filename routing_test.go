@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKeyPartition(t *testing.T) {
+	routes := []CfgRoute{
+		{Prefix: "tenant-", Partition: 1},
+		{Prefix: "tenant-a", Partition: 2},
+		{Prefix: "tenant-b", Partition: 3},
+	}
+
+	testCases := []struct {
+		key       string
+		partition int32
+	}{
+		{"tenant-a:42", 2},
+		{"tenant-b", 3},
+		{"tenant-c", 1},
+	}
+
+	for _, tc := range testCases {
+		if n := keyPartition(routes, PartitionerFNV1a, tc.key, 4); n != tc.partition {
+			t.Fatalf("%s: expected partition %d, got %d", tc.key, tc.partition, n)
+		}
+	}
+
+	n := keyPartition(routes, PartitionerFNV1a, "other", 4)
+	if n < 0 || n >= 4 {
+		t.Fatalf("partition out of range: %d", n)
+	}
+
+	if keyPartition(nil, PartitionerFNV1a, "other", 4) != n {
+		t.Fatalf("hash of key is not stable")
+	}
+}
+
+func TestMurmur2(t *testing.T) {
+	// The hashes from the tests of Kafka Java client.
+	testCases := []struct {
+		key  string
+		hash int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	}
+
+	for _, tc := range testCases {
+		if h := int32(murmur2([]byte(tc.key))); h != tc.hash {
+			t.Fatalf("%s: expected hash %d, got %d", tc.key, tc.hash, h)
+		}
+	}
+
+	// toPositive(-790332482) % 10 == 1357151166 % 10
+	if n := keyPartition(nil, PartitionerMurmur2, "foobar", 10); n != 6 {
+		t.Fatalf("unexpected partition: %d", n)
+	}
+}
+
+func TestCfgRoute(t *testing.T) {
+	var r CfgRoute
+
+	if err := r.UnmarshalText([]byte("a:b:5")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if r.Prefix != "a:b" || r.Partition != 5 {
+		t.Fatalf("unexpected route: %+v", r)
+	}
+
+	for _, s := range []string{"a", "a:", "a:-1", "a:x"} {
+		if err := r.UnmarshalText([]byte(s)); err == nil {
+			t.Fatalf("%s: expected error", s)
+		}
+	}
+}
+
+func TestContentTypeTopic(t *testing.T) {
+	types := map[string]*struct{ Topic string }{
+		"application/vnd.events+json": {Topic: "events"},
+	}
+
+	topic, err := contentTypeTopic(types, "Application/Vnd.Events+JSON; charset=utf-8")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if topic != "events" {
+		t.Fatalf("expected events, got %q", topic)
+	}
+
+	if _, err := contentTypeTopic(types, "application/json"); err == nil {
+		t.Fatalf("expected error for unknown type")
+	}
+
+	if _, err := contentTypeTopic(types, ""); err == nil {
+		t.Fatalf("expected error for empty type")
+	}
+}
+
+func TestIsJSONMediaType(t *testing.T) {
+	testCases := []struct {
+		contentType string
+		expected    bool
+	}{
+		{"application/json", true},
+		{"Application/Vnd.Events+JSON; charset=utf-8", true},
+		{"application/x-protobuf", false},
+		{"text/plain", false},
+		{"", false},
+	}
+
+	for _, tc := range testCases {
+		if v := isJSONMediaType(tc.contentType); v != tc.expected {
+			t.Fatalf("%q: expected %v, got %v", tc.contentType, tc.expected, v)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	"github.com/xeipuuv/gojsonschema"
+
+	"fmt"
+	"io/ioutil"
+)
+
+// SchemaRegistry contains JSON schemas of topics.
+type SchemaRegistry struct {
+	Topics map[string]*gojsonschema.Schema
+}
+
+// NewSchemaRegistry loads JSON schemas specified in the config.
+func NewSchemaRegistry(settings *Config) (*SchemaRegistry, error) {
+	registry := &SchemaRegistry{
+		Topics: make(map[string]*gojsonschema.Schema),
+	}
+
+	for topic, schema := range settings.Schema {
+		data, err := ioutil.ReadFile(schema.File)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read schema of topic %s: %v", topic, err)
+		}
+
+		registry.Topics[topic], err = gojsonschema.NewSchema(gojsonschema.NewBytesLoader(data))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse schema of topic %s: %v", topic, err)
+		}
+	}
+
+	return registry, nil
+}
+
+// Validate checks the message against the schema of topic and returns
+// the list of validation errors. Messages of topics without schema are
+// always valid.
+func (r *SchemaRegistry) Validate(topic string, message []byte) ([]string, error) {
+	schema, ok := r.Topics[topic]
+	if !ok {
+		return nil, nil
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(message))
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	for _, e := range result.Errors() {
+		errs = append(errs, e.String())
+	}
+
+	return errs, nil
+}
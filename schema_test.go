@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+const testSchema = `{
+	"type": "object",
+	"properties": {
+		"a": {"type": "integer"}
+	},
+	"required": ["a"]
+}`
+
+func testSchemaConfig(t *testing.T, schema string) *Config {
+	file := filepath.Join(t.TempDir(), "test.json")
+
+	if err := ioutil.WriteFile(file, []byte(schema), 0644); err != nil {
+		t.Fatalf("unable to write schema: %s", err)
+	}
+
+	cfg := &Config{}
+	cfg.Schema = map[string]*struct {
+		File string
+	}{
+		"test": {File: file},
+	}
+
+	return cfg
+}
+
+func TestNewSchemaRegistry(t *testing.T) {
+	registry, err := NewSchemaRegistry(testSchemaConfig(t, testSchema))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if errs, err := registry.Validate("test", []byte(`{"a":1}`)); err != nil || len(errs) != 0 {
+		t.Fatalf("expected valid message, got %v: %v", errs, err)
+	}
+
+	if errs, err := registry.Validate("test", []byte(`{"a":"1"}`)); err != nil || len(errs) != 1 {
+		t.Fatalf("expected one validation error, got %v: %v", errs, err)
+	}
+
+	// Messages of other topics are not checked.
+	if errs, err := registry.Validate("other", []byte(`{}`)); err != nil || len(errs) != 0 {
+		t.Fatalf("expected valid message, got %v: %v", errs, err)
+	}
+
+	if _, err := NewSchemaRegistry(testSchemaConfig(t, `{"type":`)); err == nil {
+		t.Fatalf("expected error for broken schema")
+	}
+
+	cfg := testSchemaConfig(t, testSchema)
+	cfg.Schema["test"].File = filepath.Join(t.TempDir(), "missing.json")
+
+	if _, err := NewSchemaRegistry(cfg); err == nil {
+		t.Fatalf("expected error for missing schema")
+	}
+}
+
+func TestSendHandlerSchema(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	var produced int32
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		atomic.AddInt32(&produced, 1)
+
+		req := request.(*proto.ProduceReq)
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: 42},
+					},
+				},
+			},
+		}
+	})
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	var err error
+
+	s.Schemas, err = NewSchemaRegistry(testSchemaConfig(t, testSchema))
+	if err != nil {
+		t.Fatalf("unable to make schema registry: %s", err)
+	}
+
+	send := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.sendHandler(&HTTPResponse{ResponseWriter: rec}, httptest.NewRequest("POST", "/v1/topics/test/0", bytes.NewBufferString(body)), &url.Values{
+			"topic":     []string{"test"},
+			"partition": []string{"0"},
+		})
+		return rec
+	}
+
+	if rec := send(`{"a":1}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := send(`{"b":1}`)
+	if rec.Code != 422 {
+		t.Fatalf("expected status 422, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var res struct {
+		Data JSONErrorValidation `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("unable to decode response: %s: %s", err, rec.Body.String())
+	}
+
+	if res.Data.Topic != "test" || len(res.Data.Errors) != 1 {
+		t.Fatalf("unexpected response: %s", rec.Body.String())
+	}
+
+	if v := atomic.LoadInt32(&produced); v != 1 {
+		t.Fatalf("expected only valid message to be produced, got %d requests", v)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"strconv"
@@ -12,20 +13,57 @@ import (
 )
 
 const (
-	AnyRequest              = -1
-	ProduceRequest          = 0
-	FetchRequest            = 1
-	OffsetRequest           = 2
-	MetadataRequest         = 3
-	OffsetCommitRequest     = 8
-	OffsetFetchRequest      = 9
-	ConsumerMetadataRequest = 10
+	AnyRequest                = -1
+	ProduceRequest            = 0
+	FetchRequest              = 1
+	OffsetRequest             = 2
+	MetadataRequest           = 3
+	OffsetCommitRequest       = 8
+	OffsetFetchRequest        = 9
+	ConsumerMetadataRequest   = 10
+	DescribeGroupsRequest     = 15
+	ListGroupsRequest         = 16
+	APIVersionsRequest        = 18
+	InitProducerIDRequest     = 22
+	AddPartitionsToTxnRequest = 24
+	EndTxnRequest             = 26
 )
 
 type Serializable interface {
 	Bytes() ([]byte, error)
 }
 
+// RawRequest is a request which is not decoded by the kafka library.
+type RawRequest struct {
+	CorrelationID int32
+	Body          []byte
+}
+
+func (r *RawRequest) Bytes() ([]byte, error) {
+	return r.Body, nil
+}
+
+// readRawRequest skips the request header up to the client ID.
+func readRawRequest(b []byte) (*RawRequest, error) {
+	if len(b) < 14 {
+		return nil, proto.ErrNotEnoughData
+	}
+
+	clientIDLen := int(int16(binary.BigEndian.Uint16(b[12:])))
+	if clientIDLen < 0 {
+		clientIDLen = 0
+	}
+
+	if len(b) < 14+clientIDLen {
+		return nil, proto.ErrNotEnoughData
+	}
+
+	return &RawRequest{
+		CorrelationID: int32(binary.BigEndian.Uint32(b[8:])),
+		Body:          b[14+clientIDLen:],
+	}, nil
+}
+
 type RequestHandler func(request Serializable) (response Serializable)
 
 type KafkaServer struct {
@@ -138,21 +176,34 @@ func (srv *KafkaServer) handleClient(c net.Conn) {
 
 		var request Serializable
 
-		switch kind {
-		case FetchRequest:
-			request, err = proto.ReadFetchReq(bytes.NewBuffer(b))
-		case ProduceRequest:
-			request, err = proto.ReadProduceReq(bytes.NewBuffer(b))
-		case OffsetRequest:
-			request, err = proto.ReadOffsetReq(bytes.NewBuffer(b))
-		case MetadataRequest:
-			request, err = proto.ReadMetadataReq(bytes.NewBuffer(b))
-		case ConsumerMetadataRequest:
-			request, err = proto.ReadConsumerMetadataReq(bytes.NewBuffer(b))
-		case OffsetCommitRequest:
-			request, err = proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
-		case OffsetFetchRequest:
-			request, err = proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
+		// The newer versions are not supported by the kafka library.
+		version := int16(binary.BigEndian.Uint16(b[6:]))
+
+		raw := kind == ProduceRequest && version >= proto.KafkaV3 ||
+			kind == OffsetRequest && version >= proto.KafkaV1 ||
+			kind == ConsumerMetadataRequest && version >= proto.KafkaV1
+
+		if raw {
+			request, err = readRawRequest(b)
+		} else {
+			switch kind {
+			case FetchRequest:
+				request, err = proto.ReadFetchReq(bytes.NewBuffer(b))
+			case ProduceRequest:
+				request, err = proto.ReadProduceReq(bytes.NewBuffer(b))
+			case OffsetRequest:
+				request, err = proto.ReadOffsetReq(bytes.NewBuffer(b))
+			case MetadataRequest:
+				request, err = proto.ReadMetadataReq(bytes.NewBuffer(b))
+			case ConsumerMetadataRequest:
+				request, err = proto.ReadConsumerMetadataReq(bytes.NewBuffer(b))
+			case OffsetCommitRequest:
+				request, err = proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
+			case OffsetFetchRequest:
+				request, err = proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
+			case DescribeGroupsRequest, ListGroupsRequest, APIVersionsRequest, InitProducerIDRequest, AddPartitionsToTxnRequest, EndTxnRequest:
+				request, err = readRawRequest(b)
+			}
 		}
 
 		if err != nil {
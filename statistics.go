@@ -10,7 +10,9 @@ package main
 import (
 	"github.com/facebookgo/metrics"
 
+	"os"
 	"runtime"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -52,19 +54,74 @@ func GetSnapshot(s metrics.Timer) (res *SnapshotTimer) {
 	return
 }
 
+// SnapshotHistogram is a snapshot of the Histogram values.
+type SnapshotHistogram struct {
+	Min   int64
+	Max   int64
+	Avg   float64
+	Count int64
+
+	Percentile05  float64
+	Percentile075 float64
+	Percentile095 float64
+	Percentile099 float64
+}
+
+// GetHistogramSnapshot creates a snapshot of the Histogram values.
+func GetHistogramSnapshot(s metrics.Histogram) *SnapshotHistogram {
+	return &SnapshotHistogram{
+		Min:           s.Min(),
+		Max:           s.Max(),
+		Avg:           s.Mean(),
+		Count:         s.Count(),
+		Percentile05:  s.Percentile(0.5),
+		Percentile075: s.Percentile(0.75),
+		Percentile095: s.Percentile(0.95),
+		Percentile099: s.Percentile(0.99),
+	}
+}
+
 // MetricStats contains statistics about HTTP responses.
 type MetricStats struct {
 	HTTPStatus       map[int]metrics.Counter
-	HTTPResponseTime map[string]metrics.Timer
+	HTTPResponseTime *Timings
+
+	// MessageSize contains distribution of produced and consumed message sizes.
+	MessageSize map[string]metrics.Histogram
+
+	// ResponseCache contains hits and misses of the consume response cache.
+	ResponseCache map[string]metrics.Counter
+
+	// FetchResizes contains distribution of the number of times the fetch
+	// size was too small per consume request.
+	FetchResizes metrics.Histogram
 }
 
 // NewMetricStats creates new MetricStats object.
 func NewMetricStats() *MetricStats {
 	return &MetricStats{
-		HTTPStatus:       NewHTTPStatus([]int{200, 400, 404, 405, 416, 500, 502, 503}),
-		HTTPResponseTime: NewTimings([]string{"GET", "POST", "GetTopicList", "GetTopicInfo", "GetPartitionInfo",
-			"CommitOffset", "FetchOffset"}),
+		HTTPStatus:       NewHTTPStatus([]int{200, 207, 304, 400, 401, 403, 404, 405, 409, 415, 416, 422, 429, 500, 502, 503, 504}),
+		HTTPResponseTime: NewTimings([]string{"GET", "POST", "GetClusterInfo", "GetUnderReplicated", "GetTopicList", "GetTopicInfo", "GetTopicOffsets", "GetPartitionInfo",
+			"GetPartitionOffsets", "GetMessage", "GetTopicMessages", "GetGroupList", "DescribeGroup", "GetAPIVersions", "CommitOffset", "CommitOffsets", "FetchOffset", "ProduceBatch", "ProduceStream", "ProduceTransaction"}),
+		MessageSize:   NewHistograms([]string{"Produce", "Consume"}),
+		ResponseCache: NewCounters([]string{"Hits", "Misses"}),
+		FetchResizes:  metrics.NewHistogram(metrics.NewUniformSample(MessageSizeSamples)),
+	}
+}
+
+// Reset clears the accumulated statistics.
+func (m *MetricStats) Reset() {
+	for _, metric := range m.HTTPStatus {
+		metric.Clear()
+	}
+	for _, metric := range m.MessageSize {
+		metric.Clear()
+	}
+	for _, metric := range m.ResponseCache {
+		metric.Clear()
 	}
+	m.FetchResizes.Clear()
+	m.HTTPResponseTime.Reset()
 }
 
 // RuntimeStat contains runtime statistic.
@@ -74,30 +131,145 @@ type RuntimeStat struct {
 	CPU             int
 	GoMaxProcs      int
 	UsedDescriptors int
+
+	HeapAlloc uint64
+	HeapSys   uint64
+	NumGC     uint32
+
+	// LastGCPause is the duration of the last GC pause in nanoseconds.
+	LastGCPause uint64
 }
 
-// GetRuntimeStat creates new RuntimeStat object.
+// GetRuntimeStat creates new RuntimeStat object. It stops the world to
+// read the memory statistics and counts the open descriptors, so it
+// shouldn't be called per request.
 func GetRuntimeStat() *RuntimeStat {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
 	data := &RuntimeStat{
 		Goroutines:      runtime.NumGoroutine(),
 		CgoCall:         runtime.NumCgoCall(),
 		CPU:             runtime.NumCPU(),
 		GoMaxProcs:      runtime.GOMAXPROCS(0),
 		UsedDescriptors: 0,
+		HeapAlloc:       ms.HeapAlloc,
+		HeapSys:         ms.HeapSys,
+		NumGC:           ms.NumGC,
+	}
+	if ms.NumGC > 0 {
+		data.LastGCPause = ms.PauseNs[(ms.NumGC+255)%256]
+	}
+
+	data.UsedDescriptors = usedDescriptors()
+	return data
+}
+
+// RuntimeCollector periodically collects the runtime statistics and keeps
+// the latest snapshot, so the cost of collection doesn't depend on how
+// often the metrics are requested.
+type RuntimeCollector struct {
+	sync.RWMutex
+
+	Interval time.Duration
+
+	last *RuntimeStat
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRuntimeCollector creates new RuntimeCollector object with the first
+// snapshot.
+func NewRuntimeCollector(interval time.Duration) *RuntimeCollector {
+	return &RuntimeCollector{
+		Interval: interval,
+		last:     GetRuntimeStat(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs collector in background. The statistics are collected on
+// each request if the interval is not positive.
+func (c *RuntimeCollector) Start() {
+	if c.Interval <= 0 {
+		close(c.done)
+		return
+	}
+
+	go func() {
+		defer close(c.done)
+
+		for {
+			select {
+			case <-time.After(c.Interval):
+			case <-c.stop:
+				return
+			}
+
+			stat := GetRuntimeStat()
+
+			c.Lock()
+			c.last = stat
+			c.Unlock()
+		}
+	}()
+}
+
+// Stop stops collector.
+func (c *RuntimeCollector) Stop() {
+	close(c.stop)
+	<-c.done
+}
+
+// Last returns the latest snapshot.
+func (c *RuntimeCollector) Last() *RuntimeStat {
+	if c.Interval <= 0 {
+		return GetRuntimeStat()
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.last
+}
+
+// DescriptorsScanLimit limits the number of descriptors checked one by one
+// if /proc is not available.
+const DescriptorsScanLimit = 65536
+
+// usedDescriptors returns the number of open file descriptors. It lists
+// /proc/self/fd on Linux. Otherwise the descriptors are probed up to the
+// RLIMIT_NOFILE, which is slow with high limits, so the scan is limited.
+func usedDescriptors() int {
+	if dir, err := os.Open("/proc/self/fd"); err == nil {
+		names, err := dir.Readdirnames(-1)
+		dir.Close()
+
+		if err == nil {
+			// The directory itself is open while it is read.
+			return len(names) - 1
+		}
 	}
 
 	var nofileLimit syscall.Rlimit
-	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &nofileLimit)
-	if err != nil {
-		return data
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &nofileLimit); err != nil {
+		return 0
+	}
+
+	limit := int(DescriptorsScanLimit)
+	if nofileLimit.Cur < uint64(limit) {
+		limit = int(nofileLimit.Cur)
 	}
-	for i := 0; i < int(nofileLimit.Cur); i++ {
+
+	n := 0
+	for i := 0; i < limit; i++ {
 		_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(i), syscall.F_GETFD, 0)
 		if errno == 0 {
-			data.UsedDescriptors++
+			n++
 		}
 	}
-	return data
+	return n
 }
 
 // NewHTTPStatus creates object for HTTP status statistic.
@@ -120,18 +292,37 @@ func NewCounters(names []string) map[string]metrics.Counter {
 	return res
 }
 
-// NewTimings creates map of timings
-func NewTimings(names []string) map[string]metrics.Timer {
-	res := make(map[string]metrics.Timer)
+// NewHistograms creates map of histograms
+func NewHistograms(names []string) map[string]metrics.Histogram {
+	res := make(map[string]metrics.Histogram)
+
+	for _, name := range names {
+		res[name] = metrics.NewHistogram(metrics.NewUniformSample(MessageSizeSamples))
+	}
+	return res
+}
+
+// Timings is a set of named timers. The timers can't be cleared, so they
+// are replaced on reset.
+type Timings struct {
+	sync.RWMutex
+	timers map[string]metrics.Timer
+}
+
+// NewTimings creates set of timings
+func NewTimings(names []string) *Timings {
+	res := &Timings{
+		timers: make(map[string]metrics.Timer),
+	}
 
 	for _, name := range names {
-		res[name] = metrics.NewTimer()
+		res.timers[name] = metrics.NewTimer()
 	}
 
 	go func() {
 		for {
-			for _, name := range names {
-				res[name].Tick()
+			for _, timer := range res.All() {
+				timer.Tick()
 			}
 			time.Sleep(metrics.TickDuration)
 		}
@@ -139,3 +330,33 @@ func NewTimings(names []string) map[string]metrics.Timer {
 
 	return res
 }
+
+// Get returns the timer by name.
+func (t *Timings) Get(name string) metrics.Timer {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.timers[name]
+}
+
+// All returns a copy of the timers map.
+func (t *Timings) All() map[string]metrics.Timer {
+	t.RLock()
+	defer t.RUnlock()
+
+	res := make(map[string]metrics.Timer, len(t.timers))
+	for name, timer := range t.timers {
+		res[name] = timer
+	}
+	return res
+}
+
+// Reset replaces all timers with the new ones.
+func (t *Timings) Reset() {
+	t.Lock()
+	defer t.Unlock()
+
+	for name := range t.timers {
+		t.timers[name] = metrics.NewTimer()
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestGetRuntimeStat(t *testing.T) {
+	runtime.GC()
+
+	rs := GetRuntimeStat()
+
+	if rs.NumGC == 0 {
+		t.Fatalf("expected at least one GC, got %+v", rs)
+	}
+	if rs.HeapAlloc == 0 || rs.HeapSys < rs.HeapAlloc {
+		t.Fatalf("unexpected heap statistics: %+v", rs)
+	}
+}
+
+func TestRuntimeCollector(t *testing.T) {
+	c := NewRuntimeCollector(10 * time.Millisecond)
+
+	first := c.Last()
+
+	c.Start()
+	defer c.Stop()
+
+	deadline := time.Now().Add(time.Second)
+	for c.Last() == first {
+		if time.Now().After(deadline) {
+			t.Fatal("expected new snapshot")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The snapshot is taken on each call without the interval.
+	c = NewRuntimeCollector(0)
+	c.Start()
+	defer c.Stop()
+
+	if c.Last() == c.Last() {
+		t.Fatal("expected new snapshot per call")
+	}
+}
+
+func TestUsedDescriptors(t *testing.T) {
+	before := usedDescriptors()
+	if before <= 0 {
+		t.Fatalf("expected open descriptors, got %d", before)
+	}
+
+	// Other tests may leave the connections behind, so the count is
+	// checked roughly.
+	for i := 0; i < 16; i++ {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatalf("unable to open %s: %v", os.DevNull, err)
+		}
+		defer f.Close()
+	}
+
+	if n := usedDescriptors(); n < before+8 {
+		t.Fatalf("expected about %d descriptors, got %d", before+16, n)
+	}
+}
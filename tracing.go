@@ -0,0 +1,397 @@
+/*
+* Copyright (C) 2015 Alexey Gladkov <gladkov.alexey@gmail.com>
+*
+* This file is covered by the GNU General Public License,
+* which should be included with kafka-http-proxy as the file COPYING.
+ */
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The kinds of spans as in OpenTelemetry.
+const (
+	SpanKindServer = 2
+	SpanKindClient = 3
+)
+
+// spanStatusError is the OpenTelemetry status of failed span.
+const spanStatusError = 2
+
+type spanContextKey struct{}
+
+// SpanAttribute is a named value of span.
+type SpanAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is the operation of trace. All methods of nil span do nothing, so
+// the spans can be used if the tracing is disabled.
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes []SpanAttribute
+	Error      string
+
+	sampled bool
+	tracer  *Tracer
+}
+
+// SetAttribute adds the attribute to span.
+func (sp *Span) SetAttribute(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.Attributes = append(sp.Attributes, SpanAttribute{Key: key, Value: value})
+}
+
+// SetError marks the span as failed.
+func (sp *Span) SetError(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.Error = err.Error()
+}
+
+// Finish ends the span and queues it for export if it is sampled.
+func (sp *Span) Finish() {
+	if sp == nil {
+		return
+	}
+
+	sp.End = time.Now()
+
+	if !sp.sampled {
+		return
+	}
+
+	// The span is dropped rather than slowing down the request.
+	select {
+	case sp.tracer.spans <- sp:
+	default:
+		log.Debugf("Trace queue is full, span %s is dropped", sp.Name)
+	}
+}
+
+// Tracer records spans of requests and sends them in batches to the
+// OpenTelemetry collector using OTLP/HTTP protocol with JSON encoding.
+type Tracer struct {
+	Endpoint    string
+	ServiceName string
+	SampleRatio float64
+	BatchSize   int
+	Interval    time.Duration
+
+	client *http.Client
+	spans  chan *Span
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewTracer creates new Tracer object.
+func NewTracer(s *Server) *Tracer {
+	cfg := s.Config().Tracing
+
+	return &Tracer{
+		Endpoint:    cfg.Endpoint,
+		ServiceName: cfg.ServiceName,
+		SampleRatio: cfg.SampleRatio,
+		BatchSize:   cfg.BatchSize,
+		Interval:    cfg.Interval.Duration,
+		client:      &http.Client{Timeout: cfg.Interval.Duration},
+		spans:       make(chan *Span, 2*cfg.BatchSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// StartSpan starts the child of span from the context. If there is no
+// parent the new trace is started and it is sampled by SampleRatio.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	sp := &Span{
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+		tracer: t,
+	}
+
+	if parent, ok := ctx.Value(spanContextKey{}).(*Span); ok && parent != nil {
+		sp.TraceID = parent.TraceID
+		sp.ParentID = parent.SpanID
+		sp.sampled = parent.sampled
+	} else {
+		rand.Read(sp.TraceID[:])
+		sp.sampled = t.sample(sp.TraceID)
+	}
+	rand.Read(sp.SpanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, sp), sp
+}
+
+// StartRequestSpan starts the server span of request. The trace of client
+// is continued if the request has the W3C traceparent header.
+func (t *Tracer) StartRequestSpan(r *http.Request) (*http.Request, *Span) {
+	if t == nil {
+		return r, nil
+	}
+
+	ctx := r.Context()
+	if parent := remoteSpan(r.Header.Get("traceparent")); parent != nil {
+		ctx = context.WithValue(ctx, spanContextKey{}, parent)
+	}
+
+	ctx, sp := t.StartSpan(ctx, r.Method+" "+r.URL.Path, SpanKindServer)
+	sp.SetAttribute("http.request.method", r.Method)
+	sp.SetAttribute("url.path", r.URL.Path)
+
+	return r.WithContext(ctx), sp
+}
+
+// sample decides by the trace ID like TraceIDRatioBased sampler, so all
+// instances make the same decision for the trace.
+func (t *Tracer) sample(traceID [16]byte) bool {
+	if t.SampleRatio >= 1 {
+		return true
+	}
+	if t.SampleRatio <= 0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < uint64(t.SampleRatio*(1<<63))
+}
+
+// remoteSpan returns the parent span from the traceparent header.
+func remoteSpan(value string) *Span {
+	if _, _, ok := parseTraceparent(value); !ok {
+		return nil
+	}
+
+	m := traceparentRegexp.FindStringSubmatch(value)
+	sp := &Span{}
+
+	hex.Decode(sp.TraceID[:], []byte(m[2]))
+	hex.Decode(sp.SpanID[:], []byte(m[3]))
+
+	flags, _ := strconv.ParseUint(m[4], 16, 8)
+	sp.sampled = flags&1 == 1
+
+	return sp
+}
+
+// Start runs exporter in background.
+func (t *Tracer) Start() {
+	go func() {
+		defer close(t.done)
+
+		var batch []*Span
+
+		ticker := time.NewTicker(t.Interval)
+		defer ticker.Stop()
+
+		for {
+			flush := false
+
+			select {
+			case sp := <-t.spans:
+				batch = append(batch, sp)
+				flush = len(batch) >= t.BatchSize
+			case <-ticker.C:
+				flush = true
+			case <-t.stop:
+				// The queued spans are sent before exit.
+				for len(t.spans) > 0 {
+					batch = append(batch, <-t.spans)
+				}
+				if err := t.export(batch); err != nil {
+					log.Errorln("Unable to send spans:", err)
+				}
+				return
+			}
+
+			if !flush || len(batch) == 0 {
+				continue
+			}
+
+			if err := t.export(batch); err != nil {
+				log.Errorln("Unable to send spans:", err)
+			}
+			batch = nil
+		}
+	}()
+}
+
+// Stop stops exporter and waits for the last spans to be sent.
+func (t *Tracer) Stop() {
+	close(t.stop)
+	<-t.done
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttributeOf(key string, value interface{}) otlpAttribute {
+	attr := otlpAttribute{Key: key}
+
+	switch v := value.(type) {
+	case string:
+		attr.Value.StringValue = &v
+	case bool:
+		attr.Value.BoolValue = &v
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		attr.Value.IntValue = &s
+	case int32:
+		s := strconv.FormatInt(int64(v), 10)
+		attr.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		attr.Value.IntValue = &s
+	case float64:
+		attr.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		attr.Value.StringValue = &s
+	}
+
+	return attr
+}
+
+// encodeSpans returns the OTLP JSON export request of spans.
+func (t *Tracer) encodeSpans(spans []*Span) ([]byte, error) {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "kafka-http-proxy"
+
+	for _, sp := range spans {
+		res := otlpSpan{
+			TraceID:           hex.EncodeToString(sp.TraceID[:]),
+			SpanID:            hex.EncodeToString(sp.SpanID[:]),
+			Name:              sp.Name,
+			Kind:              sp.Kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.End.UnixNano(), 10),
+		}
+
+		if sp.ParentID != [8]byte{} {
+			res.ParentSpanID = hex.EncodeToString(sp.ParentID[:])
+		}
+
+		for _, attr := range sp.Attributes {
+			res.Attributes = append(res.Attributes, otlpAttributeOf(attr.Key, attr.Value))
+		}
+
+		if sp.Error != "" {
+			res.Status = otlpStatus{Code: spanStatusError, Message: sp.Error}
+		}
+
+		scope.Spans = append(scope.Spans, res)
+	}
+
+	rs := otlpResourceSpans{
+		ScopeSpans: []otlpScopeSpans{scope},
+	}
+	rs.Resource.Attributes = []otlpAttribute{
+		otlpAttributeOf("service.name", t.ServiceName),
+	}
+
+	return json.Marshal(&otlpTraces{
+		ResourceSpans: []otlpResourceSpans{rs},
+	})
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	b, err := t.encodeSpans(spans)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.Endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// startKafkaSpan starts the span of Kafka operation on the partition as
+// the child of request span.
+func (s *Server) startKafkaSpan(r *http.Request, name string, topic string, partition int32) *Span {
+	_, sp := s.Tracer.StartSpan(r.Context(), name, SpanKindClient)
+	sp.SetAttribute("messaging.system", "kafka")
+	sp.SetAttribute("messaging.destination.name", topic)
+	sp.SetAttribute("messaging.destination.partition.id", strconv.Itoa(int(partition)))
+	return sp
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+func TestTracer(t *testing.T) {
+	srv := NewKafkaServer()
+	srv.Start()
+	defer srv.Close()
+
+	handleTestMetadata(srv)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: 42},
+					},
+				},
+			},
+		}
+	})
+
+	exported := make(chan otlpTraces, 10)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+			t.Errorf("unable to decode spans: %v", err)
+		}
+		exported <- traces
+	}))
+	defer collector.Close()
+
+	s := newTestServer(t, srv)
+	defer s.Client.Close()
+
+	s.Config().Tracing.Endpoint = collector.URL
+	s.Config().Tracing.SampleRatio = 0
+
+	s.Tracer = NewTracer(s)
+	s.Tracer.Start()
+
+	r := httptest.NewRequest("POST", "/v1/topics/test/0", bytes.NewBufferString(`{"a":1}`))
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	r, span := s.Tracer.StartRequestSpan(r)
+
+	rec := httptest.NewRecorder()
+	s.sendHandler(&HTTPResponse{ResponseWriter: rec}, r, &url.Values{
+		"topic":     []string{"test"},
+		"partition": []string{"0"},
+	})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	span.Finish()
+	s.Tracer.Stop()
+
+	spans := make(map[string]otlpSpan)
+	for len(exported) > 0 {
+		traces := <-exported
+
+		if name := traces.ResourceSpans[0].Resource.Attributes[0]; name.Key != "service.name" || *name.Value.StringValue != "kafka-http-proxy" {
+			t.Fatalf("unexpected resource attribute: %+v", name)
+		}
+
+		for _, sp := range traces.ResourceSpans[0].ScopeSpans[0].Spans {
+			spans[sp.Name] = sp
+		}
+	}
+
+	server, ok := spans["POST /v1/topics/test/0"]
+	if !ok || len(spans) != 2 {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+
+	// The trace of client is continued even if the new ones are not sampled.
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" || server.Kind != SpanKindServer {
+		t.Fatalf("unexpected server span: %+v", server)
+	}
+
+	child := spans["SendMessage"]
+	if child.TraceID != server.TraceID || child.ParentSpanID != server.SpanID || child.Kind != SpanKindClient {
+		t.Fatalf("unexpected child span: %+v", child)
+	}
+
+	attrs := make(map[string]otlpValue)
+	for _, attr := range child.Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+
+	if v := attrs["messaging.destination.name"].StringValue; v == nil || *v != "test" {
+		t.Fatalf("unexpected topic attribute: %+v", child.Attributes)
+	}
+
+	if v := attrs["messaging.kafka.offset"].IntValue; v == nil || *v != "42" {
+		t.Fatalf("unexpected offset attribute: %+v", child.Attributes)
+	}
+}
+
+func TestTracerSample(t *testing.T) {
+	tracer := &Tracer{SampleRatio: 0}
+
+	if _, sp := tracer.StartSpan(context.Background(), "test", SpanKindClient); sp.sampled {
+		t.Fatalf("expected new trace not to be sampled")
+	}
+
+	tracer.SampleRatio = 1
+
+	if _, sp := tracer.StartSpan(context.Background(), "test", SpanKindClient); !sp.sampled {
+		t.Fatalf("expected new trace to be sampled")
+	}
+
+	// The decision of client is followed.
+	r := httptest.NewRequest("GET", "/v1/topics/test/0", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	if _, sp := tracer.StartRequestSpan(r); sp.sampled {
+		t.Fatalf("expected trace of client not to be sampled")
+	}
+
+	// The disabled tracer makes no spans.
+	var disabled *Tracer
+
+	_, sp := disabled.StartSpan(context.Background(), "test", SpanKindClient)
+	sp.SetAttribute("key", "value")
+	sp.SetError(context.Canceled)
+	sp.Finish()
+
+	if sp != nil {
+		t.Fatalf("expected no span, got %+v", sp)
+	}
+}
+
+func TestEncodeSpans(t *testing.T) {
+	tracer := &Tracer{ServiceName: "proxy"}
+
+	sp := &Span{
+		TraceID: [16]byte{1},
+		SpanID:  [8]byte{2},
+		Name:    "GetOffsets",
+		Kind:    SpanKindClient,
+		Start:   time.Unix(1, 0),
+		End:     time.Unix(2, 0),
+		Error:   "broken",
+	}
+	sp.SetAttribute("partition", int32(3))
+
+	b, err := tracer.encodeSpans([]*Span{sp})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"proxy"}}]},` +
+		`"scopeSpans":[{"scope":{"name":"kafka-http-proxy"},"spans":[{"traceId":"01000000000000000000000000000000",` +
+		`"spanId":"0200000000000000","name":"GetOffsets","kind":3,"startTimeUnixNano":"1000000000","endTimeUnixNano":"2000000000",` +
+		`"attributes":[{"key":"partition","value":{"intValue":"3"}}],"status":{"code":2,"message":"broken"}}]}]}]}`
+
+	if string(b) != expected {
+		t.Fatalf("unexpected request: %s", b)
+	}
+}